@@ -9,6 +9,12 @@ var (
 	backend = cgabackend{}
 )
 
+// Size returns the columns and rows of text screen, the VGA text mode and
+// the framebuffer console share the same size.
+func Size() (cols, rows int) {
+	return 80, 25
+}
+
 func WriteString(s string) {
 	for i := range s {
 		WriteByte(s[i])
@@ -4,6 +4,7 @@ import (
 	"io"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/icexin/eggos/cga"
@@ -13,6 +14,10 @@ import (
 
 const (
 	CON_BUFLEN = 128
+
+	// missing in syscall
+	_TCSETSW = 0x5403
+	_TCSETSF = 0x5404
 )
 
 type console struct {
@@ -22,9 +27,13 @@ type console struct {
 	r, w, e uint
 
 	tios syscall.Termios
+	// echo writes the echoed input, it's putc except in tests
+	echo func(ch byte)
 
 	mutex  sync.Mutex
 	notify *sync.Cond
+	// called when input becomes readable
+	readable []func()
 }
 
 var (
@@ -33,14 +42,29 @@ var (
 
 func newConsole() *console {
 	c := &console{
-		tios: syscall.Termios{
-			Lflag: syscall.ICANON | syscall.ECHO,
-		},
+		tios: defaultTermios(),
 	}
+	c.echo = c.putc
 	c.notify = sync.NewCond(&c.mutex)
 	return c
 }
 
+// defaultTermios is the cooked mode of linux console
+func defaultTermios() syscall.Termios {
+	tios := syscall.Termios{
+		Iflag: syscall.ICRNL,
+		Oflag: syscall.OPOST | syscall.ONLCR,
+		Cflag: syscall.CS8 | syscall.CREAD,
+		Lflag: syscall.ICANON | syscall.ECHO | syscall.ECHOE | syscall.ISIG,
+	}
+	tios.Cc[syscall.VINTR] = ctrl('C')
+	tios.Cc[syscall.VERASE] = 0x7f
+	tios.Cc[syscall.VKILL] = ctrl('U')
+	tios.Cc[syscall.VEOF] = ctrl('D')
+	tios.Cc[syscall.VMIN] = 1
+	return tios
+}
+
 func ctrl(c byte) byte {
 	return c - '@'
 }
@@ -54,6 +78,10 @@ func (c *console) rawmode() bool {
 	return c.tios.Lflag&syscall.ICANON == 0
 }
 
+func (c *console) echoed() bool {
+	return c.tios.Lflag&syscall.ECHO != 0
+}
+
 func (c *console) handleRaw(ch byte) {
 	if c.e-c.r >= CON_BUFLEN {
 		return
@@ -62,22 +90,70 @@ func (c *console) handleRaw(ch byte) {
 	c.e++
 	c.buf[idx] = byte(ch)
 	c.w = c.e
+	if c.echoed() {
+		c.echo(ch)
+	}
 	c.notify.Broadcast()
 }
 
+// isCC reports whether ch is the control char cc, zero disables cc
+func (c *console) isCC(ch byte, cc int) bool {
+	v := c.tios.Cc[cc]
+	return v != 0 && ch == v
+}
+
+// erase removes the last char of the line being edited
+func (c *console) erase() bool {
+	if c.e == c.w {
+		return false
+	}
+	c.e--
+	if c.echoed() {
+		c.echo(0x7f)
+	}
+	return true
+}
+
 func (c *console) handleInput(ch byte) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	w := c.w
+	c.input(ch)
+	ready := c.w != w
+	fns := c.readable
+	c.mutex.Unlock()
+
+	if ready {
+		for _, fn := range fns {
+			fn()
+		}
+	}
+}
+
+func (c *console) input(ch byte) {
+	if ch == '\r' && c.tios.Iflag&syscall.ICRNL != 0 {
+		ch = '\n'
+	}
+	if c.tios.Lflag&syscall.ISIG != 0 && c.isCC(ch, syscall.VINTR) {
+		// no process to signal, the line being edited is dropped
+		c.e = c.w
+		if c.echoed() {
+			c.echo('^')
+			c.echo('C')
+			c.echo('\n')
+		}
+		return
+	}
 	if c.rawmode() {
 		c.handleRaw(ch)
 		return
 	}
 
-	switch ch {
-	case 0x7f, ctrl('H'):
-		if c.e > c.w {
-			c.e--
-			c.putc(0x7f)
+	switch {
+	case c.isCC(ch, syscall.VERASE), ch == ctrl('H'):
+		c.erase()
+		return
+	case c.isCC(ch, syscall.VKILL):
+		for c.erase() {
 		}
 		return
 	}
@@ -85,13 +161,12 @@ func (c *console) handleInput(ch byte) {
 	if c.e-c.r >= CON_BUFLEN {
 		return
 	}
-	if ch == '\r' {
-		ch = '\n'
-	}
 	idx := c.e % CON_BUFLEN
 	c.e++
 	c.buf[idx] = byte(ch)
-	c.putc(ch)
+	if c.echoed() {
+		c.echo(ch)
+	}
 	if ch == '\n' || c.e == c.r+CON_BUFLEN {
 		c.w = c.e
 		c.notify.Broadcast()
@@ -109,21 +184,16 @@ func (c *console) putc(ch byte) {
 	cga.WriteByte(ch)
 }
 
+// read copies the buffered input to p, it stops at the end of line in
+// cooked mode.
 func (c *console) read(p []byte) int {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
 	i := 0
-	for i < len(p) {
-		for c.r == c.w {
-			c.notify.Wait()
-		}
-		idx := c.r
+	for i < len(p) && c.r != c.w {
+		ch := c.buf[c.r%CON_BUFLEN]
 		c.r++
-		ch := c.buf[idx%CON_BUFLEN]
-		p[i] = byte(ch)
+		p[i] = ch
 		i++
-		if ch == '\n' || c.rawmode() {
+		if ch == '\n' && !c.rawmode() {
 			break
 		}
 	}
@@ -131,9 +201,81 @@ func (c *console) read(p []byte) int {
 }
 
 func (c *console) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rawmode() {
+		return c.readRaw(p), nil
+	}
+	for c.r == c.w {
+		c.notify.Wait()
+	}
+	return c.read(p), nil
+}
+
+// readRaw reads in noncanonical mode, it returns after VMIN bytes are read
+// or VTIME tenths of a second passed, the same as linux.
+func (c *console) readRaw(p []byte) int {
+	min := int(c.tios.Cc[syscall.VMIN])
+	if min > len(p) {
+		min = len(p)
+	}
+	timeout := time.Duration(c.tios.Cc[syscall.VTIME]) * 100 * time.Millisecond
+	n := 0
+	for {
+		n += c.read(p[n:])
+		switch {
+		case n >= min && (n > 0 || timeout == 0):
+			return n
+		case timeout == 0 || n == 0 && min > 0:
+			// the timer starts after the first byte if VMIN is set
+			c.notify.Wait()
+		case !c.waitTimeout(timeout):
+			return n
+		}
+	}
+}
+
+// waitTimeout waits for new input at most d, it reports whether the input
+// arrived.
+func (c *console) waitTimeout(d time.Duration) bool {
+	w := c.w
+	expired := false
+	t := time.AfterFunc(d, func() {
+		c.mutex.Lock()
+		expired = true
+		c.notify.Broadcast()
+		c.mutex.Unlock()
+	})
+	defer t.Stop()
+	for c.w == w && !expired {
+		c.notify.Wait()
+	}
+	return c.w != w
+}
+
+// ReadNonBlock is the same as Read but returns EAGAIN if there is no input
+func (c *console) ReadNonBlock(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.r == c.w {
+		return 0, syscall.EAGAIN
+	}
 	return c.read(p), nil
 }
 
+// Readable reports whether Read can return without blocking
+func (c *console) Readable() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.r != c.w
+}
+
 func (c *console) Write(p []byte) (int, error) {
 	for _, ch := range p {
 		c.putc(ch)
@@ -144,24 +286,46 @@ func (c *console) Write(p []byte) (int, error) {
 func (c *console) Ioctl(op, arg uintptr) error {
 	switch op {
 	case syscall.TIOCGWINSZ:
+		cols, rows := cga.Size()
 		w := (*winSize)(unsafe.Pointer(arg))
-		w.row = 25
-		w.col = 80
+		*w = winSize{row: uint16(rows), col: uint16(cols)}
 		return nil
 	case syscall.TCGETS:
-		tios := (*syscall.Termios)(unsafe.Pointer(arg))
-		*tios = c.tios
+		c.mutex.Lock()
+		*(*syscall.Termios)(unsafe.Pointer(arg)) = c.tios
+		c.mutex.Unlock()
 		return nil
-	case syscall.TCSETS:
-		tios := (*syscall.Termios)(unsafe.Pointer(arg))
-		c.tios = *tios
+	case syscall.TCSETS, _TCSETSW, _TCSETSF:
+		// the output is never buffered, TCSETSW has nothing to drain
+		c.setTermios((*syscall.Termios)(unsafe.Pointer(arg)), op == _TCSETSF)
 		return nil
-
 	default:
 		return syscall.EINVAL
 	}
 }
 
+func (c *console) setTermios(tios *syscall.Termios, flush bool) {
+	c.mutex.Lock()
+	c.tios = *tios
+	if flush {
+		c.r, c.w = c.e, c.e
+	}
+	// the line being edited becomes readable in raw mode
+	ready := c.rawmode() && c.w != c.e
+	if ready {
+		c.w = c.e
+	}
+	c.notify.Broadcast()
+	fns := c.readable
+	c.mutex.Unlock()
+
+	if ready {
+		for _, fn := range fns {
+			fn()
+		}
+	}
+}
+
 type winSize struct {
 	row, col       uint16
 	xpixel, ypixel uint16
@@ -171,6 +335,14 @@ func Console() io.ReadWriter {
 	return con
 }
 
+// OnReadable registers fn which is called when the input of console becomes
+// readable, such as a line is finished in cooked mode.
+func OnReadable(fn func()) {
+	con.mutex.Lock()
+	con.readable = append(con.readable, fn)
+	con.mutex.Unlock()
+}
+
 func Init() {
 	con = newConsole()
 	uart.OnInput(con.intr)
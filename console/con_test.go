@@ -0,0 +1,175 @@
+package console
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestReadNonBlock(t *testing.T) {
+	c := newConsole()
+	// raw mode without echo, the input is not written to the screen
+	c.tios.Lflag = 0
+	ready := make(chan struct{}, 1)
+	c.readable = append(c.readable, func() {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	})
+
+	buf := make([]byte, 8)
+	if _, err := c.ReadNonBlock(buf); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.handleInput('h')
+		c.handleInput('i')
+		close(done)
+	}()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("not woken up by input")
+	}
+	if !c.Readable() {
+		t.Fatal("expect console readable")
+	}
+
+	// partial read returns what's buffered
+	<-done
+	n, err := c.ReadNonBlock(buf)
+	if err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	if _, err := c.ReadNonBlock(buf); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN after draining, got %v", err)
+	}
+}
+
+// newTestConsole returns a console echoing to the returned buffer
+func newTestConsole() (*console, *[]byte) {
+	c := newConsole()
+	var echo []byte
+	c.echo = func(ch byte) { echo = append(echo, ch) }
+	return c, &echo
+}
+
+func input(c *console, s string) {
+	for i := 0; i < len(s); i++ {
+		c.handleInput(s[i])
+	}
+}
+
+func TestCookedEditing(t *testing.T) {
+	c, echo := newTestConsole()
+	input(c, "xy\x15ab\x7fc")
+	if c.Readable() {
+		t.Fatal("readable before end of line")
+	}
+	input(c, "\r")
+	buf := make([]byte, 16)
+	n, _ := c.Read(buf)
+	if string(buf[:n]) != "ac\n" {
+		t.Fatalf("read %q", buf[:n])
+	}
+	if string(*echo) != "xy\x7f\x7fab\x7fc\n" {
+		t.Fatalf("echo %q", *echo)
+	}
+
+	// ^C drops the line
+	input(c, "ab\x03d\n")
+	n, _ = c.Read(buf)
+	if string(buf[:n]) != "d\n" {
+		t.Fatalf("read %q after ^C", buf[:n])
+	}
+}
+
+// makeRaw is what golang.org/x/term.MakeRaw does
+func makeRaw(c *console) syscall.Termios {
+	var old syscall.Termios
+	if err := c.Ioctl(syscall.TCGETS, uintptr(unsafe.Pointer(&old))); err != nil {
+		panic(err)
+	}
+	tios := old
+	tios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	tios.Oflag &^= syscall.OPOST
+	tios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	tios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	tios.Cflag |= syscall.CS8
+	tios.Cc[syscall.VMIN] = 1
+	tios.Cc[syscall.VTIME] = 0
+	if err := c.Ioctl(syscall.TCSETS, uintptr(unsafe.Pointer(&tios))); err != nil {
+		panic(err)
+	}
+	return old
+}
+
+func TestRawMode(t *testing.T) {
+	c, echo := newTestConsole()
+	// the partial line becomes readable on switching to raw mode
+	input(c, "ab")
+	old := makeRaw(c)
+	input(c, "\r\x03")
+	buf := make([]byte, 16)
+	n, _ := c.Read(buf)
+	if string(buf[:n]) != "ab\r\x03" {
+		t.Fatalf("read %q", buf[:n])
+	}
+	if string(*echo) != "ab" {
+		t.Fatalf("raw input echoed %q", *echo)
+	}
+
+	// VMIN
+	var tios syscall.Termios
+	c.Ioctl(syscall.TCGETS, uintptr(unsafe.Pointer(&tios)))
+	tios.Cc[syscall.VMIN] = 3
+	c.Ioctl(_TCSETSW, uintptr(unsafe.Pointer(&tios)))
+	done := make(chan string)
+	go func() {
+		n, _ := c.Read(buf)
+		done <- string(buf[:n])
+	}()
+	input(c, "12")
+	select {
+	case s := <-done:
+		t.Fatalf("returned before VMIN bytes: %q", s)
+	case <-time.After(20 * time.Millisecond):
+	}
+	input(c, "3")
+	if s := <-done; s != "123" {
+		t.Fatalf("read %q", s)
+	}
+
+	// VTIME without VMIN times out with nothing read
+	tios.Cc[syscall.VMIN], tios.Cc[syscall.VTIME] = 0, 1
+	c.Ioctl(syscall.TCSETS, uintptr(unsafe.Pointer(&tios)))
+	start := time.Now()
+	if n, _ := c.Read(buf); n != 0 {
+		t.Fatalf("read %d bytes", n)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("VTIME expired after %v", d)
+	}
+
+	c.Ioctl(syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	if c.rawmode() {
+		t.Fatal("cooked mode not restored")
+	}
+}
+
+func TestWinSize(t *testing.T) {
+	c := newConsole()
+	var w winSize
+	if err := c.Ioctl(syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&w))); err != nil {
+		t.Fatal(err)
+	}
+	if w.col != 80 || w.row != 25 {
+		t.Fatalf("bad size %dx%d", w.col, w.row)
+	}
+}
@@ -0,0 +1,111 @@
+// Package ksyms resolves the addresses of kernel text to the Go functions,
+// the symbols are found by walking the pclntab with runtime.FuncForPC.
+package ksyms
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/icexin/eggos/sys"
+)
+
+// Symbol is a function in the kernel text
+type Symbol struct {
+	Addr uintptr
+	Name string
+	// Size is the distance to the next function, including the padding
+	Size uintptr
+}
+
+var (
+	once    sync.Once
+	symbols []Symbol
+)
+
+// funcEnd returns the first pc after entry which is not in the function of
+// entry, found by doubling the step and then binary searching.
+func funcEnd(entry uintptr) uintptr {
+	in := func(pc uintptr) bool {
+		f := runtime.FuncForPC(pc)
+		return f != nil && f.Entry() == entry
+	}
+	lo, step := entry, uintptr(16)
+	for in(lo + step) {
+		lo += step
+		step *= 2
+	}
+	hi := lo + step
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if in(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
+
+// build walks back from this package to the first function of text, and
+// then forward to the end. It's done on the first use, after the runtime
+// is fully initialized.
+func build() {
+	first := runtime.FuncForPC(sys.FuncPC(build)).Entry()
+	for {
+		f := runtime.FuncForPC(first - 1)
+		if f == nil {
+			break
+		}
+		first = f.Entry()
+	}
+	for pc := first; ; {
+		f := runtime.FuncForPC(pc)
+		if f == nil {
+			break
+		}
+		end := funcEnd(pc)
+		symbols = append(symbols, Symbol{Addr: pc, Name: f.Name(), Size: end - pc})
+		pc = end
+	}
+}
+
+// Symbols returns the functions of the kernel ordered by address
+func Symbols() []Symbol {
+	once.Do(build)
+	return symbols
+}
+
+// Lookup returns the symbol containing addr
+func Lookup(addr uintptr) (Symbol, bool) {
+	syms := Symbols()
+	i := sort.Search(len(syms), func(i int) bool {
+		return syms[i].Addr > addr
+	})
+	if i == 0 || addr >= syms[i-1].Addr+syms[i-1].Size {
+		return Symbol{}, false
+	}
+	return syms[i-1], true
+}
+
+// Resolve returns the function, file and line of addr, the inlined function
+// is reported if addr is in one. The name is empty if addr is not in text.
+func Resolve(addr uintptr) (name string, file string, line int) {
+	f := runtime.FuncForPC(addr)
+	if f == nil {
+		return "", "", 0
+	}
+	file, line = f.FileLine(addr)
+	return f.Name(), file, line
+}
+
+// Kallsyms returns the symbols in the format of /proc/kallsyms
+func Kallsyms() []byte {
+	var buf bytes.Buffer
+	for _, s := range Symbols() {
+		fmt.Fprintf(&buf, "%08x T %s\n", s.Addr, s.Name)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,38 @@
+package ksyms
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/icexin/eggos/sys"
+)
+
+func TestSymbols(t *testing.T) {
+	syms := Symbols()
+	if len(syms) == 0 {
+		t.Fatal("no symbols")
+	}
+	if !sort.SliceIsSorted(syms, func(i, j int) bool { return syms[i].Addr < syms[j].Addr }) {
+		t.Fatal("symbols not sorted")
+	}
+
+	pc := sys.FuncPC(Resolve)
+	s, ok := Lookup(pc + 1)
+	if !ok || s.Addr != pc || !strings.HasSuffix(s.Name, "ksyms.Resolve") {
+		t.Fatalf("bad lookup %+v", s)
+	}
+	if _, ok = Lookup(0); ok {
+		t.Fatal("expect no symbol of 0")
+	}
+
+	name, file, line := Resolve(pc)
+	if name != s.Name || !strings.HasSuffix(file, "ksyms.go") || line == 0 {
+		t.Fatalf("bad resolve %s %s:%d", name, file, line)
+	}
+	if !bytes.Contains(Kallsyms(), []byte(fmt.Sprintf("%08x T %s\n", s.Addr, s.Name))) {
+		t.Fatal("symbol missing in kallsyms")
+	}
+}
@@ -0,0 +1,31 @@
+// Package block defines the interface of sector addressed storage, such as
+// disks and partitions, used by the disk file system drivers.
+package block
+
+import "syscall"
+
+// BlockDevice is a storage accessed by whole sectors. The length of buf
+// passed to ReadAt and WriteAt must be a multiple of SectorSize, lba is the
+// index of the first sector.
+type BlockDevice interface {
+	ReadAt(buf []byte, lba int64) error
+	WriteAt(buf []byte, lba int64) error
+	// SectorSize returns the size of sector in bytes, usually 512 or 4096
+	SectorSize() int
+	// Capacity returns the number of sectors
+	Capacity() int64
+}
+
+// checkRange returns EINVAL if buf is not sector aligned or out of the
+// capacity of dev, it returns the number of sectors otherwise.
+func checkRange(dev BlockDevice, buf []byte, lba int64) (int64, error) {
+	size := dev.SectorSize()
+	if len(buf)%size != 0 {
+		return 0, syscall.EINVAL
+	}
+	n := int64(len(buf) / size)
+	if lba < 0 || lba+n > dev.Capacity() {
+		return 0, syscall.EINVAL
+	}
+	return n, nil
+}
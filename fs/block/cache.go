@@ -0,0 +1,314 @@
+package block
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the max number of sectors read ahead on a cache miss
+const readAhead = 8
+
+type sector struct {
+	lba   int64
+	data  []byte
+	dirty bool
+}
+
+// CacheStats is the counters of a CachedBlockDevice
+type CacheStats struct {
+	// Hits and Misses count the sectors read from the cache and the device
+	Hits   uint64
+	Misses uint64
+	// Writebacks counts the dirty sectors written to the device
+	Writebacks uint64
+}
+
+// CachedBlockDevice keeps the recently used sectors of a BlockDevice in
+// memory. Writes go through to the device before the cache is updated,
+// unless it's created by NewWriteBackBlockDevice. All the accesses are
+// serialized by one mutex.
+type CachedBlockDevice struct {
+	dev       BlockDevice
+	size      int
+	max       int
+	writeBack bool
+
+	mutex   sync.Mutex
+	lru     *list.List
+	sectors map[int64]*list.Element
+	stats   CacheStats
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCachedBlockDevice caches at most cacheBytes of sectors of dev, the
+// cache is disabled if cacheBytes is less than one sector.
+func NewCachedBlockDevice(dev BlockDevice, cacheBytes int) *CachedBlockDevice {
+	size := dev.SectorSize()
+	return &CachedBlockDevice{
+		dev:     dev,
+		size:    size,
+		max:     cacheBytes / size,
+		lru:     list.New(),
+		sectors: make(map[int64]*list.Element),
+	}
+}
+
+// NewWriteBackBlockDevice is NewCachedBlockDevice keeping the writes in
+// cache. The dirty sectors are written back on eviction, Sync, Close and every
+// interval if interval is positive.
+func NewWriteBackBlockDevice(dev BlockDevice, cacheBytes int, interval time.Duration) *CachedBlockDevice {
+	c := NewCachedBlockDevice(dev, cacheBytes)
+	c.writeBack = true
+	if interval > 0 {
+		c.stop = make(chan struct{})
+		go c.flusher(interval)
+	}
+	return c
+}
+
+func (c *CachedBlockDevice) flusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mutex.Lock()
+			c.flush()
+			c.mutex.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *CachedBlockDevice) SectorSize() int {
+	return c.size
+}
+
+func (c *CachedBlockDevice) Capacity() int64 {
+	return c.dev.Capacity()
+}
+
+// Stats returns the counters of cache
+func (c *CachedBlockDevice) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// get returns the cached sector lba, or nil if not cached
+func (c *CachedBlockDevice) get(lba int64) []byte {
+	e, ok := c.sectors[lba]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*sector).data
+}
+
+// put caches a copy of data as sector lba, the least recently used sector
+// is evicted if the cache is full, it's written back first if dirty.
+func (c *CachedBlockDevice) put(lba int64, data []byte, dirty bool) error {
+	if e, ok := c.sectors[lba]; ok {
+		s := e.Value.(*sector)
+		copy(s.data, data)
+		s.dirty = s.dirty || dirty
+		c.lru.MoveToFront(e)
+		return nil
+	}
+	var s *sector
+	if c.lru.Len() >= c.max {
+		e := c.lru.Back()
+		s = e.Value.(*sector)
+		if s.dirty {
+			if err := c.dev.WriteAt(s.data, s.lba); err != nil {
+				return err
+			}
+			c.stats.Writebacks++
+		}
+		c.lru.Remove(e)
+		delete(c.sectors, s.lba)
+	} else {
+		s = &sector{data: make([]byte, c.size)}
+	}
+	s.lba = lba
+	s.dirty = dirty
+	copy(s.data, data)
+	c.sectors[lba] = c.lru.PushFront(s)
+	return nil
+}
+
+// drop removes sector lba from cache, the dirty data is lost
+func (c *CachedBlockDevice) drop(lba int64) {
+	if e, ok := c.sectors[lba]; ok {
+		c.lru.Remove(e)
+		delete(c.sectors, lba)
+	}
+}
+
+func (c *CachedBlockDevice) ReadAt(buf []byte, lba int64) error {
+	n, err := checkRange(c, buf, lba)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.max == 0 {
+		c.stats.Misses += uint64(n)
+		return c.dev.ReadAt(buf, lba)
+	}
+	for i := int64(0); i < n; {
+		if data := c.get(lba + i); data != nil {
+			copy(buf[i*int64(c.size):], data)
+			c.stats.Hits++
+			i++
+			continue
+		}
+		// read the missing sectors in one request, and some more sectors
+		// after them for the following reads.
+		run := int64(1)
+		for i+run < n && c.sectors[lba+i+run] == nil {
+			run++
+		}
+		c.stats.Misses += uint64(run)
+		if i+run == n {
+			run += readAhead
+			if max := c.dev.Capacity() - lba - i; run > max {
+				run = max
+			}
+		}
+		tmp := make([]byte, run*int64(c.size))
+		if err := c.dev.ReadAt(tmp, lba+i); err != nil {
+			return err
+		}
+		for j := int64(0); j < run; j++ {
+			data := tmp[j*int64(c.size) : (j+1)*int64(c.size)]
+			if i+j < n {
+				copy(buf[(i+j)*int64(c.size):], data)
+			} else if c.sectors[lba+i+j] != nil {
+				// the cached sector read ahead may be newer than device
+				continue
+			}
+			if err := c.put(lba+i+j, data, false); err != nil {
+				return err
+			}
+		}
+		if i += run; i > n {
+			i = n
+		}
+	}
+	return nil
+}
+
+func (c *CachedBlockDevice) WriteAt(buf []byte, lba int64) error {
+	n, err := checkRange(c, buf, lba)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.max == 0 {
+		return c.dev.WriteAt(buf, lba)
+	}
+	if c.writeBack {
+		for i := int64(0); i < n; i++ {
+			if err := c.put(lba+i, buf[i*int64(c.size):(i+1)*int64(c.size)], true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := c.dev.WriteAt(buf, lba); err != nil {
+		// the device may be partially written, drop the stale sectors
+		for i := int64(0); i < n; i++ {
+			c.drop(lba + i)
+		}
+		return err
+	}
+	for i := int64(0); i < n; i++ {
+		if err := c.put(lba+i, buf[i*int64(c.size):(i+1)*int64(c.size)], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes back the dirty sectors, the adjacent ones are written in one
+// request. It must be called with mutex held.
+func (c *CachedBlockDevice) flush() error {
+	var dirty []*sector
+	for _, e := range c.sectors {
+		if s := e.Value.(*sector); s.dirty {
+			dirty = append(dirty, s)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].lba < dirty[j].lba
+	})
+	for len(dirty) > 0 {
+		run := 1
+		for run < len(dirty) && dirty[run].lba == dirty[0].lba+int64(run) {
+			run++
+		}
+		buf := make([]byte, 0, run*c.size)
+		for _, s := range dirty[:run] {
+			buf = append(buf, s.data...)
+		}
+		if err := c.dev.WriteAt(buf, dirty[0].lba); err != nil {
+			return err
+		}
+		for _, s := range dirty[:run] {
+			s.dirty = false
+		}
+		c.stats.Writebacks += uint64(run)
+		dirty = dirty[run:]
+	}
+	return nil
+}
+
+// Sync writes back the dirty sectors, and syncs the device if it can.
+func (c *CachedBlockDevice) Sync() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if s, ok := c.dev.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Invalidate drops the count sectors from lba in cache, used after writing
+// the device around the cache. The dirty data of the sectors is discarded.
+func (c *CachedBlockDevice) Invalidate(lba, count int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if count > int64(len(c.sectors)) {
+		for l := range c.sectors {
+			if l >= lba && l < lba+count {
+				c.drop(l)
+			}
+		}
+		return
+	}
+	for i := int64(0); i < count; i++ {
+		c.drop(lba + i)
+	}
+}
+
+// Close stops the background flush and writes back the dirty sectors.
+func (c *CachedBlockDevice) Close() error {
+	c.closeOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
+	return c.Sync()
+}
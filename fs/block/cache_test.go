@@ -0,0 +1,215 @@
+package block
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type memDevice struct {
+	data   []byte
+	size   int
+	reads  int
+	writes int
+}
+
+func (m *memDevice) ReadAt(buf []byte, lba int64) error {
+	if _, err := checkRange(m, buf, lba); err != nil {
+		return err
+	}
+	m.reads++
+	copy(buf, m.data[lba*int64(m.size):])
+	return nil
+}
+
+func (m *memDevice) WriteAt(buf []byte, lba int64) error {
+	if _, err := checkRange(m, buf, lba); err != nil {
+		return err
+	}
+	m.writes++
+	copy(m.data[lba*int64(m.size):], buf)
+	return nil
+}
+
+func (m *memDevice) SectorSize() int {
+	return m.size
+}
+
+func (m *memDevice) Capacity() int64 {
+	return int64(len(m.data) / m.size)
+}
+
+func newMemDevice(sectors int) *memDevice {
+	m := &memDevice{data: make([]byte, sectors*512), size: 512}
+	for i := range m.data {
+		m.data[i] = byte(i / 512)
+	}
+	return m
+}
+
+func TestCacheRead(t *testing.T) {
+	mem := newMemDevice(64)
+	dev := NewCachedBlockDevice(mem, 16*512)
+
+	buf := make([]byte, 2*512)
+	for i := 0; i < 3; i++ {
+		if err := dev.ReadAt(buf, 10); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, mem.data[10*512:12*512]) {
+			t.Fatalf("bad content of sector 10")
+		}
+	}
+	if mem.reads != 1 {
+		t.Fatalf("expect 1 read, got %d", mem.reads)
+	}
+
+	// the following sectors are read ahead
+	if err := dev.ReadAt(buf[:512], 12); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 12 || mem.reads != 1 {
+		t.Fatalf("sector 12 not read ahead, reads:%d", mem.reads)
+	}
+
+	// read ahead stops at the end of device
+	if err := dev.ReadAt(buf, 62); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 62 || buf[512] != 63 {
+		t.Fatalf("bad content of sector 62")
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	mem := newMemDevice(64)
+	dev := NewCachedBlockDevice(mem, 2*512)
+
+	buf := make([]byte, 512)
+	dev.ReadAt(buf, 0)
+	dev.ReadAt(buf, 40)
+	// sector 0 is evicted by the read ahead of sector 40
+	mem.reads = 0
+	dev.ReadAt(buf, 0)
+	if mem.reads != 1 || buf[0] != 0 {
+		t.Fatalf("expect sector 0 evicted, reads:%d", mem.reads)
+	}
+}
+
+func TestCacheWrite(t *testing.T) {
+	mem := newMemDevice(64)
+	dev := NewCachedBlockDevice(mem, 16*512)
+
+	buf := make([]byte, 512)
+	dev.ReadAt(buf, 5)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	if err := dev.WriteAt(buf, 5); err != nil {
+		t.Fatal(err)
+	}
+	if mem.data[5*512] != 0xff {
+		t.Fatal("write not go through to device")
+	}
+	reads := mem.reads
+	got := make([]byte, 512)
+	dev.ReadAt(got, 5)
+	if !bytes.Equal(got, buf) || mem.reads != reads {
+		t.Fatal("cache not updated by write")
+	}
+}
+
+func TestCacheRange(t *testing.T) {
+	dev := NewCachedBlockDevice(newMemDevice(8), 4096)
+	if err := dev.ReadAt(make([]byte, 100), 0); err != syscall.EINVAL {
+		t.Errorf("unaligned read, got %v", err)
+	}
+	if err := dev.ReadAt(make([]byte, 1024), 7); err != syscall.EINVAL {
+		t.Errorf("read beyond capacity, got %v", err)
+	}
+	if err := dev.WriteAt(make([]byte, 512), -1); err != syscall.EINVAL {
+		t.Errorf("write at negative lba, got %v", err)
+	}
+}
+
+func TestCacheWriteBack(t *testing.T) {
+	mem := newMemDevice(64)
+	dev := NewWriteBackBlockDevice(mem, 2*512, 0)
+
+	buf := bytes.Repeat([]byte{0xff}, 2*512)
+	if err := dev.WriteAt(buf, 4); err != nil {
+		t.Fatal(err)
+	}
+	if mem.writes != 0 || mem.data[4*512] != 4 {
+		t.Fatal("write reached device before sync")
+	}
+	got := make([]byte, 512)
+	dev.ReadAt(got, 5)
+	if got[0] != 0xff || mem.reads != 0 {
+		t.Fatal("dirty sector not read from cache")
+	}
+	if err := dev.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if mem.writes != 1 || mem.data[4*512] != 0xff || mem.data[5*512] != 0xff {
+		t.Fatalf("expect sectors written by 1 request, got %d", mem.writes)
+	}
+
+	// eviction writes back
+	dev.WriteAt(buf[:512], 10)
+	dev.ReadAt(got, 20)
+	if mem.data[10*512] != 0xff {
+		t.Fatal("evicted dirty sector lost")
+	}
+	if st := dev.Stats(); st.Writebacks != 3 {
+		t.Fatalf("expect 3 write backs, got %d", st.Writebacks)
+	}
+}
+
+func TestCacheFlusher(t *testing.T) {
+	mem := newMemDevice(8)
+	dev := NewWriteBackBlockDevice(mem, 4096, time.Millisecond)
+	defer dev.Close()
+	dev.WriteAt(bytes.Repeat([]byte{0xff}, 512), 1)
+	for i := 0; i < 1000 && dev.Stats().Writebacks == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	if mem.data[512] != 0xff {
+		t.Fatal("dirty sector not flushed in background")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	mem := newMemDevice(64)
+	dev := NewCachedBlockDevice(mem, 16*512)
+
+	buf := make([]byte, 512)
+	dev.ReadAt(buf, 3)
+	mem.data[3*512] = 0xee
+	dev.ReadAt(buf, 3)
+	if buf[0] != 3 {
+		t.Fatal("expect stale cached sector")
+	}
+	dev.Invalidate(3, 1)
+	dev.ReadAt(buf, 3)
+	if buf[0] != 0xee {
+		t.Fatal("sector not invalidated")
+	}
+	if st := dev.Stats(); st.Hits != 1 || st.Misses != 2 {
+		t.Fatalf("expect 1 hit and 2 misses, got %+v", st)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	mem := newMemDevice(8)
+	dev := NewCachedBlockDevice(mem, 0)
+	buf := make([]byte, 512)
+	dev.ReadAt(buf, 1)
+	dev.ReadAt(buf, 1)
+	if mem.reads != 2 {
+		t.Fatalf("expect 2 reads, got %d", mem.reads)
+	}
+}
@@ -0,0 +1,56 @@
+package block
+
+import "io"
+
+// ImageFile is the file holding a disk image
+type ImageFile interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// fileDevice is a disk image file used as a BlockDevice
+type fileDevice struct {
+	f       ImageFile
+	size    int
+	sectors int64
+}
+
+// NewFileDevice returns the BlockDevice of the disk image f of size bytes,
+// the bytes after the last whole sector are not used.
+func NewFileDevice(f ImageFile, size int64, sectorSize int) BlockDevice {
+	return &fileDevice{
+		f:       f,
+		size:    sectorSize,
+		sectors: size / int64(sectorSize),
+	}
+}
+
+func (d *fileDevice) ReadAt(buf []byte, lba int64) error {
+	if _, err := checkRange(d, buf, lba); err != nil {
+		return err
+	}
+	n, err := d.f.ReadAt(buf, lba*int64(d.size))
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *fileDevice) WriteAt(buf []byte, lba int64) error {
+	if _, err := checkRange(d, buf, lba); err != nil {
+		return err
+	}
+	_, err := d.f.WriteAt(buf, lba*int64(d.size))
+	return err
+}
+
+func (d *fileDevice) SectorSize() int {
+	return d.size
+}
+
+func (d *fileDevice) Capacity() int64 {
+	return d.sectors
+}
@@ -0,0 +1,140 @@
+package fs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+// owner is the uid and gid of a file, eggos has no users, the ownership is
+// only recorded and reported by stat.
+type owner [2]uint32
+
+var (
+	// StrictPermissions makes chown refuse the owners other than root
+	StrictPermissions bool
+
+	ownerMutex sync.Mutex
+	// owners is the ownership of the paths changed by chown, the others
+	// are owned by root.
+	owners = make(map[string]owner)
+)
+
+// fileOwner returns the owner of the file name
+func fileOwner(name string) (uid, gid uint32) {
+	name = resolveLink(name)
+	ownerMutex.Lock()
+	defer ownerMutex.Unlock()
+	o := owners[name]
+	return o[0], o[1]
+}
+
+// chownIds merges the new uid and gid into o, -1 leaves the id unchanged.
+func chownIds(o owner, uid, gid uint32) (owner, error) {
+	if StrictPermissions && (uid != ^uint32(0) && uid != 0 || gid != ^uint32(0) && gid != 0) {
+		return o, syscall.EPERM
+	}
+	if uid != ^uint32(0) {
+		o[0] = uid
+	}
+	if gid != ^uint32(0) {
+		o[1] = gid
+	}
+	return o, nil
+}
+
+func chown(name string, uid, gid uint32) error {
+	if _, err := statFile(name); err != nil {
+		return fsErrno(err)
+	}
+	name = resolveLink(name)
+	ownerMutex.Lock()
+	o, err := chownIds(owners[name], uid, gid)
+	if err == nil {
+		owners[name] = o
+	}
+	ownerMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the opened files follow the path
+	inodeMutex.Lock()
+	for _, ni := range inodes {
+		if ni != nil && ni.Name != "" && resolveLink(ni.Name) == name {
+			ni.Uid, ni.Gid = o[0], o[1]
+		}
+	}
+	inodeMutex.Unlock()
+	inotify(name, syscall.IN_ATTRIB, 0)
+	return nil
+}
+
+func sysFchown(ni *Inode, uid, gid uint32) error {
+	if ni.Name != "" && ni.mount != "" {
+		return chown(ni.Name, uid, gid)
+	}
+	o, err := chownIds(owner{ni.Uid, ni.Gid}, uid, gid)
+	if err != nil {
+		return err
+	}
+	ni.Uid, ni.Gid = o[0], o[1]
+	return nil
+}
+
+func removeOwner(name string) {
+	ownerMutex.Lock()
+	defer ownerMutex.Unlock()
+	delete(owners, path.Clean("/"+name))
+}
+
+func renameOwner(oldname, newname string) {
+	ownerMutex.Lock()
+	defer ownerMutex.Unlock()
+	oldname, newname = path.Clean("/"+oldname), path.Clean("/"+newname)
+	delete(owners, newname)
+	if o, ok := owners[oldname]; ok {
+		delete(owners, oldname)
+		owners[newname] = o
+	}
+}
+
+// removeOwners drops the owners under the mount point target
+func removeOwners(target string) {
+	prefix := strings.TrimSuffix(target, "/") + "/"
+	ownerMutex.Lock()
+	defer ownerMutex.Unlock()
+	for name := range owners {
+		if strings.HasPrefix(name, prefix) {
+			delete(owners, name)
+		}
+	}
+}
+
+// chownId converts the ids of the legacy 16bit chown syscalls
+func chownId(id uintptr, legacy bool) uint32 {
+	if legacy && uint16(id) == ^uint16(0) {
+		return ^uint32(0)
+	}
+	return uint32(id)
+}
+
+// func chown(path string, uid, gid int)
+// func lchown(path string, uid, gid int)
+// func fchownat(dirfd int, path string, uid, gid int, flags int)
+func sysChown(c *isyscall.Request) {
+	dirfd, pathptr, uid, gid := _AT_FDCWD, c.Args[0], c.Args[1], c.Args[2]
+	if c.NO == syscall.SYS_FCHOWNAT {
+		dirfd, pathptr, uid, gid = c.Args[0], c.Args[1], c.Args[2], c.Args[3]
+	}
+	legacy := c.NO == syscall.SYS_CHOWN || c.NO == syscall.SYS_LCHOWN
+	name, err := atPath(dirfd, pathptr)
+	if err == nil {
+		err = chown(name, chownId(uid, legacy), chownId(gid, legacy))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/spf13/afero"
+)
+
+func TestChown(t *testing.T) {
+	if err := Mount("/mnt/chown", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/chown")
+
+	name := []byte("/mnt/chown/file\x00")
+	fd, err := sysOpen(0, uintptr(unsafe.Pointer(&name[0])), uintptr(os.O_RDWR|os.O_CREATE), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, _ := GetInode(fd)
+	defer sysClose(ni)
+
+	owner := func() (uint32, uint32) {
+		var stat syscall.Stat_t
+		if err := sysStat(ni, uintptr(unsafe.Pointer(&stat))); err != nil {
+			t.Fatal(err)
+		}
+		return stat.Uid, stat.Gid
+	}
+	if err = sysFchown(ni, 1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := owner(); uid != 1000 || gid != 100 {
+		t.Fatalf("expect 1000:100, got %d:%d", uid, gid)
+	}
+	// -1 keeps the id
+	if err = chown("/mnt/chown/file", ^uint32(0), 200); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := owner(); uid != 1000 || gid != 200 {
+		t.Fatalf("expect 1000:200, got %d:%d", uid, gid)
+	}
+	if uid, gid := fileOwner("/mnt/chown/file"); uid != 1000 || gid != 200 {
+		t.Fatalf("expect 1000:200 by path, got %d:%d", uid, gid)
+	}
+	if err = chown("/mnt/chown/none", 0, 0); err != syscall.ENOENT {
+		t.Fatalf("expect ENOENT, got %v", err)
+	}
+
+	StrictPermissions = true
+	defer func() { StrictPermissions = false }()
+	if err = sysFchown(ni, 1, 1); err != syscall.EPERM {
+		t.Fatalf("expect EPERM, got %v", err)
+	}
+	if err = sysFchown(ni, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/sys"
+	"github.com/spf13/afero"
+)
+
+// _AT_FDCWD is -100, the dirfd of *at syscalls meaning the working directory
+const _AT_FDCWD = ^uintptr(99)
+
+var (
+	cwdMutex sync.Mutex
+	// cwd is the working directory shared by all threads, it's always clean
+	// and absolute.
+	cwd = "/"
+)
+
+// Getwd returns the working directory
+func Getwd() string {
+	cwdMutex.Lock()
+	defer cwdMutex.Unlock()
+	return cwd
+}
+
+// Chdir changes the working directory to dir
+func Chdir(dir string) error {
+	if dir == "" {
+		return syscall.ENOENT
+	}
+	dir = absPath(dir)
+	info, err := statFile(dir)
+	if err != nil {
+		return fsErrno(err)
+	}
+	if !info.IsDir() {
+		return syscall.ENOTDIR
+	}
+	cwdMutex.Lock()
+	cwd = dir
+	cwdMutex.Unlock()
+	return nil
+}
+
+// absPath returns the clean absolute path of name, the relative names are
+// resolved against the working directory.
+func absPath(name string) string {
+	if !path.IsAbs(name) {
+		name = path.Join(Getwd(), name)
+	}
+	return path.Clean(name)
+}
+
+// atPath returns the absolute path of the path argument of *at syscalls,
+// the relative names are resolved against the directory of dirfd.
+func atPath(dirfd, ptr uintptr) (string, error) {
+	name := cstring(ptr)
+	if name == "" {
+		return "", syscall.ENOENT
+	}
+	if path.IsAbs(name) || dirfd == _AT_FDCWD {
+		return absPath(name), nil
+	}
+	ni, err := GetInode(int(dirfd))
+	if err != nil {
+		return "", err
+	}
+	file, ok := ni.File.(afero.File)
+	if !ok || ni.Name == "" {
+		return "", syscall.ENOTDIR
+	}
+	if info, err := file.Stat(); err != nil || !info.IsDir() {
+		return "", syscall.ENOTDIR
+	}
+	return path.Join(ni.Name, name), nil
+}
+
+func getcwd(buf []byte) (int, error) {
+	dir := Getwd()
+	if len(dir)+1 > len(buf) {
+		return 0, syscall.ERANGE
+	}
+	copy(buf, dir)
+	buf[len(dir)] = 0
+	return len(dir) + 1, nil
+}
+
+// func chdir(path string)
+func sysChdir(c *isyscall.Request) {
+	c.Ret = isyscall.Error(Chdir(cstring(c.Args[0])))
+	c.Done()
+}
+
+// func getcwd(buf []byte)
+func sysGetcwd(c *isyscall.Request) {
+	n, err := getcwd(sys.UnsafeBuffer(c.Args[0], int(c.Args[1])))
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+	} else {
+		c.Ret = uintptr(n)
+	}
+	c.Done()
+}
@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/spf13/afero"
+)
+
+func TestChdir(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	mfs.MkdirAll("/a/b", 0755)
+	afero.WriteFile(mfs, "/a/file", []byte("file"), 0644)
+	if err := Mount("/mnt/cwd", mfs); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/cwd")
+	defer Chdir("/")
+
+	if err := Chdir("/mnt/cwd/a/b/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chdir("../."); err != nil {
+		t.Fatal(err)
+	}
+	var buf [64]byte
+	n, err := getcwd(buf[:])
+	if err != nil || string(buf[:n]) != "/mnt/cwd/a\x00" {
+		t.Fatalf("got %q %v", buf[:n], err)
+	}
+	if _, err = getcwd(buf[:5]); err != syscall.ERANGE {
+		t.Fatalf("expect ERANGE, got %v", err)
+	}
+	if err = Chdir("file"); err != syscall.ENOTDIR {
+		t.Fatalf("expect ENOTDIR, got %v", err)
+	}
+	if err = Chdir("none"); err != syscall.ENOENT {
+		t.Fatalf("expect ENOENT, got %v", err)
+	}
+
+	name := []byte("file\x00")
+	fd, err := sysOpen(_AT_FDCWD, uintptr(unsafe.Pointer(&name[0])), uintptr(os.O_RDONLY), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, _ := GetInode(fd)
+	defer sysClose(ni)
+	if ni.Name != "/mnt/cwd/a/file" {
+		t.Fatalf("expect absolute name, got %s", ni.Name)
+	}
+
+	// relative to dirfd
+	dir := []byte("/mnt/cwd/a/b\x00")
+	dirfd, err := sysOpen(_AT_FDCWD, uintptr(unsafe.Pointer(&dir[0])), uintptr(os.O_RDONLY), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirni, _ := GetInode(dirfd)
+	defer sysClose(dirni)
+	name = []byte("../file\x00")
+	if p, err := atPath(uintptr(dirfd), uintptr(unsafe.Pointer(&name[0]))); err != nil || p != "/mnt/cwd/a/file" {
+		t.Fatalf("got %s %v", p, err)
+	}
+	if _, err = atPath(uintptr(fd), uintptr(unsafe.Pointer(&name[0]))); err != syscall.ENOTDIR {
+		t.Fatalf("expect ENOTDIR, got %v", err)
+	}
+}
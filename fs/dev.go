@@ -1,6 +1,45 @@
 package fs
 
-import "math/rand"
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/console"
+	"github.com/icexin/eggos/fs/devfs"
+	"github.com/icexin/eggos/kernel/random"
+)
+
+const charMode = os.ModeDevice | os.ModeCharDevice | 0666
+
+var (
+	// Devices is the devfs mounted at /dev
+	Devices = devfs.New()
+
+	deviceMutex sync.Mutex
+	// devices is the devices added by RegisterDevice
+	devices = make(map[string]io.ReadWriteCloser)
+)
+
+// Opener is implemented by the devices handing out per-open state, Open is
+// called on every open of the device file, and the returned instance is
+// closed with the file.
+type Opener interface {
+	Open(flags int) (io.ReadWriteCloser, error)
+}
+
+type null struct{}
+
+func (n null) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (n null) Write(b []byte) (int, error) {
+	return len(b), nil
+}
 
 type zero struct{}
 
@@ -11,8 +50,134 @@ func (z zero) Read(b []byte) (int, error) {
 	return len(b), nil
 }
 
-type random struct{}
+func (z zero) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+type randomDev struct{}
 
-func (r random) Read(b []byte) (int, error) {
-	return rand.Read(b)
+func (r randomDev) Read(b []byte) (int, error) {
+	return random.Read(b)
+}
+
+// Write mixes b into the pool without crediting entropy, like linux.
+func (r randomDev) Write(b []byte) (int, error) {
+	random.AddEntropy(b)
+	return len(b), nil
+}
+
+// nopCloser makes a shared device usable as the factory of
+// RegisterCharDevice, closing a node doesn't close the device.
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (n nopCloser) Close() error {
+	return nil
+}
+
+func (n nopCloser) Ioctl(op, arg uintptr) error {
+	ctl, ok := n.ReadWriter.(interface {
+		Ioctl(op, arg uintptr) error
+	})
+	if !ok {
+		return syscall.ENOTTY
+	}
+	return ctl.Ioctl(op, arg)
+}
+
+func (n nopCloser) ReadNonBlock(p []byte) (int, error) {
+	if nb, ok := n.ReadWriter.(NonBlockReader); ok {
+		return nb.ReadNonBlock(p)
+	}
+	return n.Read(p)
+}
+
+func (n nopCloser) Readable() bool {
+	r, ok := n.ReadWriter.(readable)
+	return ok && r.Readable()
+}
+
+func registerChar(major, minor uint32, dev io.ReadWriter) {
+	RegisterCharDevice(major, minor, func() io.ReadWriteCloser {
+		return nopCloser{dev}
+	})
+}
+
+// RegisterDevice makes dev a character device file at name, all the opens
+// share dev unless it implements Opener. The device is placed in devfs if
+// name is under /dev, otherwise a placeholder file is created like mknod.
+func RegisterDevice(name string, dev io.ReadWriteCloser) error {
+	name = path.Clean("/" + name)
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	if _, ok := devices[name]; ok {
+		return &os.PathError{Op: "register", Path: name, Err: os.ErrExist}
+	}
+	if d, rel, ok := devfsOf(name); ok {
+		// devfs is a flat directory
+		if strings.Contains(strings.Trim(rel, "/"), "/") {
+			return &os.PathError{Op: "register", Path: name, Err: os.ErrNotExist}
+		}
+		if err := d.RegisterMode(rel, dev, charMode); err != nil {
+			return err
+		}
+	} else {
+		f, err := Root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		nodeMutex.Lock()
+		nodes[name] = &specialNode{dev: dev, mode: charMode}
+		nodeMutex.Unlock()
+	}
+	devices[name] = dev
+	return nil
+}
+
+// UnregisterDevice removes the device file name added by RegisterDevice and
+// closes the device.
+func UnregisterDevice(name string) error {
+	name = path.Clean("/" + name)
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	dev, ok := devices[name]
+	if !ok {
+		return &os.PathError{Op: "unregister", Path: name, Err: os.ErrNotExist}
+	}
+	if d, rel, ok := devfsOf(name); ok {
+		if err := d.Unregister(rel); err != nil {
+			return err
+		}
+	} else {
+		if err := Root.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removeNode(name)
+	}
+	delete(devices, name)
+	return dev.Close()
+}
+
+func devInit() {
+	// the device numbers are the same as linux
+	registerChar(1, 3, null{})
+	registerChar(1, 5, zero{})
+	registerChar(1, 8, randomDev{})
+	registerChar(1, 9, randomDev{})
+	registerChar(5, 1, console.Console())
+
+	Devices.Register("null", null{})
+	Devices.Register("zero", zero{})
+	Devices.Register("random", randomDev{})
+	Devices.Register("urandom", randomDev{})
+	err := Mount("/dev", Devices)
+	if err != nil {
+		panic(err)
+	}
+	err = RegisterDevice("/dev/console", nopCloser{console.Console()})
+	if err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/icexin/eggos/fs/devfs"
+	"github.com/spf13/afero"
+)
+
+type testDevice struct {
+	bytes.Buffer
+	closed bool
+	opens  []*testDevice
+}
+
+func (d *testDevice) Close() error {
+	d.closed = true
+	return nil
+}
+
+func (d *testDevice) Ioctl(op, arg uintptr) error {
+	if op != 1 {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// openDevice hands out a testDevice on every open
+type openDevice struct {
+	testDevice
+}
+
+func (d *openDevice) Open(flags int) (io.ReadWriteCloser, error) {
+	o := new(testDevice)
+	d.opens = append(d.opens, o)
+	return o, nil
+}
+
+func TestRegisterDevice(t *testing.T) {
+	if err := Mount("/mnt/mem", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/mem")
+	if err := Mount("/mnt/dev", devfs.New()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/dev")
+
+	for _, name := range []string{"/mnt/dev/tty", "/mnt/mem/tty"} {
+		dev := new(testDevice)
+		if err := RegisterDevice(name, dev); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterDevice(name, dev); !os.IsExist(err) {
+			t.Fatalf("expect EEXIST, got %v", err)
+		}
+		info, err := statFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != charMode {
+			t.Fatalf("%s: bad mode %v", name, info.Mode())
+		}
+		names, err := afero.ReadDir(Root, name[:len(name)-4])
+		if err != nil || len(names) != 1 || names[0].Name() != "tty" {
+			t.Fatalf("%s: bad listing %v %v", name, names, err)
+		}
+
+		f, err := openFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("hello"))
+		if dev.String() != "hello" {
+			t.Fatalf("%s: write %q", name, dev.String())
+		}
+		if err := f.(Ioctler).Ioctl(1, 0); err != nil {
+			t.Fatalf("%s: ioctl %v", name, err)
+		}
+		f.Close()
+		if dev.closed {
+			t.Fatalf("%s: shared device closed", name)
+		}
+
+		if err := UnregisterDevice(name); err != nil {
+			t.Fatal(err)
+		}
+		if !dev.closed {
+			t.Fatalf("%s: device not closed on unregister", name)
+		}
+		if _, err := statFile(name); !os.IsNotExist(err) {
+			t.Fatalf("%s: expect ENOENT, got %v", name, err)
+		}
+	}
+
+	// every open gets its own instance
+	dev := new(openDevice)
+	if err := RegisterDevice("/mnt/mem/ptmx", dev); err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterDevice("/mnt/mem/ptmx")
+	f1, _ := openFile("/mnt/mem/ptmx", os.O_RDWR, 0)
+	f2, _ := openFile("/mnt/mem/ptmx", os.O_RDWR, 0)
+	f1.Write([]byte("1"))
+	f2.Write([]byte("2"))
+	f1.Close()
+	if len(dev.opens) != 2 || dev.opens[0].String() != "1" || dev.opens[1].String() != "2" {
+		t.Fatalf("bad opens %v", dev.opens)
+	}
+	if !dev.opens[0].closed || dev.opens[1].closed {
+		t.Fatal("the instance should be closed with its file")
+	}
+	f2.Close()
+}
+
+// the fds of /dev/console opened by vfsInit honor O_NONBLOCK through devfs
+func TestDeviceNonBlock(t *testing.T) {
+	if err := Mount("/mnt/dev", devfs.New()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/dev")
+	if err := RegisterDevice("/mnt/dev/console", nopCloser{newEventFd(0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterDevice("/mnt/dev/console")
+
+	f, err := openFile("/mnt/dev/console", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, ni, err := AllocFileNode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysClose(ni)
+	if _, err := fcntlFlags(fd, syscall.F_SETFL, syscall.O_NONBLOCK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBuf(ni, make([]byte, 8), false); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+}
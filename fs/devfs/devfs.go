@@ -0,0 +1,352 @@
+// Package devfs implements a tiny afero.Fs which exposes the registered
+// devices as character device files, it's mounted at /dev by fs.
+package devfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	devMode = os.ModeDevice | os.ModeCharDevice | 0666
+	dirMode = os.ModeDir | 0755
+)
+
+type ioctler interface {
+	Ioctl(op, arg uintptr) error
+}
+
+type nonBlockReader interface {
+	ReadNonBlock(p []byte) (int, error)
+}
+
+type readable interface {
+	Readable() bool
+}
+
+// opener is implemented by the devices handing out a new instance on every
+// open, the same as fs.Opener.
+type opener interface {
+	Open(flags int) (io.ReadWriteCloser, error)
+}
+
+// device is a registered file and the mode reported by Stat
+type device struct {
+	dev  io.ReadWriter
+	mode os.FileMode
+}
+
+// Devfs is a flat directory of devices.
+type Devfs struct {
+	mutex   sync.Mutex
+	devices map[string]device
+	modTime time.Time
+}
+
+func New() *Devfs {
+	return &Devfs{
+		devices: make(map[string]device),
+		modTime: time.Now(),
+	}
+}
+
+// Register adds the device dev as file name, all the opens of the file
+// share the same dev, unless dev has the method Open(flags int)
+// (io.ReadWriteCloser, error) which is called on every open, the returned
+// instance is closed with the file.
+func (d *Devfs) Register(name string, dev io.ReadWriter) error {
+	return d.RegisterMode(name, dev, devMode)
+}
+
+// RegisterMode is like Register, but the file is reported with mode, e.g.
+// os.ModeNamedPipe for a fifo.
+func (d *Devfs) RegisterMode(name string, dev io.ReadWriter, mode os.FileMode) error {
+	name = clean(name)
+	if name == "" {
+		return &os.PathError{Op: "register", Path: name, Err: syscall.EINVAL}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.devices[name]; ok {
+		return &os.PathError{Op: "register", Path: name, Err: os.ErrExist}
+	}
+	d.devices[name] = device{dev: dev, mode: mode}
+	d.modTime = time.Now()
+	return nil
+}
+
+// Unregister removes the device registered as name.
+func (d *Devfs) Unregister(name string) error {
+	name = clean(name)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.devices[name]; !ok {
+		return &os.PathError{Op: "unregister", Path: name, Err: os.ErrNotExist}
+	}
+	delete(d.devices, name)
+	d.modTime = time.Now()
+	return nil
+}
+
+func clean(name string) string {
+	name = filepath.Clean("/" + name)
+	return name[1:]
+}
+
+func (d *Devfs) lookup(name string) (device, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	dev, ok := d.devices[clean(name)]
+	return dev, ok
+}
+
+func (d *Devfs) names() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var names []string
+	for name := range d.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create creates a file in the filesystem, returning the file and an
+// error, if any happens.
+func (d *Devfs) Create(name string) (afero.File, error) {
+	return d.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Mkdir creates a directory in the filesystem, return an error if any
+// happens.
+func (d *Devfs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+// MkdirAll creates a directory path and all parents that does not exist
+// yet.
+func (d *Devfs) MkdirAll(path string, perm os.FileMode) error {
+	if clean(path) == "" {
+		return nil
+	}
+	return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EPERM}
+}
+
+// Open opens a file, returning it or an error, if any happens.
+func (d *Devfs) Open(name string) (afero.File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file using the given flags and the given mode.
+func (d *Devfs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if clean(name) == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return &dirFile{fs: d}, nil
+	}
+	dev, ok := d.lookup(name)
+	if !ok {
+		if flag&os.O_CREATE != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if o, ok := dev.dev.(opener); ok {
+		rw, err := o.Open(flag)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &devFile{name: clean(name), dev: rw, closer: rw, mode: dev.mode}, nil
+	}
+	return &devFile{name: clean(name), dev: dev.dev, mode: dev.mode}, nil
+}
+
+// Remove removes a file identified by name, returning an error, if any
+// happens.
+func (d *Devfs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+// RemoveAll removes a directory path and any children it contains. It
+// does not fail if the path does not exist (return nil).
+func (d *Devfs) RemoveAll(path string) error {
+	return &os.PathError{Op: "remove", Path: path, Err: syscall.EPERM}
+}
+
+// Rename renames a file.
+func (d *Devfs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EPERM}
+}
+
+// Stat returns a FileInfo describing the named file, or an error, if any
+// happens.
+func (d *Devfs) Stat(name string) (os.FileInfo, error) {
+	if clean(name) == "" {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return &fileInfo{name: "/", mode: dirMode, modTime: d.modTime}, nil
+	}
+	dev, ok := d.lookup(name)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return &fileInfo{name: filepath.Base(name), mode: dev.mode, modTime: d.modTime}, nil
+}
+
+// The name of this FileSystem
+func (d *Devfs) Name() string {
+	return "devfs"
+}
+
+//Chmod changes the mode of the named file to mode.
+func (d *Devfs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+//Chtimes changes the access and modification times of the named file
+func (d *Devfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+type fileInfo struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return 0 }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+// devFile is an opened device, seeking on it is a no-op like linux
+type devFile struct {
+	name string
+	dev  io.ReadWriter
+	// closer is the instance opened for this file only
+	closer io.Closer
+	mode   os.FileMode
+}
+
+func (f *devFile) Read(p []byte) (int, error)  { return f.dev.Read(p) }
+func (f *devFile) Write(p []byte) (int, error) { return f.dev.Write(p) }
+
+// ReadNonBlock falls back to Read if the device can't be read without
+// blocking.
+func (f *devFile) ReadNonBlock(p []byte) (int, error) {
+	if nb, ok := f.dev.(nonBlockReader); ok {
+		return nb.ReadNonBlock(p)
+	}
+	return f.dev.Read(p)
+}
+
+func (f *devFile) Readable() bool {
+	r, ok := f.dev.(readable)
+	return ok && r.Readable()
+}
+
+func (f *devFile) ReadAt(p []byte, off int64) (int, error)  { return f.dev.Read(p) }
+func (f *devFile) WriteAt(p []byte, off int64) (int, error) { return f.dev.Write(p) }
+
+func (f *devFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (f *devFile) WriteString(s string) (int, error) { return f.dev.Write([]byte(s)) }
+
+func (f *devFile) Name() string { return f.name }
+
+func (f *devFile) Readdir(count int) ([]os.FileInfo, error) { return nil, syscall.ENOTDIR }
+func (f *devFile) Readdirnames(n int) ([]string, error)     { return nil, syscall.ENOTDIR }
+
+func (f *devFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: filepath.Base(f.name), mode: f.mode}, nil
+}
+
+func (f *devFile) Sync() error               { return nil }
+func (f *devFile) Truncate(size int64) error { return nil }
+
+func (f *devFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+func (f *devFile) Ioctl(op, arg uintptr) error {
+	ctl, ok := f.dev.(ioctler)
+	if !ok {
+		return syscall.ENOTTY
+	}
+	return ctl.Ioctl(op, arg)
+}
+
+// dirFile is the opened root directory of devfs
+type dirFile struct {
+	fs     *Devfs
+	offset int
+}
+
+func (f *dirFile) Read(p []byte) (int, error)                   { return 0, syscall.EISDIR }
+func (f *dirFile) ReadAt(p []byte, off int64) (int, error)      { return 0, syscall.EISDIR }
+func (f *dirFile) Write(p []byte) (int, error)                  { return 0, syscall.EISDIR }
+func (f *dirFile) WriteAt(p []byte, off int64) (int, error)     { return 0, syscall.EISDIR }
+func (f *dirFile) WriteString(s string) (int, error)            { return 0, syscall.EISDIR }
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) { return 0, syscall.EISDIR }
+
+func (f *dirFile) Name() string { return "/" }
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	names, err := f.Readdirnames(count)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := f.fs.Stat(name)
+		if err != nil {
+			// unregistered after Readdirnames
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *dirFile) Readdirnames(n int) ([]string, error) {
+	names := f.fs.names()
+	if f.offset >= len(names) {
+		names = nil
+	} else {
+		names = names[f.offset:]
+	}
+	if n > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if len(names) > n {
+			names = names[:n]
+		}
+	}
+	f.offset += len(names)
+	return names, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) { return f.fs.Stat("/") }
+
+func (f *dirFile) Sync() error               { return nil }
+func (f *dirFile) Truncate(size int64) error { return syscall.EISDIR }
+func (f *dirFile) Close() error              { return nil }
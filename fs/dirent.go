@@ -0,0 +1,195 @@
+package fs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/sys"
+	"github.com/spf13/afero"
+)
+
+// dirent is an entry returned by getdents
+type dirent struct {
+	ino  uint64
+	off  int64
+	typ  uint8
+	name string
+}
+
+// dirState is the entries of an opened directory read from the fs but not
+// returned by getdents yet.
+type dirState struct {
+	pending []dirent
+	off     int64
+	eof     bool
+}
+
+var truncInoOnce sync.Once
+
+// inodeNumber synthesizes the inode number of name, the fs doesn't provide
+// one.
+func inodeNumber(name string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, path.Clean("/"+name))
+	return h.Sum64()
+}
+
+func (d *dirState) add(dir string, name string, mode os.FileMode) {
+	d.off++
+	d.pending = append(d.pending, dirent{
+		ino:  inodeNumber(path.Join(dir, name)),
+		off:  d.off,
+		typ:  uint8(unixMode(mode) >> 12),
+		name: name,
+	})
+}
+
+// readDir passes the entries of directory ni to put until put returns
+// false, the refused entry is kept for the next call and full is set.
+func readDir(ni *Inode, put func(d *dirent) bool) (full bool, err error) {
+	file, ok := ni.File.(afero.File)
+	if !ok {
+		return false, syscall.ENOTDIR
+	}
+	ni.mutex.Lock()
+	defer ni.mutex.Unlock()
+	if ni.dir == nil {
+		info, err := file.Stat()
+		if err != nil {
+			return false, err
+		}
+		if !info.IsDir() {
+			return false, syscall.ENOTDIR
+		}
+		ni.dir = &dirState{}
+		ni.dir.add(ni.Name, ".", os.ModeDir)
+		ni.dir.add(ni.Name, "..", os.ModeDir)
+	}
+	d := ni.dir
+	for {
+		if len(d.pending) == 0 {
+			if d.eof {
+				return false, nil
+			}
+			infos, err := file.Readdir(64)
+			if err == io.EOF || (err == nil && len(infos) == 0) {
+				d.eof = true
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			for _, info := range infos {
+				d.add(ni.Name, info.Name(), info.Mode())
+			}
+		}
+		if !put(&d.pending[0]) {
+			return true, nil
+		}
+		d.pending = d.pending[1:]
+	}
+}
+
+func align(n, a int) int {
+	return (n + a - 1) &^ (a - 1)
+}
+
+// getdents64 fills buf with struct linux_dirent64
+func getdents64(ni *Inode, buf []byte) (int, error) {
+	n := 0
+	full, err := readDir(ni, func(d *dirent) bool {
+		// ino, off, reclen, type, name and the NUL
+		reclen := align(8+8+2+1+len(d.name)+1, 8)
+		if n+reclen > len(buf) {
+			return false
+		}
+		rec := buf[n : n+reclen]
+		binary.LittleEndian.PutUint64(rec[0:], d.ino)
+		binary.LittleEndian.PutUint64(rec[8:], uint64(d.off))
+		binary.LittleEndian.PutUint16(rec[16:], uint16(reclen))
+		rec[18] = d.typ
+		copy(rec[19:], d.name)
+		for i := 19 + len(d.name); i < reclen; i++ {
+			rec[i] = 0
+		}
+		n += reclen
+		return true
+	})
+	return direntResult(n, full, err)
+}
+
+// getdents fills buf with the legacy struct linux_dirent of 32bit inode
+// number and offset, the type is in the last byte of record.
+func getdents(ni *Inode, buf []byte) (int, error) {
+	n := 0
+	full, err := readDir(ni, func(d *dirent) bool {
+		// ino, off, reclen, name, the NUL and type
+		reclen := align(4+4+2+len(d.name)+2, 4)
+		if n+reclen > len(buf) {
+			return false
+		}
+		if d.ino > math.MaxUint32 {
+			truncInoOnce.Do(func() {
+				log.Printf("[fs] getdents: inode numbers truncated to 32 bits")
+			})
+		}
+		rec := buf[n : n+reclen]
+		binary.LittleEndian.PutUint32(rec[0:], uint32(d.ino))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(d.off))
+		binary.LittleEndian.PutUint16(rec[8:], uint16(reclen))
+		copy(rec[10:], d.name)
+		for i := 10 + len(d.name); i < reclen; i++ {
+			rec[i] = 0
+		}
+		rec[reclen-1] = d.typ
+		n += reclen
+		return true
+	})
+	return direntResult(n, full, err)
+}
+
+// direntResult returns EINVAL if the buffer can't hold one entry, the
+// error after some entries is left to the next call.
+func direntResult(n int, full bool, err error) (int, error) {
+	switch {
+	case n != 0:
+		return n, nil
+	case err != nil:
+		return 0, err
+	case full:
+		return 0, syscall.EINVAL
+	}
+	return 0, nil
+}
+
+// func getdents(fd int, buf []byte)
+// func getdents64(fd int, buf []byte)
+func sysGetdents(c *isyscall.Request) {
+	ni, err := GetInode(int(c.Args[0]))
+	if err != nil {
+		c.Ret = isyscall.Errno(errnoFromErr(err))
+		c.Done()
+		return
+	}
+	buf := sys.UnsafeBuffer(c.Args[1], int(c.Args[2]))
+	var n int
+	if c.NO == syscall.SYS_GETDENTS {
+		n, err = getdents(ni, buf)
+	} else {
+		n, err = getdents64(ni, buf)
+	}
+	if err != nil {
+		c.Ret = isyscall.Errno(errnoFromErr(err))
+	} else {
+		c.Ret = uintptr(n)
+	}
+	c.Done()
+}
@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// parseDirents returns the names and types in buf, wide is set for
+// linux_dirent64.
+func parseDirents(buf []byte, wide bool) ([]string, []uint8) {
+	var names []string
+	var types []uint8
+	for len(buf) > 0 {
+		var reclen int
+		var name string
+		var typ uint8
+		if wide {
+			reclen = int(binary.LittleEndian.Uint16(buf[16:]))
+			name, typ = string(buf[19:reclen]), buf[18]
+		} else {
+			reclen = int(binary.LittleEndian.Uint16(buf[8:]))
+			name, typ = string(buf[10:reclen-1]), buf[reclen-1]
+		}
+		names = append(names, strings.TrimRight(name, "\x00"))
+		types = append(types, typ)
+		buf = buf[reclen:]
+	}
+	return names, types
+}
+
+func readAllDirents(t *testing.T, name string, size int, wide bool) ([]string, []uint8) {
+	_, ni := openTest(t, name, os.O_RDONLY)
+	defer sysClose(ni)
+	var names []string
+	var types []uint8
+	buf := make([]byte, size)
+	for {
+		var n int
+		var err error
+		if wide {
+			n, err = getdents64(ni, buf)
+		} else {
+			n, err = getdents(ni, buf)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return names, types
+		}
+		ns, ts := parseDirents(buf[:n], wide)
+		names = append(names, ns...)
+		types = append(types, ts...)
+	}
+}
+
+func TestGetdents(t *testing.T) {
+	Root.MkdirAll("/tmp/dents/sub", 0755)
+	defer Root.RemoveAll("/tmp/dents")
+	for _, name := range []string{"a", "bb", "a_long_file_name"} {
+		afero.WriteFile(Root, "/tmp/dents/"+name, nil, 0644)
+	}
+
+	want := []string{".", "..", "a", "a_long_file_name", "bb", "sub"}
+	wantTypes := []uint8{syscall.DT_DIR, syscall.DT_DIR, syscall.DT_REG, syscall.DT_REG, syscall.DT_REG, syscall.DT_DIR}
+	for _, wide := range []bool{true, false} {
+		// small buffer takes several calls
+		names, types := readAllDirents(t, "/tmp/dents", 40, wide)
+		if !reflect.DeepEqual(names, want) || !reflect.DeepEqual(types, wantTypes) {
+			t.Fatalf("wide %v: got %v %v", wide, names, types)
+		}
+	}
+
+	_, ni := openTest(t, "/tmp/dents", os.O_RDONLY)
+	defer sysClose(ni)
+	if _, err := getdents64(ni, make([]byte, 8)); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	_, file := openTest(t, "/tmp/dents/a", os.O_RDONLY)
+	defer sysClose(file)
+	if _, err := getdents64(file, make([]byte, 128)); err != syscall.ENOTDIR {
+		t.Fatalf("expect ENOTDIR, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+// errnoFromErr converts the errors returned by afero.Fs and the files to the
+// errno seen by guest programs. A missing file under a regular file is
+// reported as ENOTDIR like linux, the unknown errors become EIO.
+func errnoFromErr(err error) syscall.Errno {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		if os.IsNotExist(e.Err) && parentNotDir(e.Path) {
+			return syscall.ENOTDIR
+		}
+		return errnoFromErr(e.Err)
+	case *os.LinkError:
+		return errnoFromErr(e.Err)
+	case *os.SyscallError:
+		return errnoFromErr(e.Err)
+	}
+
+	switch err {
+	case afero.ErrFileClosed, mem.ErrFileClosed, os.ErrClosed:
+		return syscall.EBADF
+	case afero.ErrFileNotFound:
+		return syscall.ENOENT
+	case afero.ErrFileExists, afero.ErrDestinationExists:
+		return syscall.EEXIST
+	case afero.ErrOutOfRange, os.ErrInvalid:
+		return syscall.EINVAL
+	case afero.ErrTooLarge:
+		return syscall.EFBIG
+	case io.ErrClosedPipe:
+		return syscall.EPIPE
+	}
+	switch {
+	case os.IsNotExist(err):
+		return syscall.ENOENT
+	case os.IsExist(err):
+		return syscall.EEXIST
+	case os.IsPermission(err):
+		return syscall.EACCES
+	}
+	return syscall.EIO
+}
+
+// parentNotDir reports whether a parent of name is not a directory
+func parentNotDir(name string) bool {
+	for dir := path.Dir(name); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		info, err := Root.Stat(dir)
+		if err == nil {
+			return !info.IsDir()
+		}
+	}
+	return false
+}
+
+// checkParent returns the errno of creating name, ENOENT if the parent is
+// missing and ENOTDIR if it's not a directory.
+func checkParent(name string) error {
+	dir := path.Dir(path.Clean("/" + name))
+	info, err := Root.Stat(dir)
+	switch {
+	case err == nil && !info.IsDir():
+		return syscall.ENOTDIR
+	case err != nil && parentNotDir(dir):
+		return syscall.ENOTDIR
+	case err != nil:
+		return syscall.ENOENT
+	}
+	return nil
+}
+
+// checkOpen catches the errors of open that afero.Fs doesn't report, EISDIR
+// on writing a directory and ENOTDIR on creating under a file.
+func checkOpen(name string, flags int) error {
+	info, err := Root.Stat(name)
+	switch {
+	case err == nil && info.IsDir() && flags&syscall.O_ACCMODE != syscall.O_RDONLY:
+		return syscall.EISDIR
+	case err == nil && info.IsDir() && flags&syscall.O_TRUNC != 0:
+		return syscall.EISDIR
+	case err != nil && flags&syscall.O_CREAT != 0:
+		return checkParent(name)
+	}
+	return nil
+}
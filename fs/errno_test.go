@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/spf13/afero"
+)
+
+func openErrno(name string, flags int) error {
+	b := append([]byte(name), 0)
+	fd, err := sysOpen(0, uintptr(unsafe.Pointer(&b[0])), uintptr(flags), 0644)
+	if err == nil {
+		ni, _ := GetInode(fd)
+		sysClose(ni)
+	}
+	return err
+}
+
+func TestErrno(t *testing.T) {
+	Root.MkdirAll("/tmp/errno/dir/sub", 0755)
+	afero.WriteFile(Root, "/tmp/errno/file", []byte("x"), 0644)
+	defer Root.RemoveAll("/tmp/errno")
+
+	closed, _ := Root.Open("/tmp/errno/file")
+	closed.Close()
+	_, closedErr := closed.Read(make([]byte, 1))
+
+	tests := []struct {
+		name string
+		err  func() error
+		want syscall.Errno
+	}{
+		{"open missing", func() error { return openErrno("/tmp/errno/none", os.O_RDONLY) }, syscall.ENOENT},
+		{"create in missing dir", func() error { return openErrno("/tmp/errno/none/f", os.O_CREATE|os.O_WRONLY) }, syscall.ENOENT},
+		{"create exclusive", func() error { return openErrno("/tmp/errno/file", os.O_CREATE|os.O_EXCL|os.O_WRONLY) }, syscall.EEXIST},
+		{"open under file", func() error { return openErrno("/tmp/errno/file/f", os.O_RDONLY) }, syscall.ENOTDIR},
+		{"create under file", func() error { return openErrno("/tmp/errno/file/f", os.O_CREATE|os.O_WRONLY) }, syscall.ENOTDIR},
+		{"write dir", func() error { return openErrno("/tmp/errno/dir", os.O_WRONLY) }, syscall.EISDIR},
+		{"truncate dir", func() error { return openErrno("/tmp/errno/dir", os.O_RDONLY|os.O_TRUNC) }, syscall.EISDIR},
+		{"mkdir exist", func() error { return mkdirat("/tmp/errno/dir", 0755) }, syscall.EEXIST},
+		{"mkdir under file", func() error { return mkdirat("/tmp/errno/file/d", 0755) }, syscall.ENOTDIR},
+		{"mkdir in missing dir", func() error { return mkdirat("/tmp/errno/none/d", 0755) }, syscall.ENOENT},
+		{"rmdir not empty", func() error { return unlinkat("/tmp/errno/dir", _AT_REMOVEDIR) }, syscall.ENOTEMPTY},
+		{"unlink dir", func() error { return unlinkat("/tmp/errno/dir", 0) }, syscall.EISDIR},
+		{"rmdir file", func() error { return unlinkat("/tmp/errno/file", _AT_REMOVEDIR) }, syscall.ENOTDIR},
+		{"rename missing", func() error { return rename("/tmp/errno/none", "/tmp/errno/none1") }, syscall.ENOENT},
+		{"read closed", func() error { return fsErrno(closedErr) }, syscall.EBADF},
+		{"permission", func() error { return fsErrno(os.ErrPermission) }, syscall.EACCES},
+		{"unknown", func() error { return fsErrno(errors.New("boom")) }, syscall.EIO},
+	}
+	for _, test := range tests {
+		if err := test.err(); err != test.want {
+			t.Errorf("%s: expect %v, got %v", test.name, test.want, err)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package fs
 
-import "github.com/spf13/afero"
+import (
+	"github.com/icexin/eggos/kernel"
+	"github.com/spf13/afero"
+)
 
 var builtinFiles = map[string]string{
-	"/etc/resolv.conf":          `nameserver 114.114.114.114`,
-	"/proc/sys/kernel/hostname": `eggos`,
+	"/etc/resolv.conf": `nameserver 114.114.114.114`,
+}
+
+// writeHostname keeps /etc/hostname in sync with the hostname of uname
+func writeHostname(name string) {
+	afero.WriteFile(Root, "/etc/hostname", []byte(name+"\n"), 0644)
 }
 
 func etcInit() {
@@ -14,4 +21,6 @@ func etcInit() {
 			panic(err)
 		}
 	}
+	writeHostname(kernel.Hostname())
+	kernel.OnHostname(writeHostname)
 }
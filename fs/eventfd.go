@@ -0,0 +1,177 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	_EFD_SEMAPHORE = 0x1
+	_EFD_NONBLOCK  = syscall.O_NONBLOCK
+	_EFD_CLOEXEC   = syscall.O_CLOEXEC
+
+	// the max value of counter
+	_EFD_MAX = 0xfffffffffffffffe
+)
+
+type eventFd struct {
+	fd    int
+	flags int
+
+	counter uint64
+	closed  bool
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+func newEventFd(initval uint64, flags int) *eventFd {
+	e := &eventFd{
+		flags:   flags,
+		counter: initval,
+	}
+	e.cond = sync.NewCond(&e.mutex)
+	return e
+}
+
+func (e *eventFd) Read(p []byte) (int, error) {
+	return e.read(p, false)
+}
+
+// ReadNonBlock returns EAGAIN if the counter is zero, it's used by the fds
+// with O_NONBLOCK.
+func (e *eventFd) ReadNonBlock(p []byte) (int, error) {
+	return e.read(p, true)
+}
+
+func (e *eventFd) Readable() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.counter != 0
+}
+
+// Poll reports POLLOUT if at least 1 can be written without blocking
+func (e *eventFd) Poll() uint32 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var events uint32
+	if e.counter != 0 {
+		events |= _POLLIN
+	}
+	if e.counter < _EFD_MAX {
+		events |= _POLLOUT
+	}
+	return events
+}
+
+func (e *eventFd) read(p []byte, nonblock bool) (int, error) {
+	if len(p) < 8 {
+		return 0, syscall.EINVAL
+	}
+	e.mutex.Lock()
+	for e.counter == 0 {
+		// the blocked readers fail after close
+		if e.closed {
+			e.mutex.Unlock()
+			return 0, syscall.EBADF
+		}
+		if nonblock {
+			e.mutex.Unlock()
+			return 0, syscall.EAGAIN
+		}
+		e.cond.Wait()
+	}
+
+	var val uint64
+	if e.flags&_EFD_SEMAPHORE != 0 {
+		val = 1
+	} else {
+		val = e.counter
+	}
+	e.counter -= val
+	// wake up the writers waiting for room
+	e.cond.Broadcast()
+	e.mutex.Unlock()
+	*(*uint64)(unsafe.Pointer(&p[0])) = val
+
+	evnotify(uintptr(e.fd), syscall.EPOLLOUT)
+	return 8, nil
+}
+
+func (e *eventFd) Write(p []byte) (int, error) {
+	return e.write(p, false)
+}
+
+// WriteNonBlock returns EAGAIN if the write overflows the counter
+func (e *eventFd) WriteNonBlock(p []byte) (int, error) {
+	return e.write(p, true)
+}
+
+func (e *eventFd) write(p []byte, nonblock bool) (int, error) {
+	if len(p) < 8 {
+		return 0, syscall.EINVAL
+	}
+	val := *(*uint64)(unsafe.Pointer(&p[0]))
+	if val == ^uint64(0) {
+		return 0, syscall.EINVAL
+	}
+	e.mutex.Lock()
+	// the counter can't exceed _EFD_MAX, the write waits for a read
+	// making enough room.
+	for _EFD_MAX-e.counter < val {
+		if e.closed {
+			e.mutex.Unlock()
+			return 0, syscall.EBADF
+		}
+		if nonblock {
+			e.mutex.Unlock()
+			return 0, syscall.EAGAIN
+		}
+		e.cond.Wait()
+	}
+	e.counter += val
+	e.cond.Broadcast()
+	e.mutex.Unlock()
+
+	evnotify(uintptr(e.fd), syscall.EPOLLIN)
+	return 8, nil
+}
+
+func (e *eventFd) Close() error {
+	e.mutex.Lock()
+	e.closed = true
+	e.cond.Broadcast()
+	e.mutex.Unlock()
+	return nil
+}
+
+// func eventfd2(initval uint, flags int) (fd int)
+func sysEventfd2(c *isyscall.Request) {
+	var flags int
+	if c.NO == syscall.SYS_EVENTFD2 {
+		flags = int(c.Args[1])
+	}
+	if flags&^(_EFD_SEMAPHORE|_EFD_NONBLOCK|_EFD_CLOEXEC) != 0 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+
+	e := newEventFd(uint64(c.Args[0]), flags)
+	fd, ni, err := AllocFileNode(e)
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	inodeMutex.Lock()
+	// EFD_NONBLOCK and EFD_CLOEXEC are the same as the O_* flags
+	ni.Flags |= flags & (_EFD_NONBLOCK | _EFD_CLOEXEC)
+	ni.Name = "anon_inode:[eventfd]"
+	inodeMutex.Unlock()
+	e.fd = fd
+	c.Ret = uintptr(fd)
+	c.Done()
+}
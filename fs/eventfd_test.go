@@ -0,0 +1,116 @@
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func eventWrite(e *eventFd, val uint64, nonblock bool) error {
+	buf := (*[8]byte)(unsafe.Pointer(&val))[:]
+	_, err := e.write(buf, nonblock)
+	return err
+}
+
+func eventRead(e *eventFd, nonblock bool) (uint64, error) {
+	var val uint64
+	buf := (*[8]byte)(unsafe.Pointer(&val))[:]
+	_, err := e.read(buf, nonblock)
+	return val, err
+}
+
+func TestEventFd(t *testing.T) {
+	e := newEventFd(3, 0)
+	if err := eventWrite(e, 4, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := eventRead(e, false); v != 7 || err != nil {
+		t.Fatalf("expect 7, got %d %v", v, err)
+	}
+	if _, err := eventRead(e, true); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+	if err := eventWrite(e, ^uint64(0), false); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	if _, err := e.Read(make([]byte, 4)); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL on short buffer, got %v", err)
+	}
+
+	// a blocked read is woken up by write
+	done := make(chan uint64)
+	go func() {
+		v, _ := eventRead(e, false)
+		done <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+	eventWrite(e, 1, false)
+	if v := <-done; v != 1 {
+		t.Fatalf("expect 1, got %d", v)
+	}
+}
+
+func TestEventFdSemaphore(t *testing.T) {
+	e := newEventFd(2, _EFD_SEMAPHORE)
+	for i := 0; i < 2; i++ {
+		if v, err := eventRead(e, true); v != 1 || err != nil {
+			t.Fatalf("expect 1, got %d %v", v, err)
+		}
+	}
+	if _, err := eventRead(e, true); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+}
+
+func TestEventFdOverflow(t *testing.T) {
+	e := newEventFd(0, 0)
+	if err := eventWrite(e, _EFD_MAX, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := eventWrite(e, 1, true); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+
+	// a blocked write waits for the read making room
+	done := make(chan error)
+	go func() {
+		done <- eventWrite(e, 1, false)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write should block, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if v, _ := eventRead(e, false); v != _EFD_MAX {
+		t.Fatalf("expect %d, got %d", uint64(_EFD_MAX), v)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := eventRead(e, true); v != 1 {
+		t.Fatalf("expect 1, got %d", v)
+	}
+}
+
+func TestEventFdClose(t *testing.T) {
+	e := newEventFd(0, 0)
+	if events := e.Poll(); events != _POLLOUT {
+		t.Fatalf("expect POLLOUT, got %#x", events)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := eventRead(e, false)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	e.Close()
+	select {
+	case err := <-done:
+		if err != syscall.EBADF {
+			t.Fatalf("expect EBADF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not woken up by close")
+	}
+}
@@ -0,0 +1,111 @@
+// Package fat gives read-only access to the FAT32 partitions, such as the
+// EFI system partition of boot disk. The volume is parsed by package fatfs.
+package fat
+
+import (
+	"encoding/binary"
+	"io"
+	"syscall"
+
+	"github.com/icexin/eggos/fs/block"
+	"github.com/icexin/eggos/fs/fatfs"
+	"github.com/spf13/afero"
+)
+
+// partition is the sectors [start, start+count) of disk, writes are
+// rejected.
+type partition struct {
+	dev   block.BlockDevice
+	start int64
+	count int64
+}
+
+func (p *partition) SectorSize() int { return p.dev.SectorSize() }
+func (p *partition) Capacity() int64 { return p.count }
+
+func (p *partition) ReadAt(buf []byte, lba int64) error {
+	if lba < 0 || lba+int64(len(buf)/p.SectorSize()) > p.count {
+		return syscall.EINVAL
+	}
+	return p.dev.ReadAt(buf, p.start+lba)
+}
+
+func (p *partition) WriteAt(buf []byte, lba int64) error {
+	return syscall.EROFS
+}
+
+// readerDevice is the read-only disk of an io.ReaderAt, the volume starts
+// at byte offset.
+type readerDevice struct {
+	r        io.ReaderAt
+	offset   int64
+	size     int
+	capacity int64
+}
+
+func (d *readerDevice) SectorSize() int { return d.size }
+func (d *readerDevice) Capacity() int64 { return d.capacity }
+
+func (d *readerDevice) ReadAt(buf []byte, lba int64) error {
+	n, err := d.r.ReadAt(buf, d.offset+lba*int64(d.size))
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *readerDevice) WriteAt(buf []byte, lba int64) error {
+	return syscall.EROFS
+}
+
+// newReaderDevice sizes the volume at offset of r by its boot sector
+func newReaderDevice(r io.ReaderAt, offset int64) (*readerDevice, error) {
+	if offset < 0 {
+		return nil, syscall.EINVAL
+	}
+	var bpb [36]byte
+	if _, err := r.ReadAt(bpb[:], offset); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	size := int(le.Uint16(bpb[11:]))
+	total := int64(le.Uint16(bpb[19:]))
+	if total == 0 {
+		total = int64(le.Uint32(bpb[32:]))
+	}
+	if size == 0 || size%512 != 0 || total == 0 {
+		return nil, syscall.EINVAL
+	}
+	// the reader must hold the whole volume
+	var last [1]byte
+	if _, err := r.ReadAt(last[:], offset+total*int64(size)-1); err != nil {
+		return nil, syscall.EINVAL
+	}
+	return &readerDevice{r: r, offset: offset, size: size, capacity: total}, nil
+}
+
+// NewFAT32 opens the FAT32 volume starts at offset bytes of dev, the size
+// of volume is read from its boot sector.
+func NewFAT32(dev io.ReaderAt, offset int64) (afero.Fs, error) {
+	d, err := newReaderDevice(dev, offset)
+	if err != nil {
+		return nil, err
+	}
+	return NewFAT32Device(d, 0, d.capacity)
+}
+
+// NewFAT32Device opens the FAT32 volume in the count sectors starting at
+// sector start of dev.
+func NewFAT32Device(dev block.BlockDevice, start, count int64) (afero.Fs, error) {
+	if start < 0 || count < 0 || start+count > dev.Capacity() {
+		return nil, syscall.EINVAL
+	}
+	fs, err := fatfs.New(&partition{dev: dev, start: start, count: count})
+	if err != nil {
+		return nil, err
+	}
+	return afero.NewReadOnlyFs(fs), nil
+}
@@ -0,0 +1,125 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// disk is a memory disk of 512 bytes sectors
+type disk []byte
+
+func (d disk) SectorSize() int { return 512 }
+func (d disk) Capacity() int64 { return int64(len(d)) / 512 }
+
+func (d disk) ReadAt(p []byte, lba int64) error {
+	if lba < 0 || lba*512+int64(len(p)) > int64(len(d)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(p, d[lba*512:])
+	return nil
+}
+
+func (d disk) WriteAt(p []byte, lba int64) error {
+	copy(d[lba*512:], p)
+	return nil
+}
+
+// mkvolume formats a FAT32 volume of total sectors with HELLO.TXT in root
+func mkvolume(b []byte, total uint32, content string) {
+	const (
+		reserved = 32
+		numFATs  = 2
+		fatSize  = 20
+	)
+	le := binary.LittleEndian
+	copy(b, []byte{0xEB, 0x58, 0x90})
+	le.PutUint16(b[11:], 512)
+	b[13] = 1
+	le.PutUint16(b[14:], reserved)
+	b[16] = numFATs
+	b[21] = 0xF8
+	le.PutUint32(b[32:], total)
+	le.PutUint32(b[36:], fatSize)
+	le.PutUint32(b[44:], 2)
+	b[510], b[511] = 0x55, 0xAA
+
+	for i := 0; i < numFATs; i++ {
+		fat := b[(reserved+i*fatSize)*512:]
+		le.PutUint32(fat[0:], 0x0FFFFFF8)
+		le.PutUint32(fat[4:], 0x0FFFFFFF)
+		// root directory and the file
+		le.PutUint32(fat[8:], 0x0FFFFFFF)
+		le.PutUint32(fat[12:], 0x0FFFFFFF)
+	}
+	data := b[(reserved+numFATs*fatSize)*512:]
+	ent := data[:32]
+	copy(ent, "HELLO   TXT")
+	ent[11] = 0x20
+	le.PutUint16(ent[26:], 3)
+	le.PutUint32(ent[28:], uint32(len(content)))
+	copy(data[512:], content)
+}
+
+func TestPartitionOffset(t *testing.T) {
+	const (
+		start = 63
+		total = 2048
+	)
+	d := make(disk, (start+total)*512)
+	// garbage before the partition
+	for i := 0; i < start*512; i++ {
+		d[i] = 0xAA
+	}
+	mkvolume(d[start*512:], total, "hello fat")
+
+	if _, err := NewFAT32Device(d, 0, total); err == nil {
+		t.Fatal("expect error on the sectors before partition")
+	}
+	if _, err := NewFAT32Device(d, start, total+1); err == nil {
+		t.Fatal("expect error on partition out of disk")
+	}
+	fs, err := NewFAT32Device(d, start, total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := afero.ReadFile(fs, "/HELLO.TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello fat" {
+		t.Fatalf("bad content %q", buf)
+	}
+	if err := afero.WriteFile(fs, "/NEW.TXT", []byte("x"), 0644); err == nil {
+		t.Fatal("expect error on writing read-only volume")
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	const (
+		start = 63
+		total = 2048
+	)
+	d := make([]byte, (start+total)*512)
+	mkvolume(d[start*512:], total, "hello reader")
+
+	// bytes.Reader is only an io.ReaderAt
+	r := bytes.NewReader(d)
+	if _, err := NewFAT32(r, 0); err == nil {
+		t.Fatal("expect error on the sectors before partition")
+	}
+	if _, err := NewFAT32(bytes.NewReader(d[:(start+total/2)*512]), start*512); err == nil {
+		t.Fatal("expect error on truncated volume")
+	}
+	fs, err := NewFAT32(r, start*512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := afero.ReadFile(fs, "/HELLO.TXT")
+	if err != nil || string(buf) != "hello reader" {
+		t.Fatalf("bad content %q %v", buf, err)
+	}
+}
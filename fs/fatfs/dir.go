@@ -0,0 +1,536 @@
+package fatfs
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	// flags in the NTRes field of short entry, used by Windows and Linux for
+	// the lowercase 8.3 names
+	ntresLowerBase = 0x08
+	ntresLowerExt  = 0x10
+
+	dirEntrySize = 32
+	// entryFree marks a deleted entry, entryEnd marks the end of directory
+	entryFree = 0xE5
+	entryEnd  = 0x00
+
+	lfnLast        = 0x40
+	lfnChars       = 13
+	maxNameLen     = 255
+	maxDirSlots    = 65536
+	maxNumericTail = 999999
+)
+
+// dirent is a parsed directory entry
+type dirent struct {
+	name    string
+	short   [11]byte
+	attr    byte
+	ntres   byte
+	cluster uint32
+	size    uint32
+	mtime   time.Time
+	// slot is the index of short entry in directory, first is the index of
+	// the first long name entry, or slot if there is no long name.
+	slot  int
+	first int
+}
+
+func (e *dirent) isDir() bool {
+	return e.attr&attrDirectory != 0
+}
+
+func (e *dirent) isDot() bool {
+	return e.short[0] == '.'
+}
+
+// shortString formats the 8.3 name, honoring the lowercase flags
+func shortString(short [11]byte, ntres byte) string {
+	base := strings.TrimRight(string(short[:8]), " ")
+	ext := strings.TrimRight(string(short[8:]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xe5" + base[1:]
+	}
+	if ntres&ntresLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if ntres&ntresLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func checksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+func decodeTime(d, t uint16) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(d>>9)+1980, time.Month(d>>5&0xF), int(d&0x1F),
+		int(t>>11), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.Local)
+}
+
+func encodeTime(tm time.Time) (d, t uint16) {
+	tm = tm.Local()
+	if tm.Year() < 1980 {
+		return 0x21, 0 // 1980-01-01
+	}
+	if tm.Year() > 2107 {
+		tm = time.Date(2107, 12, 31, 23, 59, 58, 0, time.Local)
+	}
+	d = uint16(tm.Year()-1980)<<9 | uint16(tm.Month())<<5 | uint16(tm.Day())
+	t = uint16(tm.Hour())<<11 | uint16(tm.Minute())<<5 | uint16(tm.Second()/2)
+	return
+}
+
+// lfn accumulates the long name entries before a short entry
+type lfn struct {
+	parts [][]uint16
+	sum   byte
+	next  int // the expected ordinal of next entry
+	first int
+}
+
+func (l *lfn) reset() {
+	l.parts = nil
+	l.next = 0
+}
+
+func (l *lfn) add(b []byte, slot int) {
+	ord := int(b[0])
+	if ord&lfnLast != 0 {
+		n := ord &^ lfnLast
+		if n == 0 || n > 20 {
+			l.reset()
+			return
+		}
+		l.parts = make([][]uint16, n)
+		l.sum = b[13]
+		l.next = n
+		l.first = slot
+	}
+	if l.parts == nil || ord&^lfnLast != l.next || b[13] != l.sum {
+		l.reset()
+		return
+	}
+	var chars []uint16
+	for _, off := range [...]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+		chars = append(chars, le.Uint16(b[off:]))
+	}
+	l.parts[l.next-1] = chars
+	l.next--
+}
+
+// name returns the long name if it matches the short entry
+func (l *lfn) name(short [11]byte) (string, bool) {
+	if l.parts == nil || l.next != 0 || checksum(short) != l.sum {
+		return "", false
+	}
+	var chars []uint16
+	for _, part := range l.parts {
+		chars = append(chars, part...)
+	}
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars)), true
+}
+
+func parseEntry(b []byte) dirent {
+	var e dirent
+	copy(e.short[:], b[:11])
+	e.attr = b[11]
+	e.ntres = b[12]
+	e.cluster = uint32(le.Uint16(b[20:]))<<16 | uint32(le.Uint16(b[26:]))
+	e.mtime = decodeTime(le.Uint16(b[24:]), le.Uint16(b[22:]))
+	e.size = le.Uint32(b[28:])
+	return e
+}
+
+// slotOffset returns the byte offset of slot in the directory.
+func (f *Fs) slotOffset(chain []uint32, slot int) int64 {
+	off := slot * dirEntrySize
+	cs := int(f.clusterSize)
+	return f.clusterOffset(chain[off/cs]) + int64(off%cs)
+}
+
+// readDir returns the entries of directory dir, the volume label, dot and
+// dotdot are not included.
+func (f *Fs) readDir(dir *node) ([]dirent, error) {
+	chain, err := f.nodeChain(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ents []dirent
+	var l lfn
+	buf := make([]byte, f.clusterSize)
+	perCluster := int(f.clusterSize / dirEntrySize)
+	for ci, c := range chain {
+		if err := f.readAt(buf, f.clusterOffset(c)); err != nil {
+			return nil, err
+		}
+		for i := 0; i < perCluster; i++ {
+			b := buf[i*dirEntrySize : (i+1)*dirEntrySize]
+			slot := ci*perCluster + i
+			switch {
+			case b[0] == entryEnd:
+				return ents, nil
+			case b[0] == entryFree:
+				l.reset()
+				continue
+			case b[11]&0x3F == attrLongName:
+				l.add(b, slot)
+				continue
+			}
+			e := parseEntry(b)
+			e.slot, e.first = slot, slot
+			if name, ok := l.name(e.short); ok {
+				e.name, e.first = name, l.first
+			} else {
+				e.name = shortString(e.short, e.ntres)
+			}
+			l.reset()
+			if e.attr&attrVolumeID != 0 || e.isDot() {
+				continue
+			}
+			ents = append(ents, e)
+		}
+	}
+	return ents, nil
+}
+
+func findEntry(ents []dirent, name string) *dirent {
+	for i := range ents {
+		e := &ents[i]
+		if strings.EqualFold(e.name, name) || strings.EqualFold(shortString(e.short, 0), name) {
+			return e
+		}
+	}
+	return nil
+}
+
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(utf16.Encode([]rune(name))) > maxNameLen {
+		return false
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune("\"*/:<>?\\|", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func shortChar(c rune) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.ContainsRune("!#$%&'()-@^_`{}~", c)
+}
+
+// shortOnly checks whether name can be stored as a short entry without
+// long name, it returns the 8.3 name and lowercase flags.
+func shortOnly(name string) ([11]byte, byte, bool) {
+	var short [11]byte
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 {
+		return short, 0, false
+	}
+	var ntres byte
+	for i, part := range [...]string{base, ext} {
+		upper := strings.ToUpper(part)
+		lower := strings.ToLower(part)
+		switch part {
+		case upper:
+		case lower:
+			ntres |= [...]byte{ntresLowerBase, ntresLowerExt}[i]
+		default:
+			// mixed case
+			return short, 0, false
+		}
+		for _, c := range upper {
+			if !shortChar(c) {
+				return short, 0, false
+			}
+		}
+	}
+	copy(short[:], strings.Repeat(" ", 11))
+	copy(short[:8], strings.ToUpper(base))
+	copy(short[8:], strings.ToUpper(ext))
+	return short, ntres, true
+}
+
+// genShort generates a unique 8.3 name with numeric tail for long name
+func genShort(name string, ents []dirent) ([11]byte, error) {
+	var short [11]byte
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			switch {
+			case c == ' ' || c == '.':
+			case shortChar(c):
+				b.WriteRune(c)
+			default:
+				b.WriteByte('_')
+			}
+		}
+		return b.String()
+	}
+	name = strings.TrimLeft(name, ".")
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+
+	used := make(map[[11]byte]bool, len(ents))
+	for i := range ents {
+		used[ents[i].short] = true
+	}
+	for n := 1; n <= maxNumericTail; n++ {
+		tail := "~" + strconv.Itoa(n)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		copy(short[:], strings.Repeat(" ", 11))
+		copy(short[:8], b+tail)
+		copy(short[8:], ext)
+		if !used[short] {
+			return short, nil
+		}
+	}
+	return short, syscall.EEXIST
+}
+
+// newEntry encodes the entry as the raw slots, the long name entries come
+// first if needed.
+func newEntry(name string, ents []dirent, e *dirent) ([][dirEntrySize]byte, error) {
+	var err error
+	short, ntres, ok := shortOnly(name)
+	if ok {
+		for i := range ents {
+			if ents[i].short == short {
+				ok = false
+				break
+			}
+		}
+	}
+	if !ok {
+		ntres = 0
+		if short, err = genShort(name, ents); err != nil {
+			return nil, err
+		}
+	}
+	e.short, e.ntres = short, ntres
+
+	var slots [][dirEntrySize]byte
+	if !ok {
+		chars := utf16.Encode([]rune(name))
+		n := (len(chars) + lfnChars - 1) / lfnChars
+		if len(chars)%lfnChars != 0 {
+			chars = append(chars, 0)
+		}
+		for len(chars)%lfnChars != 0 {
+			chars = append(chars, 0xFFFF)
+		}
+		sum := checksum(short)
+		for ord := n; ord >= 1; ord-- {
+			var b [dirEntrySize]byte
+			b[0] = byte(ord)
+			if ord == n {
+				b[0] |= lfnLast
+			}
+			b[11] = attrLongName
+			b[13] = sum
+			part := chars[(ord-1)*lfnChars : ord*lfnChars]
+			for i, off := range [...]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				le.PutUint16(b[off:], part[i])
+			}
+			slots = append(slots, b)
+		}
+	}
+	slots = append(slots, encodeEntry(e))
+	return slots, nil
+}
+
+func encodeEntry(e *dirent) [dirEntrySize]byte {
+	var b [dirEntrySize]byte
+	copy(b[:11], e.short[:])
+	if b[0] == entryFree {
+		b[0] = 0x05
+	}
+	b[11] = e.attr
+	b[12] = e.ntres
+	d, t := encodeTime(e.mtime)
+	le.PutUint16(b[14:], t)
+	le.PutUint16(b[16:], d)
+	le.PutUint16(b[18:], d)
+	le.PutUint16(b[20:], uint16(e.cluster>>16))
+	le.PutUint16(b[22:], t)
+	le.PutUint16(b[24:], d)
+	le.PutUint16(b[26:], uint16(e.cluster))
+	le.PutUint32(b[28:], e.size)
+	return b
+}
+
+// findFree finds count contiguous free slots in directory, the directory
+// is extended if there is no enough space.
+func (f *Fs) findFree(dir *node, count int) (int, error) {
+	perCluster := int(f.clusterSize / dirEntrySize)
+	chain, err := f.nodeChain(dir)
+	if err != nil {
+		return 0, err
+	}
+	var b [1]byte
+	run, start := 0, 0
+	for slot := 0; slot < len(chain)*perCluster; slot++ {
+		if err := f.readAt(b[:], f.slotOffset(chain, slot)); err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case entryEnd:
+			// the slots after the end are all free
+			if run == 0 {
+				start = slot
+			}
+			return start, f.reserveSlots(dir, start+count)
+		case entryFree:
+			if run == 0 {
+				start = slot
+			}
+			run++
+			if run == count {
+				return start, nil
+			}
+		default:
+			run = 0
+		}
+	}
+	if run == 0 {
+		start = len(chain) * perCluster
+	}
+	return start, f.reserveSlots(dir, start+count)
+}
+
+// reserveSlots grows directory to hold n slots
+func (f *Fs) reserveSlots(dir *node, n int) error {
+	if n > maxDirSlots {
+		return syscall.ENOSPC
+	}
+	perCluster := int(f.clusterSize / dirEntrySize)
+	return f.growChain(dir, (n+perCluster-1)/perCluster)
+}
+
+// addEntry creates the entry e named name in directory dir, e.slot and
+// e.first are set to the location of the new entry.
+func (f *Fs) addEntry(dir *node, name string, e *dirent) error {
+	if !validName(name) {
+		return syscall.EINVAL
+	}
+	ents, err := f.readDir(dir)
+	if err != nil {
+		return err
+	}
+	// the dot entries are not returned by readDir, but they occupy the names
+	ents = append(ents, dirent{short: [11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}})
+	slots, err := newEntry(name, ents, e)
+	if err != nil {
+		return err
+	}
+	first, err := f.findFree(dir, len(slots))
+	if err != nil {
+		return err
+	}
+	for i := range slots {
+		off := f.slotOffset(dir.chain, first+i)
+		if err := f.writeAt(slots[i][:], off); err != nil {
+			return err
+		}
+	}
+	e.name = name
+	e.first, e.slot = first, first+len(slots)-1
+	return nil
+}
+
+// deleteEntry marks the slots of e as free
+func (f *Fs) deleteEntry(dir *node, e *dirent) error {
+	chain, err := f.nodeChain(dir)
+	if err != nil {
+		return err
+	}
+	b := []byte{entryFree}
+	for slot := e.first; slot <= e.slot; slot++ {
+		if err := f.writeAt(b, f.slotOffset(chain, slot)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initDir writes the dot and dotdot entries to the new directory cluster c
+func (f *Fs) initDir(c, parent uint32, mtime time.Time) error {
+	if parent == f.rootCluster {
+		parent = 0
+	}
+	dot := dirent{attr: attrDirectory, cluster: c, mtime: mtime}
+	copy(dot.short[:], ".          ")
+	dotdot := dirent{attr: attrDirectory, cluster: parent, mtime: mtime}
+	copy(dotdot.short[:], "..         ")
+	b1, b2 := encodeEntry(&dot), encodeEntry(&dotdot)
+	off := f.clusterOffset(c)
+	if err := f.writeAt(b1[:], off); err != nil {
+		return err
+	}
+	return f.writeAt(b2[:], off+dirEntrySize)
+}
+
+// setDotdot points the dotdot entry of directory c to parent
+func (f *Fs) setDotdot(c, parent uint32) error {
+	if parent == f.rootCluster {
+		parent = 0
+	}
+	var b [4]byte
+	off := f.clusterOffset(c) + dirEntrySize
+	le.PutUint16(b[0:], uint16(parent>>16))
+	if err := f.writeAt(b[:2], off+20); err != nil {
+		return err
+	}
+	le.PutUint16(b[0:], uint16(parent))
+	return f.writeAt(b[:2], off+26)
+}
@@ -0,0 +1,282 @@
+package fatfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+)
+
+const (
+	clusterFree = 0
+	clusterEOC  = 0x0FFFFFFF
+	clusterMask = 0x0FFFFFFF
+	// cluster values not less than clusterEOCMin mark the end of chain
+	clusterEOCMin = 0x0FFFFFF8
+
+	fsInfoLeadSig   = 0x41615252
+	fsInfoStructSig = 0x61417272
+	fsInfoUnknown   = 0xFFFFFFFF
+
+	// cacheSize is the bytes of sectors cached for every filesystem
+	cacheSize = 2 << 20
+)
+
+var (
+	errNotFAT32 = errors.New("fatfs: not a FAT32 filesystem")
+	// errCorrupt is returned on broken cluster chains
+	errCorrupt = syscall.EIO
+)
+
+var le = binary.LittleEndian
+
+// bpb is the BIOS parameter block in the boot sector
+type bpb struct {
+	bytesPerSector    uint32
+	sectorsPerCluster uint32
+	reservedSectors   uint32
+	numFATs           uint32
+	totalSectors      uint32
+	fatSize           uint32
+	rootCluster       uint32
+	fsInfoSector      uint32
+}
+
+func parseBPB(b []byte) (*bpb, error) {
+	if len(b) < 512 || b[510] != 0x55 || b[511] != 0xAA {
+		return nil, errNotFAT32
+	}
+	p := &bpb{
+		bytesPerSector:    uint32(le.Uint16(b[11:])),
+		sectorsPerCluster: uint32(b[13]),
+		reservedSectors:   uint32(le.Uint16(b[14:])),
+		numFATs:           uint32(b[16]),
+		totalSectors:      uint32(le.Uint16(b[19:])),
+		fatSize:           le.Uint32(b[36:]),
+		rootCluster:       le.Uint32(b[44:]),
+		fsInfoSector:      uint32(le.Uint16(b[48:])),
+	}
+	if p.totalSectors == 0 {
+		p.totalSectors = le.Uint32(b[32:])
+	}
+	// FAT12 and FAT16 have non-zero root entry count and 16-bit fat size
+	if le.Uint16(b[17:]) != 0 || le.Uint16(b[22:]) != 0 || p.fatSize == 0 {
+		return nil, errNotFAT32
+	}
+	switch p.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, errNotFAT32
+	}
+	spc := p.sectorsPerCluster
+	if spc == 0 || spc&(spc-1) != 0 || p.numFATs == 0 || p.reservedSectors == 0 {
+		return nil, errNotFAT32
+	}
+	return p, nil
+}
+
+// readAt reads len(p) bytes at byte offset off of device, the whole
+// sectors are read in place, the partial ones through a bounce buffer.
+func (f *Fs) readAt(p []byte, off int64) error {
+	size := int64(f.dev.SectorSize())
+	for len(p) > 0 {
+		lba, skip := off/size, off%size
+		if skip == 0 && int64(len(p)) >= size {
+			n := int64(len(p)) / size * size
+			if err := f.dev.ReadAt(p[:n], lba); err != nil {
+				return err
+			}
+			p = p[n:]
+			off += n
+			continue
+		}
+		buf := make([]byte, size)
+		if err := f.dev.ReadAt(buf, lba); err != nil {
+			return err
+		}
+		n := copy(p, buf[skip:])
+		p = p[n:]
+		off += int64(n)
+	}
+	return nil
+}
+
+// writeAt writes p at byte offset off of device, the partial sectors are
+// read, modified and written back.
+func (f *Fs) writeAt(p []byte, off int64) error {
+	size := int64(f.dev.SectorSize())
+	for len(p) > 0 {
+		lba, skip := off/size, off%size
+		if skip == 0 && int64(len(p)) >= size {
+			n := int64(len(p)) / size * size
+			if err := f.dev.WriteAt(p[:n], lba); err != nil {
+				return err
+			}
+			p = p[n:]
+			off += n
+			continue
+		}
+		buf := make([]byte, size)
+		if err := f.dev.ReadAt(buf, lba); err != nil {
+			return err
+		}
+		n := copy(buf[skip:], p)
+		if err := f.dev.WriteAt(buf, lba); err != nil {
+			return err
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return nil
+}
+
+// flush writes the FSInfo and syncs the device
+func (f *Fs) flush() error {
+	if f.fsInfoDirty && f.fsInfoSector != 0 && f.fsInfoSector != 0xFFFF {
+		var b [8]byte
+		le.PutUint32(b[0:], f.freeCount)
+		le.PutUint32(b[4:], f.nextFree)
+		off := int64(f.fsInfoSector)*int64(f.bytesPerSector) + 488
+		if err := f.writeAt(b[:], off); err != nil {
+			return err
+		}
+		f.fsInfoDirty = false
+	}
+	if f.syncer != nil {
+		return f.syncer.Sync()
+	}
+	return nil
+}
+
+func (f *Fs) loadFSInfo() error {
+	f.freeCount, f.nextFree = fsInfoUnknown, fsInfoUnknown
+	if f.fsInfoSector == 0 || f.fsInfoSector == 0xFFFF {
+		return nil
+	}
+	b := make([]byte, f.bytesPerSector)
+	if err := f.readAt(b, int64(f.fsInfoSector)*int64(f.bytesPerSector)); err != nil {
+		return err
+	}
+	if le.Uint32(b[0:]) != fsInfoLeadSig || le.Uint32(b[484:]) != fsInfoStructSig {
+		// not a valid FSInfo, don't touch it
+		f.fsInfoSector = 0
+		return nil
+	}
+	f.freeCount = le.Uint32(b[488:])
+	f.nextFree = le.Uint32(b[492:])
+	if f.freeCount > f.clusters {
+		f.freeCount = fsInfoUnknown
+	}
+	return nil
+}
+
+func (f *Fs) validCluster(c uint32) bool {
+	return c >= 2 && c < f.clusters+2
+}
+
+func (f *Fs) clusterOffset(c uint32) int64 {
+	return f.dataStart + int64(c-2)*int64(f.clusterSize)
+}
+
+func (f *Fs) fatEntry(c uint32) (uint32, error) {
+	var b [4]byte
+	if err := f.readAt(b[:], f.fatStart+int64(c)*4); err != nil {
+		return 0, err
+	}
+	return le.Uint32(b[:]) & clusterMask, nil
+}
+
+// setFatEntry updates the entry of cluster c in all the FATs, the reserved
+// high 4 bits are kept.
+func (f *Fs) setFatEntry(c, v uint32) error {
+	var b [4]byte
+	fatBytes := int64(f.fatSize) * int64(f.bytesPerSector)
+	for i := uint32(0); i < f.numFATs; i++ {
+		off := f.fatStart + int64(i)*fatBytes + int64(c)*4
+		if err := f.readAt(b[:], off); err != nil {
+			return err
+		}
+		old := le.Uint32(b[:])
+		le.PutUint32(b[:], old&^clusterMask|v&clusterMask)
+		if err := f.writeAt(b[:], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chain returns the cluster chain starting at start
+func (f *Fs) chain(start uint32) ([]uint32, error) {
+	var clusters []uint32
+	c := start
+	for c != clusterFree && c < clusterEOCMin {
+		if !f.validCluster(c) || uint32(len(clusters)) >= f.clusters {
+			return nil, errCorrupt
+		}
+		clusters = append(clusters, c)
+		next, err := f.fatEntry(c)
+		if err != nil {
+			return nil, err
+		}
+		c = next
+	}
+	return clusters, nil
+}
+
+// allocCluster allocates a zeroed cluster and links it after prev if prev
+// is not zero.
+func (f *Fs) allocCluster(prev uint32) (uint32, error) {
+	if f.freeCount == 0 {
+		return 0, syscall.ENOSPC
+	}
+	c := f.nextFree
+	if !f.validCluster(c) {
+		c = 2
+	}
+	for i := uint32(0); i < f.clusters; i++ {
+		v, err := f.fatEntry(c)
+		if err != nil {
+			return 0, err
+		}
+		if v != clusterFree {
+			c++
+			if !f.validCluster(c) {
+				c = 2
+			}
+			continue
+		}
+		if err = f.writeAt(f.zero, f.clusterOffset(c)); err != nil {
+			return 0, err
+		}
+		if err = f.setFatEntry(c, clusterEOC); err != nil {
+			return 0, err
+		}
+		if prev != 0 {
+			if err = f.setFatEntry(prev, c); err != nil {
+				return 0, err
+			}
+		}
+		if f.freeCount != fsInfoUnknown {
+			f.freeCount--
+		}
+		f.nextFree = c + 1
+		f.fsInfoDirty = true
+		return c, nil
+	}
+	return 0, syscall.ENOSPC
+}
+
+// freeClusters gives the clusters back to the FAT
+func (f *Fs) freeClusters(clusters []uint32) error {
+	for _, c := range clusters {
+		if err := f.setFatEntry(c, clusterFree); err != nil {
+			return err
+		}
+		if f.freeCount != fsInfoUnknown {
+			f.freeCount++
+		}
+	}
+	if len(clusters) != 0 {
+		f.fsInfoDirty = true
+	}
+	return nil
+}
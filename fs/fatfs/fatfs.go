@@ -0,0 +1,711 @@
+// Package fatfs implements the FAT32 filesystem over a block device as an afero.Fs.
+//
+// All the metadata and data go through the sector cache of package block,
+// writes reach the device at once unless dev is a write-back cache. The device is synced on Sync and Close
+// of files, and after the operations changing directories such as Mkdir,
+// Remove and Rename.
+package fatfs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/icexin/eggos/fs/block"
+	"github.com/spf13/afero"
+)
+
+type syncer interface {
+	Sync() error
+}
+
+// nodeKey identifies a file by the location of its directory entry
+type nodeKey struct {
+	parent uint32
+	slot   int
+}
+
+// node is the in-memory state of file, the opened files of the same
+// directory entry share one node.
+type node struct {
+	key     nodeKey
+	name    string
+	attr    byte
+	ntres   byte
+	cluster uint32
+	size    uint32
+	mtime   time.Time
+	// chain caches the cluster chain, nil means not loaded
+	chain []uint32
+	refs  int
+	// removed is set when the entry of an opened file is deleted, the
+	// clusters are freed on the last close.
+	removed bool
+}
+
+func (n *node) isDir() bool {
+	return n.attr&attrDirectory != 0
+}
+
+func (n *node) isRoot() bool {
+	return n.key.slot < 0
+}
+
+// Fs is a FAT32 filesystem
+type Fs struct {
+	mutex  sync.Mutex
+	dev    block.BlockDevice
+	syncer syncer
+	bpb
+
+	clusterSize uint32
+	// number of data clusters
+	clusters uint32
+	// byte offsets of the first FAT and the cluster 2
+	fatStart  int64
+	dataStart int64
+	zero      []byte
+
+	freeCount   uint32
+	nextFree    uint32
+	fsInfoDirty bool
+
+	nodes map[nodeKey]*node
+	root  *node
+}
+
+// New mounts the FAT32 filesystem on dev, usually a disk or a partition.
+func New(dev block.BlockDevice) (*Fs, error) {
+	size := dev.SectorSize()
+	if size < 512 || dev.Capacity() < 1 {
+		return nil, errNotFAT32
+	}
+	boot := make([]byte, size)
+	if err := dev.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	p, err := parseBPB(boot)
+	if err != nil {
+		return nil, err
+	}
+	// the logical sectors of FAT are made of whole device sectors
+	if int(p.bytesPerSector)%size != 0 {
+		return nil, errNotFAT32
+	}
+	f := &Fs{
+		dev:   dev,
+		bpb:   *p,
+		nodes: make(map[nodeKey]*node),
+	}
+	// the cache passed in is used as is, such as a write-back one which
+	// Sync flushes.
+	if _, ok := dev.(*block.CachedBlockDevice); !ok {
+		f.dev = block.NewCachedBlockDevice(dev, cacheSize)
+	}
+	f.syncer, _ = dev.(syncer)
+	f.clusterSize = p.bytesPerSector * p.sectorsPerCluster
+	f.fatStart = int64(p.reservedSectors) * int64(p.bytesPerSector)
+	dataSector := p.reservedSectors + p.numFATs*p.fatSize
+	if dataSector >= p.totalSectors {
+		return nil, errNotFAT32
+	}
+	f.dataStart = int64(dataSector) * int64(p.bytesPerSector)
+	f.clusters = (p.totalSectors - dataSector) / p.sectorsPerCluster
+	// the FAT may be smaller than data area
+	if max := p.fatSize*p.bytesPerSector/4 - 2; f.clusters > max {
+		f.clusters = max
+	}
+	if !f.validCluster(p.rootCluster) {
+		return nil, errNotFAT32
+	}
+	f.zero = make([]byte, f.clusterSize)
+	if err = f.loadFSInfo(); err != nil {
+		return nil, err
+	}
+	f.root = &node{
+		key:     nodeKey{slot: -1},
+		name:    "/",
+		attr:    attrDirectory,
+		cluster: p.rootCluster,
+	}
+	return f, nil
+}
+
+func (f *Fs) nodeChain(n *node) ([]uint32, error) {
+	if n.chain != nil || n.cluster == 0 {
+		return n.chain, nil
+	}
+	chain, err := f.chain(n.cluster)
+	if err != nil {
+		return nil, err
+	}
+	n.chain = chain
+	return chain, nil
+}
+
+// growChain extends the chain of n to count clusters
+func (f *Fs) growChain(n *node, count int) error {
+	chain, err := f.nodeChain(n)
+	if err != nil {
+		return err
+	}
+	for len(chain) < count {
+		var prev uint32
+		if len(chain) != 0 {
+			prev = chain[len(chain)-1]
+		}
+		c, err := f.allocCluster(prev)
+		if err != nil {
+			return err
+		}
+		if len(chain) == 0 {
+			n.cluster = c
+		}
+		chain = append(chain, c)
+		n.chain = chain
+	}
+	return nil
+}
+
+// shrinkChain cuts the chain of n to count clusters
+func (f *Fs) shrinkChain(n *node, count int) error {
+	chain, err := f.nodeChain(n)
+	if err != nil {
+		return err
+	}
+	if len(chain) <= count {
+		return nil
+	}
+	if count == 0 {
+		n.cluster = 0
+	} else if err = f.setFatEntry(chain[count-1], clusterEOC); err != nil {
+		return err
+	}
+	n.chain = chain[:count]
+	return f.freeClusters(chain[count:])
+}
+
+func (f *Fs) clustersOf(size int64) int {
+	return int((size + int64(f.clusterSize) - 1) / int64(f.clusterSize))
+}
+
+// updateEntry writes the state of n back to its directory entry
+func (f *Fs) updateEntry(n *node) error {
+	if n.isRoot() || n.removed {
+		return nil
+	}
+	chain, err := f.chain(n.key.parent)
+	if err != nil {
+		return err
+	}
+	off := f.slotOffset(chain, n.key.slot)
+	var b [dirEntrySize]byte
+	if err = f.readAt(b[:], off); err != nil {
+		return err
+	}
+	e := parseEntry(b[:])
+	e.attr, e.cluster, e.size, e.mtime = n.attr, n.cluster, n.size, n.mtime
+	b = encodeEntry(&e)
+	// keep the creation time
+	if err = f.writeAt(b[11:12], off+11); err != nil {
+		return err
+	}
+	return f.writeAt(b[18:], off+18)
+}
+
+// lookup returns the node of entry e in directory dir, the node is shared
+// if the file is opened.
+func (f *Fs) lookup(dir *node, e *dirent) *node {
+	key := nodeKey{parent: dir.cluster, slot: e.slot}
+	if n, ok := f.nodes[key]; ok {
+		return n
+	}
+	return &node{
+		key:     key,
+		name:    e.name,
+		attr:    e.attr,
+		ntres:   e.ntres,
+		cluster: e.cluster,
+		size:    e.size,
+		mtime:   e.mtime,
+	}
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// walk finds the node of name.
+func (f *Fs) walk(name string) (*node, error) {
+	n := f.root
+	for _, part := range splitPath(name) {
+		if !n.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		ents, err := f.readDir(n)
+		if err != nil {
+			return nil, err
+		}
+		e := findEntry(ents, part)
+		if e == nil {
+			return nil, os.ErrNotExist
+		}
+		n = f.lookup(n, e)
+	}
+	return n, nil
+}
+
+// walkParent finds the parent directory of name and the entry of name in
+// it, the entry is nil if not found.
+func (f *Fs) walkParent(name string) (*node, *dirent, string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return nil, nil, "", syscall.EBUSY
+	}
+	dir, err := f.walk(strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, nil, "", syscall.ENOTDIR
+	}
+	ents, err := f.readDir(dir)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	base := parts[len(parts)-1]
+	return dir, findEntry(ents, base), base, nil
+}
+
+func (f *Fs) open(n *node) {
+	if n.refs == 0 && !n.isRoot() {
+		f.nodes[n.key] = n
+	}
+	n.refs++
+}
+
+func (f *Fs) release(n *node) error {
+	n.refs--
+	if n.refs > 0 {
+		return nil
+	}
+	if f.nodes[n.key] == n {
+		delete(f.nodes, n.key)
+	}
+	if n.removed {
+		return f.shrinkChain(n, 0)
+	}
+	return nil
+}
+
+// removeEntry deletes the entry e of directory dir, the clusters are freed
+// after the last close if the file is opened.
+func (f *Fs) removeEntry(dir *node, e *dirent) error {
+	n := f.lookup(dir, e)
+	if n.isDir() {
+		ents, err := f.readDir(n)
+		if err != nil {
+			return err
+		}
+		if len(ents) != 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if err := f.deleteEntry(dir, e); err != nil {
+		return err
+	}
+	if n.refs != 0 {
+		delete(f.nodes, n.key)
+		n.removed = true
+		return nil
+	}
+	return f.shrinkChain(n, 0)
+}
+
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// sync flushes the FSInfo after a successful metadata operation
+func (f *Fs) sync(err error) error {
+	if err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+// Sync writes the FSInfo and syncs the device.
+func (f *Fs) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.flush()
+}
+
+// Create creates a file in the filesystem, returning the file and an
+// error, if any happens.
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Mkdir creates a directory in the filesystem, return an error if any
+// happens.
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return pathError("mkdir", name, f.sync(f.mkdir(name, perm)))
+}
+
+func (f *Fs) mkdir(name string, perm os.FileMode) error {
+	dir, e, base, err := f.walkParent(name)
+	if err == syscall.EBUSY {
+		return os.ErrExist
+	}
+	if err != nil {
+		return err
+	}
+	if e != nil {
+		return os.ErrExist
+	}
+	now := time.Now()
+	c, err := f.allocCluster(0)
+	if err != nil {
+		return err
+	}
+	if err = f.initDir(c, dir.cluster, now); err != nil {
+		return err
+	}
+	ent := dirent{attr: attrDirectory, cluster: c, mtime: now}
+	if perm&0200 == 0 {
+		ent.attr |= attrReadOnly
+	}
+	if err = f.addEntry(dir, base, &ent); err != nil {
+		f.freeClusters([]uint32{c})
+		return err
+	}
+	dir.mtime = now
+	return f.updateEntry(dir)
+}
+
+// MkdirAll creates a directory path and all parents that does not exist
+// yet.
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return pathError("mkdir", name, f.sync(f.mkdirAll(name, perm)))
+}
+
+func (f *Fs) mkdirAll(name string, perm os.FileMode) error {
+	parts := splitPath(name)
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		err := f.mkdir(p, perm)
+		if err == nil {
+			continue
+		}
+		if err != os.ErrExist {
+			return err
+		}
+		n, err := f.walk(p)
+		if err != nil {
+			return err
+		}
+		if !n.isDir() {
+			return syscall.ENOTDIR
+		}
+	}
+	return nil
+}
+
+// Open opens a file, returning it or an error, if any happens.
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file using the given flags and the given mode.
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.openNode(name, flag, perm)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	f.open(n)
+	return &file{
+		fs:   f,
+		node: n,
+		name: name,
+		flag: flag,
+	}, nil
+}
+
+func (f *Fs) openNode(name string, flag int, perm os.FileMode) (*node, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	n, err := f.walk(name)
+	switch {
+	case err == nil:
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, os.ErrExist
+		}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		dir, _, base, err := f.walkParent(name)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		e := dirent{attr: attrArchive, mtime: now}
+		if perm&0200 == 0 {
+			e.attr |= attrReadOnly
+		}
+		if err = f.addEntry(dir, base, &e); err != nil {
+			return nil, err
+		}
+		dir.mtime = now
+		if err = f.updateEntry(dir); err != nil {
+			return nil, err
+		}
+		// a new file is writable regardless of perm
+		return f.lookup(dir, &e), nil
+	default:
+		return nil, err
+	}
+
+	if n.isDir() && writable {
+		return nil, syscall.EISDIR
+	}
+	if n.attr&attrReadOnly != 0 && writable {
+		return nil, os.ErrPermission
+	}
+	if flag&os.O_TRUNC != 0 && writable && n.size != 0 {
+		if err = f.truncate(n, 0); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Remove removes a file identified by name, returning an error, if any
+// happens.
+func (f *Fs) Remove(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return pathError("remove", name, f.sync(f.remove(name)))
+}
+
+func (f *Fs) remove(name string) error {
+	dir, e, _, err := f.walkParent(name)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return os.ErrNotExist
+	}
+	if err = f.removeEntry(dir, e); err != nil {
+		return err
+	}
+	dir.mtime = time.Now()
+	return f.updateEntry(dir)
+}
+
+// RemoveAll removes a directory path and any children it contains. It
+// does not fail if the path does not exist (return nil).
+func (f *Fs) RemoveAll(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return pathError("remove", name, f.sync(f.removeAll(name)))
+}
+
+func (f *Fs) removeAll(name string) error {
+	n, err := f.walk(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		ents, err := f.readDir(n)
+		if err != nil {
+			return err
+		}
+		for _, e := range ents {
+			if err = f.removeAll(path.Join(name, e.name)); err != nil {
+				return err
+			}
+		}
+	}
+	if n.isRoot() {
+		return nil
+	}
+	return f.remove(name)
+}
+
+// Rename renames a file.
+func (f *Fs) Rename(oldname, newname string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.sync(f.rename(oldname, newname))
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (f *Fs) rename(oldname, newname string) error {
+	odir, oe, _, err := f.walkParent(oldname)
+	if err != nil {
+		return err
+	}
+	if oe == nil {
+		return os.ErrNotExist
+	}
+	ndir, ne, base, err := f.walkParent(newname)
+	if err != nil {
+		return err
+	}
+	if oe.isDir() {
+		o := strings.ToLower(path.Clean("/"+oldname)) + "/"
+		n := strings.ToLower(path.Clean("/"+newname)) + "/"
+		if n != o && strings.HasPrefix(n, o) {
+			// move a directory into itself
+			return syscall.EINVAL
+		}
+	}
+
+	if ne != nil {
+		if odir.cluster == ndir.cluster && ne.slot == oe.slot {
+			if ne.name == base {
+				return nil
+			}
+			// only the case of name changes
+		} else {
+			switch {
+			case oe.isDir() && !ne.isDir():
+				return syscall.ENOTDIR
+			case !oe.isDir() && ne.isDir():
+				return syscall.EISDIR
+			}
+			if err = f.removeEntry(ndir, ne); err != nil {
+				return err
+			}
+		}
+	}
+
+	n := f.lookup(odir, oe)
+	e := *oe
+	e.attr, e.cluster, e.size, e.mtime = n.attr, n.cluster, n.size, n.mtime
+	if err = f.addEntry(ndir, base, &e); err != nil {
+		return err
+	}
+	if err = f.deleteEntry(odir, oe); err != nil {
+		return err
+	}
+	if n.refs != 0 {
+		delete(f.nodes, n.key)
+		n.key = nodeKey{parent: ndir.cluster, slot: e.slot}
+		f.nodes[n.key] = n
+	}
+	n.name = base
+	if e.isDir() && odir.cluster != ndir.cluster {
+		if err = f.setDotdot(e.cluster, ndir.cluster); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	odir.mtime, ndir.mtime = now, now
+	if err = f.updateEntry(odir); err != nil {
+		return err
+	}
+	return f.updateEntry(ndir)
+}
+
+// Stat returns a FileInfo describing the named file, or an error, if any
+// happens.
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.walk(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return newFileInfo(n), nil
+}
+
+// The name of this FileSystem
+func (f *Fs) Name() string {
+	return "fatfs"
+}
+
+// Chmod changes the mode of the named file to mode.
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.walk(name)
+	if err != nil {
+		return pathError("chmod", name, err)
+	}
+	if n.isRoot() {
+		return nil
+	}
+	if mode&0200 == 0 {
+		n.attr |= attrReadOnly
+	} else {
+		n.attr &^= attrReadOnly
+	}
+	return pathError("chmod", name, f.sync(f.updateEntry(n)))
+}
+
+// Chtimes changes the access and modification times of the named file
+func (f *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.walk(name)
+	if err != nil {
+		return pathError("chtimes", name, err)
+	}
+	n.mtime = mtime
+	return pathError("chtimes", name, f.sync(f.updateEntry(n)))
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newFileInfo(n *node) *fileInfo {
+	mode := os.FileMode(0644)
+	if n.isDir() {
+		mode = os.ModeDir | 0755
+	}
+	if n.attr&attrReadOnly != 0 {
+		mode &^= 0222
+	}
+	info := &fileInfo{
+		name:    n.name,
+		mode:    mode,
+		modTime: n.mtime,
+	}
+	if !n.isDir() {
+		info.size = int64(n.size)
+	}
+	return info
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,277 @@
+package fatfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/icexin/eggos/fs/block"
+	"github.com/spf13/afero"
+)
+
+// memDevice is a disk of 512 bytes sectors
+type memDevice []byte
+
+func (m memDevice) SectorSize() int { return 512 }
+func (m memDevice) Capacity() int64 { return int64(len(m)) / 512 }
+
+func (m memDevice) ReadAt(p []byte, lba int64) error {
+	if lba < 0 || lba*512+int64(len(p)) > int64(len(m)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(p, m[lba*512:])
+	return nil
+}
+
+func (m memDevice) WriteAt(p []byte, lba int64) error {
+	if lba < 0 || lba*512+int64(len(p)) > int64(len(m)) {
+		return io.ErrShortWrite
+	}
+	copy(m[lba*512:], p)
+	return nil
+}
+
+// mkfs formats the image like `mkfs.vfat -F 32 -s 1`
+func mkfs(size int) memDevice {
+	const (
+		bps      = 512
+		reserved = 32
+		numFATs  = 2
+	)
+	img := make(memDevice, size)
+	total := uint32(size / bps)
+	// one sector per cluster
+	fatSize := ((total-reserved)+2)*4/bps + 1
+	clusters := total - reserved - numFATs*fatSize
+
+	b := img[:bps]
+	copy(b, []byte{0xEB, 0x58, 0x90})
+	copy(b[3:], "mkfs.fat")
+	le.PutUint16(b[11:], bps)
+	b[13] = 1
+	le.PutUint16(b[14:], reserved)
+	b[16] = numFATs
+	b[21] = 0xF8
+	le.PutUint16(b[24:], 32)
+	le.PutUint16(b[26:], 64)
+	le.PutUint32(b[32:], total)
+	le.PutUint32(b[36:], fatSize)
+	le.PutUint32(b[44:], 2)
+	le.PutUint16(b[48:], 1)
+	le.PutUint16(b[50:], 6)
+	b[64] = 0x80
+	b[66] = 0x29
+	le.PutUint32(b[67:], 0x12345678)
+	copy(b[71:], "NO NAME    ")
+	copy(b[82:], "FAT32   ")
+	b[510], b[511] = 0x55, 0xAA
+
+	info := img[bps : 2*bps]
+	le.PutUint32(info[0:], fsInfoLeadSig)
+	le.PutUint32(info[484:], fsInfoStructSig)
+	le.PutUint32(info[488:], clusters-1)
+	le.PutUint32(info[492:], 3)
+	le.PutUint32(info[508:], 0xAA550000)
+	// backup boot sector
+	copy(img[6*bps:], img[:2*bps])
+
+	for i := uint32(0); i < numFATs; i++ {
+		fat := img[(reserved+i*fatSize)*bps:]
+		le.PutUint32(fat[0:], 0x0FFFFFF8)
+		le.PutUint32(fat[4:], 0x0FFFFFFF)
+		le.PutUint32(fat[8:], 0x0FFFFFFF)
+	}
+	return img
+}
+
+func writeFile(t *testing.T, fs *Fs, name string, content []byte) {
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *Fs, name string) []byte {
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	img := mkfs(40 << 20)
+	fs, err := New(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	if err = fs.MkdirAll("/data/a long directory name", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/data/a long directory name/Hello World.txt", []byte("hello"))
+	writeFile(t, fs, "/data/big.bin", big)
+	writeFile(t, fs, "/data/readme.txt", []byte("readme"))
+	// enough entries to extend the directory
+	for i := 0; i < 40; i++ {
+		writeFile(t, fs, filepath.Join("/data", "file with long name "+string(rune('a'+i%26))+string(rune('0'+i/26))), nil)
+	}
+	for i := 0; i < 40; i += 2 {
+		name := filepath.Join("/data", "file with long name "+string(rune('a'+i%26))+string(rune('0'+i/26)))
+		if err = fs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.Rename("/data/readme.txt", "/data/a long directory name/README"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Rename("/data/a long directory name", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	// remount
+	fs, err = New(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readFile(t, fs, "/moved/hello world.TXT"); string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+	if b := readFile(t, fs, "/moved/README"); string(b) != "readme" {
+		t.Fatalf("got %q", b)
+	}
+	if b := readFile(t, fs, "/data/big.bin"); !bytes.Equal(b, big) {
+		t.Fatal("big file mismatch")
+	}
+	info, err := fs.Stat("/data/big.bin")
+	if err != nil || info.Size() != int64(len(big)) || info.ModTime().IsZero() {
+		t.Fatalf("bad stat %v %v", info, err)
+	}
+
+	dir, _ := fs.Open("/moved")
+	names, _ := dir.Readdirnames(-1)
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "Hello World.txt" || names[1] != "README" {
+		t.Fatalf("got %v", names)
+	}
+	dir, _ = fs.Open("/data")
+	names, _ = dir.Readdirnames(-1)
+	if len(names) != 21 {
+		t.Fatalf("expect 21 entries, got %d", len(names))
+	}
+	if _, err = fs.Stat("/data/readme.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if err = fs.Remove("/data"); err == nil {
+		t.Fatal("expect error on removing non-empty directory")
+	}
+
+	// truncate and sparse write
+	f, _ := fs.OpenFile("/data/big.bin", os.O_RDWR, 0)
+	f.Truncate(10)
+	f.WriteAt([]byte("x"), 5000)
+	f.Close()
+	b := readFile(t, fs, "/data/big.bin")
+	if len(b) != 5001 || string(b[:10]) != "0123456789" || b[100] != 0 || b[5000] != 'x' {
+		t.Fatalf("bad content after truncate, len %d", len(b))
+	}
+
+	if err = fs.RemoveAll("/data"); err != nil {
+		t.Fatal(err)
+	}
+
+	// all the FATs must be the same
+	fatBytes := int(fs.fatSize * fs.bytesPerSector)
+	fat1 := img[fs.fatStart : int(fs.fatStart)+fatBytes]
+	fat2 := img[int(fs.fatStart)+fatBytes : int(fs.fatStart)+2*fatBytes]
+	if !bytes.Equal(fat1, fat2) {
+		t.Fatal("FAT copies mismatch")
+	}
+
+	fsck, err := exec.LookPath("fsck.fat")
+	if err != nil {
+		t.Log("fsck.fat not found, skip checking image")
+		return
+	}
+	tmp, err := ioutil.TempFile("", "fatfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(img)
+	tmp.Close()
+	out, err := exec.Command(fsck, "-n", "-v", tmp.Name()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("fsck: %s\n%s", err, out)
+	}
+}
+
+// countDevice counts the reads reaching the device
+type countDevice struct {
+	memDevice
+	reads int
+}
+
+func (c *countDevice) ReadAt(p []byte, lba int64) error {
+	c.reads++
+	return c.memDevice.ReadAt(p, lba)
+}
+
+// BenchmarkWalk compares the directory traversal with and without the
+// sector cache.
+func BenchmarkWalk(b *testing.B) {
+	img := mkfs(16 << 20)
+	fs, err := New(img)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		dir := fmt.Sprintf("/dir%d", i)
+		fs.Mkdir(dir, 0755)
+		for j := 0; j < 20; j++ {
+			afero.WriteFile(fs, fmt.Sprintf("%s/file%d.txt", dir, j), []byte("hello"), 0644)
+		}
+	}
+
+	for _, bench := range []struct {
+		name       string
+		cacheBytes int
+	}{{"uncached", 0}, {"cached", 2 << 20}} {
+		b.Run(bench.name, func(b *testing.B) {
+			dev := &countDevice{memDevice: img}
+			fs, err := New(block.NewCachedBlockDevice(dev, bench.cacheBytes))
+			if err != nil {
+				b.Fatal(err)
+			}
+			dev.reads = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(dev.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
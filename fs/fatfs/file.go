@@ -0,0 +1,359 @@
+package fatfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+const maxFileSize = 0xFFFFFFFF
+
+// readNode reads the content of n at off
+func (f *Fs) readNode(n *node, p []byte, off int64) (int, error) {
+	if off >= int64(n.size) {
+		return 0, io.EOF
+	}
+	if remain := int64(n.size) - off; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	chain, err := f.nodeChain(n)
+	if err != nil {
+		return 0, err
+	}
+	cs := int64(f.clusterSize)
+	var total int
+	for len(p) > 0 {
+		ci := int(off / cs)
+		if ci >= len(chain) {
+			return total, errCorrupt
+		}
+		chunk := cs - off%cs
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		if err := f.readAt(p[:chunk], f.clusterOffset(chain[ci])+off%cs); err != nil {
+			return total, err
+		}
+		p = p[chunk:]
+		off += chunk
+		total += int(chunk)
+	}
+	return total, nil
+}
+
+// writeRange writes p at off of n, the clusters must be allocated
+func (f *Fs) writeRange(n *node, p []byte, off int64) error {
+	cs := int64(f.clusterSize)
+	for len(p) > 0 {
+		chunk := cs - off%cs
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		c := n.chain[off/cs]
+		if err := f.writeAt(p[:chunk], f.clusterOffset(c)+off%cs); err != nil {
+			return err
+		}
+		p = p[chunk:]
+		off += chunk
+	}
+	return nil
+}
+
+// zeroRange fills [start, end) of n with zero
+func (f *Fs) zeroRange(n *node, start, end int64) error {
+	for start < end {
+		chunk := int64(len(f.zero))
+		if chunk > end-start {
+			chunk = end - start
+		}
+		if err := f.writeRange(n, f.zero[:chunk], start); err != nil {
+			return err
+		}
+		start += chunk
+	}
+	return nil
+}
+
+// resize makes sure the clusters of n can hold size bytes, the gap after
+// the old size is filled with zero.
+func (f *Fs) resize(n *node, size int64) error {
+	if size > maxFileSize {
+		return syscall.EFBIG
+	}
+	if err := f.growChain(n, f.clustersOf(size)); err != nil {
+		// give back the clusters allocated by this call
+		f.shrinkChain(n, f.clustersOf(int64(n.size)))
+		return err
+	}
+	if old := int64(n.size); size > old {
+		return f.zeroRange(n, old, size)
+	}
+	return nil
+}
+
+func (f *Fs) writeNode(n *node, p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > maxFileSize {
+		return 0, syscall.EFBIG
+	}
+	if end > int64(n.size) {
+		if err := f.growChain(n, f.clustersOf(end)); err != nil {
+			f.shrinkChain(n, f.clustersOf(int64(n.size)))
+			return 0, err
+		}
+		// the hole between old size and off reads as zero
+		if old := int64(n.size); off > old {
+			if err := f.zeroRange(n, old, off); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := f.writeRange(n, p, off); err != nil {
+		return 0, err
+	}
+	if end > int64(n.size) {
+		n.size = uint32(end)
+	}
+	n.mtime = time.Now()
+	n.attr |= attrArchive
+	return len(p), f.updateEntry(n)
+}
+
+func (f *Fs) truncate(n *node, size int64) error {
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	if size > int64(n.size) {
+		if err := f.resize(n, size); err != nil {
+			return err
+		}
+	} else if err := f.shrinkChain(n, f.clustersOf(size)); err != nil {
+		return err
+	}
+	n.size = uint32(size)
+	n.mtime = time.Now()
+	n.attr |= attrArchive
+	return f.updateEntry(n)
+}
+
+// file is an opened file or directory, all files of the same entry share
+// one node, every file has its own offset.
+type file struct {
+	fs     *Fs
+	node   *node
+	name   string
+	flag   int
+	offset int64
+	// offset of directory entries
+	dirOffset int
+	closed    bool
+}
+
+func (f *file) check(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.node.isDir() {
+		return syscall.EISDIR
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return syscall.EBADF
+	}
+	if !write && f.flag&os.O_WRONLY != 0 {
+		return syscall.EBADF
+	}
+	return nil
+}
+
+func (f *file) pathError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &os.PathError{Op: op, Path: f.name, Err: err}
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, f.pathError("read", err)
+	}
+	n, err := f.fs.readNode(f.node, p, f.offset)
+	f.offset += int64(n)
+	return n, f.pathError("read", err)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, f.pathError("read", err)
+	}
+	if off < 0 {
+		return 0, f.pathError("read", syscall.EINVAL)
+	}
+	var total int
+	for len(p) > 0 {
+		n, err := f.fs.readNode(f.node, p, off)
+		total += n
+		if err != nil {
+			return total, f.pathError("read", err)
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return total, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed {
+		return 0, f.pathError("seek", os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.node.size)
+	default:
+		return 0, f.pathError("seek", syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, f.pathError("seek", syscall.EINVAL)
+	}
+	if f.node.isDir() {
+		// rewinddir
+		f.dirOffset = 0
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, f.pathError("write", err)
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(f.node.size)
+	}
+	n, err := f.fs.writeNode(f.node, p, f.offset)
+	f.offset += int64(n)
+	return n, f.pathError("write", err)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, f.pathError("write", err)
+	}
+	if off < 0 {
+		return 0, f.pathError("write", syscall.EINVAL)
+	}
+	n, err := f.fs.writeNode(f.node, p, off)
+	return n, f.pathError("write", err)
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Name() string { return f.name }
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	ents, err := f.readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(ents))
+	for i := range ents {
+		infos = append(infos, newFileInfo(f.fs.lookup(f.node, &ents[i])))
+	}
+	return infos, nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	ents, err := f.readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ents))
+	for i := range ents {
+		names = append(names, ents[i].name)
+	}
+	return names, nil
+}
+
+func (f *file) readdir(n int) ([]dirent, error) {
+	if f.closed {
+		return nil, f.pathError("readdir", os.ErrClosed)
+	}
+	if !f.node.isDir() {
+		return nil, f.pathError("readdir", syscall.ENOTDIR)
+	}
+	ents, err := f.fs.readDir(f.node)
+	if err != nil {
+		return nil, f.pathError("readdir", err)
+	}
+	if f.dirOffset >= len(ents) {
+		ents = nil
+	} else {
+		ents = ents[f.dirOffset:]
+	}
+	if n > 0 {
+		if len(ents) == 0 {
+			return nil, io.EOF
+		}
+		if len(ents) > n {
+			ents = ents[:n]
+		}
+	}
+	f.dirOffset += len(ents)
+	return ents, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return newFileInfo(f.node), nil
+}
+
+func (f *file) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed {
+		return f.pathError("sync", os.ErrClosed)
+	}
+	return f.pathError("sync", f.fs.flush())
+}
+
+func (f *file) Truncate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.check(true); err != nil {
+		return f.pathError("truncate", err)
+	}
+	return f.pathError("truncate", f.fs.truncate(f.node, size))
+}
+
+func (f *file) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed {
+		return f.pathError("close", os.ErrClosed)
+	}
+	f.closed = true
+	if err := f.fs.release(f.node); err != nil {
+		return f.pathError("close", err)
+	}
+	return f.pathError("close", f.fs.flush())
+}
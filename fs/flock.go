@@ -0,0 +1,353 @@
+package fs
+
+import (
+	"io"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/spf13/afero"
+)
+
+const (
+	// the fcntl commands using struct flock with 32bit offsets, the ones of
+	// package syscall are the 64bit versions.
+	_F_GETLK32  = 5
+	_F_SETLK32  = 6
+	_F_SETLKW32 = 7
+)
+
+// fileLock is a lock of flock or a byte range lock of fcntl. Eggos runs one
+// process, the locks are owned by the open file like F_OFD_SETLK, otherwise
+// the fcntl locks would never conflict.
+type fileLock struct {
+	owner *Inode
+	// the locks of flock and fcntl don't conflict with each other
+	flock bool
+	typ   int16
+	// the locked range is [start, end)
+	start, end int64
+}
+
+func (l *fileLock) conflict(o *fileLock) bool {
+	return l.owner != o.owner && l.flock == o.flock &&
+		l.start < o.end && o.start < l.end &&
+		(l.typ == syscall.F_WRLCK || o.typ == syscall.F_WRLCK)
+}
+
+type lockWaiter struct {
+	lock *fileLock
+	// err is set if the fd is closed while waiting
+	err  error
+	done chan struct{}
+}
+
+// lockFile is the locks and the waiters of one file
+type lockFile struct {
+	locks   []*fileLock
+	waiters []*lockWaiter
+}
+
+var (
+	lockMutex sync.Mutex
+	lockFiles = make(map[interface{}]*lockFile)
+	// lockWaiting is the lock every blocked owner waits for, used to detect
+	// deadlocks.
+	lockWaiting = make(map[*Inode]*lockWaiter)
+)
+
+// lockKey identifies the file of inode by path, the files not opened from
+// fs are identified by the inode itself.
+func lockKey(ni *Inode) interface{} {
+	if _, ok := ni.File.(afero.File); !ok || ni.Name == "" {
+		return ni
+	}
+	return resolveLink(ni.Name)
+}
+
+// conflicts returns the first held lock conflicting with l
+func (f *lockFile) conflicts(l *fileLock) *fileLock {
+	for _, o := range f.locks {
+		if l.conflict(o) {
+			return o
+		}
+	}
+	return nil
+}
+
+// apply replaces the range of l held by the owner of l with l, it must be
+// called with lockMutex held.
+func (f *lockFile) apply(l *fileLock) {
+	var locks []*fileLock
+	for _, o := range f.locks {
+		if o.owner != l.owner || o.flock != l.flock || o.end <= l.start || l.end <= o.start {
+			locks = append(locks, o)
+			continue
+		}
+		// keep the parts out of l
+		if o.start < l.start {
+			left := *o
+			left.end = l.start
+			locks = append(locks, &left)
+		}
+		if l.end < o.end {
+			right := *o
+			right.start = l.end
+			locks = append(locks, &right)
+		}
+	}
+	if l.typ != syscall.F_UNLCK {
+		locks = append(locks, l)
+	}
+	f.locks = locks
+}
+
+// wake grants the waiters in FIFO order, it must be called with lockMutex
+// held.
+func (f *lockFile) wake() {
+	for i := 0; i < len(f.waiters); {
+		w := f.waiters[i]
+		if f.conflicts(w.lock) != nil {
+			i++
+			continue
+		}
+		f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+		delete(lockWaiting, w.lock.owner)
+		f.apply(w.lock)
+		close(w.done)
+		// the lock may be a conversion which releases others, start over
+		i = 0
+	}
+}
+
+// deadlock reports whether the holders of the locks conflicting with l
+// wait for the owner of l in the end, it must be called with lockMutex held.
+func deadlock(f *lockFile, l *fileLock) bool {
+	owner := l.owner
+	seen := make(map[*Inode]bool)
+	var blocked func(f *lockFile, l *fileLock) bool
+	blocked = func(f *lockFile, l *fileLock) bool {
+		for _, o := range f.locks {
+			if !l.conflict(o) || seen[o.owner] {
+				continue
+			}
+			if o.owner == owner {
+				return true
+			}
+			seen[o.owner] = true
+			w, ok := lockWaiting[o.owner]
+			if ok && blocked(lockFiles[lockKey(o.owner)], w.lock) {
+				return true
+			}
+		}
+		return false
+	}
+	return blocked(f, l)
+}
+
+// lock acquires l, it blocks if wait is set and the range is held by
+// others, or returns EAGAIN.
+func lock(ni *Inode, l *fileLock, wait bool) error {
+	key := lockKey(ni)
+	lockMutex.Lock()
+	f := lockFiles[key]
+	if f == nil {
+		f = &lockFile{}
+		lockFiles[key] = f
+	}
+	if l.typ == syscall.F_UNLCK || f.conflicts(l) == nil {
+		f.apply(l)
+		f.wake()
+		if len(f.locks) == 0 && len(f.waiters) == 0 {
+			delete(lockFiles, key)
+		}
+		lockMutex.Unlock()
+		return nil
+	}
+	if !wait {
+		lockMutex.Unlock()
+		return syscall.EAGAIN
+	}
+	if deadlock(f, l) {
+		lockMutex.Unlock()
+		return syscall.EDEADLK
+	}
+	if l.flock {
+		// converting a flock lock drops the old one first, like linux
+		f.apply(&fileLock{owner: l.owner, flock: true, typ: syscall.F_UNLCK, end: math.MaxInt64})
+		f.wake()
+	}
+	w := &lockWaiter{lock: l, done: make(chan struct{})}
+	f.waiters = append(f.waiters, w)
+	lockWaiting[ni] = w
+	lockMutex.Unlock()
+	<-w.done
+	return w.err
+}
+
+// getlock returns the first lock conflicting with l, nil if l can be
+// acquired.
+func getlock(ni *Inode, l *fileLock) *fileLock {
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+	f := lockFiles[lockKey(ni)]
+	if f == nil {
+		return nil
+	}
+	return f.conflicts(l)
+}
+
+// unlockAll drops all the locks of inode, it's called on closing.
+func unlockAll(ni *Inode) {
+	key := lockKey(ni)
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+	f := lockFiles[key]
+	if f == nil {
+		return
+	}
+	var locks []*fileLock
+	for _, l := range f.locks {
+		if l.owner != ni {
+			locks = append(locks, l)
+		}
+	}
+	f.locks = locks
+	var waiters []*lockWaiter
+	for _, w := range f.waiters {
+		if w.lock.owner != ni {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.err = syscall.EBADF
+		close(w.done)
+	}
+	f.waiters = waiters
+	delete(lockWaiting, ni)
+	f.wake()
+	if len(f.locks) == 0 && len(f.waiters) == 0 {
+		delete(lockFiles, key)
+	}
+}
+
+// func flock(fd int, how int)
+func sysFlock(c *isyscall.Request) {
+	c.Ret = isyscall.Errno(errnoFromErr(flock(int(c.Args[0]), int(c.Args[1]))))
+	c.Done()
+}
+
+func flock(fd, how int) error {
+	ni, err := GetInode(fd)
+	if err != nil {
+		return err
+	}
+	l := &fileLock{owner: ni, flock: true, end: math.MaxInt64}
+	switch how &^ syscall.LOCK_NB {
+	case syscall.LOCK_SH:
+		l.typ = syscall.F_RDLCK
+	case syscall.LOCK_EX:
+		l.typ = syscall.F_WRLCK
+	case syscall.LOCK_UN:
+		l.typ = syscall.F_UNLCK
+	default:
+		return syscall.EINVAL
+	}
+	return lock(ni, l, how&syscall.LOCK_NB == 0)
+}
+
+// lockRange converts the range of struct flock to [start, end)
+func lockRange(ni *Inode, whence int16, start, length int64) (int64, int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent, io.SeekEnd:
+		file, ok := ni.File.(afero.File)
+		if !ok {
+			return 0, 0, syscall.EINVAL
+		}
+		base, err := file.Seek(0, io.SeekCurrent)
+		if whence == io.SeekEnd {
+			var info os.FileInfo
+			if info, err = file.Stat(); err == nil {
+				base = info.Size()
+			}
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		start += base
+	default:
+		return 0, 0, syscall.EINVAL
+	}
+	end := int64(math.MaxInt64)
+	switch {
+	case length > 0:
+		end = start + length
+	case length < 0:
+		start, end = start+length, start
+	}
+	if start < 0 {
+		return 0, 0, syscall.EINVAL
+	}
+	return start, end, nil
+}
+
+// fcntlLock handles F_GETLK, F_SETLK and F_SETLKW, arg points to a struct
+// flock or flock64 according to cmd.
+func fcntlLock(fd, cmd int, arg uintptr) error {
+	ni, err := GetInode(fd)
+	if err != nil {
+		return err
+	}
+	var lk syscall.Flock_t
+	switch cmd {
+	case _F_GETLK32, _F_SETLK32, _F_SETLKW32:
+		lk32 := (*flock32)(unsafe.Pointer(arg))
+		lk = syscall.Flock_t{Type: lk32.Type, Whence: lk32.Whence, Start: int64(lk32.Start), Len: int64(lk32.Len)}
+	default:
+		lk = *(*syscall.Flock_t)(unsafe.Pointer(arg))
+	}
+
+	start, end, err := lockRange(ni, lk.Whence, lk.Start, lk.Len)
+	if err != nil {
+		return err
+	}
+	l := &fileLock{owner: ni, typ: lk.Type, start: start, end: end}
+	switch lk.Type {
+	case syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK:
+	default:
+		return syscall.EINVAL
+	}
+
+	switch cmd {
+	case syscall.F_GETLK, _F_GETLK32:
+		lk = syscall.Flock_t{Type: syscall.F_UNLCK}
+		if o := getlock(ni, l); o != nil {
+			lk = syscall.Flock_t{Type: o.typ, Start: o.start, Pid: -1}
+			if o.end != math.MaxInt64 {
+				lk.Len = o.end - o.start
+			}
+		}
+		if cmd == _F_GETLK32 {
+			*(*flock32)(unsafe.Pointer(arg)) = flock32{Type: lk.Type, Start: int32(lk.Start), Len: int32(lk.Len), Pid: lk.Pid}
+		} else {
+			*(*syscall.Flock_t)(unsafe.Pointer(arg)) = lk
+		}
+		return nil
+	case syscall.F_SETLKW, _F_SETLKW32:
+		return lock(ni, l, true)
+	default:
+		return lock(ni, l, false)
+	}
+}
+
+// flock32 is the struct flock of 32bit offsets
+type flock32 struct {
+	Type   int16
+	Whence int16
+	Start  int32
+	Len    int32
+	Pid    int32
+}
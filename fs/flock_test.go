@@ -0,0 +1,172 @@
+package fs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/spf13/afero"
+)
+
+// waitBlocked waits until n lockers are blocked on name
+func waitBlocked(t *testing.T, name string, n int) {
+	for i := 0; i < 1000; i++ {
+		lockMutex.Lock()
+		f := lockFiles[name]
+		blocked := f != nil && len(f.waiters) == n
+		lockMutex.Unlock()
+		if blocked {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expect %d lockers blocked", n)
+}
+
+func TestFlock(t *testing.T) {
+	const name = "/tmp/flock"
+	afero.WriteFile(Root, name, nil, 0644)
+	fd1, ni1 := openTest(t, name, syscall.O_RDWR)
+	fd2, ni2 := openTest(t, name, syscall.O_RDWR)
+	defer sysClose(ni2)
+	fd3, ni3 := openTest(t, name, syscall.O_RDWR)
+	defer sysClose(ni3)
+
+	if err := flock(fd1, syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if err := flock(fd2, syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+
+	// the blocked lockers are woken in order
+	order := make(chan int, 2)
+	go func() { flock(fd2, syscall.LOCK_EX); order <- fd2 }()
+	waitBlocked(t, name, 1)
+	go func() { flock(fd3, syscall.LOCK_EX); order <- fd3 }()
+	waitBlocked(t, name, 2)
+
+	// closing the fd drops its lock
+	sysClose(ni1)
+	if fd := <-order; fd != fd2 {
+		t.Fatalf("expect fd %d first, got %d", fd2, fd)
+	}
+	flock(fd2, syscall.LOCK_UN)
+	if fd := <-order; fd != fd3 {
+		t.Fatalf("expect fd %d, got %d", fd3, fd)
+	}
+}
+
+func TestFlockExclusive(t *testing.T) {
+	const name = "/tmp/flock_ex"
+	afero.WriteFile(Root, name, nil, 0644)
+	fd, ni := openTest(t, name, syscall.O_RDWR)
+	defer sysClose(ni)
+
+	// the shared locks coexist until one asks for LOCK_EX
+	if err := flock(fd, syscall.LOCK_SH); err != nil {
+		t.Fatal(err)
+	}
+	sfd, sni := openTest(t, name, syscall.O_RDWR)
+	if err := flock(sfd, syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		t.Fatalf("expect shared lock, got %v", err)
+	}
+	if err := flock(sfd, syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("expect EWOULDBLOCK, got %v", err)
+	}
+	sysClose(sni)
+	flock(fd, syscall.LOCK_UN)
+
+	var (
+		inside  int32
+		counter int
+		wg      sync.WaitGroup
+	)
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		fd, ni := openTest(t, name, syscall.O_RDWR)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sysClose(ni)
+			for j := 0; j < 100; j++ {
+				if err := flock(fd, syscall.LOCK_EX); err != nil {
+					errs <- err
+					return
+				}
+				if atomic.AddInt32(&inside, 1) != 1 {
+					errs <- errors.New("two holders of LOCK_EX")
+				}
+				counter++
+				atomic.AddInt32(&inside, -1)
+				flock(fd, syscall.LOCK_UN)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if counter != 800 {
+		t.Fatalf("expect 800, got %d", counter)
+	}
+}
+
+func setlk(fd, cmd int, typ int16, start, length int64) error {
+	lk := syscall.Flock_t{Type: typ, Start: start, Len: length}
+	return fcntlLock(fd, cmd, uintptr(unsafe.Pointer(&lk)))
+}
+
+func TestFcntlLock(t *testing.T) {
+	const name = "/tmp/fcntl_lock"
+	afero.WriteFile(Root, name, nil, 0644)
+	fd1, ni1 := openTest(t, name, syscall.O_RDWR)
+	defer sysClose(ni1)
+	fd2, ni2 := openTest(t, name, syscall.O_RDWR)
+	defer sysClose(ni2)
+
+	if err := setlk(fd1, syscall.F_SETLK, syscall.F_WRLCK, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := setlk(fd2, syscall.F_SETLK, syscall.F_WRLCK, 10, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := setlk(fd2, syscall.F_SETLK, syscall.F_RDLCK, 5, 10); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+	lk := syscall.Flock_t{Type: syscall.F_RDLCK, Start: 5, Len: 1}
+	if err := fcntlLock(fd2, syscall.F_GETLK, uintptr(unsafe.Pointer(&lk))); err != nil {
+		t.Fatal(err)
+	}
+	if lk.Type != syscall.F_WRLCK || lk.Start != 0 || lk.Len != 10 {
+		t.Fatalf("bad F_GETLK result %+v", lk)
+	}
+
+	// unlocking the middle splits the range
+	if err := setlk(fd1, syscall.F_SETLK, syscall.F_UNLCK, 3, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := setlk(fd2, syscall.F_SETLK, syscall.F_WRLCK, 3, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := setlk(fd2, syscall.F_SETLK, syscall.F_WRLCK, 7, 1); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+
+	// fd2 waits for fd1, fd1 waiting for fd2 is a deadlock
+	done := make(chan error)
+	go func() { done <- setlk(fd2, syscall.F_SETLKW, syscall.F_WRLCK, 0, 1) }()
+	waitBlocked(t, name, 1)
+	if err := setlk(fd1, syscall.F_SETLKW, syscall.F_WRLCK, 10, 1); err != syscall.EDEADLK {
+		t.Fatalf("expect EDEADLK, got %v", err)
+	}
+	setlk(fd1, syscall.F_SETLK, syscall.F_UNLCK, 0, 0)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/icexin/eggos/fs/block"
+	"github.com/icexin/eggos/fs/fatfs"
+	"github.com/icexin/eggos/fs/tarfs"
+	"github.com/icexin/eggos/multiboot"
+	"github.com/spf13/afero"
+)
+
+// FsCtor creates the fs mounted by the mount= directives of the kernel
+// command line, source is the last field of the directive.
+type FsCtor func(source string) (afero.Fs, error)
+
+var (
+	fsTypeMutex sync.Mutex
+	fsTypes     = map[string]FsCtor{
+		"mem": memFsType,
+		"tar": tarFsType,
+		"fat": fatFsType,
+	}
+)
+
+// RegisterFsType makes the fs type name available to the mount= directives
+// of the kernel command line, a registered type is replaced. It must be
+// called before Init to be used at boot.
+func RegisterFsType(name string, ctor FsCtor) {
+	fsTypeMutex.Lock()
+	defer fsTypeMutex.Unlock()
+	fsTypes[name] = ctor
+}
+
+func lookupFsType(name string) FsCtor {
+	fsTypeMutex.Lock()
+	defer fsTypeMutex.Unlock()
+	return fsTypes[name]
+}
+
+func fsTypeNames() []string {
+	fsTypeMutex.Lock()
+	defer fsTypeMutex.Unlock()
+	var names []string
+	for name := range fsTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memFsType is an empty memory fs, the source is ignored
+func memFsType(source string) (afero.Fs, error) {
+	return afero.NewMemMapFs(), nil
+}
+
+// tarFsType mounts the tar archive of source, which is moduleN for the Nth
+// boot module, or the path of an archive file.
+func tarFsType(source string) (afero.Fs, error) {
+	if strings.HasPrefix(source, "module") {
+		n, err := strconv.Atoi(source[len("module"):])
+		if err != nil {
+			return nil, fmt.Errorf("bad module %q", source)
+		}
+		var mods []multiboot.Module
+		if multiboot.Enabled() {
+			mods = multiboot.BootInfo.Modules()
+		}
+		if n < 0 || n >= len(mods) {
+			return nil, fmt.Errorf("no boot module %d", n)
+		}
+		return newTarFs(mods[n].Data())
+	}
+	data, err := afero.ReadFile(Root, source)
+	if err != nil {
+		return nil, err
+	}
+	return newTarFs(data)
+}
+
+func newTarFs(data []byte) (afero.Fs, error) {
+	tfs, err := tarfs.New(data)
+	if err != nil {
+		return nil, err
+	}
+	return tfs, nil
+}
+
+// fatFsType mounts the FAT32 disk image at the path source
+func fatFsType(source string) (afero.Fs, error) {
+	f, err := Root.OpenFile(source, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ffs, err := fatfs.New(block.NewFileDevice(f, info.Size(), 512))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ffs, nil
+}
+
+// mountDirective is a mount=<target>:<type>:<source> of command line
+type mountDirective struct {
+	target string
+	typ    string
+	source string
+}
+
+// parseMountArgs returns the mount directives of cmdline in order, and
+// whether mount.required is given. The malformed directives are reported
+// in errs.
+func parseMountArgs(cmdline string) (dirs []mountDirective, required bool, errs []error) {
+	for _, arg := range strings.Fields(cmdline) {
+		if arg == "mount.required" {
+			required = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "mount=") {
+			continue
+		}
+		fields := strings.SplitN(arg[len("mount="):], ":", 3)
+		switch {
+		case len(fields) != 3:
+			errs = append(errs, fmt.Errorf("%s: expect mount=<target>:<type>:<source>", arg))
+		case !path.IsAbs(fields[0]):
+			errs = append(errs, fmt.Errorf("%s: target %q is not an absolute path", arg, fields[0]))
+		case fields[1] == "":
+			errs = append(errs, fmt.Errorf("%s: empty fs type", arg))
+		default:
+			dirs = append(dirs, mountDirective{
+				target: path.Clean(fields[0]),
+				typ:    fields[1],
+				source: fields[2],
+			})
+		}
+	}
+	return
+}
+
+func mountOne(d mountDirective) error {
+	ctor := lookupFsType(d.typ)
+	if ctor == nil {
+		return fmt.Errorf("unknown fs type %q, the known ones are %s", d.typ, strings.Join(fsTypeNames(), ","))
+	}
+	fs, err := ctor(d.source)
+	if err != nil {
+		return err
+	}
+	return Mount(d.target, fs)
+}
+
+// mountCmdline mounts the directives of cmdline in order, the failures are
+// logged and returned as one error.
+func mountCmdline(cmdline string) (required bool, err error) {
+	dirs, required, errs := parseMountArgs(cmdline)
+	for _, d := range dirs {
+		if err := mountOne(d); err != nil {
+			errs = append(errs, fmt.Errorf("mount %s:%s:%s: %s", d.target, d.typ, d.source, err))
+		}
+	}
+	var msgs []string
+	for _, err := range errs {
+		log.Printf("[fs] %s", err)
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) != 0 {
+		return required, errors.New(strings.Join(msgs, "; "))
+	}
+	return required, nil
+}
+
+// cmdlineInit mounts the mount= directives of the kernel command line, it
+// panics on failure if mount.required is given.
+func cmdlineInit() {
+	if !multiboot.Enabled() {
+		return
+	}
+	required, err := mountCmdline(multiboot.BootInfo.CmdlineString())
+	if err != nil && required {
+		panic(err)
+	}
+}
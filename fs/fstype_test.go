@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestParseMountArgs(t *testing.T) {
+	dirs, required, errs := parseMountArgs("strace mount=/data/:fat:/disk.img mount=/assets:tar:module0 " +
+		"mount=/a:tar mount=b:mem: mount=/c::x mount.required")
+	expect := []mountDirective{
+		{"/data", "fat", "/disk.img"},
+		{"/assets", "tar", "module0"},
+	}
+	if len(dirs) != len(expect) || dirs[0] != expect[0] || dirs[1] != expect[1] {
+		t.Fatalf("expect %v, got %v", expect, dirs)
+	}
+	if !required {
+		t.Fatal("expect mount.required")
+	}
+	if len(errs) != 3 {
+		t.Fatalf("expect 3 errors, got %v", errs)
+	}
+	for i, arg := range []string{"mount=/a:tar", "mount=b:mem:", "mount=/c::x"} {
+		if !strings.HasPrefix(errs[i].Error(), arg+": ") {
+			t.Fatalf("bad error %q for %s", errs[i], arg)
+		}
+	}
+}
+
+func TestMountCmdline(t *testing.T) {
+	var sources []string
+	RegisterFsType("test", func(source string) (afero.Fs, error) {
+		sources = append(sources, source)
+		if source == "bad" {
+			return nil, errors.New("bad source")
+		}
+		return afero.NewMemMapFs(), nil
+	})
+	defer func() {
+		fsTypeMutex.Lock()
+		delete(fsTypes, "test")
+		fsTypeMutex.Unlock()
+	}()
+
+	required, err := mountCmdline("mount=/mnt/t1:test:a mount=/mnt/t2:mem: mount=/mnt/t3:test:bad mount=/mnt/t4:none:x")
+	defer Umount("/mnt/t1")
+	defer Umount("/mnt/t2")
+	if required {
+		t.Fatal("unexpected mount.required")
+	}
+	if err == nil || !strings.Contains(err.Error(), "bad source") ||
+		!strings.Contains(err.Error(), `unknown fs type "none"`) {
+		t.Fatalf("bad error %v", err)
+	}
+	if len(sources) != 2 || sources[0] != "a" || sources[1] != "bad" {
+		t.Fatalf("bad sources %v", sources)
+	}
+	// the failures don't stop the following directives
+	for _, name := range []string{"/mnt/t1", "/mnt/t2"} {
+		if err := afero.WriteFile(Root, name+"/file", []byte("x"), 0644); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	if _, err := statFile("/mnt/t3"); err == nil {
+		t.Fatal("/mnt/t3 should not be mounted")
+	}
+
+	if required, err = mountCmdline("mount=/mnt/t5:none:x mount.required"); !required || err == nil {
+		t.Fatalf("expect required error, got %v %v", required, err)
+	}
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/icexin/eggos/fs/tarfs"
+	"github.com/icexin/eggos/multiboot"
+)
+
+const (
+	// defaultArchiveMount is the mount point of boot modules without a path
+	defaultArchiveMount = "/assets"
+)
+
+type bootArchive struct {
+	target string
+	data   []byte
+}
+
+var (
+	archiveMutex sync.Mutex
+	archives     []bootArchive
+)
+
+// RegisterBootArchive registers a tar archive which will be mounted read-only
+// at target during fs.Init, it's intended to be called from init functions of
+// the application, so that the assets can be embedded in the kernel image.
+func RegisterBootArchive(target string, data []byte) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	archives = append(archives, bootArchive{
+		target: target,
+		data:   data,
+	})
+}
+
+// moduleTarget returns the mount point of boot module, the first word of
+// module command line is the module file, the second one is the mount point.
+// e.g. the grub line `module /boot/assets.tar /www` mounts the module at /www
+func moduleTarget(cmdline string) string {
+	fields := strings.Fields(cmdline)
+	if len(fields) < 2 {
+		return defaultArchiveMount
+	}
+	return fields[1]
+}
+
+func mountArchive(target string, data []byte) error {
+	tfs, err := tarfs.New(data)
+	if err != nil {
+		return err
+	}
+	target = filepath.Clean("/" + target)
+	return Mount(target, tfs)
+}
+
+func initrdInit() {
+	archiveMutex.Lock()
+	list := append([]bootArchive(nil), archives...)
+	archiveMutex.Unlock()
+
+	if multiboot.Enabled() {
+		mods := multiboot.BootInfo.Modules()
+		for i := range mods {
+			list = append(list, bootArchive{
+				target: moduleTarget(mods[i].CmdlineString()),
+				data:   mods[i].Data(),
+			})
+		}
+	}
+
+	for _, a := range list {
+		if err := mountArchive(a.target, a.data); err != nil {
+			log.Printf("[fs] mount archive at %s: %s", a.target, err)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package fs
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	// the events reported to the watch of the file itself, the others are
+	// only reported to the watch of parent directory.
+	inSelfEvents = syscall.IN_ALL_EVENTS &^ (syscall.IN_CREATE | syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO)
+	// the events reported to the watch of parent directory
+	inChildEvents = syscall.IN_ALL_EVENTS &^ (syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF)
+
+	// the max number of events queued by an inotify fd
+	inMaxQueued = 16384
+)
+
+type inotifyWatch struct {
+	wd   int32
+	name string
+	mask uint32
+}
+
+// inotifyFd is an inotify instance, the events are queued as the packed
+// struct inotify_event until read.
+type inotifyFd struct {
+	fd int
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	nextWd  int32
+	watches map[int32]*inotifyWatch
+	byName  map[string]*inotifyWatch
+	events  [][]byte
+	closed  bool
+}
+
+var (
+	inotifyMutex sync.Mutex
+	inotifies    = make(map[*inotifyFd]bool)
+	// inotifyCookie pairs IN_MOVED_FROM and IN_MOVED_TO of a rename
+	inotifyCookie uint32
+)
+
+func newInotifyFd() *inotifyFd {
+	n := &inotifyFd{
+		nextWd:  1,
+		watches: make(map[int32]*inotifyWatch),
+		byName:  make(map[string]*inotifyWatch),
+	}
+	n.cond = sync.NewCond(&n.mutex)
+	inotifyMutex.Lock()
+	inotifies[n] = true
+	inotifyMutex.Unlock()
+	return n
+}
+
+// packEvent returns the struct inotify_event, the name is padded to 16
+// bytes with NUL.
+func packEvent(wd int32, mask, cookie uint32, name string) []byte {
+	nameLen := 0
+	if name != "" {
+		nameLen = align(len(name)+1, 16)
+	}
+	buf := make([]byte, syscall.SizeofInotifyEvent+nameLen)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(wd))
+	binary.LittleEndian.PutUint32(buf[4:], mask)
+	binary.LittleEndian.PutUint32(buf[8:], cookie)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(nameLen))
+	copy(buf[syscall.SizeofInotifyEvent:], name)
+	return buf
+}
+
+// queue adds an event, it must be called with mutex held.
+func (n *inotifyFd) queue(ev []byte) {
+	switch {
+	case len(n.events) < inMaxQueued:
+		n.events = append(n.events, ev)
+	case len(n.events) == inMaxQueued:
+		n.events = append(n.events, packEvent(-1, syscall.IN_Q_OVERFLOW, 0, ""))
+	default:
+		// the overflow has been reported
+		return
+	}
+	n.cond.Broadcast()
+}
+
+// remove drops w and queues IN_IGNORED, it must be called with mutex held.
+func (n *inotifyFd) remove(w *inotifyWatch) {
+	delete(n.watches, w.wd)
+	delete(n.byName, w.name)
+	n.queue(packEvent(w.wd, syscall.IN_IGNORED, 0, ""))
+}
+
+// deliver queues the event to watch w if it's interested in, it reports
+// whether an event is queued. It must be called with mutex held.
+func (n *inotifyFd) deliver(w *inotifyWatch, mask, cookie uint32, name string) bool {
+	if w == nil {
+		return false
+	}
+	queued := false
+	if w.mask&mask&syscall.IN_ALL_EVENTS != 0 {
+		n.queue(packEvent(w.wd, mask&(w.mask|syscall.IN_ISDIR), cookie, name))
+		if w.mask&syscall.IN_ONESHOT != 0 {
+			n.remove(w)
+			return true
+		}
+		queued = true
+	}
+	// the watch of a deleted file goes away
+	if mask&syscall.IN_DELETE_SELF != 0 {
+		n.remove(w)
+		queued = true
+	}
+	return queued
+}
+
+func (n *inotifyFd) notify(name string, mask, cookie uint32) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	isdir := mask & syscall.IN_ISDIR
+	queued := false
+	if m := mask & inChildEvents; m != 0 && name != "/" {
+		dir, base := path.Split(name)
+		queued = n.deliver(n.byName[path.Clean(dir)], m|isdir, cookie, base)
+	}
+	if m := mask & inSelfEvents; m != 0 {
+		queued = n.deliver(n.byName[name], m|isdir, cookie, "") || queued
+	}
+	return queued
+}
+
+// inotify reports the events of mask on the file name to the watches of
+// the file and its parent directory. The callers OR IN_ISDIR to mask for
+// directories.
+func inotify(name string, mask, cookie uint32) {
+	if !path.IsAbs(name) {
+		return
+	}
+	name = path.Clean(name)
+	var fds []int
+	inotifyMutex.Lock()
+	for n := range inotifies {
+		if n.notify(name, mask, cookie) {
+			fds = append(fds, n.fd)
+		}
+	}
+	inotifyMutex.Unlock()
+	for _, fd := range fds {
+		evnotify(uintptr(fd), syscall.EPOLLIN)
+	}
+}
+
+// inotifyWatched reports whether any inotify fd exists, so that the
+// callers can skip the work of finding out the events.
+func inotifyWatched() bool {
+	inotifyMutex.Lock()
+	defer inotifyMutex.Unlock()
+	return len(inotifies) != 0
+}
+
+// inotifyRename reports a rename as IN_MOVED_FROM and IN_MOVED_TO of the
+// same cookie.
+func inotifyRename(oldname, newname string, isdir uint32) {
+	inotifyMutex.Lock()
+	inotifyCookie++
+	cookie := inotifyCookie
+	inotifyMutex.Unlock()
+	inotify(oldname, syscall.IN_MOVED_FROM|syscall.IN_MOVE_SELF|isdir, cookie)
+	inotify(newname, syscall.IN_MOVED_TO|isdir, cookie)
+
+	// the watches follow the files
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	inotifyMutex.Lock()
+	defer inotifyMutex.Unlock()
+	for n := range inotifies {
+		n.mutex.Lock()
+		for name, w := range n.byName {
+			if name != oldname && !strings.HasPrefix(name, oldname+"/") {
+				continue
+			}
+			delete(n.byName, name)
+			w.name = newname + strings.TrimPrefix(name, oldname)
+			n.byName[w.name] = w
+		}
+		n.mutex.Unlock()
+	}
+}
+
+func (n *inotifyFd) addWatch(name string, mask uint32) (int32, error) {
+	if mask&syscall.IN_ALL_EVENTS == 0 {
+		return 0, syscall.EINVAL
+	}
+	info, err := statFile(name)
+	if err != nil {
+		return 0, fsErrno(err)
+	}
+	if mask&syscall.IN_ONLYDIR != 0 && !info.IsDir() {
+		return 0, syscall.ENOTDIR
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if w, ok := n.byName[name]; ok {
+		if mask&syscall.IN_MASK_ADD != 0 {
+			w.mask |= mask &^ syscall.IN_MASK_ADD
+		} else {
+			w.mask = mask
+		}
+		return w.wd, nil
+	}
+	w := &inotifyWatch{wd: n.nextWd, name: name, mask: mask &^ syscall.IN_MASK_ADD}
+	n.nextWd++
+	n.watches[w.wd] = w
+	n.byName[name] = w
+	return w.wd, nil
+}
+
+func (n *inotifyFd) rmWatch(wd int32) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	w, ok := n.watches[wd]
+	if !ok {
+		return syscall.EINVAL
+	}
+	n.remove(w)
+	return nil
+}
+
+func (n *inotifyFd) Read(p []byte) (int, error) {
+	return n.read(p, false)
+}
+
+// ReadNonBlock returns EAGAIN if no event is queued
+func (n *inotifyFd) ReadNonBlock(p []byte) (int, error) {
+	return n.read(p, true)
+}
+
+func (n *inotifyFd) Readable() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.events) != 0
+}
+
+// read returns the whole events fitting in p, EINVAL if p can't hold the
+// first one.
+func (n *inotifyFd) read(p []byte, nonblock bool) (int, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for len(n.events) == 0 {
+		if n.closed {
+			return 0, syscall.EBADF
+		}
+		if nonblock {
+			return 0, syscall.EAGAIN
+		}
+		n.cond.Wait()
+	}
+	if len(n.events[0]) > len(p) {
+		return 0, syscall.EINVAL
+	}
+	ret := 0
+	for len(n.events) > 0 && ret+len(n.events[0]) <= len(p) {
+		ret += copy(p[ret:], n.events[0])
+		n.events = n.events[1:]
+	}
+	return ret, nil
+}
+
+func (n *inotifyFd) Write(p []byte) (int, error) {
+	return 0, syscall.EINVAL
+}
+
+func (n *inotifyFd) Close() error {
+	inotifyMutex.Lock()
+	delete(inotifies, n)
+	inotifyMutex.Unlock()
+	n.mutex.Lock()
+	n.closed = true
+	n.cond.Broadcast()
+	n.mutex.Unlock()
+	return nil
+}
+
+// func inotify_init1(flags int) (fd int)
+func sysInotifyInit(c *isyscall.Request) {
+	var flags int
+	if c.NO == syscall.SYS_INOTIFY_INIT1 {
+		flags = int(c.Args[0])
+	}
+	if flags&^(syscall.IN_NONBLOCK|syscall.IN_CLOEXEC) != 0 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+	n := newInotifyFd()
+	fd, ni, err := AllocFileNode(n)
+	if err != nil {
+		n.Close()
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	inodeMutex.Lock()
+	// IN_NONBLOCK and IN_CLOEXEC are the same as the O_* flags
+	ni.Flags |= flags
+	ni.Name = "anon_inode:inotify"
+	inodeMutex.Unlock()
+	n.fd = fd
+	c.Ret = uintptr(fd)
+	c.Done()
+}
+
+func inotifyOf(fd int) (*inotifyFd, error) {
+	ni, err := GetInode(fd)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := ni.File.(*inotifyFd)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return n, nil
+}
+
+// func inotify_add_watch(fd int, path string, mask uint32) (wd int)
+func sysInotifyAddWatch(c *isyscall.Request) {
+	n, err := inotifyOf(int(c.Args[0]))
+	var name string
+	if err == nil {
+		name, err = atPath(_AT_FDCWD, c.Args[1])
+	}
+	var wd int32
+	if err == nil {
+		wd, err = n.addWatch(name, uint32(c.Args[2]))
+	}
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+	} else {
+		c.Ret = uintptr(wd)
+	}
+	c.Done()
+}
+
+// func inotify_rm_watch(fd int, wd uint32)
+func sysInotifyRmWatch(c *isyscall.Request) {
+	n, err := inotifyOf(int(c.Args[0]))
+	if err == nil {
+		err = n.rmWatch(int32(c.Args[1]))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
@@ -0,0 +1,111 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/spf13/afero"
+)
+
+type inotifyEvent struct {
+	wd     int32
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+func readEvents(t *testing.T, n *inotifyFd) []inotifyEvent {
+	buf := make([]byte, 4096)
+	ret, err := n.ReadNonBlock(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evs []inotifyEvent
+	for buf = buf[:ret]; len(buf) > 0; {
+		l := int(binary.LittleEndian.Uint32(buf[12:]))
+		name := buf[16 : 16+l]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		evs = append(evs, inotifyEvent{
+			wd:     int32(binary.LittleEndian.Uint32(buf)),
+			mask:   binary.LittleEndian.Uint32(buf[4:]),
+			cookie: binary.LittleEndian.Uint32(buf[8:]),
+			name:   string(name),
+		})
+		buf = buf[16+l:]
+	}
+	return evs
+}
+
+func TestInotify(t *testing.T) {
+	if err := Mount("/mnt/inotify", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/inotify")
+	n := newInotifyFd()
+	defer n.Close()
+
+	wd, err := n.addWatch("/mnt/inotify", syscall.IN_CREATE|syscall.IN_MODIFY|syscall.IN_DELETE|syscall.IN_MOVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.addWatch("/mnt/inotify/none", syscall.IN_ALL_EVENTS); err != syscall.ENOENT {
+		t.Fatalf("expect ENOENT, got %v", err)
+	}
+
+	name := []byte("/mnt/inotify/file\x00")
+	fd, err := sysOpen(_AT_FDCWD, uintptr(unsafe.Pointer(&name[0])), uintptr(os.O_RDWR|os.O_CREATE), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, _ := GetInode(fd)
+	writeBuf(ni, []byte("hello"))
+	sysClose(ni)
+	mkdirat("/mnt/inotify/dir", 0755)
+	rename("/mnt/inotify/file", "/mnt/inotify/moved")
+	unlinkat("/mnt/inotify/moved", 0)
+
+	evs := readEvents(t, n)
+	expect := []inotifyEvent{
+		{wd, syscall.IN_CREATE, 0, "file"},
+		{wd, syscall.IN_MODIFY, 0, "file"},
+		{wd, syscall.IN_CREATE | syscall.IN_ISDIR, 0, "dir"},
+		{wd, syscall.IN_MOVED_FROM, evs[3].cookie, "file"},
+		{wd, syscall.IN_MOVED_TO, evs[3].cookie, "moved"},
+		{wd, syscall.IN_DELETE, 0, "moved"},
+	}
+	if len(evs) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, evs)
+	}
+	for i := range evs {
+		if evs[i] != expect[i] {
+			t.Fatalf("expect %v, got %v", expect[i], evs[i])
+		}
+	}
+	if evs[3].cookie == 0 {
+		t.Fatal("expect cookie of rename")
+	}
+
+	// the watch goes away with the directory
+	dwd, _ := n.addWatch("/mnt/inotify/dir", syscall.IN_DELETE_SELF)
+	unlinkat("/mnt/inotify/dir", _AT_REMOVEDIR)
+	evs = readEvents(t, n)
+	if len(evs) != 3 || evs[1] != (inotifyEvent{dwd, syscall.IN_DELETE_SELF | syscall.IN_ISDIR, 0, ""}) ||
+		evs[2].mask != syscall.IN_IGNORED {
+		t.Fatalf("got %v", evs)
+	}
+	if err = n.rmWatch(dwd); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	if err = n.rmWatch(wd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.Read(make([]byte, 8)); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL on short buffer, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	_AT_SYMLINK_FOLLOW = 0x400
+)
+
+// The fs has no hard links, they are emulated like the special nodes: the
+// new name holds an empty regular file and the opens are redirected to the
+// path holding the content.
+var (
+	linkMutex sync.Mutex
+	// links maps a hard link to the path holding the content
+	links = make(map[string]string)
+	// nlinks is the link count of the paths having hard links, the others
+	// have one link.
+	nlinks = make(map[string]int)
+)
+
+// resolveLink returns the path holding the content of name
+func resolveLink(name string) string {
+	name = path.Clean("/" + name)
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+	if target, ok := links[name]; ok {
+		return target
+	}
+	return name
+}
+
+// linkCount returns the st_nlink of name
+func linkCount(name string) uint32 {
+	name = path.Clean("/" + name)
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+	if target, ok := links[name]; ok {
+		name = target
+	}
+	if n, ok := nlinks[name]; ok {
+		return uint32(n)
+	}
+	return 1
+}
+
+func linkat(oldname, newname string, flags int) error {
+	if flags&^_AT_SYMLINK_FOLLOW != 0 {
+		return syscall.EINVAL
+	}
+	oldname, newname = path.Clean("/"+oldname), path.Clean("/"+newname)
+	if err := checkWritable(newname); err != nil {
+		return err
+	}
+	info, err := Root.Stat(oldname)
+	if err != nil {
+		return fsErrno(err)
+	}
+	if info.IsDir() {
+		return syscall.EPERM
+	}
+	if Root.MountPath(oldname) != Root.MountPath(newname) {
+		return syscall.EXDEV
+	}
+	if err := checkParent(newname); err != nil {
+		return err
+	}
+	f, err := Root.OpenFile(newname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return fsErrno(err)
+	}
+	f.Close()
+
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+	target := oldname
+	if t, ok := links[oldname]; ok {
+		target = t
+	}
+	links[newname] = target
+	if nlinks[target] == 0 {
+		nlinks[target] = 1
+	}
+	nlinks[target]++
+	return nil
+}
+
+// unlinkLink removes name if it has hard links, ok is false for the other
+// files. The content moves to one of the links if name holds it.
+func unlinkLink(name string) (ok bool, err error) {
+	name = path.Clean("/" + name)
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+	if target, ok := links[name]; ok {
+		if err := Root.Remove(name); err != nil {
+			return true, fsErrno(err)
+		}
+		delete(links, name)
+		dropLinkCount(target)
+		return true, nil
+	}
+	if nlinks[name] == 0 {
+		return false, nil
+	}
+
+	var aliases []string
+	for alias, target := range links {
+		if target == name {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	heir := aliases[0]
+	if err := Root.Remove(heir); err != nil {
+		return true, fsErrno(err)
+	}
+	if err := Root.Rename(name, heir); err != nil {
+		return true, fsErrno(err)
+	}
+	delete(links, heir)
+	for _, alias := range aliases[1:] {
+		links[alias] = heir
+	}
+	nlinks[heir] = nlinks[name]
+	delete(nlinks, name)
+	renameOwner(name, heir)
+	dropLinkCount(heir)
+	return true, nil
+}
+
+// dropLinkCount decrements the link count of target, it must be called with
+// linkMutex held.
+func dropLinkCount(target string) {
+	nlinks[target]--
+	if nlinks[target] <= 1 {
+		delete(nlinks, target)
+	}
+}
+
+// renameLink moves the hard link records of oldname to newname
+func renameLink(oldname, newname string) {
+	oldname, newname = path.Clean("/"+oldname), path.Clean("/"+newname)
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+	if target, ok := links[oldname]; ok {
+		delete(links, oldname)
+		links[newname] = target
+		return
+	}
+	if n, ok := nlinks[oldname]; ok {
+		delete(nlinks, oldname)
+		nlinks[newname] = n
+		for alias, target := range links {
+			if target == oldname {
+				links[alias] = newname
+			}
+		}
+	}
+}
+
+// removeLinks drops the hard links under the mount point target
+func removeLinks(target string) {
+	prefix := strings.TrimSuffix(target, "/") + "/"
+	linkMutex.Lock()
+	defer linkMutex.Unlock()
+	for name := range links {
+		if strings.HasPrefix(name, prefix) {
+			delete(links, name)
+		}
+	}
+	for name := range nlinks {
+		if strings.HasPrefix(name, prefix) {
+			delete(nlinks, name)
+		}
+	}
+}
+
+// func link(oldpath string, newpath string)
+// func linkat(olddirfd int, oldpath string, newdirfd int, newpath string, flags int)
+func sysLinkat(c *isyscall.Request) {
+	olddirfd, oldpath, newdirfd, newpath, flags := c.Args[0], c.Args[1], c.Args[2], c.Args[3], c.Args[4]
+	if c.NO == syscall.SYS_LINK {
+		olddirfd, oldpath, newdirfd, newpath, flags = _AT_FDCWD, c.Args[0], _AT_FDCWD, c.Args[1], 0
+	}
+	oldname, err := atPath(olddirfd, oldpath)
+	var newname string
+	if err == nil {
+		newname, err = atPath(newdirfd, newpath)
+	}
+	if err == nil {
+		err = linkat(oldname, newname, int(flags))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
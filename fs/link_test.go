@@ -0,0 +1,111 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func nlinkOf(t *testing.T, name string) uint32 {
+	info, err := statFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stat syscall.Stat_t
+	fillStat(&stat, info, name)
+	return stat.Nlink
+}
+
+// writeLinked and readLinked open name by openFile, which resolves the
+// hard links.
+func writeLinked(t *testing.T, name, content string) {
+	f, err := openFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+}
+
+func readLinked(t *testing.T, name string) string {
+	f, err := openFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, _ := ioutil.ReadAll(f)
+	return string(b)
+}
+
+func TestLink(t *testing.T) {
+	Root.MkdirAll("/tmp/links/dir", 0755)
+	defer Root.RemoveAll("/tmp/links")
+	afero.WriteFile(Root, "/tmp/links/a", []byte("hello"), 0644)
+
+	if err := linkat("/tmp/links/a", "/tmp/links/b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := nlinkOf(t, "/tmp/links/a"); n != 2 {
+		t.Fatalf("expect 2 links, got %d", n)
+	}
+	// the content is shared
+	writeLinked(t, "/tmp/links/b", "world")
+	if b := readLinked(t, "/tmp/links/a"); b != "world" {
+		t.Fatalf("got %q", b)
+	}
+
+	// the content moves to b after unlinking a
+	if err := unlinkat("/tmp/links/a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if b := readLinked(t, "/tmp/links/b"); b != "world" {
+		t.Fatalf("got %q", b)
+	}
+	if n := nlinkOf(t, "/tmp/links/b"); n != 1 {
+		t.Fatalf("expect 1 link, got %d", n)
+	}
+
+	if err := linkat("/tmp/links/b", "/tmp/links/c", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename("/tmp/links/c", "/tmp/links/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename("/tmp/links/d", "/tmp/links/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlinkat("/tmp/links/b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if b := readLinked(t, "/tmp/links/d"); b != "world" {
+		t.Fatalf("got %q", b)
+	}
+	if len(links) != 0 || len(nlinks) != 0 {
+		t.Fatalf("records left %v %v", links, nlinks)
+	}
+	if err := unlinkat("/tmp/links/d", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Root.Stat("/tmp/links/d"); err == nil {
+		t.Fatal("expect d removed")
+	}
+
+	afero.WriteFile(Root, "/tmp/links/f", nil, 0644)
+	tests := []struct {
+		oldname, newname string
+		want             syscall.Errno
+	}{
+		{"/tmp/links/none", "/tmp/links/e", syscall.ENOENT},
+		{"/tmp/links/dir", "/tmp/links/e", syscall.EPERM},
+		{"/tmp/links/f", "/tmp/links/dir", syscall.EEXIST},
+		{"/tmp/links/f", "/tmp/links/none/e", syscall.ENOENT},
+	}
+	for _, test := range tests {
+		if err := linkat(test.oldname, test.newname, 0); err != test.want {
+			t.Errorf("link %s %s: expect %v, got %v", test.oldname, test.newname, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	_MFD_CLOEXEC       = 0x1
+	_MFD_ALLOW_SEALING = 0x2
+
+	_F_ADD_SEALS = 1033
+	_F_GET_SEALS = 1034
+
+	_F_SEAL_SEAL   = 0x1
+	_F_SEAL_SHRINK = 0x2
+	_F_SEAL_GROW   = 0x4
+	_F_SEAL_WRITE  = 0x8
+
+	allSeals = _F_SEAL_SEAL | _F_SEAL_SHRINK | _F_SEAL_GROW | _F_SEAL_WRITE
+)
+
+// memFd is an anonymous file created by memfd_create, the content lives in
+// memory only and is dropped on close.
+type memFd struct {
+	name string
+
+	mutex sync.Mutex
+	buf   bytes.Buffer
+	off   int64
+	seals int
+	mtime time.Time
+}
+
+func newMemFd(name string, flags int) *memFd {
+	m := &memFd{
+		name:  name,
+		mtime: time.Now(),
+	}
+	if flags&_MFD_ALLOW_SEALING == 0 {
+		// no more seals can be added
+		m.seals = _F_SEAL_SEAL
+	}
+	return m
+}
+
+// resize must be called with m.mutex held
+func (m *memFd) resize(size int64) error {
+	curr := int64(m.buf.Len())
+	switch {
+	case size < curr && m.seals&_F_SEAL_SHRINK != 0:
+		return syscall.EPERM
+	case size > curr && m.seals&_F_SEAL_GROW != 0:
+		return syscall.EPERM
+	case size < curr:
+		m.buf.Truncate(int(size))
+	case size > curr:
+		m.buf.Write(make([]byte, size-curr))
+	}
+	return nil
+}
+
+func (m *memFd) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(m.buf.Len()) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf.Bytes()[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// writeAt must be called with m.mutex held
+func (m *memFd) writeAt(p []byte, off int64) (int, error) {
+	if m.seals&_F_SEAL_WRITE != 0 {
+		return 0, syscall.EPERM
+	}
+	if end := off + int64(len(p)); end > int64(m.buf.Len()) {
+		if err := m.resize(end); err != nil {
+			return 0, err
+		}
+	}
+	m.mtime = time.Now()
+	return copy(m.buf.Bytes()[off:], p), nil
+}
+
+func (m *memFd) Read(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n, err := m.readAt(p, m.off)
+	m.off += int64(n)
+	return n, err
+}
+
+func (m *memFd) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.readAt(p, off)
+}
+
+func (m *memFd) Write(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n, err := m.writeAt(p, m.off)
+	m.off += int64(n)
+	return n, err
+}
+
+func (m *memFd) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.writeAt(p, off)
+}
+
+func (m *memFd) Seek(offset int64, whence int) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += int64(m.buf.Len())
+	default:
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	m.off = offset
+	return offset, nil
+}
+
+func (m *memFd) Truncate(size int64) error {
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.resize(size); err != nil {
+		return err
+	}
+	m.mtime = time.Now()
+	return nil
+}
+
+func (m *memFd) Stat() (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return &memFdInfo{
+		name:  "memfd:" + m.name,
+		size:  int64(m.buf.Len()),
+		mtime: m.mtime,
+	}, nil
+}
+
+func (m *memFd) Close() error {
+	return nil
+}
+
+// addSeals applies seals, F_SEAL_WRITE can be added whenever, for the file
+// is never mapped shared.
+func (m *memFd) addSeals(seals int) error {
+	if seals&^allSeals != 0 {
+		return syscall.EINVAL
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.seals&_F_SEAL_SEAL != 0 {
+		return syscall.EPERM
+	}
+	m.seals |= seals
+	return nil
+}
+
+func (m *memFd) getSeals() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.seals
+}
+
+type memFdInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (i *memFdInfo) Name() string       { return i.name }
+func (i *memFdInfo) Size() int64        { return i.size }
+func (i *memFdInfo) Mode() os.FileMode  { return 0777 }
+func (i *memFdInfo) ModTime() time.Time { return i.mtime }
+func (i *memFdInfo) IsDir() bool        { return false }
+func (i *memFdInfo) Sys() interface{}   { return nil }
+
+// func memfd_create(name string, flags uint) (fd int)
+func sysMemfdCreate(c *isyscall.Request) {
+	name := cstring(c.Args[0])
+	flags := int(c.Args[1])
+	if flags&^(_MFD_CLOEXEC|_MFD_ALLOW_SEALING) != 0 || len(name) > 249 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+
+	_, ni, err := AllocFileNode(newMemFd(name, flags))
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	ni.Flags = syscall.O_RDWR
+	if flags&_MFD_CLOEXEC != 0 {
+		ni.Flags |= syscall.O_CLOEXEC
+	}
+	ni.Name = "/memfd:" + name + " (deleted)"
+	c.Ret = uintptr(ni.Fd)
+	c.Done()
+}
+
+// memfdFcntl handles F_ADD_SEALS and F_GET_SEALS
+func memfdFcntl(fd, cmd, arg uintptr) (int, error) {
+	ni, err := GetInode(int(fd))
+	if err != nil {
+		return 0, err
+	}
+	m, ok := ni.File.(*memFd)
+	if !ok {
+		return 0, syscall.EINVAL
+	}
+	if cmd == _F_GET_SEALS {
+		return m.getSeals(), nil
+	}
+	if ni.Flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return 0, syscall.EPERM
+	}
+	return 0, m.addSeals(int(arg))
+}
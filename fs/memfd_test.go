@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestMemfdSeals(t *testing.T) {
+	m := newMemFd("test", _MFD_ALLOW_SEALING)
+	fd, ni, _ := AllocFileNode(m)
+	ni.Flags = syscall.O_RDWR
+	defer ni.Release()
+
+	if _, err := m.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, _ := m.Read(buf); string(buf[:n]) != "world" {
+		t.Fatalf("got %q", buf[:n])
+	}
+
+	if _, err := memfdFcntl(uintptr(fd), _F_ADD_SEALS, _F_SEAL_SHRINK|_F_SEAL_GROW); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Truncate(5); err != syscall.EPERM {
+		t.Fatalf("expect EPERM on shrinking, got %v", err)
+	}
+	if _, err := m.WriteAt([]byte("!!"), 10); err != syscall.EPERM {
+		t.Fatalf("expect EPERM on growing, got %v", err)
+	}
+	if _, err := m.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := memfdFcntl(uintptr(fd), _F_ADD_SEALS, _F_SEAL_WRITE|_F_SEAL_SEAL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WriteAt([]byte("w"), 6); err != syscall.EPERM {
+		t.Fatalf("expect EPERM on writing, got %v", err)
+	}
+	if _, err := memfdFcntl(uintptr(fd), _F_ADD_SEALS, _F_SEAL_WRITE); err != syscall.EPERM {
+		t.Fatalf("expect EPERM after F_SEAL_SEAL, got %v", err)
+	}
+	seals, _ := memfdFcntl(uintptr(fd), _F_GET_SEALS, 0)
+	if seals != allSeals {
+		t.Fatalf("got seals %x", seals)
+	}
+	if n, _ := m.ReadAt(buf, 6); string(buf[:n]) != "World" {
+		t.Fatalf("got %q", buf[:n])
+	}
+
+	// sealing is not allowed without MFD_ALLOW_SEALING
+	if err := newMemFd("test", 0).addSeals(_F_SEAL_WRITE); err != syscall.EPERM {
+		t.Fatalf("expect EPERM, got %v", err)
+	}
+}
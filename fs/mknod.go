@@ -0,0 +1,285 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/fs/devfs"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/spf13/afero"
+)
+
+var (
+	charMutex   sync.Mutex
+	charDevices = make(map[uint64]func() io.ReadWriteCloser)
+)
+
+func mkdev(major, minor uint32) uint64 {
+	return uint64(major)<<32 | uint64(minor)
+}
+
+// decodeDev splits the dev_t passed to mknod, the same as new_decode_dev
+// of linux.
+func decodeDev(dev uint32) (major, minor uint32) {
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
+
+// RegisterCharDevice makes the character device major:minor available to
+// mknod, factory is called on creating every device node.
+func RegisterCharDevice(major, minor uint32, factory func() io.ReadWriteCloser) {
+	charMutex.Lock()
+	defer charMutex.Unlock()
+	charDevices[mkdev(major, minor)] = factory
+}
+
+func lookupCharDevice(major, minor uint32) func() io.ReadWriteCloser {
+	charMutex.Lock()
+	defer charMutex.Unlock()
+	return charDevices[mkdev(major, minor)]
+}
+
+// fifo is a named pipe, all the opens share the same pipe
+type fifo struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func newFifo() *fifo {
+	r, w := io.Pipe()
+	return &fifo{r: r, w: w}
+}
+
+func (f *fifo) Read(p []byte) (int, error)  { return f.r.Read(p) }
+func (f *fifo) Write(p []byte) (int, error) { return f.w.Write(p) }
+
+// devfsOf returns the devfs and the name in it where name locates, ok is
+// false if name is on another fs.
+func devfsOf(name string) (*devfs.Devfs, string, bool) {
+	target := Root.MountPath(name)
+	for _, m := range Root.Mounts() {
+		if m.Path != target {
+			continue
+		}
+		d, ok := m.Fs.(*devfs.Devfs)
+		if !ok {
+			return nil, "", false
+		}
+		rel := name[len(target):]
+		return d, rel, true
+	}
+	return nil, "", false
+}
+
+// specialNode is a device node or fifo created on an ordinary fs. The fs
+// only holds an empty regular file, the node itself is kept here.
+type specialNode struct {
+	dev  io.ReadWriter
+	mode os.FileMode
+}
+
+var (
+	nodeMutex sync.Mutex
+	nodes     = make(map[string]*specialNode)
+)
+
+func lookupNode(name string) *specialNode {
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	return nodes[path.Clean("/"+name)]
+}
+
+func removeNode(name string) {
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	delete(nodes, path.Clean("/"+name))
+}
+
+func renameNode(oldname, newname string) {
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	oldname, newname = path.Clean("/"+oldname), path.Clean("/"+newname)
+	delete(nodes, newname)
+	if n, ok := nodes[oldname]; ok {
+		delete(nodes, oldname)
+		nodes[newname] = n
+	}
+}
+
+// removeNodes drops the nodes under the mount point target
+func removeNodes(target string) {
+	prefix := strings.TrimSuffix(target, "/") + "/"
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	for name := range nodes {
+		if strings.HasPrefix(name, prefix) {
+			delete(nodes, name)
+		}
+	}
+}
+
+// nodeFile is an opened special node, the data goes to the device and the
+// rest to the placeholder file.
+type nodeFile struct {
+	afero.File
+	node *specialNode
+	dev  io.ReadWriter
+	// closer is the instance opened by Opener for this file only
+	closer io.Closer
+}
+
+func (f *nodeFile) Read(p []byte) (int, error)               { return f.dev.Read(p) }
+func (f *nodeFile) Write(p []byte) (int, error)              { return f.dev.Write(p) }
+func (f *nodeFile) ReadAt(p []byte, off int64) (int, error)  { return f.dev.Read(p) }
+func (f *nodeFile) WriteAt(p []byte, off int64) (int, error) { return f.dev.Write(p) }
+func (f *nodeFile) WriteString(s string) (int, error)        { return f.dev.Write([]byte(s)) }
+
+func (f *nodeFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (f *nodeFile) Truncate(size int64) error                    { return nil }
+
+func (f *nodeFile) Ioctl(op, arg uintptr) error {
+	ctl, ok := f.dev.(Ioctler)
+	if !ok {
+		return syscall.ENOTTY
+	}
+	return ctl.Ioctl(op, arg)
+}
+
+func (f *nodeFile) ReadNonBlock(p []byte) (int, error) {
+	if nb, ok := f.dev.(NonBlockReader); ok {
+		return nb.ReadNonBlock(p)
+	}
+	return f.dev.Read(p)
+}
+
+func (f *nodeFile) Readable() bool {
+	r, ok := f.dev.(readable)
+	return ok && r.Readable()
+}
+
+func (f *nodeFile) Close() error {
+	err := f.File.Close()
+	if f.closer != nil {
+		if cerr := f.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (f *nodeFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &nodeInfo{FileInfo: info, mode: f.node.mode}, nil
+}
+
+type nodeInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (i *nodeInfo) Mode() os.FileMode { return i.mode }
+func (i *nodeInfo) Size() int64       { return 0 }
+
+// openFile opens name on Root, the special nodes are opened as nodeFile and
+// the hard links open the file they link to.
+func openFile(name string, flags int, perm os.FileMode) (afero.File, error) {
+	f, err := Root.OpenFile(resolveLink(name), flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	n := lookupNode(name)
+	if n == nil {
+		return f, nil
+	}
+	if o, ok := n.dev.(Opener); ok {
+		rw, err := o.Open(flags)
+		if err != nil {
+			f.Close()
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &nodeFile{File: f, node: n, dev: rw, closer: rw}, nil
+	}
+	return &nodeFile{File: f, node: n, dev: n.dev}, nil
+}
+
+// statFile is Root.Stat with the mode of special nodes filled and the hard
+// links resolved.
+func statFile(name string) (os.FileInfo, error) {
+	info, err := Root.Stat(resolveLink(name))
+	if err != nil {
+		return nil, err
+	}
+	if n := lookupNode(name); n != nil {
+		return &nodeInfo{FileInfo: info, mode: n.mode}, nil
+	}
+	return info, nil
+}
+
+func mknodat(name string, mode uint32, dev uint32) error {
+	name = path.Clean("/" + name)
+	if err := checkWritable(name); err != nil {
+		return err
+	}
+
+	perm := os.FileMode(mode & 0777)
+	var node io.ReadWriter
+	var nodeMode os.FileMode
+	switch mode & syscall.S_IFMT {
+	case 0, syscall.S_IFREG:
+		f, err := Root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+		if err != nil {
+			return fsErrno(err)
+		}
+		return f.Close()
+	case syscall.S_IFCHR:
+		factory := lookupCharDevice(decodeDev(dev))
+		if factory == nil {
+			return syscall.ENXIO
+		}
+		node = factory()
+		nodeMode = os.ModeDevice | os.ModeCharDevice | perm
+	case syscall.S_IFIFO:
+		node = newFifo()
+		nodeMode = os.ModeNamedPipe | perm
+	case syscall.S_IFBLK:
+		// no block layer yet
+		return syscall.EPERM
+	default:
+		return syscall.EINVAL
+	}
+
+	if d, rel, ok := devfsOf(name); ok {
+		return fsErrno(d.RegisterMode(rel, node, nodeMode))
+	}
+	// other fs only stores a placeholder file
+	f, err := Root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return fsErrno(err)
+	}
+	f.Close()
+	nodeMutex.Lock()
+	nodes[name] = &specialNode{dev: node, mode: nodeMode}
+	nodeMutex.Unlock()
+	return nil
+}
+
+// func mknod(path string, mode uint32, dev int)
+// func mknodat(dirfd int, path string, mode uint32, dev int)
+func sysMknodat(c *isyscall.Request) {
+	dirfd, pathptr, mode, dev := c.Args[0], c.Args[1], c.Args[2], c.Args[3]
+	if c.NO == syscall.SYS_MKNOD {
+		dirfd, pathptr, mode, dev = _AT_FDCWD, c.Args[0], c.Args[1], c.Args[2]
+	}
+	name, err := atPath(dirfd, pathptr)
+	if err == nil {
+		err = mknodat(name, uint32(mode), uint32(dev))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/mm"
+	"github.com/icexin/eggos/sys"
+)
+
+var (
+	mapMutex sync.Mutex
+	// fileMaps is the start and size of the file mappings
+	fileMaps = make(map[uintptr]uintptr)
+
+	// allocPages and freePages back the file mappings, replaced by tests
+	// running on host.
+	allocPages = mapAnon
+	freePages  = kernel.FreePages
+)
+
+func pageRoundUp(n uintptr) uintptr {
+	return (n + mm.PGSIZE - 1) &^ (mm.PGSIZE - 1)
+}
+
+// mapAnon maps zeroed pages by the anonymous mmap of kernel
+func mapAnon(size uintptr) (uintptr, error) {
+	va, _, errno := syscall.Syscall6(syscall.SYS_MMAP2, 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON, ^uintptr(0), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return va, nil
+}
+
+// mmapFile maps the file of fd, the content is copied at once, so that the
+// mapping is kept after closing fd. The pages beyond EOF are zero.
+func mmapFile(length, prot, flags uintptr, fd int, pgoff uintptr) (uintptr, error) {
+	if length == 0 || flags&syscall.MAP_FIXED != 0 {
+		return 0, syscall.EINVAL
+	}
+	switch flags & (syscall.MAP_SHARED | syscall.MAP_PRIVATE) {
+	case syscall.MAP_PRIVATE:
+	case syscall.MAP_SHARED:
+		// the writes can't go back to the file
+		if prot&syscall.PROT_WRITE != 0 {
+			return 0, syscall.ENODEV
+		}
+	default:
+		return 0, syscall.EINVAL
+	}
+	ni, err := GetInode(fd)
+	if err != nil {
+		return 0, err
+	}
+	file, flag, err := ni.file()
+	if err != nil {
+		return 0, err
+	}
+	r, ok := file.(io.ReaderAt)
+	if !ok {
+		return 0, syscall.ENODEV
+	}
+	if flag&syscall.O_ACCMODE == syscall.O_WRONLY {
+		return 0, syscall.EACCES
+	}
+
+	size := pageRoundUp(length)
+	va, err := allocPages(size)
+	if err != nil {
+		return 0, err
+	}
+	buf := sys.UnsafeBuffer(va, int(length))
+	off := int64(pgoff) * mm.PGSIZE
+	for len(buf) > 0 {
+		n, err := r.ReadAt(buf, off)
+		buf, off = buf[n:], off+int64(n)
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			freePages(va, size)
+			return 0, err
+		}
+	}
+
+	mapMutex.Lock()
+	fileMaps[va] = size
+	mapMutex.Unlock()
+	return va, nil
+}
+
+// munmapFile frees the pages of the file mappings in [addr, addr+length),
+// the other memory is left to kernel.
+func munmapFile(addr, length uintptr) error {
+	if addr&(mm.PGSIZE-1) != 0 || length == 0 {
+		return syscall.EINVAL
+	}
+	end := addr + pageRoundUp(length)
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	for va, size := range fileMaps {
+		start, stop := va, va+size
+		if stop <= addr || end <= start {
+			continue
+		}
+		if start < addr {
+			start = addr
+		}
+		if stop > end {
+			stop = end
+		}
+		freePages(start, stop-start)
+		delete(fileMaps, va)
+		// keep the parts not unmapped
+		if va < start {
+			fileMaps[va] = start - va
+		}
+		if stop < va+size {
+			fileMaps[stop] = va + size - stop
+		}
+	}
+	return nil
+}
+
+// func mmap2(addr uintptr, length uintptr, prot int, flags int, fd int, pgoff uintptr)
+func sysMmap(c *isyscall.Request) {
+	va, err := mmapFile(c.Args[1], c.Args[2], c.Args[3], int(int32(c.Args[4])), c.Args[5])
+	if err != nil {
+		c.Ret = isyscall.Errno(errnoFromErr(err))
+	} else {
+		c.Ret = va
+	}
+	c.Done()
+}
+
+// func munmap(addr uintptr, length uintptr)
+func sysMunmap(c *isyscall.Request) {
+	c.Ret = isyscall.Errno(errnoFromErr(munmapFile(c.Args[0], c.Args[1])))
+	c.Done()
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/icexin/eggos/sys"
+	"github.com/spf13/afero"
+)
+
+func TestMmapFile(t *testing.T) {
+	var freed uintptr
+	old := freePages
+	defer func() { freePages = old }()
+	freePages = func(va, size uintptr) {
+		freed += size
+		syscall.Syscall(syscall.SYS_MUNMAP, va, size, 0)
+	}
+
+	if err := Mount("/mnt/mmap", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/mmap")
+	content := make([]byte, 10<<20+100)
+	rand.Read(content)
+	afero.WriteFile(Root, "/mnt/mmap/data", content, 0644)
+
+	name := []byte("/mnt/mmap/data\x00")
+	fd, err := sysOpen(0, uintptr(unsafe.Pointer(&name[0])), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := uintptr(len(content) + 4000)
+	va, err := mmapFile(length, syscall.PROT_READ, syscall.MAP_PRIVATE, fd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mapping is kept after closing
+	ni, _ := GetInode(fd)
+	sysClose(ni)
+
+	mem := sys.UnsafeBuffer(va, int(length))
+	if sha256.Sum256(mem[:len(content)]) != sha256.Sum256(content) {
+		t.Fatal("checksum mismatch")
+	}
+	if !bytes.Equal(mem[len(content):], make([]byte, 4000)) {
+		t.Fatal("expect zeros beyond EOF")
+	}
+	if err := munmapFile(va, length); err != nil || freed != pageRoundUp(length) {
+		t.Fatalf("munmap freed %d, %v", freed, err)
+	}
+	if len(fileMaps) != 0 {
+		t.Fatalf("mappings left %v", fileMaps)
+	}
+
+	fd, _ = sysOpen(0, uintptr(unsafe.Pointer(&name[0])), syscall.O_RDONLY, 0)
+	ni, _ = GetInode(fd)
+	defer sysClose(ni)
+	// the offset is in pages
+	va, err = mmapFile(8192, syscall.PROT_READ, syscall.MAP_SHARED, fd, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sys.UnsafeBuffer(va, 8192), content[8192:16384]) {
+		t.Fatal("content mismatch at offset")
+	}
+	// unmap the first page only
+	munmapFile(va, 4096)
+	if fileMaps[va+4096] != 4096 {
+		t.Fatalf("bad mappings after partial munmap %v", fileMaps)
+	}
+	munmapFile(va+4096, 4096)
+
+	if _, err := mmapFile(4096, syscall.PROT_WRITE, syscall.MAP_SHARED, fd, 0); err != syscall.ENODEV {
+		t.Fatalf("expect ENODEV, got %v", err)
+	}
+	if _, err := mmapFile(0, syscall.PROT_READ, syscall.MAP_PRIVATE, fd, 0); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	if err := munmapFile(va+1, 4096); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	. "github.com/spf13/afero"
@@ -63,6 +64,12 @@ func NewMountableFs(base Fs) *MountableFs {
 // You must wrap an afero.OsFs in an afero.BasePathFs to mount it,
 // even if that's just to dispose of the Windows drive letter.
 func (m *MountableFs) Mount(path string, fs Fs) error {
+	return m.MountWithFlags(path, fs, 0)
+}
+
+// MountWithFlags mounts fs at path like Mount, the flags are kept with the
+// mount point, and can be queried by Flags.
+func (m *MountableFs) MountWithFlags(path string, fs Fs, flags int) error {
 	// No idea what to do with windows drive letters here, so force BasePathFs
 	if _, ok := fs.(*OsFs); ok {
 		return errOsFs
@@ -106,6 +113,7 @@ func (m *MountableFs) Mount(path string, fs Fs) error {
 	}
 
 	cur.fs = fs
+	cur.flags = flags
 	return nil
 }
 
@@ -123,19 +131,19 @@ func (m *MountableFs) Umount(path string) error {
 	if cur.fs == nil {
 		return &os.PathError{Err: errNotMounted, Op: "Umount", Path: path}
 	}
+	// Don't stuff around with the root node!
+	if cur.parent == nil {
+		return &os.PathError{Err: errRootMount, Op: "Umount", Path: path}
+	}
 
-	for cur != nil {
-		// Don't stuff around with the root node!
-		if cur.parent != nil {
-			cur.fs = nil
-			cur.parent.mountedNodes--
-			if len(cur.nodes) == 0 {
-				delete(cur.parent.nodes, cur.name)
-			}
-		}
+	cur.fs = nil
+	cur.flags = 0
+	cur.parent.mountedNodes--
+	// remove the nodes which have neither fs nor children
+	for cur.parent != nil && cur.fs == nil && len(cur.nodes) == 0 {
+		delete(cur.parent.nodes, cur.name)
 		cur = cur.parent
 	}
-
 	return nil
 }
 
@@ -146,7 +154,72 @@ func (m *MountableFs) Remount(path string, fs Fs) error {
 	return m.Mount(path, fs)
 }
 
+// SetFlags changes the flags of the mount point path
+func (m *MountableFs) SetFlags(path string, flags int) error {
+	node := m.node.findNode(path)
+	if node == nil || node.fs == nil {
+		return &os.PathError{Err: errNotMounted, Op: "SetFlags", Path: path}
+	}
+	node.flags = flags
+	return nil
+}
+
+// Flags returns the flags of the mount serving path
+func (m *MountableFs) Flags(path string) int {
+	return m.node.findMount(path).flags
+}
+
+// MountPoint describes a Fs mounted at Path
+type MountPoint struct {
+	Path  string
+	Fs    Fs
+	Flags int
+}
+
+// Mounts returns all the mount points sorted by path, the first one is
+// the root.
+func (m *MountableFs) Mounts() []MountPoint {
+	var out []MountPoint
+	var walk func(n *mountableNode)
+	walk = func(n *mountableNode) {
+		if n.fs != nil {
+			out = append(out, MountPoint{Path: n.fullName(), Fs: n.fs, Flags: n.flags})
+		}
+		for _, child := range n.nodes {
+			walk(child)
+		}
+	}
+	walk(m.node)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+// MountPath returns the mount point of the Fs serving path.
+func (m *MountableFs) MountPath(path string) string {
+	_, base, _ := m.node.findPath(path)
+	return base
+}
+
+// FindFs returns the Fs serving path.
+func (m *MountableFs) FindFs(path string) Fs {
+	fs, _, _ := m.node.findPath(path)
+	return fs
+}
+
+// checkWritable returns EROFS if path is served by a read-only mount
+func (m *MountableFs) checkWritable(op, path string) error {
+	if m.node.findMount(path).flags&syscall.MS_RDONLY != 0 {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EROFS}
+	}
+	return nil
+}
+
 func (m *MountableFs) Mkdir(name string, perm os.FileMode) error {
+	if err := m.checkWritable("Mkdir", name); err != nil {
+		return err
+	}
 	node := m.node.findNode(name)
 	if node != nil {
 		// if the path points to an intermediate node and the intermediate node
@@ -197,6 +270,11 @@ func (m *MountableFs) Open(name string) (File, error) {
 }
 
 func (m *MountableFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := m.checkWritable("OpenFile", name); err != nil {
+			return nil, err
+		}
+	}
 	fs, _, rel := m.node.findPath(name)
 
 	exists := true
@@ -254,11 +332,17 @@ func (m *MountableFs) OpenFile(name string, flag int, perm os.FileMode) (File, e
 }
 
 func (m *MountableFs) Remove(name string) error {
+	if err := m.checkWritable("Remove", name); err != nil {
+		return err
+	}
 	fs, _, rel := m.node.findPath(name)
 	return wrapErrorPath(name, fs.Remove(rel))
 }
 
 func (m *MountableFs) RemoveAll(path string) error {
+	if err := m.checkWritable("RemoveAll", path); err != nil {
+		return err
+	}
 	info, err := lstatIfPossible(m, path)
 	if err != nil {
 		return wrapErrorPath(path, err)
@@ -283,6 +367,12 @@ func (m *MountableFs) RemoveAll(path string) error {
 }
 
 func (m *MountableFs) Rename(oldname string, newname string) error {
+	if err := m.checkWritable("Rename", oldname); err != nil {
+		return err
+	}
+	if err := m.checkWritable("Rename", newname); err != nil {
+		return err
+	}
 	ofs, _, orel := m.node.findPath(oldname)
 	nfs, _, nrel := m.node.findPath(newname)
 
@@ -311,11 +401,17 @@ func (m *MountableFs) Name() string {
 }
 
 func (m *MountableFs) Chmod(name string, mode os.FileMode) error {
+	if err := m.checkWritable("Chmod", name); err != nil {
+		return err
+	}
 	fs, _, rel := m.node.findPath(name)
 	return wrapErrorPath(name, fs.Chmod(rel, mode))
 }
 
 func (m *MountableFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := m.checkWritable("Chtimes", name); err != nil {
+		return err
+	}
 	fs, _, rel := m.node.findPath(name)
 	ok, err := Exists(fs, rel)
 	if err != nil {
@@ -366,6 +462,7 @@ type mountableNode struct {
 	nodes        map[string]*mountableNode
 	name         string
 	mountedNodes int
+	flags        int
 	modTime      time.Time
 	depth        int
 }
@@ -406,6 +503,23 @@ func (n *mountableNode) findNode(path string) *mountableNode {
 	return cur
 }
 
+// findMount returns the node of the Fs serving path
+func (n *mountableNode) findMount(path string) *mountableNode {
+	out := n
+	cur := n
+	for _, p := range splitPath(path) {
+		next, ok := cur.nodes[p]
+		if !ok {
+			break
+		}
+		cur = next
+		if cur.fs != nil {
+			out = cur
+		}
+	}
+	return out
+}
+
 func (n *mountableNode) findPath(path string) (fs Fs, base, rel string) {
 	parts := splitPath(path)
 
@@ -597,6 +711,7 @@ var (
 	errShortCopy      = errors.New("short copy")
 	errAlreadyMounted = errors.New("already mounted")
 	errNotMounted     = errors.New("not mounted")
+	errRootMount      = errors.New("root can not be unmounted")
 	errNotAFile       = errors.New("not a file")
 	errOsFs           = errors.New("afero.OsFs should not be mounted - use afero.BasePathFs instead")
 )
@@ -614,6 +729,7 @@ func IsErrRecursiveMount(err error) bool { return underlyingError(err) == errRec
 func IsErrShortCopy(err error) bool      { return underlyingError(err) == errShortCopy }
 func IsErrAlreadyMounted(err error) bool { return underlyingError(err) == errAlreadyMounted }
 func IsErrNotMounted(err error) bool     { return underlyingError(err) == errNotMounted }
+func IsErrRootMount(err error) bool      { return underlyingError(err) == errRootMount }
 func IsErrNotAFile(err error) bool       { return underlyingError(err) == errNotAFile }
 func IsErrOsFs(err error) bool           { return underlyingError(err) == errOsFs }
 
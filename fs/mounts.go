@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	_MNT_FORCE       = 0x1
+	_MNT_DETACH      = 0x2
+	_MNT_EXPIRE      = 0x4
+	_UMOUNT_NOFOLLOW = 0x8
+)
+
+// MountInfo describes a mount point of Root
+type MountInfo struct {
+	Path string
+	// Type is the name of the mounted fs
+	Type  string
+	Flags int
+}
+
+// MountWithFlags mounts fs at target, flags is the combination of
+// syscall.MS_* flags, only MS_RDONLY is supported now.
+func MountWithFlags(target string, fs afero.Fs, flags int) error {
+	if flags&^syscall.MS_RDONLY != 0 {
+		return syscall.EINVAL
+	}
+	return Root.MountWithFlags(target, fs, flags)
+}
+
+// Remount changes the flags of the mount point target. It returns EBUSY on
+// making a mount read-only while files are opened for writing on it.
+func Remount(target string, flags int) error {
+	if flags&^syscall.MS_RDONLY != 0 {
+		return syscall.EINVAL
+	}
+	target = path.Clean("/" + target)
+	if Root.MountPath(target) != target {
+		return syscall.EINVAL
+	}
+
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	if flags&syscall.MS_RDONLY != 0 {
+		for _, ni := range inodes {
+			if ni != nil && ni.mount == target && ni.canWrite() {
+				return syscall.EBUSY
+			}
+		}
+	}
+	if err := Root.SetFlags(target, flags); err != nil {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// checkWritable returns EROFS if name is on a read-only mount
+func checkWritable(name string) error {
+	if Root.Flags(name)&syscall.MS_RDONLY != 0 {
+		return syscall.EROFS
+	}
+	return nil
+}
+
+// Mounts returns the mount points of Root sorted by path, the first one is
+// the root.
+func Mounts() []MountInfo {
+	mounts := Root.Mounts()
+	ret := make([]MountInfo, 0, len(mounts))
+	for _, m := range mounts {
+		ret = append(ret, MountInfo{
+			Path:  m.Path,
+			Type:  m.Fs.Name(),
+			Flags: m.Flags,
+		})
+	}
+	return ret
+}
+
+// Umount unmounts the fs mounted at target. It returns EINVAL if target is
+// not a mount point, and EBUSY if target is the root, has nested mounts or
+// has files opened.
+func Umount(target string) error {
+	target = path.Clean("/" + target)
+	if target == "/" {
+		return syscall.EBUSY
+	}
+
+	found, nested := false, false
+	for _, m := range Root.Mounts() {
+		switch {
+		case m.Path == target:
+			found = true
+		case strings.HasPrefix(m.Path, target+"/"):
+			nested = true
+		}
+	}
+	if !found {
+		return syscall.EINVAL
+	}
+	if nested {
+		return syscall.EBUSY
+	}
+
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	for _, ni := range inodes {
+		if ni != nil && ni.mount == target {
+			return syscall.EBUSY
+		}
+	}
+	if err := Root.Umount(target); err != nil {
+		return err
+	}
+	removeNodes(target)
+	removeLinks(target)
+	removeOwners(target)
+	return nil
+}
+
+// func umount2(target string, flags int)
+func sysUmount2(c *isyscall.Request) {
+	flags := c.Args[1]
+	if flags&^(_MNT_FORCE|_MNT_DETACH|_MNT_EXPIRE|_UMOUNT_NOFOLLOW) != 0 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+	err := Umount(cstring(c.Args[0]))
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+	} else {
+		c.Ret = 0
+	}
+	c.Done()
+}
@@ -0,0 +1,378 @@
+package ninep
+
+import (
+	"sync"
+	"syscall"
+)
+
+// Transport carries the 9P messages, such as the virtio-9p device.
+type Transport interface {
+	// RoundTrip sends the request in tx and receives the response into rx,
+	// it returns the length of response.
+	RoundTrip(tx, rx []byte) (int, error)
+	// Msize returns the max message size supported by transport
+	Msize() uint32
+}
+
+// client makes the 9P calls one by one
+type client struct {
+	mutex sync.Mutex
+	t     Transport
+	msize uint32
+	tx    []byte
+	rx    []byte
+
+	fidMutex sync.Mutex
+	nextFid  uint32
+	freeFids []uint32
+}
+
+func newClient(t Transport) (*client, error) {
+	c := &client{
+		t:       t,
+		msize:   t.Msize(),
+		nextFid: 1,
+	}
+	c.tx = make([]byte, c.msize)
+	c.rx = make([]byte, c.msize)
+	if err := c.version(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client) allocFid() uint32 {
+	c.fidMutex.Lock()
+	defer c.fidMutex.Unlock()
+	if n := len(c.freeFids); n != 0 {
+		fid := c.freeFids[n-1]
+		c.freeFids = c.freeFids[:n-1]
+		return fid
+	}
+	fid := c.nextFid
+	c.nextFid++
+	return fid
+}
+
+func (c *client) freeFid(fid uint32) {
+	c.fidMutex.Lock()
+	defer c.fidMutex.Unlock()
+	c.freeFids = append(c.freeFids, fid)
+}
+
+// rpc sends the request built by enc, and calls dec with the response
+// body. Rlerror is converted to syscall.Errno.
+func (c *client) rpc(typ uint8, enc func(e *encoder), dec func(d *decoder)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tag := uint16(0)
+	if typ == tversion {
+		tag = notag
+	}
+	e := newEncoder(c.tx, typ, tag)
+	enc(e)
+	if len(e.buf) > int(c.msize) {
+		return syscall.EMSGSIZE
+	}
+	n, err := c.t.RoundTrip(e.finish(), c.rx)
+	if err != nil {
+		return err
+	}
+	d := &decoder{buf: c.rx[:n]}
+	size := d.u32()
+	rtyp := d.u8()
+	rtag := d.u16()
+	if d.err != nil || size != uint32(n) || rtag != tag {
+		return errMessage
+	}
+	switch rtyp {
+	case rlerror:
+		return syscall.Errno(d.u32())
+	case typ + 1:
+	default:
+		return errMessage
+	}
+	if dec != nil {
+		dec(d)
+	}
+	return d.err
+}
+
+func (c *client) version() error {
+	var msize uint32
+	var ver string
+	err := c.rpc(tversion, func(e *encoder) {
+		e.u32(c.msize)
+		e.str(version)
+	}, func(d *decoder) {
+		msize = d.u32()
+		ver = d.str()
+	})
+	if err != nil {
+		return err
+	}
+	if ver != version {
+		return syscall.EPROTONOSUPPORT
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	if c.msize <= ioHeaderSize {
+		return errMessage
+	}
+	return nil
+}
+
+func (c *client) attach(fid uint32, aname string) error {
+	return c.rpc(tattach, func(e *encoder) {
+		e.u32(fid)
+		e.u32(nofid)
+		e.str("root")
+		e.str(aname)
+		e.u32(0)
+	}, func(d *decoder) {
+		d.qid()
+	})
+}
+
+// walk clones fid to newfid, and walks newfid along names.
+func (c *client) walk(fid, newfid uint32, names []string) error {
+	for {
+		n := len(names)
+		if n > maxWalk {
+			n = maxWalk
+		}
+		var nqid uint16
+		err := c.rpc(twalk, func(e *encoder) {
+			e.u32(fid)
+			e.u32(newfid)
+			e.u16(uint16(n))
+			for _, name := range names[:n] {
+				e.str(name)
+			}
+		}, func(d *decoder) {
+			nqid = d.u16()
+			for i := 0; i < int(nqid); i++ {
+				d.qid()
+			}
+		})
+		if err != nil {
+			if fid == newfid {
+				c.clunk(newfid)
+			}
+			return err
+		}
+		if int(nqid) != n {
+			// newfid is not created if the walk stops at the middle
+			if fid == newfid {
+				c.clunk(newfid)
+			}
+			return syscall.ENOENT
+		}
+		names = names[n:]
+		if len(names) == 0 {
+			return nil
+		}
+		fid = newfid
+	}
+}
+
+func (c *client) clunk(fid uint32) error {
+	return c.rpc(tclunk, func(e *encoder) {
+		e.u32(fid)
+	}, nil)
+}
+
+func (c *client) lopen(fid uint32, flags uint32) (iounit uint32, err error) {
+	err = c.rpc(tlopen, func(e *encoder) {
+		e.u32(fid)
+		e.u32(flags)
+	}, func(d *decoder) {
+		d.qid()
+		iounit = d.u32()
+	})
+	return
+}
+
+func (c *client) lcreate(fid uint32, name string, flags, mode uint32) (iounit uint32, err error) {
+	err = c.rpc(tlcreate, func(e *encoder) {
+		e.u32(fid)
+		e.str(name)
+		e.u32(flags)
+		e.u32(mode)
+		e.u32(0)
+	}, func(d *decoder) {
+		d.qid()
+		iounit = d.u32()
+	})
+	return
+}
+
+func (c *client) getattr(fid uint32) (*attr, error) {
+	a := new(attr)
+	err := c.rpc(tgetattr, func(e *encoder) {
+		e.u32(fid)
+		e.u64(getattrBasic)
+	}, func(d *decoder) {
+		d.u64() // valid
+		a.qid = d.qid()
+		a.mode = d.u32()
+		d.u32() // uid
+		d.u32() // gid
+		d.u64() // nlink
+		d.u64() // rdev
+		a.size = d.u64()
+		d.u64() // blksize
+		d.u64() // blocks
+		d.u64() // atime
+		d.u64()
+		a.mtime = int64(d.u64())
+		a.mnsec = int64(d.u64())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+type setattr struct {
+	valid uint32
+	mode  uint32
+	size  uint64
+	atime int64
+	ansec int64
+	mtime int64
+	mnsec int64
+}
+
+func (c *client) setattr(fid uint32, s *setattr) error {
+	return c.rpc(tsetattr, func(e *encoder) {
+		e.u32(fid)
+		e.u32(s.valid)
+		e.u32(s.mode)
+		e.u32(0) // uid
+		e.u32(0) // gid
+		e.u64(s.size)
+		e.u64(uint64(s.atime))
+		e.u64(uint64(s.ansec))
+		e.u64(uint64(s.mtime))
+		e.u64(uint64(s.mnsec))
+	}, nil)
+}
+
+// maxIO returns the max count of Tread and Twrite
+func (c *client) maxIO(iounit uint32) int {
+	n := c.msize - ioHeaderSize
+	if iounit != 0 && iounit < n {
+		n = iounit
+	}
+	return int(n)
+}
+
+// read reads at most one Rread into p
+func (c *client) read(fid uint32, iounit uint32, p []byte, off int64) (int, error) {
+	if max := c.maxIO(iounit); len(p) > max {
+		p = p[:max]
+	}
+	var n int
+	err := c.rpc(tread, func(e *encoder) {
+		e.u32(fid)
+		e.u64(uint64(off))
+		e.u32(uint32(len(p)))
+	}, func(d *decoder) {
+		cnt := d.u32()
+		n = copy(p, d.next(int(cnt)))
+	})
+	return n, err
+}
+
+// write splits p into multiple Twrites
+func (c *client) write(fid uint32, iounit uint32, p []byte, off int64) (int, error) {
+	max := c.maxIO(iounit)
+	var total int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		var n uint32
+		err := c.rpc(twrite, func(e *encoder) {
+			e.u32(fid)
+			e.u64(uint64(off))
+			e.bytes(chunk)
+		}, func(d *decoder) {
+			n = d.u32()
+		})
+		total += int(n)
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, syscall.EIO
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return total, nil
+}
+
+// readdir reads one page of directory entries at offset
+func (c *client) readdir(fid uint32, iounit uint32, offset uint64) ([]dirent, error) {
+	var ents []dirent
+	err := c.rpc(treaddir, func(e *encoder) {
+		e.u32(fid)
+		e.u64(offset)
+		e.u32(uint32(c.maxIO(iounit)))
+	}, func(d *decoder) {
+		cnt := d.u32()
+		data := &decoder{buf: d.next(int(cnt))}
+		for len(data.buf) > 0 && data.err == nil {
+			ents = append(ents, dirent{
+				qid:    data.qid(),
+				offset: data.u64(),
+				typ:    data.u8(),
+				name:   data.str(),
+			})
+		}
+		if data.err != nil {
+			d.err = data.err
+		}
+	})
+	return ents, err
+}
+
+func (c *client) fsync(fid uint32) error {
+	return c.rpc(tfsync, func(e *encoder) {
+		e.u32(fid)
+		e.u32(0)
+	}, nil)
+}
+
+func (c *client) mkdir(dfid uint32, name string, mode uint32) error {
+	return c.rpc(tmkdir, func(e *encoder) {
+		e.u32(dfid)
+		e.str(name)
+		e.u32(mode)
+		e.u32(0)
+	}, func(d *decoder) {
+		d.qid()
+	})
+}
+
+func (c *client) renameat(olddfid uint32, oldname string, newdfid uint32, newname string) error {
+	return c.rpc(trenameat, func(e *encoder) {
+		e.u32(olddfid)
+		e.str(oldname)
+		e.u32(newdfid)
+		e.str(newname)
+	}, nil)
+}
+
+func (c *client) unlinkat(dfid uint32, name string, flags uint32) error {
+	return c.rpc(tunlinkat, func(e *encoder) {
+		e.u32(dfid)
+		e.str(name)
+		e.u32(flags)
+	}, nil)
+}
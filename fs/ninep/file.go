@@ -0,0 +1,304 @@
+package ninep
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// file is an opened fid, the offset is maintained by client.
+type file struct {
+	fs     *Fs
+	fid    uint32
+	name   string
+	flag   int
+	iounit uint32
+	isDir  bool
+
+	mutex  sync.Mutex
+	offset int64
+	closed bool
+	// cookie of the next Treaddir and the entries not returned yet
+	dirOffset uint64
+	dirents   []dirent
+	dirEOF    bool
+}
+
+func newFile(fs *Fs, fid uint32, name string, flag int, iounit uint32, isDir bool) *file {
+	return &file{
+		fs:     fs,
+		fid:    fid,
+		name:   name,
+		flag:   flag,
+		iounit: iounit,
+		isDir:  isDir,
+	}
+}
+
+func (f *file) pathError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &os.PathError{Op: op, Path: f.name, Err: err}
+}
+
+func (f *file) check() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.isDir {
+		return syscall.EISDIR
+	}
+	return nil
+}
+
+func (f *file) read(p []byte, off int64) (int, error) {
+	var total int
+	for len(p) > 0 {
+		n, err := f.fs.c.read(f.fid, f.iounit, p, off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return total, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check(); err != nil {
+		return 0, f.pathError("read", err)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// a short read is fine for Read
+	n, err := f.fs.c.read(f.fid, f.iounit, p, f.offset)
+	f.offset += int64(n)
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	return n, f.pathError("read", err)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check(); err != nil {
+		return 0, f.pathError("read", err)
+	}
+	if off < 0 {
+		return 0, f.pathError("read", syscall.EINVAL)
+	}
+	n, err := f.read(p, off)
+	return n, f.pathError("read", err)
+}
+
+func (f *file) size() (int64, error) {
+	a, err := f.fs.c.getattr(f.fid)
+	if err != nil {
+		return 0, err
+	}
+	return int64(a.size), nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, f.pathError("seek", os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, f.pathError("seek", err)
+		}
+		offset += size
+	default:
+		return 0, f.pathError("seek", syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, f.pathError("seek", syscall.EINVAL)
+	}
+	if f.isDir {
+		// rewinddir
+		f.dirOffset = 0
+		f.dirents = nil
+		f.dirEOF = false
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check(); err != nil {
+		return 0, f.pathError("write", err)
+	}
+	if f.flag&os.O_APPEND != 0 {
+		size, err := f.size()
+		if err != nil {
+			return 0, f.pathError("write", err)
+		}
+		f.offset = size
+	}
+	n, err := f.fs.c.write(f.fid, f.iounit, p, f.offset)
+	f.offset += int64(n)
+	return n, f.pathError("write", err)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check(); err != nil {
+		return 0, f.pathError("write", err)
+	}
+	if off < 0 {
+		return 0, f.pathError("write", syscall.EINVAL)
+	}
+	n, err := f.fs.c.write(f.fid, f.iounit, p, off)
+	return n, f.pathError("write", err)
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Name() string { return f.name }
+
+// readdir returns at most n entries, all the remaining entries if n <= 0.
+// The pages of Rreaddir are fetched on demand.
+func (f *file) readdir(n int) ([]dirent, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	if !f.isDir {
+		return nil, syscall.ENOTDIR
+	}
+	var ret []dirent
+	for n <= 0 || len(ret) < n {
+		if len(f.dirents) == 0 {
+			if f.dirEOF {
+				break
+			}
+			ents, err := f.fs.c.readdir(f.fid, f.iounit, f.dirOffset)
+			if err != nil {
+				return ret, err
+			}
+			if len(ents) == 0 {
+				f.dirEOF = true
+				break
+			}
+			f.dirOffset = ents[len(ents)-1].offset
+			f.dirents = ents
+		}
+		ent := f.dirents[0]
+		f.dirents = f.dirents[1:]
+		if ent.name == "." || ent.name == ".." {
+			continue
+		}
+		ret = append(ret, ent)
+	}
+	if n > 0 && len(ret) == 0 {
+		return nil, io.EOF
+	}
+	return ret, nil
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ents, err := f.readdir(count)
+	if err != nil {
+		return nil, f.pathError("readdir", err)
+	}
+	infos := make([]os.FileInfo, 0, len(ents))
+	for _, ent := range ents {
+		info, err := f.fs.Stat(path.Join(f.name, ent.name))
+		if err != nil {
+			// removed after listing
+			if os.IsNotExist(err) {
+				continue
+			}
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ents, err := f.readdir(n)
+	if err != nil {
+		return nil, f.pathError("readdir", err)
+	}
+	names := make([]string, 0, len(ents))
+	for _, ent := range ents {
+		names = append(names, ent.name)
+	}
+	return names, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil, f.pathError("stat", os.ErrClosed)
+	}
+	a, err := f.fs.c.getattr(f.fid)
+	if err != nil {
+		return nil, f.pathError("stat", err)
+	}
+	return newFileInfo(path.Base(path.Clean("/"+f.name)), a), nil
+}
+
+func (f *file) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return f.pathError("sync", os.ErrClosed)
+	}
+	return f.pathError("sync", f.fs.c.fsync(f.fid))
+}
+
+func (f *file) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check(); err != nil {
+		return f.pathError("truncate", err)
+	}
+	if size < 0 {
+		return f.pathError("truncate", syscall.EINVAL)
+	}
+	return f.pathError("truncate", f.fs.c.setattr(f.fid, &setattr{
+		valid: setattrSize,
+		size:  uint64(size),
+	}))
+}
+
+func (f *file) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return f.pathError("close", os.ErrClosed)
+	}
+	f.closed = true
+	err := f.fs.c.clunk(f.fid)
+	f.fs.c.freeFid(f.fid)
+	return f.pathError("close", err)
+}
@@ -0,0 +1,322 @@
+// Package ninep implements a 9P2000.L client as an afero.Fs, it's used to
+// share a host directory with eggos under QEMU through virtio-9p.
+package ninep
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const rootFid = 0
+
+// Fs is the file tree attached by a 9P connection
+type Fs struct {
+	c *client
+}
+
+// New negotiates the protocol over t and attaches the file tree aname, an
+// empty aname attaches the default tree of server.
+func New(t Transport, aname string) (*Fs, error) {
+	c, err := newClient(t)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.attach(rootFid, aname); err != nil {
+		return nil, err
+	}
+	return &Fs{c: c}, nil
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// walk returns a new fid of name, the caller must clunk it.
+func (f *Fs) walk(name string) (uint32, error) {
+	fid := f.c.allocFid()
+	if err := f.c.walk(rootFid, fid, splitPath(name)); err != nil {
+		f.c.freeFid(fid)
+		return 0, err
+	}
+	return fid, nil
+}
+
+// walkParent returns a new fid of the parent of name and the base name.
+func (f *Fs) walkParent(name string) (uint32, string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return 0, "", syscall.EBUSY
+	}
+	fid := f.c.allocFid()
+	if err := f.c.walk(rootFid, fid, parts[:len(parts)-1]); err != nil {
+		f.c.freeFid(fid)
+		return 0, "", err
+	}
+	return fid, parts[len(parts)-1], nil
+}
+
+func (f *Fs) clunk(fid uint32) {
+	f.c.clunk(fid)
+	f.c.freeFid(fid)
+}
+
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Create creates a file in the filesystem, returning the file and an
+// error, if any happens.
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Mkdir creates a directory in the filesystem, return an error if any
+// happens.
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	dfid, base, err := f.walkParent(name)
+	if err == syscall.EBUSY {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	defer f.clunk(dfid)
+	return pathError("mkdir", name, f.c.mkdir(dfid, base, uint32(perm.Perm())))
+}
+
+// MkdirAll creates a directory path and all parents that does not exist
+// yet.
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	parts := splitPath(name)
+	for i := range parts {
+		p := "/" + strings.Join(parts[:i+1], "/")
+		err := f.Mkdir(p, perm)
+		if err == nil || !os.IsExist(err) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := f.Stat(p)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return pathError("mkdir", name, syscall.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+// Open opens a file, returning it or an error, if any happens.
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file using the given flags and the given mode.
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	// the position of file is maintained by client
+	lflags := uint32(flag) &^ uint32(os.O_CREATE|os.O_EXCL|os.O_APPEND|syscall.O_NOCTTY|syscall.O_CLOEXEC)
+
+	fid, err := f.walk(name)
+	switch {
+	case err == nil:
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			f.clunk(fid)
+			return nil, pathError("open", name, os.ErrExist)
+		}
+	case err == syscall.ENOENT && flag&os.O_CREATE != 0:
+		dfid, base, err := f.walkParent(name)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		// the fid of directory becomes the fid of new file
+		iounit, err := f.c.lcreate(dfid, base, lflags|uint32(flag&os.O_EXCL), uint32(perm.Perm()))
+		if err != nil {
+			f.clunk(dfid)
+			return nil, pathError("open", name, err)
+		}
+		return newFile(f, dfid, name, flag, iounit, false), nil
+	default:
+		return nil, pathError("open", name, err)
+	}
+
+	a, err := f.c.getattr(fid)
+	if err != nil {
+		f.clunk(fid)
+		return nil, pathError("open", name, err)
+	}
+	isDir := a.qid.typ&qtdir != 0
+	if isDir {
+		lflags |= syscall.O_DIRECTORY
+	}
+	iounit, err := f.c.lopen(fid, lflags)
+	if err != nil {
+		f.clunk(fid)
+		return nil, pathError("open", name, err)
+	}
+	return newFile(f, fid, name, flag, iounit, isDir), nil
+}
+
+// Remove removes a file identified by name, returning an error, if any
+// happens.
+func (f *Fs) Remove(name string) error {
+	dfid, base, err := f.walkParent(name)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	defer f.clunk(dfid)
+	err = f.c.unlinkat(dfid, base, 0)
+	if err == syscall.EISDIR {
+		err = f.c.unlinkat(dfid, base, atRemoveDir)
+	}
+	return pathError("remove", name, err)
+}
+
+// RemoveAll removes a directory path and any children it contains. It
+// does not fail if the path does not exist (return nil).
+func (f *Fs) RemoveAll(name string) error {
+	info, err := f.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		dir, err := f.Open(name)
+		if err != nil {
+			return err
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err = f.RemoveAll(path.Join(name, n)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(splitPath(name)) == 0 {
+		return nil
+	}
+	return f.Remove(name)
+}
+
+// Rename renames a file.
+func (f *Fs) Rename(oldname, newname string) error {
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	ofid, obase, err := f.walkParent(oldname)
+	if err != nil {
+		return linkError(err)
+	}
+	defer f.clunk(ofid)
+	nfid, nbase, err := f.walkParent(newname)
+	if err != nil {
+		return linkError(err)
+	}
+	defer f.clunk(nfid)
+	if err = f.c.renameat(ofid, obase, nfid, nbase); err != nil {
+		return linkError(err)
+	}
+	return nil
+}
+
+// Stat returns a FileInfo describing the named file, or an error, if any
+// happens.
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	fid, err := f.walk(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	defer f.clunk(fid)
+	a, err := f.c.getattr(fid)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return newFileInfo(path.Base(path.Clean("/"+name)), a), nil
+}
+
+// The name of this FileSystem
+func (f *Fs) Name() string {
+	return "9p"
+}
+
+func (f *Fs) setattr(op, name string, s *setattr) error {
+	fid, err := f.walk(name)
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	defer f.clunk(fid)
+	return pathError(op, name, f.c.setattr(fid, s))
+}
+
+// Chmod changes the mode of the named file to mode.
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	return f.setattr("chmod", name, &setattr{
+		valid: setattrMode,
+		mode:  uint32(mode.Perm()),
+	})
+}
+
+// Chtimes changes the access and modification times of the named file
+func (f *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return f.setattr("chtimes", name, &setattr{
+		valid: setattrAtime | setattrAtimeSet | setattrMtime | setattrMtimeSet,
+		atime: atime.Unix(),
+		ansec: int64(atime.Nanosecond()),
+		mtime: mtime.Unix(),
+		mnsec: int64(mtime.Nanosecond()),
+	})
+}
+
+type fileInfo struct {
+	name string
+	attr *attr
+}
+
+func newFileInfo(name string, a *attr) *fileInfo {
+	return &fileInfo{name: name, attr: a}
+}
+
+func (f *fileInfo) Name() string { return f.name }
+func (f *fileInfo) Size() int64  { return int64(f.attr.size) }
+
+func (f *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(f.attr.mode & 0777)
+	switch f.attr.mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	return mode
+}
+
+func (f *fileInfo) ModTime() time.Time { return time.Unix(f.attr.mtime, f.attr.mnsec) }
+func (f *fileInfo) IsDir() bool        { return f.attr.mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (f *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,343 @@
+package ninep
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// server is a minimal 9P2000.L server over afero.Fs
+type server struct {
+	fs    afero.Fs
+	msize uint32
+	fids  map[uint32]string
+	files map[uint32]afero.File
+	// the max size of message seen
+	maxMsg int
+}
+
+func newServer(msize uint32) *server {
+	return &server{
+		fs:    afero.NewMemMapFs(),
+		msize: msize,
+		fids:  make(map[uint32]string),
+		files: make(map[uint32]afero.File),
+	}
+}
+
+func (s *server) Msize() uint32 {
+	return s.msize
+}
+
+func toErrno(err error) syscall.Errno {
+	switch {
+	case os.IsNotExist(err):
+		return syscall.ENOENT
+	case os.IsExist(err):
+		return syscall.EEXIST
+	}
+	return syscall.EIO
+}
+
+func (s *server) qid(name string) (qid, bool) {
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return qid{}, false
+	}
+	q := qid{}
+	if info.IsDir() {
+		q.typ = qtdir
+	}
+	return q, true
+}
+
+func (s *server) RoundTrip(tx, rx []byte) (int, error) {
+	if len(tx) > s.maxMsg {
+		s.maxMsg = len(tx)
+	}
+	d := &decoder{buf: tx}
+	d.u32()
+	typ := d.u8()
+	tag := d.u16()
+	e := newEncoder(rx, typ+1, tag)
+	if errno := s.handle(typ, d, e); errno != 0 {
+		e = newEncoder(rx, rlerror, tag)
+		e.u32(uint32(errno))
+	}
+	if len(e.buf) > len(rx) {
+		panic("response exceeds msize")
+	}
+	if len(e.buf) > s.maxMsg {
+		s.maxMsg = len(e.buf)
+	}
+	return len(e.finish()), nil
+}
+
+func (s *server) handle(typ uint8, d *decoder, e *encoder) syscall.Errno {
+	switch typ {
+	case tversion:
+		d.u32()
+		e.u32(s.msize)
+		e.str(d.str())
+	case tattach:
+		s.fids[d.u32()] = "/"
+		e.encodeQid(qid{typ: qtdir})
+	case twalk:
+		fid, newfid := d.u32(), d.u32()
+		name := s.fids[fid]
+		n := d.u16()
+		var qids []qid
+		for i := 0; i < int(n); i++ {
+			next := path.Join(name, d.str())
+			q, ok := s.qid(next)
+			if !ok {
+				break
+			}
+			name = next
+			qids = append(qids, q)
+		}
+		if n != 0 && len(qids) == 0 {
+			return syscall.ENOENT
+		}
+		if len(qids) == int(n) {
+			s.fids[newfid] = name
+		}
+		e.u16(uint16(len(qids)))
+		for _, q := range qids {
+			e.encodeQid(q)
+		}
+	case tlopen:
+		fid, flags := d.u32(), d.u32()
+		f, err := s.fs.OpenFile(s.fids[fid], int(flags)&^syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return toErrno(err)
+		}
+		s.files[fid] = f
+		q, _ := s.qid(s.fids[fid])
+		e.encodeQid(q)
+		e.u32(0)
+	case tlcreate:
+		fid := d.u32()
+		name := path.Join(s.fids[fid], d.str())
+		flags, mode := d.u32(), d.u32()
+		f, err := s.fs.OpenFile(name, int(flags)|os.O_CREATE, os.FileMode(mode))
+		if err != nil {
+			return toErrno(err)
+		}
+		s.fids[fid] = name
+		s.files[fid] = f
+		e.encodeQid(qid{})
+		e.u32(0)
+	case tgetattr:
+		info, err := s.fs.Stat(s.fids[d.u32()])
+		if err != nil {
+			return toErrno(err)
+		}
+		mode := uint32(info.Mode().Perm()) | syscall.S_IFREG
+		q := qid{}
+		if info.IsDir() {
+			mode = uint32(info.Mode().Perm()) | syscall.S_IFDIR
+			q.typ = qtdir
+		}
+		e.u64(getattrBasic)
+		e.encodeQid(q)
+		e.u32(mode)
+		// uid, gid, nlink, rdev
+		e.u32(0)
+		e.u32(0)
+		e.u64(0)
+		e.u64(0)
+		e.u64(uint64(info.Size()))
+		for i := 0; i < 4; i++ {
+			e.u64(0)
+		}
+		e.u64(uint64(info.ModTime().Unix()))
+		e.u64(uint64(info.ModTime().Nanosecond()))
+		for i := 0; i < 6; i++ {
+			e.u64(0)
+		}
+	case tsetattr:
+		name := s.fids[d.u32()]
+		valid, mode := d.u32(), d.u32()
+		d.u32()
+		d.u32()
+		size := d.u64()
+		if valid&setattrMode != 0 {
+			s.fs.Chmod(name, os.FileMode(mode))
+		}
+		if valid&setattrSize != 0 {
+			f, err := s.fs.OpenFile(name, os.O_WRONLY, 0)
+			if err != nil {
+				return toErrno(err)
+			}
+			f.Truncate(int64(size))
+			f.Close()
+		}
+	case treaddir:
+		fid := d.u32()
+		offset, count := d.u64(), d.u32()
+		names, err := afero.ReadDir(s.fs, s.fids[fid])
+		if err != nil {
+			return toErrno(err)
+		}
+		all := []string{".", ".."}
+		for _, info := range names {
+			all = append(all, info.Name())
+		}
+		sort.Strings(all[2:])
+		data := &encoder{}
+		for i := int(offset); i < len(all); i++ {
+			ent := &encoder{}
+			ent.encodeQid(qid{})
+			ent.u64(uint64(i + 1))
+			ent.u8(0)
+			ent.str(all[i])
+			if len(data.buf)+len(ent.buf) > int(count) {
+				break
+			}
+			data.buf = append(data.buf, ent.buf...)
+		}
+		e.bytes(data.buf)
+	case tread:
+		fid := d.u32()
+		off, count := d.u64(), d.u32()
+		if count > s.msize-ioHeaderSize {
+			panic("read count exceeds msize")
+		}
+		buf := make([]byte, count)
+		n, _ := s.files[fid].ReadAt(buf, int64(off))
+		e.bytes(buf[:n])
+	case twrite:
+		fid := d.u32()
+		off := d.u64()
+		data := d.next(int(d.u32()))
+		n, err := s.files[fid].WriteAt(data, int64(off))
+		if err != nil {
+			return toErrno(err)
+		}
+		e.u32(uint32(n))
+	case tclunk:
+		fid := d.u32()
+		if f, ok := s.files[fid]; ok {
+			f.Close()
+		}
+		delete(s.files, fid)
+		delete(s.fids, fid)
+	case tfsync:
+	case tmkdir:
+		name := path.Join(s.fids[d.u32()], d.str())
+		if err := s.fs.Mkdir(name, os.FileMode(d.u32())); err != nil {
+			return toErrno(err)
+		}
+		e.encodeQid(qid{typ: qtdir})
+	case trenameat:
+		old := path.Join(s.fids[d.u32()], d.str())
+		dir := s.fids[d.u32()]
+		if err := s.fs.Rename(old, path.Join(dir, d.str())); err != nil {
+			return toErrno(err)
+		}
+	case tunlinkat:
+		name := path.Join(s.fids[d.u32()], d.str())
+		flags := d.u32()
+		info, err := s.fs.Stat(name)
+		if err != nil {
+			return toErrno(err)
+		}
+		if info.IsDir() && flags&atRemoveDir == 0 {
+			return syscall.EISDIR
+		}
+		s.fs.Remove(name)
+	default:
+		return syscall.ENOSYS
+	}
+	return 0
+}
+
+func (e *encoder) encodeQid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := newServer(256)
+	fs, err := New(srv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.MkdirAll("/a/b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	f, err := fs.Create("/a/b/c/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Write(content); err != nil || n != len(content) {
+		t.Fatalf("write %d %v", n, err)
+	}
+	f.Close()
+
+	f, err = fs.Open("/a/b/c/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+	if srv.maxMsg > int(srv.msize) {
+		t.Fatalf("message size %d exceeds msize %d", srv.maxMsg, srv.msize)
+	}
+
+	// enough entries for multiple Rreaddir
+	for i := 0; i < 20; i++ {
+		f, err := fs.Create("/a/entry" + string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	dir, _ := fs.Open("/a")
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil || len(names) != 21 {
+		t.Fatalf("got %d names %v", len(names), err)
+	}
+	dir, _ = fs.Open("/a")
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil || len(infos) != 21 || !infos[0].IsDir() || infos[0].Name() != "b" {
+		t.Fatalf("bad readdir %v", err)
+	}
+
+	if _, err = fs.Stat("/a/missing"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if _, err = fs.OpenFile("/a/entrya", os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("expect exist, got %v", err)
+	}
+	if err = fs.Rename("/a/b/c/file", "/a/moved"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("/a/moved")
+	if err != nil || info.Size() != int64(len(content)) {
+		t.Fatalf("bad stat %v", err)
+	}
+	if err = fs.Remove("/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("/a/b/c"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if len(srv.files) != 0 || len(srv.fids) != 1 {
+		t.Fatalf("fid leaked, %d fids", len(srv.fids))
+	}
+}
@@ -0,0 +1,205 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// message types of 9P2000.L
+const (
+	tlerror   = 6
+	rlerror   = 7
+	tlopen    = 12
+	rlopen    = 13
+	tlcreate  = 14
+	rlcreate  = 15
+	tgetattr  = 24
+	rgetattr  = 25
+	tsetattr  = 26
+	rsetattr  = 27
+	treaddir  = 40
+	rreaddir  = 41
+	tfsync    = 50
+	rfsync    = 51
+	tmkdir    = 72
+	rmkdir    = 73
+	trenameat = 74
+	rrenameat = 75
+	tunlinkat = 76
+	runlinkat = 77
+	tversion  = 100
+	rversion  = 101
+	tattach   = 104
+	rattach   = 105
+	twalk     = 110
+	rwalk     = 111
+	tread     = 116
+	rread     = 117
+	twrite    = 118
+	rwrite    = 119
+	tclunk    = 120
+	rclunk    = 121
+)
+
+const (
+	version = "9P2000.L"
+
+	notag = 0xFFFF
+	nofid = 0xFFFFFFFF
+
+	// size[4] type[1] tag[2]
+	headerSize = 7
+	// the header of Tread and Rread, Twrite is the largest one
+	ioHeaderSize = headerSize + 4 + 8 + 4
+
+	// max number of names in one Twalk
+	maxWalk = 16
+
+	qtdir = 0x80
+
+	getattrBasic = 0x7ff
+
+	setattrMode     = 0x1
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+
+	atRemoveDir = 0x200
+)
+
+var errMessage = errors.New("ninep: bad message")
+
+var le = binary.LittleEndian
+
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+type attr struct {
+	qid   qid
+	mode  uint32
+	size  uint64
+	mtime int64
+	mnsec int64
+}
+
+type dirent struct {
+	qid    qid
+	offset uint64
+	typ    uint8
+	name   string
+}
+
+// encoder builds a T-message in buf
+type encoder struct {
+	buf []byte
+}
+
+func newEncoder(buf []byte, typ uint8, tag uint16) *encoder {
+	e := &encoder{buf: buf[:0]}
+	e.u32(0)
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.u32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// finish fills the size of message
+func (e *encoder) finish() []byte {
+	le.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// decoder parses a R-message, the first error sticks
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errMessage
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) u16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return le.Uint16(b)
+}
+
+func (d *decoder) u32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return le.Uint32(b)
+}
+
+func (d *decoder) u64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return le.Uint64(b)
+}
+
+func (d *decoder) str() string {
+	n := d.u16()
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) qid() qid {
+	return qid{
+		typ:     d.u8(),
+		version: d.u32(),
+		path:    d.u64(),
+	}
+}
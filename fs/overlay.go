@@ -0,0 +1,485 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// whiteoutPrefix prefixes the name of whiteout in upper layer, a whiteout
+// hides the lower entry of the same name and everything under it.
+const whiteoutPrefix = ".wh."
+
+// OverlayFs layers a writable upper fs on top of a read-only lower fs.
+// Lookups try the upper layer first, the files of lower layer are copied
+// up on the first write. Removing a lower entry leaves a whiteout in the
+// upper layer.
+type OverlayFs struct {
+	lower afero.Fs
+	upper afero.Fs
+}
+
+// NewOverlayFs returns an OverlayFs of lower and upper
+func NewOverlayFs(lower, upper afero.Fs) afero.Fs {
+	return &OverlayFs{
+		lower: lower,
+		upper: upper,
+	}
+}
+
+// MountOverlay mounts the overlay of lower and upper at target
+func MountOverlay(target string, lower, upper afero.Fs) error {
+	return Mount(target, NewOverlayFs(lower, upper))
+}
+
+func exists(fs afero.Fs, name string) (os.FileInfo, bool, error) {
+	info, err := fs.Stat(name)
+	if err == nil {
+		return info, true, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return nil, false, err
+}
+
+func whiteoutName(name string) string {
+	dir, base := filepath.Split(filepath.Clean(name))
+	return filepath.Join(dir, whiteoutPrefix+base)
+}
+
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), whiteoutPrefix)
+}
+
+// whited reports whether name or any of its parents has a whiteout
+func (o *OverlayFs) whited(name string) (bool, error) {
+	for name = filepath.Clean(name); name != filepath.Dir(name); name = filepath.Dir(name) {
+		_, ok, err := exists(o.upper, whiteoutName(name))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// lowerStat stats name in the lower layer, the whiteouts are respected
+func (o *OverlayFs) lowerStat(name string) (os.FileInfo, bool, error) {
+	if isWhiteout(name) {
+		return nil, false, nil
+	}
+	whited, err := o.whited(name)
+	if err != nil || whited {
+		return nil, false, err
+	}
+	return exists(o.lower, name)
+}
+
+// whiteout hides the lower entry name
+func (o *OverlayFs) whiteout(name string) error {
+	if err := o.copyUpDir(filepath.Dir(filepath.Clean(name))); err != nil {
+		return err
+	}
+	f, err := o.upper.OpenFile(whiteoutName(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyUpDir makes sure the directory name exists in upper layer, the
+// missing directories are created with the mode of lower layer.
+func (o *OverlayFs) copyUpDir(name string) error {
+	name = filepath.Clean(name)
+	info, ok, err := exists(o.upper, name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if !info.IsDir() {
+			return syscall.ENOTDIR
+		}
+		return nil
+	}
+	linfo, ok, err := o.lowerStat(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !linfo.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err = o.copyUpDir(parent); err != nil {
+			return err
+		}
+	}
+	if err = o.upper.Mkdir(name, linfo.Mode().Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return o.upper.Chtimes(name, linfo.ModTime(), linfo.ModTime())
+}
+
+// copyUp copies the file name from lower layer to upper layer if it's not
+// in the upper layer yet.
+func (o *OverlayFs) copyUp(name string) error {
+	_, ok, err := exists(o.upper, name)
+	if err != nil || ok {
+		return err
+	}
+	info, err := o.lower.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return o.copyUpDir(name)
+	}
+	if err = o.copyUpDir(filepath.Dir(filepath.Clean(name))); err != nil {
+		return err
+	}
+
+	src, err := o.lower.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := o.upper.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		o.upper.Remove(name)
+		return err
+	}
+	return o.upper.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// inLower reports whether name exists in the lower layer and not whited
+// out.
+func (o *OverlayFs) inLower(name string) (bool, error) {
+	_, ok, err := o.lowerStat(name)
+	return ok, err
+}
+
+func (o *OverlayFs) Create(name string) (afero.File, error) {
+	return o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (o *OverlayFs) Mkdir(name string, perm os.FileMode) error {
+	if _, err := o.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := o.copyUpDir(filepath.Dir(filepath.Clean(name))); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return o.upper.Mkdir(name, perm)
+}
+
+func (o *OverlayFs) MkdirAll(path string, perm os.FileMode) error {
+	info, err := o.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	path = filepath.Clean(path)
+	if parent := filepath.Dir(path); parent != path {
+		if err = o.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	return o.Mkdir(path, perm)
+}
+
+func (o *OverlayFs) Open(name string) (afero.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *OverlayFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if isWhiteout(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return o.openRead(name)
+	}
+
+	_, inUpper, err := exists(o.upper, name)
+	if err != nil {
+		return nil, err
+	}
+	if !inUpper {
+		info, inLower, err := o.lowerStat(name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case inLower && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		case inLower && info.IsDir():
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		case inLower:
+			err = o.copyUp(name)
+		case flag&os.O_CREATE != 0:
+			err = o.copyUpDir(filepath.Dir(filepath.Clean(name)))
+		default:
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return o.upper.OpenFile(name, flag, perm)
+}
+
+func (o *OverlayFs) openRead(name string) (afero.File, error) {
+	uinfo, inUpper, err := exists(o.upper, name)
+	if err != nil {
+		return nil, err
+	}
+	if !inUpper {
+		ok, err := o.inLower(name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return o.lower.Open(name)
+	}
+	if !uinfo.IsDir() {
+		return o.upper.Open(name)
+	}
+	linfo, inLower, err := o.lowerStat(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := o.upper.Open(name)
+	if err != nil || !inLower || !linfo.IsDir() {
+		return f, err
+	}
+	return &overlayDir{File: f, fs: o, name: name}, nil
+}
+
+func (o *OverlayFs) Remove(name string) error {
+	info, err := o.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		names, err := afero.ReadDir(o, name)
+		if err != nil {
+			return err
+		}
+		if len(names) != 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return o.remove(name, o.upper.Remove)
+}
+
+func (o *OverlayFs) RemoveAll(path string) error {
+	if _, err := o.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return o.remove(path, o.upper.RemoveAll)
+}
+
+// remove removes name from upper layer by fn, a whiteout is left if name
+// is in lower layer.
+func (o *OverlayFs) remove(name string, fn func(string) error) error {
+	_, inUpper, err := exists(o.upper, name)
+	if err != nil {
+		return err
+	}
+	if inUpper {
+		if err = fn(name); err != nil {
+			return err
+		}
+	}
+	ok, err := o.inLower(name)
+	if err != nil || !ok {
+		return err
+	}
+	if err = o.whiteout(name); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (o *OverlayFs) Rename(oldname, newname string) error {
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	info, err := o.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	oldInLower, err := o.inLower(oldname)
+	if err != nil {
+		return err
+	}
+	if oldInLower {
+		// like overlayfs of linux, the lower directories are not moved
+		if info.IsDir() {
+			return linkErr(syscall.EXDEV)
+		}
+		if err = o.copyUp(oldname); err != nil {
+			return linkErr(err)
+		}
+	}
+	newInLower, err := o.inLower(newname)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUpDir(filepath.Dir(filepath.Clean(newname))); err != nil {
+		return linkErr(err)
+	}
+	if newInLower {
+		// hide the lower entries under newname
+		if err = o.whiteout(newname); err != nil {
+			return linkErr(err)
+		}
+	}
+	if err = o.upper.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if oldInLower {
+		if err = o.whiteout(oldname); err != nil {
+			return linkErr(err)
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFs) Stat(name string) (os.FileInfo, error) {
+	if isWhiteout(name) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	info, ok, err := exists(o.upper, name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return info, nil
+	}
+	info, ok, err = o.lowerStat(name)
+	if err == nil && !ok {
+		err = &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return info, err
+}
+
+func (o *OverlayFs) Name() string {
+	return "overlayfs"
+}
+
+func (o *OverlayFs) Chmod(name string, mode os.FileMode) error {
+	if err := o.copyUp(name); err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return o.upper.Chmod(name, mode)
+}
+
+func (o *OverlayFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := o.copyUp(name); err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return o.upper.Chtimes(name, atime, mtime)
+}
+
+// overlayDir is a directory existing in both layers, the entries of two
+// layers are merged.
+type overlayDir struct {
+	afero.File
+	fs   *OverlayFs
+	name string
+
+	// ents is nil until the first readdir
+	ents []os.FileInfo
+	off  int
+}
+
+func (d *overlayDir) load() error {
+	if d.ents != nil {
+		return nil
+	}
+	uents, err := afero.ReadDir(d.fs.upper, d.name)
+	if err != nil {
+		return err
+	}
+	lents, err := afero.ReadDir(d.fs.lower, d.name)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(uents))
+	ents := make([]os.FileInfo, 0, len(uents)+len(lents))
+	for _, ent := range uents {
+		if isWhiteout(ent.Name()) {
+			seen[strings.TrimPrefix(ent.Name(), whiteoutPrefix)] = true
+			continue
+		}
+		seen[ent.Name()] = true
+		ents = append(ents, ent)
+	}
+	for _, ent := range lents {
+		if !seen[ent.Name()] {
+			ents = append(ents, ent)
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].Name() < ents[j].Name()
+	})
+	d.ents = ents
+	return nil
+}
+
+func (d *overlayDir) Readdir(count int) ([]os.FileInfo, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	ents := d.ents[d.off:]
+	if count > 0 {
+		if len(ents) == 0 {
+			return nil, io.EOF
+		}
+		if len(ents) > count {
+			ents = ents[:count]
+		}
+	}
+	d.off += len(ents)
+	return ents, nil
+}
+
+func (d *overlayDir) Readdirnames(n int) ([]string, error) {
+	ents, err := d.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ents))
+	for i, ent := range ents {
+		names[i] = ent.Name()
+	}
+	return names, nil
+}
+
+func (d *overlayDir) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		// rewinddir
+		d.ents = nil
+		d.off = 0
+	}
+	return d.File.Seek(offset, whence)
+}
@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestOverlayFs(t *testing.T) {
+	lower := afero.NewMemMapFs()
+	afero.WriteFile(lower, "/etc/conf", []byte("lower"), 0644)
+	afero.WriteFile(lower, "/etc/hosts", []byte("hosts"), 0644)
+	upper := afero.NewMemMapFs()
+	fs := NewOverlayFs(afero.NewReadOnlyFs(lower), upper)
+
+	if b, err := afero.ReadFile(fs, "/etc/conf"); err != nil || string(b) != "lower" {
+		t.Fatalf("got %q %v", b, err)
+	}
+	// copy up on write
+	f, err := fs.OpenFile("/etc/conf", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" upper"))
+	f.Close()
+	if b, _ := afero.ReadFile(fs, "/etc/conf"); string(b) != "lower upper" {
+		t.Fatalf("got %q", b)
+	}
+	if b, _ := afero.ReadFile(lower, "/etc/conf"); string(b) != "lower" {
+		t.Fatalf("lower layer changed, got %q", b)
+	}
+
+	if err = afero.WriteFile(fs, "/etc/new", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := afero.ReadDir(fs, "/etc")
+	if err != nil || len(names) != 3 {
+		t.Fatalf("expect 3 entries, got %d %v", len(names), err)
+	}
+	if names[0].Name() != "conf" || names[0].Size() != int64(len("lower upper")) {
+		t.Fatalf("expect entry of upper layer, got %s %d", names[0].Name(), names[0].Size())
+	}
+
+	if _, err = fs.OpenFile("/etc/hosts", os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("expect exist, got %v", err)
+	}
+	if err = fs.Remove("/etc/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove of lower file leaves a whiteout
+	if err = fs.Remove("/etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("/etc/hosts"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if _, err = fs.Open("/etc/hosts"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if names, _ = afero.ReadDir(fs, "/etc"); len(names) != 1 || names[0].Name() != "conf" {
+		t.Fatalf("expect only conf, got %v", names)
+	}
+	if _, err = lower.Stat("/etc/hosts"); err != nil {
+		t.Fatalf("lower layer changed, got %v", err)
+	}
+	if err = afero.WriteFile(fs, "/etc/hosts", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := afero.ReadFile(fs, "/etc/hosts"); string(b) != "new" {
+		t.Fatalf("got %q", b)
+	}
+
+	// rename of lower file
+	afero.WriteFile(lower, "/etc/old", []byte("old"), 0644)
+	if err = fs.Rename("/etc/old", "/etc/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("/etc/old"); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+	if b, _ := afero.ReadFile(fs, "/etc/moved"); string(b) != "old" {
+		t.Fatalf("got %q", b)
+	}
+
+	// the removed lower directory is hidden after recreating
+	afero.WriteFile(lower, "/var/log/boot", nil, 0644)
+	if err = fs.Remove("/var/log"); underlying(err) != syscall.ENOTEMPTY {
+		t.Fatalf("expect ENOTEMPTY, got %v", err)
+	}
+	if err = fs.RemoveAll("/var/log"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Mkdir("/var/log", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if names, err = afero.ReadDir(fs, "/var/log"); err != nil || len(names) != 0 {
+		t.Fatalf("expect empty dir, got %v %v", names, err)
+	}
+}
+
+func underlying(err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	_AT_REMOVEDIR = 0x200
+)
+
+// fsErrno is errnoFromErr for the helpers returning error
+func fsErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errnoFromErr(err)
+}
+
+func mkdirat(name string, mode os.FileMode) error {
+	if err := checkParent(name); err != nil {
+		return err
+	}
+	if err := Root.Mkdir(name, mode); err != nil {
+		return fsErrno(err)
+	}
+	inotify(name, syscall.IN_CREATE|syscall.IN_ISDIR, 0)
+	return nil
+}
+
+func unlinkat(name string, flags int) error {
+	if flags&^_AT_REMOVEDIR != 0 {
+		return syscall.EINVAL
+	}
+	if err := checkWritable(name); err != nil {
+		return err
+	}
+	info, err := Root.Stat(name)
+	if err != nil {
+		return fsErrno(err)
+	}
+	switch {
+	case info.IsDir() && flags&_AT_REMOVEDIR == 0:
+		return syscall.EISDIR
+	case !info.IsDir() && flags&_AT_REMOVEDIR != 0:
+		return syscall.ENOTDIR
+	case info.IsDir():
+		dir, err := Root.Open(name)
+		if err != nil {
+			return fsErrno(err)
+		}
+		names, _ := dir.Readdirnames(1)
+		dir.Close()
+		if len(names) != 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if ok, err := unlinkLink(name); ok {
+		if err == nil {
+			// the file lives on with the other links
+			inotify(name, syscall.IN_DELETE, 0)
+		}
+		return err
+	}
+	if err := Root.Remove(name); err != nil {
+		return fsErrno(err)
+	}
+	removeNode(name)
+	removeOwner(name)
+	events := uint32(syscall.IN_DELETE | syscall.IN_DELETE_SELF)
+	if info.IsDir() {
+		events |= syscall.IN_ISDIR
+	}
+	inotify(name, events, 0)
+	return nil
+}
+
+func rename(oldname, newname string) error {
+	if resolveLink(oldname) == resolveLink(newname) {
+		// the links of the same file
+		return nil
+	}
+	info, err := Root.Stat(oldname)
+	if err != nil {
+		return fsErrno(err)
+	}
+	// the link records of newname go away with it
+	if _, err := unlinkLink(newname); err != nil {
+		return err
+	}
+	if err := Root.Rename(oldname, newname); err != nil {
+		return fsErrno(err)
+	}
+	renameNode(oldname, newname)
+	renameLink(oldname, newname)
+	renameOwner(oldname, newname)
+	var isdir uint32
+	if info.IsDir() {
+		isdir = syscall.IN_ISDIR
+	}
+	inotifyRename(oldname, newname, isdir)
+	return nil
+}
+
+func chmod(name string, mode uint32) error {
+	if err := Root.Chmod(resolveLink(name), os.FileMode(mode&0777)); err != nil {
+		return fsErrno(err)
+	}
+	inotify(name, syscall.IN_ATTRIB, 0)
+	return nil
+}
+
+func truncate(name string, size int64) error {
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	name = resolveLink(name)
+	info, err := Root.Stat(name)
+	if err != nil {
+		return fsErrno(err)
+	}
+	if info.IsDir() {
+		return syscall.EISDIR
+	}
+	f, err := Root.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return fsErrno(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		return fsErrno(err)
+	}
+	inotify(name, syscall.IN_MODIFY, 0)
+	return nil
+}
+
+// func mkdirat(dirfd int, path string, mode uint32)
+func sysMkdirat(c *isyscall.Request) {
+	name, err := atPath(c.Args[0], c.Args[1])
+	if err == nil {
+		err = mkdirat(name, os.FileMode(c.Args[2]&0777))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
+
+// func unlinkat(dirfd int, path string, flags int)
+func sysUnlinkat(c *isyscall.Request) {
+	name, err := atPath(c.Args[0], c.Args[1])
+	if err == nil {
+		err = unlinkat(name, int(c.Args[2]))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
+
+// func rename(oldpath, newpath string)
+// func renameat(olddirfd int, oldpath string, newdirfd int, newpath string)
+func sysRename(c *isyscall.Request) {
+	olddirfd, oldpath, newdirfd, newpath := c.Args[0], c.Args[1], c.Args[2], c.Args[3]
+	if c.NO == syscall.SYS_RENAME {
+		olddirfd, oldpath, newdirfd, newpath = _AT_FDCWD, c.Args[0], _AT_FDCWD, c.Args[1]
+	}
+	oldname, err := atPath(olddirfd, oldpath)
+	var newname string
+	if err == nil {
+		newname, err = atPath(newdirfd, newpath)
+	}
+	if err == nil {
+		err = rename(oldname, newname)
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
+
+// func chmod(path string, mode uint32)
+// func fchmodat(dirfd int, path string, mode uint32, flags int)
+func sysChmod(c *isyscall.Request) {
+	dirfd, pathptr, mode := c.Args[0], c.Args[1], c.Args[2]
+	if c.NO == syscall.SYS_CHMOD {
+		dirfd, pathptr, mode = _AT_FDCWD, c.Args[0], c.Args[1]
+	}
+	name, err := atPath(dirfd, pathptr)
+	if err == nil {
+		err = chmod(name, uint32(mode))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
+
+// func truncate(path string, length int32)
+// func truncate64(path string, length int64)
+func sysTruncate(c *isyscall.Request) {
+	size := int64(int32(c.Args[1]))
+	if c.NO == syscall.SYS_TRUNCATE64 {
+		size = offset64(c.Args[1], c.Args[2])
+	}
+	name, err := atPath(_AT_FDCWD, c.Args[0])
+	if err == nil {
+		err = truncate(name, size)
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
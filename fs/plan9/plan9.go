@@ -0,0 +1,55 @@
+// Package plan9 mounts the 9P2000.L file servers reached by a stream, such
+// as a TCP connection to diod or a serial port. The messages are driven by
+// the 9P client of package ninep, where the 9P2000.L Tlopen, Tgetattr and
+// Tsetattr take the place of Topen, Tstat and Twstat.
+package plan9
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/icexin/eggos/fs/ninep"
+	"github.com/spf13/afero"
+)
+
+// the max message size proposed to server
+const msize = 64 << 10
+
+var errTooLarge = errors.New("plan9: message too large")
+
+// stream carries the 9P messages over an io.ReadWriter, one message at a
+// time.
+type stream struct {
+	rw io.ReadWriter
+}
+
+func (s *stream) Msize() uint32 {
+	return msize
+}
+
+func (s *stream) RoundTrip(tx, rx []byte) (int, error) {
+	if _, err := s.rw.Write(tx); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(s.rw, rx[:4]); err != nil {
+		return 0, err
+	}
+	size := int(binary.LittleEndian.Uint32(rx))
+	if size < 4 || size > len(rx) {
+		return 0, errTooLarge
+	}
+	if _, err := io.ReadFull(s.rw, rx[4:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Dial attaches the file tree aname served over transport.
+func Dial(transport io.ReadWriter, aname string) (afero.Fs, error) {
+	fs, err := ninep.New(&stream{rw: transport}, aname)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
@@ -0,0 +1,132 @@
+package plan9
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+var le = binary.LittleEndian
+
+// serve answers the 9P2000.L requests on conn with a root directory holding
+// the file hello, only the messages needed by reading it are handled.
+func serve(t *testing.T, conn net.Conn, content string) {
+	defer conn.Close()
+	files := make(map[uint32]string)
+	for {
+		var hdr [7]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		body := make([]byte, le.Uint32(hdr[:])-7)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		typ, tag := hdr[4], le.Uint16(hdr[5:])
+
+		var out []byte
+		var tmp [8]byte
+		u16 := func(v uint16) { le.PutUint16(tmp[:], v); out = append(out, tmp[:2]...) }
+		u32 := func(v uint32) { le.PutUint32(tmp[:], v); out = append(out, tmp[:4]...) }
+		u64 := func(v uint64) { le.PutUint64(tmp[:], v); out = append(out, tmp[:8]...) }
+		qid := func(dir bool) {
+			if dir {
+				out = append(out, 0x80)
+			} else {
+				out = append(out, 0)
+			}
+			u32(0)
+			u64(0)
+		}
+		rtyp := typ + 1
+		switch typ {
+		case 100: // version
+			u32(le.Uint32(body))
+			u16(8)
+			out = append(out, "9P2000.L"...)
+		case 104: // attach
+			files[le.Uint32(body)] = "/"
+			qid(true)
+		case 110: // walk
+			fid, newfid, n := le.Uint32(body), le.Uint32(body[4:]), le.Uint16(body[8:])
+			name := files[fid]
+			var nqid uint16
+			if n == 1 && string(body[12:]) == "hello" {
+				name, nqid = "/hello", 1
+			}
+			if nqid == n {
+				files[newfid] = name
+			}
+			u16(nqid)
+			for i := uint16(0); i < nqid; i++ {
+				qid(false)
+			}
+		case 24: // getattr
+			name := files[le.Uint32(body)]
+			u64(0x7ff)
+			qid(name == "/")
+			u32(0644)
+			u32(0)
+			u32(0)
+			u64(1)
+			u64(0)
+			u64(uint64(len(content)))
+			for i := 0; i < 6; i++ {
+				u64(0)
+			}
+		case 12: // lopen
+			qid(files[le.Uint32(body)] == "/")
+			u32(0)
+		case 116: // read
+			off, count := le.Uint64(body[4:]), le.Uint32(body[12:])
+			data := content
+			if off > uint64(len(data)) {
+				off = uint64(len(data))
+			}
+			data = data[off:]
+			if len(data) > int(count) {
+				data = data[:count]
+			}
+			u32(uint32(len(data)))
+			out = append(out, data...)
+		case 120: // clunk
+			delete(files, le.Uint32(body))
+		default:
+			t.Logf("unexpected message %d", typ)
+			rtyp = 7
+			u32(uint32(syscall.ENOSYS))
+		}
+		msg := make([]byte, 7, 7+len(out))
+		le.PutUint32(msg, uint32(7+len(out)))
+		msg[4] = rtyp
+		le.PutUint16(msg[5:], tag)
+		if _, err := conn.Write(append(msg, out...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestDialRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go serve(t, server, "hello 9p over a stream")
+
+	fs, err := Dial(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := afero.ReadFile(fs, "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello 9p over a stream" {
+		t.Fatalf("bad content %q", buf)
+	}
+	if _, err := fs.Open("/none"); err == nil {
+		t.Fatal("expect error on opening missing file")
+	}
+}
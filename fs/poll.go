@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	_POLLIN   = 0x1
+	_POLLPRI  = 0x2
+	_POLLOUT  = 0x4
+	_POLLERR  = 0x8
+	_POLLHUP  = 0x10
+	_POLLNVAL = 0x20
+
+	// pollRecheck is how often the waiting poll checks the fds again, for
+	// the files not waking up the pollers.
+	pollRecheck = 10 * time.Millisecond
+)
+
+// Poller is implemented by the files knowing their readiness, Poll returns
+// the ready events of POLLIN, POLLOUT, POLLERR and POLLHUP. The files only
+// implementing Readable are always writable, the others are always ready
+// like the regular files.
+type Poller interface {
+	Poll() uint32
+}
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+var (
+	pollMutex sync.Mutex
+	// pollWake is closed to wake up the waiting pollers
+	pollWake = make(chan struct{})
+)
+
+//go:linkname epollNotify github.com/icexin/eggos/kernel.epollNotify
+func epollNotify(fd, events uintptr)
+
+// evnotify tells epoll and poll the events of fd
+func evnotify(fd, events uintptr) {
+	epollNotify(fd, events)
+	PollWakeup()
+}
+
+// PollWakeup makes the waiting poll callers check their fds again, it's
+// called by the files outside fs when their readiness changes.
+func PollWakeup() {
+	pollMutex.Lock()
+	close(pollWake)
+	pollWake = make(chan struct{})
+	pollMutex.Unlock()
+}
+
+func pollChan() <-chan struct{} {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	return pollWake
+}
+
+// pollFile returns the revents of fd, POLLERR and POLLHUP are always
+// reported.
+func pollFile(fd int32, events int16) int16 {
+	if fd < 0 {
+		return 0
+	}
+	ni, err := GetInode(int(fd))
+	if err != nil {
+		return _POLLNVAL
+	}
+	var ready uint32
+	switch f := ni.File.(type) {
+	case Poller:
+		ready = f.Poll()
+	case readable:
+		ready = _POLLOUT
+		if f.Readable() {
+			ready |= _POLLIN
+		}
+	default:
+		ready = _POLLIN | _POLLOUT
+	}
+	return int16(ready & (uint32(uint16(events)) | _POLLERR | _POLLHUP))
+}
+
+// pollFds fills the revents of fds and returns the number of ready ones
+func pollFds(fds []pollFd) int {
+	n := 0
+	for i := range fds {
+		fds[i].revents = pollFile(fds[i].fd, fds[i].events)
+		if fds[i].revents != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// poll waits until any of fds is ready or timeout, a negative timeout waits
+// forever and zero doesn't wait.
+func poll(fds []pollFd, timeout time.Duration) int {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var recheck *time.Ticker
+	for {
+		wake := pollChan()
+		if n := pollFds(fds); n != 0 || timeout == 0 {
+			return n
+		}
+		if recheck == nil {
+			recheck = time.NewTicker(pollRecheck)
+			defer recheck.Stop()
+		}
+		select {
+		case <-wake:
+		case <-recheck.C:
+		case <-deadline:
+			return pollFds(fds)
+		}
+	}
+}
+
+// func poll(fds []pollfd, timeout int)
+// func ppoll(fds []pollfd, ts *timespec, sigmask *sigset, sigsetsize int)
+func sysPoll(c *isyscall.Request) {
+	fdsptr, nfds := c.Args[0], int(c.Args[1])
+	timeout := time.Duration(int32(c.Args[2])) * time.Millisecond
+	if c.NO == syscall.SYS_PPOLL {
+		timeout = -1
+		if c.Args[2] != 0 {
+			ts := (*syscall.Timespec)(unsafe.Pointer(c.Args[2]))
+			if ts.Sec < 0 || ts.Nsec < 0 || ts.Nsec >= 1e9 {
+				c.Ret = isyscall.Errno(syscall.EINVAL)
+				c.Done()
+				return
+			}
+			timeout = time.Duration(ts.Nano())
+		}
+	}
+	inodeMutex.Lock()
+	limit := nofileLimit.Cur
+	inodeMutex.Unlock()
+	if nfds < 0 || uint64(nfds) > limit {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+	var fds []pollFd
+	if nfds > 0 {
+		fds = (*[1 << 20]pollFd)(unsafe.Pointer(fdsptr))[:nfds:nfds]
+	}
+	c.Ret = uintptr(poll(fds, timeout))
+	c.Done()
+}
+
+// the max nfds of select, the size of fd_set
+const _FD_SETSIZE = 1024
+
+func fdIsSet(set *syscall.FdSet, fd int) bool {
+	return set != nil && set.Bits[fd/32]&(1<<uint(fd%32)) != 0
+}
+
+func fdSet(set *syscall.FdSet, fd int) {
+	set.Bits[fd/32] |= 1 << uint(fd%32)
+}
+
+// selectFds is select over poll, the fds in the sets are replaced by the
+// ready ones. It returns EBADF if any fd in the sets is not open.
+func selectFds(nfds int, r, w, e *syscall.FdSet, timeout time.Duration) (int, error) {
+	if nfds < 0 || nfds > _FD_SETSIZE {
+		return 0, syscall.EINVAL
+	}
+	var fds []pollFd
+	for fd := 0; fd < nfds; fd++ {
+		var events int16
+		if fdIsSet(r, fd) {
+			events |= _POLLIN
+		}
+		if fdIsSet(w, fd) {
+			events |= _POLLOUT
+		}
+		if fdIsSet(e, fd) {
+			events |= _POLLPRI
+		}
+		if events != 0 {
+			fds = append(fds, pollFd{fd: int32(fd), events: events})
+		}
+	}
+	for _, p := range fds {
+		if pollFile(p.fd, 0) == _POLLNVAL {
+			return 0, syscall.EBADF
+		}
+	}
+
+	poll(fds, timeout)
+	for _, set := range []*syscall.FdSet{r, w, e} {
+		if set != nil {
+			*set = syscall.FdSet{}
+		}
+	}
+	n := 0
+	for _, p := range fds {
+		// the errors are reported as readable and writable like linux
+		if r != nil && p.events&_POLLIN != 0 && p.revents&(_POLLIN|_POLLERR|_POLLHUP) != 0 {
+			fdSet(r, int(p.fd))
+			n++
+		}
+		if w != nil && p.events&_POLLOUT != 0 && p.revents&(_POLLOUT|_POLLERR) != 0 {
+			fdSet(w, int(p.fd))
+			n++
+		}
+		if e != nil && p.events&_POLLPRI != 0 && p.revents&_POLLPRI != 0 {
+			fdSet(e, int(p.fd))
+			n++
+		}
+	}
+	return n, nil
+}
+
+// func select(nfds int, r, w, e *FdSet, timeout *Timeval)
+// func pselect6(nfds int, r, w, e *FdSet, timeout *Timespec, sigmask *sigset)
+func sysSelect(c *isyscall.Request) {
+	args := c.Args[:5]
+	if c.NO == syscall.SYS_SELECT {
+		// the legacy select passes the arguments in a struct
+		args = (*[5]uintptr)(unsafe.Pointer(c.Args[0]))[:]
+	}
+	nfds := int(args[0])
+	r := (*syscall.FdSet)(unsafe.Pointer(args[1]))
+	w := (*syscall.FdSet)(unsafe.Pointer(args[2]))
+	e := (*syscall.FdSet)(unsafe.Pointer(args[3]))
+
+	timeout := time.Duration(-1)
+	var tv *syscall.Timeval
+	switch {
+	case args[4] == 0:
+	case c.NO == syscall.SYS_PSELECT6:
+		ts := (*syscall.Timespec)(unsafe.Pointer(args[4]))
+		if ts.Sec < 0 || ts.Nsec < 0 || ts.Nsec >= 1e9 {
+			c.Ret = isyscall.Errno(syscall.EINVAL)
+			c.Done()
+			return
+		}
+		timeout = time.Duration(ts.Nano())
+	default:
+		tv = (*syscall.Timeval)(unsafe.Pointer(args[4]))
+		if tv.Sec < 0 || tv.Usec < 0 || tv.Usec >= 1e6 {
+			c.Ret = isyscall.Errno(syscall.EINVAL)
+			c.Done()
+			return
+		}
+		timeout = time.Duration(tv.Nano())
+	}
+
+	start := time.Now()
+	n, err := selectFds(nfds, r, w, e, timeout)
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	if tv != nil {
+		// select reports the time not slept like linux
+		remain := timeout - time.Since(start)
+		if remain < 0 {
+			remain = 0
+		}
+		*tv = syscall.NsecToTimeval(int64(remain))
+	}
+	c.Ret = uintptr(n)
+	c.Done()
+}
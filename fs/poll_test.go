@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readyFile is a readable file whose readiness is set by the test
+type readyFile struct {
+	nopCloser
+	ready bool
+}
+
+func (r *readyFile) Readable() bool { return r.ready }
+
+func TestPoll(t *testing.T) {
+	e := newEventFd(0, 0)
+	efd, eni, err := AllocFileNode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysClose(eni)
+	e.fd = efd
+
+	// non-blocking poll of an empty eventfd and a bad fd
+	fds := []pollFd{
+		{fd: int32(efd), events: _POLLIN | _POLLOUT},
+		{fd: 1000, events: _POLLIN},
+		{fd: -1, events: _POLLIN},
+	}
+	if n := poll(fds, 0); n != 2 || fds[0].revents != _POLLOUT ||
+		fds[1].revents != _POLLNVAL || fds[2].revents != 0 {
+		t.Fatalf("bad poll %d %v", n, fds)
+	}
+
+	// the write wakes up the poll waiting forever
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		e.Write([]byte{1, 0, 0, 0, 0, 0, 0, 0})
+	}()
+	fds = []pollFd{{fd: int32(efd), events: _POLLIN}}
+	if n := poll(fds, -1); n != 1 || fds[0].revents != _POLLIN {
+		t.Fatalf("bad poll %d %v", n, fds)
+	}
+
+	// timeout of a file never ready
+	r := &readyFile{nopCloser: nopCloser{null{}}}
+	rfd, rni, _ := AllocFileNode(r)
+	defer sysClose(rni)
+	fds = []pollFd{{fd: int32(rfd), events: _POLLIN}}
+	start := time.Now()
+	if n := poll(fds, 30*time.Millisecond); n != 0 || fds[0].revents != 0 {
+		t.Fatalf("expect timeout, got %d %v", n, fds)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("returned after %v", d)
+	}
+
+	// all the fds negative is a sleep
+	start = time.Now()
+	if n := poll([]pollFd{{fd: -1}}, 20*time.Millisecond); n != 0 {
+		t.Fatalf("expect 0, got %d", n)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("returned after %v", d)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	e := newEventFd(1, 0)
+	efd, eni, _ := AllocFileNode(e)
+	defer sysClose(eni)
+	r := &readyFile{nopCloser: nopCloser{null{}}}
+	rfd, rni, _ := AllocFileNode(r)
+	defer sysClose(rni)
+
+	var rset, wset syscall.FdSet
+	fdSet(&rset, efd)
+	fdSet(&rset, rfd)
+	fdSet(&wset, efd)
+	nfds := efd + 1
+	if rfd >= nfds {
+		nfds = rfd + 1
+	}
+	n, err := selectFds(nfds, &rset, &wset, nil, 0)
+	if err != nil || n != 2 {
+		t.Fatalf("expect 2 ready, got %d %v", n, err)
+	}
+	if !fdIsSet(&rset, efd) || fdIsSet(&rset, rfd) || !fdIsSet(&wset, efd) {
+		t.Fatalf("bad sets %v %v", rset, wset)
+	}
+
+	// a closed fd in the sets fails the whole call
+	fdSet(&rset, 1000)
+	if _, err := selectFds(1001, &rset, nil, nil, 0); err != syscall.EBADF {
+		t.Fatalf("expect EBADF, got %v", err)
+	}
+	if _, err := selectFds(_FD_SETSIZE+1, nil, nil, nil, 0); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/icexin/eggos/debug/ksyms"
+	"github.com/icexin/eggos/fs/procfs"
+	"github.com/icexin/eggos/kernel"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/mm"
+)
+
+var (
+	// Proc is the procfs mounted at /proc
+	Proc = procfs.New()
+
+	// uptime reads the PIT, replaced by tests running on host
+	uptime = kernel.Uptime
+)
+
+func procHostname() []byte {
+	return []byte(kernel.Hostname() + "\n")
+}
+
+func procUptime() []byte {
+	return []byte(fmt.Sprintf("%.2f %.2f\n", uptime().Seconds(), 0.0))
+}
+
+func procMeminfo() []byte {
+	stat := mm.Stat()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "MemTotal:       %8d kB\n", stat.Total>>10)
+	fmt.Fprintf(&buf, "MemFree:        %8d kB\n", stat.Free>>10)
+	fmt.Fprintf(&buf, "MemAvailable:   %8d kB\n", stat.Free>>10)
+	return buf.Bytes()
+}
+
+func procMounts() []byte {
+	var buf bytes.Buffer
+	for _, m := range Mounts() {
+		opt := "rw"
+		if m.Flags&syscall.MS_RDONLY != 0 {
+			opt = "ro"
+		}
+		fmt.Fprintf(&buf, "%s %s %s %s 0 0\n", m.Type, m.Path, m.Type, opt)
+	}
+	return buf.Bytes()
+}
+
+// procFds lists the fds in use, the content of every entry is the name of
+// the file.
+func procFds() map[string][]byte {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	fds := make(map[string][]byte)
+	for fd, ni := range inodes {
+		if ni == nil {
+			continue
+		}
+		fds[strconv.Itoa(fd)] = []byte(ni.Name + "\n")
+	}
+	return fds
+}
+
+// procRegister adds the files of Proc
+func procRegister() {
+	Proc.RegisterFile("uptime", procUptime)
+	Proc.RegisterFile("meminfo", procMeminfo)
+	Proc.RegisterFile("mounts", procMounts)
+	Proc.RegisterFile("kallsyms", ksyms.Kallsyms)
+	Proc.RegisterFile("eggos/strace", isyscall.TraceLog)
+	Proc.RegisterFile("eggos/fs", procFsStats)
+	Proc.RegisterDir("self/fd", procFds)
+	Proc.RegisterFile("sys/kernel/hostname", procHostname)
+}
+
+func procInit() {
+	procRegister()
+	err := Mount("/proc", Proc)
+	if err != nil {
+		panic(err)
+	}
+}
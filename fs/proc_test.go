@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icexin/eggos/kernel"
+	"github.com/spf13/afero"
+)
+
+var procOnce sync.Once
+
+func procInitOnce() {
+	procOnce.Do(func() {
+		uptime = func() time.Duration { return 90 * time.Second }
+		procRegister()
+	})
+}
+
+func readProc(t *testing.T, name string) string {
+	buf, err := afero.ReadFile(Proc, name)
+	if err != nil {
+		t.Fatalf("read %s:%v", name, err)
+	}
+	return string(buf)
+}
+
+func TestProcFiles(t *testing.T) {
+	procInitOnce()
+
+	fields := strings.Fields(readProc(t, "uptime"))
+	if len(fields) != 2 {
+		t.Fatalf("bad uptime %q", fields)
+	}
+	if sec, _ := strconv.ParseFloat(fields[0], 64); sec != 90 {
+		t.Fatalf("bad uptime %q", fields)
+	}
+	meminfo := readProc(t, "meminfo")
+	for _, key := range []string{"MemTotal:", "MemFree:", "MemAvailable:"} {
+		if !strings.Contains(meminfo, key) {
+			t.Fatalf("%s not in meminfo %q", key, meminfo)
+		}
+	}
+	if name := readProc(t, "sys/kernel/hostname"); name != kernel.Hostname()+"\n" {
+		t.Fatalf("bad hostname %q", name)
+	}
+}
+
+func TestProcSelfFd(t *testing.T) {
+	procInitOnce()
+
+	fd, ni, err := AllocFileNode(newEventFd(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysClose(ni)
+	ni.Name = "anon_inode:[eventfd]"
+
+	dir, err := Proc.Open("self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+	found := false
+	for _, name := range names {
+		found = found || name == strconv.Itoa(fd)
+	}
+	if !found {
+		t.Fatalf("fd %d not in %v", fd, names)
+	}
+	buf, err := afero.ReadFile(Proc, "self/fd/"+strconv.Itoa(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "anon_inode:[eventfd]\n" {
+		t.Fatalf("bad fd entry %q", buf)
+	}
+}
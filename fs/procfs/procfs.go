@@ -0,0 +1,348 @@
+// Package procfs implements a read-only afero.Fs whose files are
+// synthesized on every open, it's mounted at /proc by fs.
+package procfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	fileMode = 0444
+	dirMode  = os.ModeDir | 0555
+)
+
+// FileFunc generates the content of a file
+type FileFunc func() []byte
+
+// DirFunc generates the entries of a directory, the key is the entry name
+// and the value is the content of the entry.
+type DirFunc func() map[string][]byte
+
+type node struct {
+	name string
+	// only one of gen, list and children is used
+	gen      FileFunc
+	list     DirFunc
+	children map[string]*node
+}
+
+func (n *node) isDir() bool {
+	return n.gen == nil
+}
+
+// Procfs is a tree of registered generators.
+type Procfs struct {
+	mutex   sync.Mutex
+	root    *node
+	modTime time.Time
+}
+
+func New() *Procfs {
+	return &Procfs{
+		root:    &node{name: "/", children: make(map[string]*node)},
+		modTime: time.Now(),
+	}
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(filepath.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func (p *Procfs) register(name string, n *node) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return &os.PathError{Op: "register", Path: name, Err: os.ErrExist}
+	}
+	dir := p.root
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := dir.children[part]
+		if !ok {
+			next = &node{name: part, children: make(map[string]*node)}
+			dir.children[part] = next
+		}
+		if next.children == nil {
+			return &os.PathError{Op: "register", Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = next
+	}
+	last := parts[len(parts)-1]
+	if _, ok := dir.children[last]; ok {
+		return &os.PathError{Op: "register", Path: name, Err: os.ErrExist}
+	}
+	n.name = last
+	dir.children[last] = n
+	return nil
+}
+
+// RegisterFile adds a file whose content is generated by gen on every open.
+func (p *Procfs) RegisterFile(name string, gen FileFunc) error {
+	return p.register(name, &node{gen: gen})
+}
+
+// RegisterDir adds a directory whose entries are generated by list.
+func (p *Procfs) RegisterDir(name string, list DirFunc) error {
+	return p.register(name, &node{list: list})
+}
+
+// lookup finds the node of name, entries of dynamic directory are
+// returned as a new file node.
+func (p *Procfs) lookup(name string) (*node, error) {
+	p.mutex.Lock()
+	n := p.root
+	parts := splitPath(name)
+	for i, part := range parts {
+		switch {
+		case n.children != nil:
+			next, ok := n.children[part]
+			if !ok {
+				p.mutex.Unlock()
+				return nil, os.ErrNotExist
+			}
+			n = next
+		case n.list != nil && i == len(parts)-1:
+			// don't hold the lock while generating entries
+			p.mutex.Unlock()
+			content, ok := n.list()[part]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return &node{name: part, gen: func() []byte { return content }}, nil
+		case n.list != nil:
+			p.mutex.Unlock()
+			return nil, os.ErrNotExist
+		default:
+			p.mutex.Unlock()
+			return nil, syscall.ENOTDIR
+		}
+	}
+	p.mutex.Unlock()
+	return n, nil
+}
+
+func (p *Procfs) info(n *node) os.FileInfo {
+	mode := os.FileMode(fileMode)
+	if n.isDir() {
+		mode = dirMode
+	}
+	return &fileInfo{name: n.name, mode: mode, modTime: p.modTime}
+}
+
+// Create creates a file in the filesystem, returning the file and an
+// error, if any happens.
+func (p *Procfs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrPermission}
+}
+
+// Mkdir creates a directory in the filesystem, return an error if any
+// happens.
+func (p *Procfs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+// MkdirAll creates a directory path and all parents that does not exist
+// yet.
+func (p *Procfs) MkdirAll(path string, perm os.FileMode) error {
+	if n, err := p.lookup(path); err == nil && n.isDir() {
+		return nil
+	}
+	return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrPermission}
+}
+
+// Open opens a file, returning it or an error, if any happens.
+func (p *Procfs) Open(name string) (afero.File, error) {
+	return p.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file using the given flags and the given mode.
+func (p *Procfs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	n, err := p.lookup(name)
+	if err != nil {
+		if flag&os.O_CREATE != 0 && os.IsNotExist(err) {
+			err = os.ErrPermission
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	f := &file{
+		fs:   p,
+		node: n,
+		name: name,
+	}
+	if !n.isDir() {
+		f.Reader = bytes.NewReader(n.gen())
+	}
+	return f, nil
+}
+
+// Remove removes a file identified by name, returning an error, if any
+// happens.
+func (p *Procfs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+// RemoveAll removes a directory path and any children it contains. It
+// does not fail if the path does not exist (return nil).
+func (p *Procfs) RemoveAll(path string) error {
+	return &os.PathError{Op: "remove", Path: path, Err: os.ErrPermission}
+}
+
+// Rename renames a file.
+func (p *Procfs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+// Stat returns a FileInfo describing the named file, or an error, if any
+// happens.
+func (p *Procfs) Stat(name string) (os.FileInfo, error) {
+	n, err := p.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return p.info(n), nil
+}
+
+// The name of this FileSystem
+func (p *Procfs) Name() string {
+	return "procfs"
+}
+
+//Chmod changes the mode of the named file to mode.
+func (p *Procfs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: os.ErrPermission}
+}
+
+//Chtimes changes the access and modification times of the named file
+func (p *Procfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrPermission}
+}
+
+type fileInfo struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return 0 }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+// file is an opened file or directory, the content of file is generated
+// when opening, so that reading is consistent.
+type file struct {
+	*bytes.Reader
+	fs   *Procfs
+	node *node
+	name string
+	// offset of directory entries
+	offset int
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.Reader == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.Reader == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.Reader.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.Reader == nil {
+		return 0, syscall.EISDIR
+	}
+	return f.Reader.Seek(offset, whence)
+}
+
+func (f *file) Write(p []byte) (int, error)              { return 0, syscall.EBADF }
+func (f *file) WriteAt(p []byte, off int64) (int, error) { return 0, syscall.EBADF }
+func (f *file) WriteString(s string) (int, error)        { return 0, syscall.EBADF }
+
+func (f *file) Name() string { return f.name }
+
+func (f *file) names() []string {
+	var names []string
+	f.fs.mutex.Lock()
+	for name := range f.node.children {
+		names = append(names, name)
+	}
+	f.fs.mutex.Unlock()
+	if f.node.list != nil {
+		for name := range f.node.list() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	names, err := f.Readdirnames(count)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := f.fs.Stat(filepath.Join(f.name, name))
+		if err != nil {
+			// the entry of dynamic directory may disappear
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	if !f.node.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	names := f.names()
+	if f.offset >= len(names) {
+		names = nil
+	} else {
+		names = names[f.offset:]
+	}
+	if n > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if len(names) > n {
+			names = names[:n]
+		}
+	}
+	f.offset += len(names)
+	return names, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) { return f.fs.info(f.node), nil }
+
+func (f *file) Sync() error               { return nil }
+func (f *file) Truncate(size int64) error { return syscall.EBADF }
+func (f *file) Close() error              { return nil }
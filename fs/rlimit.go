@@ -0,0 +1,190 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	defaultNoFileSoft = 1024
+	defaultNoFileHard = 4096
+
+	_RLIM_INFINITY = ^uint64(0)
+	_RLIM_NLIMITS  = 16
+
+	// eggos is the only process
+	kernelPid = 1
+)
+
+var (
+	// nofileLimit is the RLIMIT_NOFILE limit, protected by inodeMutex
+	nofileLimit = syscall.Rlimit{
+		Cur: defaultNoFileSoft,
+		Max: defaultNoFileHard,
+	}
+
+	// rlimits holds the other limits programs usually ask for, they are
+	// recorded but not enforced.
+	rlimitMutex sync.Mutex
+	rlimits     = map[uintptr]*syscall.Rlimit{
+		syscall.RLIMIT_STACK: {Cur: 8 << 20, Max: _RLIM_INFINITY},
+		syscall.RLIMIT_AS:    {Cur: _RLIM_INFINITY, Max: _RLIM_INFINITY},
+		syscall.RLIMIT_CORE:  {Cur: 0, Max: _RLIM_INFINITY},
+		syscall.RLIMIT_CPU:   {Cur: _RLIM_INFINITY, Max: _RLIM_INFINITY},
+	}
+)
+
+// rlimit32 is the struct used by getrlimit and setrlimit on 386
+type rlimit32 struct {
+	cur uint32
+	max uint32
+}
+
+// OpenFDCount returns the number of fds in use.
+func OpenFDCount() int {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	return nopen
+}
+
+// NoFileLimit returns the soft and hard limit of open fds.
+func NoFileLimit() (soft, hard uint64) {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	return nofileLimit.Cur, nofileLimit.Max
+}
+
+// SetNoFileLimit sets the soft and hard limit of open fds.
+// Unlike setrlimit, it can raise the hard limit.
+func SetNoFileLimit(soft, hard uint64) error {
+	if soft > hard {
+		return syscall.EINVAL
+	}
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	nofileLimit.Cur, nofileLimit.Max = soft, hard
+	return nil
+}
+
+// SetMaxOpenFiles sets the soft limit of open fds to n, the hard limit is
+// raised if needed.
+func SetMaxOpenFiles(n int) error {
+	if n < 0 {
+		return syscall.EINVAL
+	}
+	_, hard := NoFileLimit()
+	if uint64(n) > hard {
+		hard = uint64(n)
+	}
+	return SetNoFileLimit(uint64(n), hard)
+}
+
+func getrlimit(resource uintptr) (syscall.Rlimit, error) {
+	if resource == syscall.RLIMIT_NOFILE {
+		soft, hard := NoFileLimit()
+		return syscall.Rlimit{Cur: soft, Max: hard}, nil
+	}
+	if resource >= _RLIM_NLIMITS {
+		return syscall.Rlimit{}, syscall.EINVAL
+	}
+	rlimitMutex.Lock()
+	defer rlimitMutex.Unlock()
+	if r, ok := rlimits[resource]; ok {
+		return *r, nil
+	}
+	return syscall.Rlimit{Cur: _RLIM_INFINITY, Max: _RLIM_INFINITY}, nil
+}
+
+func setrlimit(resource uintptr, rlim *syscall.Rlimit) error {
+	if rlim.Cur > rlim.Max {
+		return syscall.EINVAL
+	}
+	if resource == syscall.RLIMIT_NOFILE {
+		inodeMutex.Lock()
+		defer inodeMutex.Unlock()
+		if rlim.Max > nofileLimit.Max {
+			return syscall.EPERM
+		}
+		nofileLimit = *rlim
+		return nil
+	}
+	rlimitMutex.Lock()
+	defer rlimitMutex.Unlock()
+	r, ok := rlimits[resource]
+	if !ok {
+		return syscall.EINVAL
+	}
+	if rlim.Max > r.Max {
+		return syscall.EPERM
+	}
+	*r = *rlim
+	return nil
+}
+
+func rlimitFrom32(r *rlimit32) syscall.Rlimit {
+	conv := func(x uint32) uint64 {
+		if x == ^uint32(0) {
+			return _RLIM_INFINITY
+		}
+		return uint64(x)
+	}
+	return syscall.Rlimit{Cur: conv(r.cur), Max: conv(r.max)}
+}
+
+func rlimitTo32(r *syscall.Rlimit) rlimit32 {
+	conv := func(x uint64) uint32 {
+		if x > uint64(^uint32(0)) {
+			return ^uint32(0)
+		}
+		return uint32(x)
+	}
+	return rlimit32{cur: conv(r.Cur), max: conv(r.Max)}
+}
+
+// func getrlimit(resource int, rlim *rlimit32)
+func sysGetrlimit(c *isyscall.Request) {
+	rlim, err := getrlimit(c.Args[0])
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	*(*rlimit32)(unsafe.Pointer(c.Args[1])) = rlimitTo32(&rlim)
+	c.Ret = 0
+	c.Done()
+}
+
+// func setrlimit(resource int, rlim *rlimit32)
+func sysSetrlimit(c *isyscall.Request) {
+	rlim := rlimitFrom32((*rlimit32)(unsafe.Pointer(c.Args[1])))
+	c.Ret = isyscall.Error(setrlimit(c.Args[0], &rlim))
+	c.Done()
+}
+
+// func prlimit(pid int, resource int, newlimit *Rlimit, old *Rlimit)
+func sysPrlimit64(c *isyscall.Request) {
+	pid, resource, newptr, oldptr := c.Args[0], c.Args[1], c.Args[2], c.Args[3]
+	if pid != 0 && pid != kernelPid {
+		c.Ret = isyscall.Errno(syscall.ESRCH)
+		c.Done()
+		return
+	}
+
+	old, err := getrlimit(resource)
+	if err == nil && newptr != 0 {
+		err = setrlimit(resource, (*syscall.Rlimit)(unsafe.Pointer(newptr)))
+	}
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	if oldptr != 0 {
+		*(*syscall.Rlimit)(unsafe.Pointer(oldptr)) = old
+	}
+	c.Ret = 0
+	c.Done()
+}
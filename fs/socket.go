@@ -0,0 +1,610 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+// The socket syscalls of i386 besides socketcall, which is handled by
+// package inet. The sockets created by them are loopback only, the data
+// is passed through memory and never reaches a network device.
+const (
+	_SYS_SOCKET      = 359
+	_SYS_BIND        = 361
+	_SYS_CONNECT     = 362
+	_SYS_LISTEN      = 363
+	_SYS_ACCEPT4     = 364
+	_SYS_GETSOCKOPT  = 365
+	_SYS_SETSOCKOPT  = 366
+	_SYS_GETSOCKNAME = 367
+	_SYS_GETPEERNAME = 368
+)
+
+const (
+	// the max bytes buffered in one direction of a connection
+	sockBufSize = 64 << 10
+	// the first port used by autobind
+	ephemeralPort = 32768
+)
+
+const (
+	sockNew = iota
+	sockBound
+	sockListen
+	sockConnected
+	sockClosed
+)
+
+type sockAddr struct {
+	ip   [4]byte
+	port uint16
+}
+
+type sockaddrIn struct {
+	family uint16
+	port   [2]byte
+	ip     [4]byte
+	_      [8]byte
+}
+
+var (
+	loopMutex sync.Mutex
+	loopPorts = make(map[uint16]*loopSocket)
+	nextPort  = uint16(ephemeralPort)
+)
+
+func isLoopback(ip [4]byte) bool {
+	return ip[0] == 127 || ip == [4]byte{}
+}
+
+// sockBuf is one direction of a connection
+type sockBuf struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+	// closed is set when either end is closed
+	closed bool
+}
+
+func newSockBuf() *sockBuf {
+	b := new(sockBuf)
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *sockBuf) read(p []byte, nonblock bool) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		if nonblock {
+			return 0, syscall.EAGAIN
+		}
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, _ := b.buf.Read(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *sockBuf) write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	written := 0
+	for len(p) > 0 {
+		if b.closed {
+			if written != 0 {
+				return written, nil
+			}
+			return 0, syscall.EPIPE
+		}
+		n := sockBufSize - b.buf.Len()
+		if n == 0 {
+			b.cond.Wait()
+			continue
+		}
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf.Write(p[:n])
+		p = p[n:]
+		written += n
+		b.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (b *sockBuf) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Len()
+}
+
+func (b *sockBuf) close() {
+	b.mutex.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+// loopSocket is a TCP like socket connected through memory
+type loopSocket struct {
+	mutex sync.Mutex
+	// fd is -1 before the connection is accepted
+	fd    int
+	state int
+
+	local, remote sockAddr
+	rx, tx        *sockBuf
+	peer          *loopSocket
+
+	// backlog holds the connections waiting for accept
+	backlog chan *loopSocket
+}
+
+func (s *loopSocket) notify() {
+	s.mutex.Lock()
+	fd := s.fd
+	s.mutex.Unlock()
+	if fd >= 0 {
+		evnotify(uintptr(fd), syscall.EPOLLIN)
+	}
+}
+
+func (s *loopSocket) read(p []byte, nonblock bool) (int, error) {
+	s.mutex.Lock()
+	rx := s.rx
+	s.mutex.Unlock()
+	if rx == nil {
+		return 0, syscall.ENOTCONN
+	}
+	return rx.read(p, nonblock)
+}
+
+func (s *loopSocket) Read(p []byte) (int, error) {
+	return s.read(p, false)
+}
+
+func (s *loopSocket) ReadNonBlock(p []byte) (int, error) {
+	return s.read(p, true)
+}
+
+func (s *loopSocket) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	tx, peer := s.tx, s.peer
+	s.mutex.Unlock()
+	if tx == nil {
+		return 0, syscall.ENOTCONN
+	}
+	n, err := tx.write(p)
+	if n != 0 {
+		peer.notify()
+	}
+	return n, err
+}
+
+func (s *loopSocket) Readable() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case s.backlog != nil:
+		return len(s.backlog) != 0
+	case s.rx != nil:
+		return s.rx.len() != 0
+	}
+	return false
+}
+
+func (s *loopSocket) Ioctl(op, arg uintptr) error {
+	switch op {
+	case _FIONREAD:
+		n := 0
+		s.mutex.Lock()
+		if s.rx != nil {
+			n = s.rx.len()
+		}
+		s.mutex.Unlock()
+		*(*int32)(unsafe.Pointer(arg)) = int32(n)
+		return nil
+	default:
+		return syscall.ENOTTY
+	}
+}
+
+// sockInfo is the os.FileInfo of the socket fds
+type sockInfo struct{}
+
+func (sockInfo) Name() string       { return "socket" }
+func (sockInfo) Size() int64        { return 0 }
+func (sockInfo) Mode() os.FileMode  { return os.ModeSocket | 0777 }
+func (sockInfo) ModTime() time.Time { return time.Time{} }
+func (sockInfo) IsDir() bool        { return false }
+func (sockInfo) Sys() interface{}   { return nil }
+
+// SocketInfo returns the os.FileInfo reported by fstat of sockets, used by
+// the socket files outside fs.
+func SocketInfo() os.FileInfo {
+	return sockInfo{}
+}
+
+func (s *loopSocket) Stat() (os.FileInfo, error) {
+	return SocketInfo(), nil
+}
+
+// Close tears down the connection or listener once, closing a closed
+// socket does nothing.
+func (s *loopSocket) Close() error {
+	s.mutex.Lock()
+	if s.state == sockClosed {
+		s.mutex.Unlock()
+		return nil
+	}
+	state, local := s.state, s.local
+	s.state = sockClosed
+	rx, tx, peer, backlog := s.rx, s.tx, s.peer, s.backlog
+	s.mutex.Unlock()
+
+	if state == sockBound || state == sockListen {
+		loopMutex.Lock()
+		if loopPorts[local.port] == s {
+			delete(loopPorts, local.port)
+		}
+		loopMutex.Unlock()
+	}
+	if backlog != nil {
+		// refuse the connections not accepted, and wake up the blocked
+		// accepts. No connect can reach the backlog once the port is freed.
+	drain:
+		for {
+			select {
+			case conn := <-backlog:
+				conn.Close()
+			default:
+				break drain
+			}
+		}
+		close(backlog)
+	}
+	if rx != nil {
+		rx.close()
+		tx.close()
+		peer.notify()
+	}
+	return nil
+}
+
+// bindPort binds s to port, a free port is picked if port is 0. It must be
+// called with loopMutex held.
+func (s *loopSocket) bindPort(port uint16) error {
+	if port == 0 {
+		for i := 0; ; i++ {
+			if i == 1<<16-ephemeralPort {
+				return syscall.EADDRINUSE
+			}
+			port = nextPort
+			if nextPort++; nextPort == 0 {
+				nextPort = ephemeralPort
+			}
+			if loopPorts[port] == nil {
+				break
+			}
+		}
+	}
+	if loopPorts[port] != nil {
+		return syscall.EADDRINUSE
+	}
+	loopPorts[port] = s
+	s.local.port = port
+	return nil
+}
+
+func (s *loopSocket) bind(addr sockAddr) error {
+	if !isLoopback(addr.ip) {
+		return syscall.EADDRNOTAVAIL
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state != sockNew {
+		return syscall.EINVAL
+	}
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+	if err := s.bindPort(addr.port); err != nil {
+		return err
+	}
+	s.local.ip = addr.ip
+	s.state = sockBound
+	return nil
+}
+
+func (s *loopSocket) listen(backlog int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// backlog is read by connect with loopMutex held
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+	switch s.state {
+	case sockListen:
+		return nil
+	case sockNew:
+		// autobind like linux
+		if err := s.bindPort(0); err != nil {
+			return err
+		}
+	case sockBound:
+	default:
+		return syscall.EINVAL
+	}
+	if backlog < 1 {
+		backlog = 1
+	}
+	if backlog > syscall.SOMAXCONN {
+		backlog = syscall.SOMAXCONN
+	}
+	s.backlog = make(chan *loopSocket, backlog)
+	s.state = sockListen
+	return nil
+}
+
+func (s *loopSocket) connect(addr sockAddr) error {
+	if !isLoopback(addr.ip) {
+		// no route to the network stack from here
+		return syscall.ECONNREFUSED
+	}
+	if addr.ip == [4]byte{} {
+		addr.ip = [4]byte{127, 0, 0, 1}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch s.state {
+	case sockConnected:
+		return syscall.EISCONN
+	case sockListen, sockClosed:
+		return syscall.EINVAL
+	}
+
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+	l := loopPorts[addr.port]
+	if l == nil || l.backlog == nil {
+		return syscall.ECONNREFUSED
+	}
+	if s.state == sockNew {
+		if err := s.bindPort(0); err != nil {
+			return err
+		}
+		s.local.ip = addr.ip
+	}
+	// the client port is not used by other connections once connected
+	if loopPorts[s.local.port] == s {
+		delete(loopPorts, s.local.port)
+	}
+
+	conn := &loopSocket{
+		fd:     -1,
+		state:  sockConnected,
+		local:  addr,
+		remote: s.local,
+		rx:     newSockBuf(),
+		tx:     newSockBuf(),
+		peer:   s,
+	}
+	select {
+	case l.backlog <- conn:
+	default:
+		return syscall.ECONNREFUSED
+	}
+	s.state = sockConnected
+	s.remote = addr
+	s.rx, s.tx = conn.tx, conn.rx
+	s.peer = conn
+	go l.notify()
+	return nil
+}
+
+func (s *loopSocket) accept(nonblock bool) (*loopSocket, error) {
+	s.mutex.Lock()
+	backlog := s.backlog
+	s.mutex.Unlock()
+	if backlog == nil {
+		return nil, syscall.EINVAL
+	}
+	var conn *loopSocket
+	var ok bool
+	if nonblock {
+		select {
+		case conn, ok = <-backlog:
+		default:
+			return nil, syscall.EAGAIN
+		}
+	} else {
+		conn, ok = <-backlog
+	}
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return conn, nil
+}
+
+func readSockaddr(p, n uintptr) (sockAddr, error) {
+	if n < unsafe.Sizeof(sockaddrIn{}) {
+		return sockAddr{}, syscall.EINVAL
+	}
+	sa := (*sockaddrIn)(unsafe.Pointer(p))
+	if sa.family != syscall.AF_INET {
+		return sockAddr{}, syscall.EAFNOSUPPORT
+	}
+	return sockAddr{
+		ip:   sa.ip,
+		port: uint16(sa.port[0])<<8 | uint16(sa.port[1]),
+	}, nil
+}
+
+// writeSockaddr writes addr to p, lenp is the length of p on input and
+// the length of address on output.
+func writeSockaddr(addr sockAddr, p, lenp uintptr) {
+	if p == 0 || lenp == 0 {
+		return
+	}
+	sa := sockaddrIn{
+		family: syscall.AF_INET,
+		port:   [2]byte{byte(addr.port >> 8), byte(addr.port)},
+		ip:     addr.ip,
+	}
+	size := (*uint32)(unsafe.Pointer(lenp))
+	n := unsafe.Sizeof(sa)
+	if uintptr(*size) < n {
+		n = uintptr(*size)
+	}
+	copy((*[unsafe.Sizeof(sa)]byte)(unsafe.Pointer(p))[:n],
+		(*[unsafe.Sizeof(sa)]byte)(unsafe.Pointer(&sa))[:])
+	*size = uint32(unsafe.Sizeof(sa))
+}
+
+func allocSocket(s *loopSocket, flags int) (int, error) {
+	fd, ni, err := AllocFileNode(s)
+	if err != nil {
+		return 0, err
+	}
+	ni.Name = "socket:[loopback]"
+	ni.Flags = syscall.O_RDWR | flags&(syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	s.mutex.Lock()
+	s.fd = fd
+	s.mutex.Unlock()
+	return fd, nil
+}
+
+func getSocket(fd uintptr) (*loopSocket, *Inode, error) {
+	ni, err := GetInode(int(fd))
+	if err != nil {
+		return nil, nil, err
+	}
+	s, ok := ni.File.(*loopSocket)
+	if !ok {
+		return nil, nil, syscall.ENOTSOCK
+	}
+	return s, ni, nil
+}
+
+func socket(domain, typ, proto int) (int, error) {
+	if domain != syscall.AF_INET {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	if typ&0xf != syscall.SOCK_STREAM {
+		return 0, syscall.ESOCKTNOSUPPORT
+	}
+	if proto != 0 && proto != syscall.IPPROTO_TCP {
+		return 0, syscall.EPROTONOSUPPORT
+	}
+	return allocSocket(&loopSocket{fd: -1}, typ&^0xf)
+}
+
+func getsockopt(s *loopSocket, level, name int) (int, error) {
+	if level != syscall.SOL_SOCKET {
+		return 0, nil
+	}
+	switch name {
+	case syscall.SO_TYPE:
+		return syscall.SOCK_STREAM, nil
+	case syscall.SO_ERROR:
+		return 0, nil
+	case syscall.SO_ACCEPTCONN:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.state == sockListen {
+			return 1, nil
+		}
+		return 0, nil
+	case syscall.SO_RCVBUF, syscall.SO_SNDBUF:
+		return sockBufSize, nil
+	}
+	return 0, nil
+}
+
+// func socket(domain, typ, proto int)
+func sysSocket(c *isyscall.Request) {
+	fd, err := socket(int(c.Args[0]), int(c.Args[1]), int(c.Args[2]))
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+	} else {
+		c.Ret = uintptr(fd)
+	}
+	c.Done()
+}
+
+// sysSockcall handles the socket syscalls on an existing socket fd
+func sysSockcall(c *isyscall.Request) {
+	s, ni, err := getSocket(c.Args[0])
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+
+	var addr sockAddr
+	c.Ret = 0
+	switch c.NO {
+	case _SYS_BIND:
+		addr, err = readSockaddr(c.Args[1], c.Args[2])
+		if err == nil {
+			err = s.bind(addr)
+		}
+	case _SYS_CONNECT:
+		addr, err = readSockaddr(c.Args[1], c.Args[2])
+		if err == nil {
+			err = s.connect(addr)
+		}
+	case _SYS_LISTEN:
+		err = s.listen(int(int32(c.Args[1])))
+	case _SYS_ACCEPT4:
+		var conn *loopSocket
+		conn, err = s.accept(ni.Flags&syscall.O_NONBLOCK != 0)
+		if err != nil {
+			break
+		}
+		var fd int
+		fd, err = allocSocket(conn, int(c.Args[3]))
+		if err != nil {
+			conn.Close()
+			break
+		}
+		writeSockaddr(conn.remote, c.Args[1], c.Args[2])
+		c.Ret = uintptr(fd)
+	case _SYS_GETSOCKNAME, _SYS_GETPEERNAME:
+		s.mutex.Lock()
+		addr = s.local
+		if c.NO == _SYS_GETPEERNAME {
+			if s.state != sockConnected {
+				err = syscall.ENOTCONN
+			}
+			addr = s.remote
+		}
+		s.mutex.Unlock()
+		if err == nil {
+			writeSockaddr(addr, c.Args[1], c.Args[2])
+		}
+	case _SYS_GETSOCKOPT:
+		var v int
+		v, err = getsockopt(s, int(c.Args[1]), int(c.Args[2]))
+		if err == nil && c.Args[3] != 0 {
+			*(*int32)(unsafe.Pointer(c.Args[3])) = int32(v)
+			*(*uint32)(unsafe.Pointer(c.Args[4])) = 4
+		}
+	case _SYS_SETSOCKOPT:
+		// the options make no difference in memory
+	}
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+	}
+	c.Done()
+}
@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func newTestSocket(t *testing.T, flags int) (*loopSocket, *Inode) {
+	fd, err := socket(syscall.AF_INET, syscall.SOCK_STREAM|flags, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ni, err := getSocket(uintptr(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ni
+}
+
+func TestLoopbackSocket(t *testing.T) {
+	l, lni := newTestSocket(t, syscall.SOCK_NONBLOCK)
+	defer sysClose(lni)
+	if err := l.bind(sockAddr{ip: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.listen(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.accept(true); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+
+	c, cni := newTestSocket(t, 0)
+	if err := c.connect(sockAddr{ip: [4]byte{10, 0, 0, 1}, port: l.local.port}); err != syscall.ECONNREFUSED {
+		t.Fatalf("expect ECONNREFUSED for non-loopback, got %v", err)
+	}
+	if err := c.connect(sockAddr{ip: [4]byte{127, 0, 0, 1}, port: l.local.port + 1}); err != syscall.ECONNREFUSED {
+		t.Fatalf("expect ECONNREFUSED without listener, got %v", err)
+	}
+	if err := c.connect(sockAddr{ip: [4]byte{127, 0, 0, 1}, port: l.local.port}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.accept(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := allocSocket(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sni, _ := GetInode(fd)
+	if conn.remote != c.local || c.remote != conn.local {
+		t.Fatalf("bad addresses %v %v", conn.remote, c.local)
+	}
+
+	msg := []byte("hello")
+	sysWrite(cni, uintptr(unsafe.Pointer(&msg[0])), uintptr(len(msg)))
+	var n int32
+	if err := conn.Ioctl(_FIONREAD, uintptr(unsafe.Pointer(&n))); err != nil || n != 5 {
+		t.Fatalf("FIONREAD:%d %v", n, err)
+	}
+	buf := make([]byte, 16)
+	ret, err := sysRead(sni, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if err != nil || string(buf[:ret]) != "hello" {
+		t.Fatalf("read %q %v", buf[:ret], err)
+	}
+
+	sni.Flags |= syscall.O_NONBLOCK
+	if _, err := sysRead(sni, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf))); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+
+	// closing one end gives EOF to the other one
+	sysClose(cni)
+	if b, err := ioutil.ReadAll(conn); err != nil || len(b) != 0 {
+		t.Fatalf("expect EOF, got %q %v", b, err)
+	}
+	if _, err := conn.Write(msg); err != syscall.EPIPE {
+		t.Fatalf("expect EPIPE, got %v", err)
+	}
+	sysClose(sni)
+}
+
+func TestSocketPortReuse(t *testing.T) {
+	a, ani := newTestSocket(t, 0)
+	if err := a.bind(sockAddr{port: 8080}); err != nil {
+		t.Fatal(err)
+	}
+	b, bni := newTestSocket(t, 0)
+	defer sysClose(bni)
+	if err := b.bind(sockAddr{port: 8080}); err != syscall.EADDRINUSE {
+		t.Fatalf("expect EADDRINUSE, got %v", err)
+	}
+	sysClose(ani)
+	if err := b.bind(sockAddr{port: 8080}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketClose(t *testing.T) {
+	l, lni := newTestSocket(t, 0)
+	defer sysClose(lni)
+	if err := l.bind(sockAddr{ip: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	l.listen(1)
+	c, cni := newTestSocket(t, 0)
+	if err := c.connect(sockAddr{ip: [4]byte{127, 0, 0, 1}, port: l.local.port}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stat syscall.Stat_t
+	if err := sysStat(cni, uintptr(unsafe.Pointer(&stat))); err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+		t.Fatalf("bad socket mode %#o %v", stat.Mode, err)
+	}
+	on := int32(1)
+	if err := sysIoctl(cni, _FIONBIO, uintptr(unsafe.Pointer(&on))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := readBuf(cni, buf, false); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN after FIONBIO, got %v", err)
+	}
+	on = 0
+	sysIoctl(cni, _FIONBIO, uintptr(unsafe.Pointer(&on)))
+
+	// closing the socket wakes up its blocked read
+	done := make(chan error)
+	go func() {
+		_, err := readBuf(cni, buf, false)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := sysClose(cni); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not woken up by close")
+	}
+	if err := sysClose(cni); err != syscall.EBADF {
+		t.Fatalf("expect EBADF on double close, got %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// the errnos counted by IOStats, the bigger ones are counted as the last one
+const maxErrno = 256
+
+// fdStats is the counters of an fd, updated by atomics
+type fdStats struct {
+	reads      uint64
+	writes     uint64
+	readBytes  uint64
+	writeBytes uint64
+	opened     time.Time
+}
+
+// ioTotals holds the counters of all the fds, the ones of an open fd are
+// folded into it on release.
+var ioTotals struct {
+	opens      uint64
+	closes     uint64
+	reads      uint64
+	writes     uint64
+	readBytes  uint64
+	writeBytes uint64
+	errors     [maxErrno]uint64
+}
+
+// IOStats is a snapshot of the vfs counters, the totals include the open
+// fds.
+type IOStats struct {
+	Opens      uint64
+	Closes     uint64
+	Reads      uint64
+	Writes     uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+	// Errors is the number of the failed fd syscalls by errno
+	Errors map[syscall.Errno]uint64
+	// Fds is the open fds ordered by fd
+	Fds []FdStats
+}
+
+// FdStats is the counters of an open fd
+type FdStats struct {
+	Fd         int
+	Name       string
+	Flags      int
+	Opened     time.Time
+	Reads      uint64
+	Writes     uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+func openStats(s *fdStats) {
+	s.opened = time.Now()
+	atomic.AddUint64(&ioTotals.opens, 1)
+}
+
+// count updates s by the syscall fn transferring n bytes
+func (s *fdStats) count(fn int, n uintptr) {
+	switch fn {
+	case syscall.SYS_READ, syscall.SYS_READV, syscall.SYS_PREAD64:
+		atomic.AddUint64(&s.reads, 1)
+		atomic.AddUint64(&s.readBytes, uint64(n))
+	case syscall.SYS_WRITE, syscall.SYS_WRITEV, syscall.SYS_PWRITE64:
+		atomic.AddUint64(&s.writes, 1)
+		atomic.AddUint64(&s.writeBytes, uint64(n))
+	}
+}
+
+// foldStats adds the counters of a released fd to ioTotals
+func foldStats(s *fdStats) {
+	atomic.AddUint64(&ioTotals.closes, 1)
+	atomic.AddUint64(&ioTotals.reads, atomic.LoadUint64(&s.reads))
+	atomic.AddUint64(&ioTotals.writes, atomic.LoadUint64(&s.writes))
+	atomic.AddUint64(&ioTotals.readBytes, atomic.LoadUint64(&s.readBytes))
+	atomic.AddUint64(&ioTotals.writeBytes, atomic.LoadUint64(&s.writeBytes))
+}
+
+// countErrno counts the error of an fd syscall, and returns its errno
+func countErrno(err error) syscall.Errno {
+	e := errnoFromErr(err)
+	i := int(e)
+	if i >= maxErrno {
+		i = maxErrno - 1
+	}
+	atomic.AddUint64(&ioTotals.errors[i], 1)
+	return e
+}
+
+// Stats returns the counters of vfs
+func Stats() IOStats {
+	st := IOStats{
+		Opens:      atomic.LoadUint64(&ioTotals.opens),
+		Closes:     atomic.LoadUint64(&ioTotals.closes),
+		Reads:      atomic.LoadUint64(&ioTotals.reads),
+		Writes:     atomic.LoadUint64(&ioTotals.writes),
+		ReadBytes:  atomic.LoadUint64(&ioTotals.readBytes),
+		WriteBytes: atomic.LoadUint64(&ioTotals.writeBytes),
+		Errors:     make(map[syscall.Errno]uint64),
+	}
+	for i := range ioTotals.errors {
+		if n := atomic.LoadUint64(&ioTotals.errors[i]); n != 0 {
+			st.Errors[syscall.Errno(i)] = n
+		}
+	}
+
+	inodeMutex.Lock()
+	for fd, ni := range inodes {
+		if ni == nil {
+			continue
+		}
+		f := FdStats{
+			Fd:         fd,
+			Name:       ni.Name,
+			Flags:      ni.Flags,
+			Opened:     ni.stats.opened,
+			Reads:      atomic.LoadUint64(&ni.stats.reads),
+			Writes:     atomic.LoadUint64(&ni.stats.writes),
+			ReadBytes:  atomic.LoadUint64(&ni.stats.readBytes),
+			WriteBytes: atomic.LoadUint64(&ni.stats.writeBytes),
+		}
+		st.Fds = append(st.Fds, f)
+		st.Reads += f.Reads
+		st.Writes += f.Writes
+		st.ReadBytes += f.ReadBytes
+		st.WriteBytes += f.WriteBytes
+	}
+	inodeMutex.Unlock()
+	return st
+}
+
+// procFsStats is /proc/eggos/fs, the totals followed by a line of every
+// open fd.
+func procFsStats() []byte {
+	st := Stats()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "opens %d\n", st.Opens)
+	fmt.Fprintf(&buf, "closes %d\n", st.Closes)
+	fmt.Fprintf(&buf, "reads %d %d\n", st.Reads, st.ReadBytes)
+	fmt.Fprintf(&buf, "writes %d %d\n", st.Writes, st.WriteBytes)
+	var errnos []int
+	for e := range st.Errors {
+		errnos = append(errnos, int(e))
+	}
+	sort.Ints(errnos)
+	for _, e := range errnos {
+		fmt.Fprintf(&buf, "errno %d %d\n", e, st.Errors[syscall.Errno(e)])
+	}
+	fmt.Fprintf(&buf, "fd flags reads writes rbytes wbytes age path\n")
+	now := time.Now()
+	for _, f := range st.Fds {
+		fmt.Fprintf(&buf, "%d %#o %d %d %d %d %.0f %s\n", f.Fd, f.Flags,
+			f.Reads, f.Writes, f.ReadBytes, f.WriteBytes, now.Sub(f.Opened).Seconds(), f.Name)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,49 @@
+package fs
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	before := Stats()
+	fd, ni, err := AllocFileNode(newEventFd(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.Name = "anon_inode:[eventfd]"
+	ni.stats.count(syscall.SYS_WRITE, 8)
+	ni.stats.count(syscall.SYS_READ, 8)
+	ni.stats.count(syscall.SYS_READV, 4)
+	countErrno(syscall.EAGAIN)
+
+	st := Stats()
+	var found bool
+	for _, f := range st.Fds {
+		if f.Fd == fd {
+			found = true
+			if f.Reads != 2 || f.ReadBytes != 12 || f.Writes != 1 || f.WriteBytes != 8 {
+				t.Fatalf("bad fd stats %+v", f)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("fd %d not listed", fd)
+	}
+	if st.Opens != before.Opens+1 || st.ReadBytes != before.ReadBytes+12 ||
+		st.Errors[syscall.EAGAIN] != before.Errors[syscall.EAGAIN]+1 {
+		t.Fatalf("bad totals %+v", st)
+	}
+	if !bytes.Contains(procFsStats(), []byte("anon_inode:[eventfd]")) {
+		t.Fatalf("fd missing in /proc/eggos/fs:\n%s", procFsStats())
+	}
+
+	// the counters of the closed fd stay in the totals
+	sysClose(ni)
+	st = Stats()
+	if st.Closes != before.Closes+1 || st.ReadBytes != before.ReadBytes+12 ||
+		st.WriteBytes != before.WriteBytes+8 {
+		t.Fatalf("bad totals after close %+v", st)
+	}
+}
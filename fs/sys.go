@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"strconv"
+	"syscall"
+
+	"github.com/icexin/eggos/fs/sysfs"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/random"
+)
+
+func sysInodes() string {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	return strconv.Itoa(len(inodes))
+}
+
+func sysSyscalls() string {
+	return strconv.Itoa(isyscall.NumHandlers())
+}
+
+// sysRandomSeed reports whether the pool is seeded, the written data is
+// mixed into the pool without crediting entropy.
+func sysRandomSeed() string {
+	if random.Ready() {
+		return "1"
+	}
+	return "0"
+}
+
+func sysSetRandomSeed(seed string) error {
+	random.AddEntropy([]byte(seed))
+	return nil
+}
+
+// sysStrictPermissions reports StrictPermissions as 0 or 1
+func sysStrictPermissions() string {
+	if StrictPermissions {
+		return "1"
+	}
+	return "0"
+}
+
+// sysSetStrictPermissions sets StrictPermissions from 0 or 1
+func sysSetStrictPermissions(v string) error {
+	switch v {
+	case "0":
+		StrictPermissions = false
+	case "1":
+		StrictPermissions = true
+	default:
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// sysfsRegister adds the built-in tunables of sysfs.Default
+func sysfsRegister() {
+	sysfs.Register("fs/inodes", sysInodes, nil)
+	sysfs.Register("fs/strict_permissions", sysStrictPermissions, sysSetStrictPermissions)
+	sysfs.Register("kernel/syscalls", sysSyscalls, nil)
+	sysfs.Register("kernel/random/seed", sysRandomSeed, sysSetRandomSeed)
+}
+
+func sysfsInit() {
+	sysfsRegister()
+	err := Mount("/sys", sysfs.Default)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,348 @@
+// Package sysfs implements an afero.Fs of the kernel tunables, every file is
+// a registered value, it's mounted at /sys by fs.
+package sysfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	roMode  = 0444
+	rwMode  = 0644
+	dirMode = os.ModeDir | 0555
+)
+
+// GetFunc returns the current value of a tunable
+type GetFunc func() string
+
+// SetFunc changes the value of a tunable, the trailing newline of written
+// data is stripped.
+type SetFunc func(string) error
+
+type node struct {
+	name string
+	// children is nil for tunables
+	get      GetFunc
+	set      SetFunc
+	children map[string]*node
+}
+
+func (n *node) isDir() bool {
+	return n.children != nil
+}
+
+// Sysfs is a tree of registered tunables.
+type Sysfs struct {
+	mutex   sync.Mutex
+	root    *node
+	modTime time.Time
+}
+
+func New() *Sysfs {
+	return &Sysfs{
+		root:    &node{name: "/", children: make(map[string]*node)},
+		modTime: time.Now(),
+	}
+}
+
+// Default is the Sysfs mounted at /sys
+var Default = New()
+
+// Register adds a tunable to Default, see Sysfs.Register.
+func Register(name string, get GetFunc, set SetFunc) error {
+	return Default.Register(name, get, set)
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(filepath.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// Register adds the tunable name, reading the file calls get and writing
+// calls set. The tunable is read-only if set is nil.
+func (s *Sysfs) Register(name string, get GetFunc, set SetFunc) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	parts := splitPath(name)
+	if len(parts) == 0 || get == nil {
+		return &os.PathError{Op: "register", Path: name, Err: os.ErrInvalid}
+	}
+	dir := s.root
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := dir.children[part]
+		if !ok {
+			next = &node{name: part, children: make(map[string]*node)}
+			dir.children[part] = next
+		}
+		if !next.isDir() {
+			return &os.PathError{Op: "register", Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = next
+	}
+	last := parts[len(parts)-1]
+	if _, ok := dir.children[last]; ok {
+		return &os.PathError{Op: "register", Path: name, Err: os.ErrExist}
+	}
+	dir.children[last] = &node{name: last, get: get, set: set}
+	return nil
+}
+
+func (s *Sysfs) lookup(name string) (*node, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.root
+	for _, part := range splitPath(name) {
+		if !n.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		next, ok := n.children[part]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		n = next
+	}
+	return n, nil
+}
+
+func (s *Sysfs) info(n *node) os.FileInfo {
+	mode := os.FileMode(roMode)
+	switch {
+	case n.isDir():
+		mode = dirMode
+	case n.set != nil:
+		mode = rwMode
+	}
+	return &fileInfo{name: n.name, mode: mode, modTime: s.modTime}
+}
+
+// Create creates a file in the filesystem, returning the file and an
+// error, if any happens.
+func (s *Sysfs) Create(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
+}
+
+// Mkdir creates a directory in the filesystem, return an error if any
+// happens.
+func (s *Sysfs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+// MkdirAll creates a directory path and all parents that does not exist
+// yet.
+func (s *Sysfs) MkdirAll(path string, perm os.FileMode) error {
+	if n, err := s.lookup(path); err == nil && n.isDir() {
+		return nil
+	}
+	return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrPermission}
+}
+
+// Open opens a file, returning it or an error, if any happens.
+func (s *Sysfs) Open(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file using the given flags and the given mode, only
+// the existing tunables can be opened.
+func (s *Sysfs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	n, err := s.lookup(name)
+	if err != nil {
+		if flag&os.O_CREATE != 0 && os.IsNotExist(err) {
+			err = os.ErrPermission
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if write && (n.isDir() || n.set == nil) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	f := &file{
+		fs:    s,
+		node:  n,
+		name:  name,
+		write: write,
+	}
+	if !n.isDir() && flag&os.O_WRONLY == 0 {
+		f.Reader = bytes.NewReader([]byte(n.get() + "\n"))
+	}
+	return f, nil
+}
+
+// Remove removes a file identified by name, returning an error, if any
+// happens.
+func (s *Sysfs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+// RemoveAll removes a directory path and any children it contains. It
+// does not fail if the path does not exist (return nil).
+func (s *Sysfs) RemoveAll(path string) error {
+	return &os.PathError{Op: "remove", Path: path, Err: os.ErrPermission}
+}
+
+// Rename renames a file.
+func (s *Sysfs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+// Stat returns a FileInfo describing the named file, or an error, if any
+// happens.
+func (s *Sysfs) Stat(name string) (os.FileInfo, error) {
+	n, err := s.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return s.info(n), nil
+}
+
+// The name of this FileSystem
+func (s *Sysfs) Name() string {
+	return "sysfs"
+}
+
+// Chmod changes the mode of the named file to mode.
+func (s *Sysfs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: os.ErrPermission}
+}
+
+// Chtimes changes the access and modification times of the named file
+func (s *Sysfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrPermission}
+}
+
+type fileInfo struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return 0 }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+// file is an opened tunable or directory, the value is read when opening
+// and every write is passed to set.
+type file struct {
+	*bytes.Reader
+	fs    *Sysfs
+	node  *node
+	name  string
+	write bool
+	// offset of directory entries
+	offset int
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.node.isDir() {
+		return 0, syscall.EISDIR
+	}
+	if f.Reader == nil {
+		return 0, syscall.EBADF
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.node.isDir() {
+		return 0, syscall.EISDIR
+	}
+	if f.Reader == nil {
+		return 0, syscall.EBADF
+	}
+	return f.Reader.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.Reader == nil {
+		return 0, nil
+	}
+	return f.Reader.Seek(offset, whence)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.write {
+		return 0, syscall.EBADF
+	}
+	if err := f.node.set(strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) { return f.Write(p) }
+func (f *file) WriteString(s string) (int, error)        { return f.Write([]byte(s)) }
+
+func (f *file) Name() string { return f.name }
+
+func (f *file) names() []string {
+	var names []string
+	f.fs.mutex.Lock()
+	for name := range f.node.children {
+		names = append(names, name)
+	}
+	f.fs.mutex.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	names, err := f.Readdirnames(count)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := f.fs.Stat(filepath.Join(f.name, name))
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	if !f.node.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	names := f.names()
+	if f.offset >= len(names) {
+		names = nil
+	} else {
+		names = names[f.offset:]
+	}
+	if n > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if len(names) > n {
+			names = names[:n]
+		}
+	}
+	f.offset += len(names)
+	return names, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) { return f.fs.info(f.node), nil }
+
+func (f *file) Sync() error { return nil }
+
+// Truncate is a no-op, so that the shell can redirect to a tunable
+func (f *file) Truncate(size int64) error { return nil }
+func (f *file) Close() error              { return nil }
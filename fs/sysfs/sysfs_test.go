@@ -0,0 +1,55 @@
+package sysfs
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestTunable(t *testing.T) {
+	s := New()
+	quantum := 10
+	get := func() string { return strconv.Itoa(quantum) }
+	set := func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return syscall.EINVAL
+		}
+		quantum = n
+		return nil
+	}
+	if err := s.Register("kernel/quantum", get, set); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("kernel/version", func() string { return "0" }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("kernel/quantum", get, set); !os.IsExist(err) {
+		t.Fatalf("expect exist error, got %v", err)
+	}
+
+	if err := afero.WriteFile(s, "/kernel/quantum", []byte("20\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := afero.ReadFile(s, "/kernel/quantum")
+	if err != nil || string(b) != "20\n" || quantum != 20 {
+		t.Fatalf("read %q %v, quantum %d", b, err, quantum)
+	}
+	if err := afero.WriteFile(s, "/kernel/quantum", []byte("fast"), 0); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	if _, err := s.OpenFile("/kernel/version", os.O_WRONLY, 0); !os.IsPermission(err) {
+		t.Fatalf("expect permission error, got %v", err)
+	}
+	if _, err := s.OpenFile("/kernel/new", os.O_WRONLY|os.O_CREATE, 0); !os.IsPermission(err) {
+		t.Fatalf("expect permission error, got %v", err)
+	}
+
+	names, err := afero.ReadDir(s, "/kernel")
+	if err != nil || len(names) != 2 || names[0].Mode() != rwMode || names[1].Mode() != roMode {
+		t.Fatalf("readdir %v %v", names, err)
+	}
+}
@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/mm"
+)
+
+const (
+	// loadInterval is the period of sampling the goroutine count
+	loadInterval = 5 * time.Second
+
+	// the fixed point shift of sysinfo loads
+	_SI_LOAD_SHIFT = 16
+)
+
+var (
+	// loadDecay is the decay of the 1, 5 and 15 minutes load average per
+	// loadInterval, the same as linux.
+	loadDecay = [3]float64{
+		math.Exp(-loadInterval.Seconds() / 60),
+		math.Exp(-loadInterval.Seconds() / 300),
+		math.Exp(-loadInterval.Seconds() / 900),
+	}
+
+	loadMutex sync.Mutex
+	loads     [3]float64
+)
+
+// updateLoads folds the sample n into the load averages
+func updateLoads(n int) {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+	for i, d := range loadDecay {
+		loads[i] = loads[i]*d + float64(n)*(1-d)
+	}
+}
+
+// loadAvg returns the 1, 5 and 15 minutes average of goroutine count,
+// eggos has no processes, the goroutines stand for the runnable tasks.
+func loadAvg() [3]float64 {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+	return loads
+}
+
+func loadavgLoop() {
+	ticker := time.NewTicker(loadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		updateLoads(runtime.NumGoroutine())
+	}
+}
+
+func sysinfo(info *syscall.Sysinfo_t) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stat := mm.Stat()
+
+	*info = syscall.Sysinfo_t{}
+	info.Uptime = int32(uptime() / time.Second)
+	for i, l := range loadAvg() {
+		info.Loads[i] = uint32(l * (1 << _SI_LOAD_SHIFT))
+	}
+	info.Totalram = uint32(stat.Total)
+	info.Freeram = uint32(stat.Free)
+	// no memory is shared, and the idle heap kept by go runtime is
+	// reported as buffers since it's reused before asking mm for more.
+	info.Bufferram = uint32(ms.HeapIdle - ms.HeapReleased)
+	procs := runtime.NumGoroutine()
+	if procs > math.MaxUint16 {
+		procs = math.MaxUint16
+	}
+	info.Procs = uint16(procs)
+	info.Unit = 1
+}
+
+// func sysinfo(info *Sysinfo_t)
+func sysSysinfo(c *isyscall.Request) {
+	sysinfo((*syscall.Sysinfo_t)(unsafe.Pointer(c.Args[0])))
+	c.Ret = 0
+	c.Done()
+}
@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSysinfo(t *testing.T) {
+	old, oldLoads := uptime, loads
+	defer func() {
+		uptime = old
+		loads = oldLoads
+	}()
+	uptime = func() time.Duration { return 90*time.Second + time.Millisecond }
+	loads = [3]float64{}
+
+	// the 1 minute average follows the samples faster
+	for i := 0; i < 12; i++ {
+		updateLoads(10)
+	}
+	l := loadAvg()
+	if !(l[0] > l[1] && l[1] > l[2] && l[2] > 0) || l[0] < 6 || l[0] > 10 {
+		t.Fatalf("bad loads %v", l)
+	}
+
+	var info syscall.Sysinfo_t
+	sysinfo(&info)
+	if info.Uptime != 90 || info.Unit != 1 || info.Procs == 0 {
+		t.Fatalf("bad sysinfo %+v", info)
+	}
+	if info.Loads[0] != uint32(l[0]*65536) {
+		t.Fatalf("expect load %v, got %d", l[0], info.Loads[0])
+	}
+}
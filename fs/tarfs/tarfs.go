@@ -0,0 +1,382 @@
+// Package tarfs implements a read-only afero.Fs backed by a tar archive in memory.
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// maxSymlinks is the max number of symlinks followed when resolving a path
+	maxSymlinks = 40
+)
+
+type entry struct {
+	name string
+	// full path in the archive, symlinks resolved
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+	// content of regular file
+	data []byte
+	// target of symlink
+	link string
+	// sorted names of directory entries
+	children []string
+}
+
+func (e *entry) isDir() bool {
+	return e.mode.IsDir()
+}
+
+func (e *entry) isSymlink() bool {
+	return e.mode&os.ModeSymlink != 0
+}
+
+// Fs serves the files of tar archive, the content of files are not copied.
+type Fs struct {
+	entries map[string]*entry
+}
+
+// counter counts the bytes read from r
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// New parses the tar archive in data, the data must not be modified.
+func New(data []byte) (*Fs, error) {
+	fs := &Fs{
+		entries: map[string]*entry{
+			"/": {name: "/", path: "/", mode: os.ModeDir | 0755},
+		},
+	}
+
+	r := &counter{r: bytes.NewReader(data)}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := clean(hdr.Name)
+		if name == "/" {
+			continue
+		}
+		e := &entry{
+			name:    path.Base(name),
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// the header has been consumed, r is at the beginning of file content
+			if r.n+hdr.Size > int64(len(data)) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			e.data = data[r.n : r.n+hdr.Size]
+		case tar.TypeDir:
+			if old, ok := fs.entries[name]; ok && old.isDir() {
+				// implicit directory created by entries inside it
+				old.mode, old.modTime = e.mode, e.modTime
+				continue
+			}
+		case tar.TypeSymlink:
+			e.link = hdr.Linkname
+		case tar.TypeLink:
+			target, ok := fs.entries[clean(hdr.Linkname)]
+			if !ok || target.isDir() {
+				return nil, &os.LinkError{Op: "link", Old: hdr.Linkname, New: hdr.Name, Err: os.ErrNotExist}
+			}
+			e.mode, e.data, e.link = target.mode, target.data, target.link
+		default:
+			// device, fifo and sparse files are not supported
+			continue
+		}
+		fs.add(name, e)
+	}
+
+	for _, e := range fs.entries {
+		sort.Strings(e.children)
+	}
+	return fs, nil
+}
+
+// add adds e to fs, and creates the missing parent directories.
+func (f *Fs) add(name string, e *entry) {
+	if _, ok := f.entries[name]; !ok {
+		dir := path.Dir(name)
+		parent, ok := f.entries[dir]
+		if !ok {
+			parent = &entry{name: path.Base(dir), mode: os.ModeDir | 0755, modTime: e.modTime}
+			f.add(dir, parent)
+		}
+		parent.children = append(parent.children, e.name)
+	}
+	e.path = name
+	f.entries[name] = e
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// resolve finds the entry of name, following the symlinks in the path.
+// The last element is not followed if follow is false.
+func (f *Fs) resolve(name string, follow bool) (*entry, error) {
+	name = clean(name)
+	links := 0
+again:
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	cur := "/"
+	e := f.entries[cur]
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if !e.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		next := path.Join(cur, part)
+		e = f.entries[next]
+		if e == nil {
+			return nil, os.ErrNotExist
+		}
+		last := i == len(parts)-1
+		if e.isSymlink() && (!last || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, syscall.ELOOP
+			}
+			target := e.link
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			name = clean(path.Join(append([]string{target}, parts[i+1:]...)...))
+			goto again
+		}
+		cur = next
+	}
+	return e, nil
+}
+
+func (f *Fs) open(name string, follow bool) (*entry, error) {
+	e, err := f.resolve(name, follow)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return e, nil
+}
+
+func erofs(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+// Create creates a file in the filesystem, returning the file and an
+// error, if any happens.
+func (f *Fs) Create(name string) (afero.File, error) {
+	return nil, erofs("create", name)
+}
+
+// Mkdir creates a directory in the filesystem, return an error if any
+// happens.
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	return erofs("mkdir", name)
+}
+
+// MkdirAll creates a directory path and all parents that does not exist
+// yet.
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	if e, err := f.resolve(name, true); err == nil && e.isDir() {
+		return nil
+	}
+	return erofs("mkdir", name)
+}
+
+// Open opens a file, returning it or an error, if any happens.
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file using the given flags and the given mode.
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, erofs("open", name)
+	}
+	e, err := f.open(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &file{
+		Reader: bytes.NewReader(e.data),
+		fs:     f,
+		entry:  e,
+		name:   name,
+	}, nil
+}
+
+// Remove removes a file identified by name, returning an error, if any
+// happens.
+func (f *Fs) Remove(name string) error {
+	return erofs("remove", name)
+}
+
+// RemoveAll removes a directory path and any children it contains. It
+// does not fail if the path does not exist (return nil).
+func (f *Fs) RemoveAll(name string) error {
+	return erofs("remove", name)
+}
+
+// Rename renames a file.
+func (f *Fs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+// Stat returns a FileInfo describing the named file, or an error, if any
+// happens.
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	e, err := f.resolve(name, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &fileInfo{e}, nil
+}
+
+// LstatIfPossible is like Stat but doesn't follow the last symlink.
+func (f *Fs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	e, err := f.resolve(name, false)
+	if err != nil {
+		return nil, true, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return &fileInfo{e}, true, nil
+}
+
+// ReadlinkIfPossible returns the target of symlink.
+func (f *Fs) ReadlinkIfPossible(name string) (string, error) {
+	e, err := f.resolve(name, false)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if !e.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return e.link, nil
+}
+
+// The name of this FileSystem
+func (f *Fs) Name() string {
+	return "tarfs"
+}
+
+// Chmod changes the mode of the named file to mode.
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	return erofs("chmod", name)
+}
+
+// Chtimes changes the access and modification times of the named file
+func (f *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return erofs("chtimes", name)
+}
+
+type fileInfo struct {
+	e *entry
+}
+
+func (f *fileInfo) Name() string       { return f.e.name }
+func (f *fileInfo) Size() int64        { return int64(len(f.e.data)) }
+func (f *fileInfo) Mode() os.FileMode  { return f.e.mode }
+func (f *fileInfo) ModTime() time.Time { return f.e.modTime }
+func (f *fileInfo) IsDir() bool        { return f.e.isDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+// file is an opened entry, every file has its own offset.
+type file struct {
+	*bytes.Reader
+	fs    *Fs
+	entry *entry
+	name  string
+	// offset of directory entries
+	offset int
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.entry.isDir() {
+		return 0, syscall.EISDIR
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.entry.isDir() {
+		return 0, syscall.EISDIR
+	}
+	return f.Reader.ReadAt(p, off)
+}
+
+func (f *file) Write(p []byte) (int, error)              { return 0, syscall.EBADF }
+func (f *file) WriteAt(p []byte, off int64) (int, error) { return 0, syscall.EBADF }
+func (f *file) WriteString(s string) (int, error)        { return 0, syscall.EBADF }
+
+func (f *file) Name() string { return f.name }
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	names, err := f.Readdirnames(count)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, _, err := f.fs.LstatIfPossible(path.Join(f.entry.path, name))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	if !f.entry.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	names := f.entry.children
+	if f.offset >= len(names) {
+		names = nil
+	} else {
+		names = names[f.offset:]
+	}
+	if n > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		if len(names) > n {
+			names = names[:n]
+		}
+	}
+	f.offset += len(names)
+	return append([]string(nil), names...), nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) { return &fileInfo{f.entry}, nil }
+
+func (f *file) Sync() error               { return nil }
+func (f *file) Truncate(size int64) error { return syscall.EROFS }
+func (f *file) Close() error              { return nil }
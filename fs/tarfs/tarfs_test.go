@@ -0,0 +1,94 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func buildTar(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	mtime := time.Unix(1600000000, 0)
+	hdrs := []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "www/", Mode: 0750, ModTime: mtime}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "www/index.html", Mode: 0644, ModTime: mtime}, "hello"},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "static/js/app.js", Mode: 0600, ModTime: mtime}, "app"},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "www/js", Linkname: "../static/js", ModTime: mtime}, ""},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "loop", Linkname: "loop", ModTime: mtime}, ""},
+	}
+	for _, h := range hdrs {
+		h.hdr.Size = int64(len(h.content))
+		if err := w.WriteHeader(&h.hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, h.content)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestTarfs(t *testing.T) {
+	fs, err := New(buildTar(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.Stat("/www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0750 || info.ModTime().Unix() != 1600000000 {
+		t.Fatalf("bad dir info %v %v", info.Mode(), info.ModTime())
+	}
+
+	// two opens have independent offsets
+	f1, _ := fs.Open("/www/index.html")
+	f2, _ := fs.Open("/www/index.html")
+	buf := make([]byte, 2)
+	f1.Read(buf)
+	b, _ := ioutil.ReadAll(f2)
+	if string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+	f1.Seek(1, io.SeekCurrent)
+	b, _ = ioutil.ReadAll(f1)
+	if string(b) != "lo" {
+		t.Fatalf("got %q", b)
+	}
+
+	// symlink
+	f, err := fs.Open("/www/js/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(f)
+	if string(b) != "app" {
+		t.Fatalf("got %q", b)
+	}
+	info, _, _ = fs.LstatIfPossible("/www/js")
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("expect symlink")
+	}
+	if _, err = fs.Stat("/loop"); err.(*os.PathError).Err != syscall.ELOOP {
+		t.Fatalf("expect ELOOP, got %v", err)
+	}
+
+	dir, _ := fs.Open("/")
+	names, _ := dir.Readdirnames(-1)
+	if len(names) != 3 || names[0] != "loop" || names[1] != "static" || names[2] != "www" {
+		t.Fatalf("got %v", names)
+	}
+
+	if _, err = fs.OpenFile("/www/index.html", os.O_RDWR, 0); err.(*os.PathError).Err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+}
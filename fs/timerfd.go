@@ -0,0 +1,292 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+const (
+	_TFD_NONBLOCK      = syscall.O_NONBLOCK
+	_TFD_CLOEXEC       = syscall.O_CLOEXEC
+	_TFD_TIMER_ABSTIME = 0x1
+
+	_CLOCK_REALTIME  = 0
+	_CLOCK_MONOTONIC = 1
+
+	_FIONREAD = 0x541B
+)
+
+type itimerspec struct {
+	interval syscall.Timespec
+	value    syscall.Timespec
+}
+
+type timerFd struct {
+	fd    int
+	flags int
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	timer *time.Timer
+	// seq is increased on every settime, used to drop the stale timer callbacks
+	seq      uint64
+	interval time.Duration
+	// deadline is the time of next expiration, zero means disarmed
+	deadline    time.Time
+	expirations uint64
+	closed      bool
+}
+
+func newTimerFd(flags int) *timerFd {
+	t := &timerFd{
+		flags: flags,
+	}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+func (t *timerFd) expire(seq uint64) {
+	t.mutex.Lock()
+	if seq != t.seq {
+		t.mutex.Unlock()
+		return
+	}
+	t.expirations++
+	if t.interval != 0 {
+		// the intervals missed by a late timer are counted too
+		now := time.Now()
+		if late := now.Sub(t.deadline); late >= t.interval {
+			missed := late / t.interval
+			t.expirations += uint64(missed)
+			t.deadline = t.deadline.Add(missed * t.interval)
+		}
+		t.deadline = t.deadline.Add(t.interval)
+		t.timer = time.AfterFunc(time.Until(t.deadline), func() {
+			t.expire(seq)
+		})
+	} else {
+		t.deadline = time.Time{}
+	}
+	t.cond.Broadcast()
+	t.mutex.Unlock()
+
+	evnotify(uintptr(t.fd), syscall.EPOLLIN)
+}
+
+// gettime must be called with t.mutex held
+func (t *timerFd) gettime() itimerspec {
+	var curr itimerspec
+	curr.interval = syscall.NsecToTimespec(int64(t.interval))
+	if !t.deadline.IsZero() {
+		remain := time.Until(t.deadline)
+		if remain <= 0 {
+			// the timer is about to expire
+			remain = 1
+		}
+		curr.value = syscall.NsecToTimespec(int64(remain))
+	}
+	return curr
+}
+
+func (t *timerFd) settime(flags int, spec *itimerspec) itimerspec {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	old := t.gettime()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.seq++
+	t.expirations = 0
+	t.deadline = time.Time{}
+	t.interval = time.Duration(spec.interval.Nano())
+
+	if spec.value.Sec == 0 && spec.value.Nsec == 0 {
+		// disarm
+		return old
+	}
+
+	if flags&_TFD_TIMER_ABSTIME != 0 {
+		t.deadline = time.Unix(int64(spec.value.Sec), int64(spec.value.Nsec))
+	} else {
+		t.deadline = time.Now().Add(time.Duration(spec.value.Nano()))
+	}
+	seq := t.seq
+	t.timer = time.AfterFunc(time.Until(t.deadline), func() {
+		t.expire(seq)
+	})
+	return old
+}
+
+func (t *timerFd) Read(p []byte) (int, error) {
+	return t.read(p, false)
+}
+
+// ReadNonBlock returns EAGAIN if the timer has not expired, it's used by
+// the fds with O_NONBLOCK.
+func (t *timerFd) ReadNonBlock(p []byte) (int, error) {
+	return t.read(p, true)
+}
+
+func (t *timerFd) Readable() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.expirations != 0
+}
+
+// Poll never reports POLLOUT, timerfd can't be written
+func (t *timerFd) Poll() uint32 {
+	if t.Readable() {
+		return _POLLIN
+	}
+	return 0
+}
+
+func (t *timerFd) read(p []byte, nonblock bool) (int, error) {
+	if len(p) < 8 {
+		return 0, syscall.EINVAL
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for t.expirations == 0 {
+		// the blocked readers fail after close
+		if t.closed {
+			return 0, syscall.EBADF
+		}
+		if nonblock {
+			return 0, syscall.EAGAIN
+		}
+		t.cond.Wait()
+	}
+	*(*uint64)(unsafe.Pointer(&p[0])) = t.expirations
+	t.expirations = 0
+	return 8, nil
+}
+
+func (t *timerFd) Write(p []byte) (int, error) {
+	return 0, syscall.EINVAL
+}
+
+func (t *timerFd) Ioctl(op, arg uintptr) error {
+	switch op {
+	case _FIONREAD:
+		t.mutex.Lock()
+		var n int32
+		if t.expirations != 0 {
+			n = 8
+		}
+		t.mutex.Unlock()
+		*(*int32)(unsafe.Pointer(arg)) = n
+		return nil
+	default:
+		return syscall.EINVAL
+	}
+}
+
+func (t *timerFd) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.seq++
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
+
+func findTimerFd(fd uintptr) (*timerFd, error) {
+	ni, err := GetInode(int(fd))
+	if err != nil {
+		return nil, err
+	}
+	t, ok := ni.File.(*timerFd)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return t, nil
+}
+
+// func timerfd_create(clockid int, flags int) (fd int)
+func sysTimerfdCreate(c *isyscall.Request) {
+	clockid, flags := c.Args[0], int(c.Args[1])
+	if clockid != _CLOCK_REALTIME && clockid != _CLOCK_MONOTONIC {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+	if flags&^(_TFD_NONBLOCK|_TFD_CLOEXEC) != 0 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+
+	t := newTimerFd(flags)
+	fd, ni, err := AllocFileNode(t)
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	inodeMutex.Lock()
+	// TFD_NONBLOCK and TFD_CLOEXEC are the same as the O_* flags
+	ni.Flags |= flags & (_TFD_NONBLOCK | _TFD_CLOEXEC)
+	ni.Name = "anon_inode:[timerfd]"
+	inodeMutex.Unlock()
+	t.fd = fd
+	c.Ret = uintptr(fd)
+	c.Done()
+}
+
+// func timerfd_settime(fd int, flags int, new *itimerspec, old *itimerspec)
+func sysTimerfdSettime(c *isyscall.Request) {
+	t, err := findTimerFd(c.Args[0])
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	flags := int(c.Args[1])
+	if flags&^_TFD_TIMER_ABSTIME != 0 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+	spec := (*itimerspec)(unsafe.Pointer(c.Args[2]))
+	if spec.value.Sec < 0 || spec.value.Nsec < 0 || spec.value.Nsec >= 1e9 ||
+		spec.interval.Sec < 0 || spec.interval.Nsec < 0 || spec.interval.Nsec >= 1e9 {
+		c.Ret = isyscall.Errno(syscall.EINVAL)
+		c.Done()
+		return
+	}
+
+	old := t.settime(flags, spec)
+	if c.Args[3] != 0 {
+		*(*itimerspec)(unsafe.Pointer(c.Args[3])) = old
+	}
+	c.Ret = 0
+	c.Done()
+}
+
+// func timerfd_gettime(fd int, curr *itimerspec)
+func sysTimerfdGettime(c *isyscall.Request) {
+	t, err := findTimerFd(c.Args[0])
+	if err != nil {
+		c.Ret = isyscall.Error(err)
+		c.Done()
+		return
+	}
+	t.mutex.Lock()
+	curr := t.gettime()
+	t.mutex.Unlock()
+	*(*itimerspec)(unsafe.Pointer(c.Args[1])) = curr
+	c.Ret = 0
+	c.Done()
+}
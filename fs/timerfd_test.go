@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func timerRead(tf *timerFd, nonblock bool) (uint64, error) {
+	var val uint64
+	buf := (*[8]byte)(unsafe.Pointer(&val))[:]
+	_, err := tf.read(buf, nonblock)
+	return val, err
+}
+
+func TestTimerFdOneShot(t *testing.T) {
+	tf := newTimerFd(0)
+	defer tf.Close()
+	if _, err := timerRead(tf, true); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN on disarmed timer, got %v", err)
+	}
+
+	spec := itimerspec{value: syscall.NsecToTimespec(int64(10 * time.Millisecond))}
+	tf.settime(0, &spec)
+	tf.mutex.Lock()
+	curr := tf.gettime()
+	tf.mutex.Unlock()
+	if curr.value.Nano() <= 0 {
+		t.Fatalf("armed timer has no remaining time")
+	}
+	if v, err := timerRead(tf, false); v != 1 || err != nil {
+		t.Fatalf("expect 1 expiration, got %d %v", v, err)
+	}
+	tf.mutex.Lock()
+	curr = tf.gettime()
+	tf.mutex.Unlock()
+	if curr.value.Nano() != 0 {
+		t.Fatalf("one shot timer is still armed")
+	}
+}
+
+func TestTimerFdInterval(t *testing.T) {
+	tf := newTimerFd(0)
+	defer tf.Close()
+	spec := itimerspec{
+		value:    syscall.NsecToTimespec(int64(time.Millisecond)),
+		interval: syscall.NsecToTimespec(int64(time.Millisecond)),
+	}
+	tf.settime(0, &spec)
+	time.Sleep(30 * time.Millisecond)
+	if v, err := timerRead(tf, true); v < 2 || err != nil {
+		t.Fatalf("expect several expirations, got %d %v", v, err)
+	}
+
+	// disarm drops the pending expirations
+	tf.settime(0, &itimerspec{})
+	if _, err := timerRead(tf, true); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN after disarm, got %v", err)
+	}
+}
+
+func TestTimerFdAbstime(t *testing.T) {
+	tf := newTimerFd(0)
+	defer tf.Close()
+	// a deadline in the past expires at once
+	spec := itimerspec{value: syscall.NsecToTimespec(time.Now().Add(-time.Second).UnixNano())}
+	tf.settime(_TFD_TIMER_ABSTIME, &spec)
+	if v, err := timerRead(tf, false); v != 1 || err != nil {
+		t.Fatalf("expect 1 expiration, got %d %v", v, err)
+	}
+}
+
+func TestTimerFdOverrun(t *testing.T) {
+	tf := newTimerFd(0)
+	// the intervals passed before the first expiration are counted at once
+	spec := itimerspec{
+		value:    syscall.NsecToTimespec(time.Now().Add(-10 * time.Millisecond).UnixNano()),
+		interval: syscall.NsecToTimespec(int64(time.Millisecond)),
+	}
+	tf.settime(_TFD_TIMER_ABSTIME, &spec)
+	if v, err := timerRead(tf, false); v < 10 || err != nil {
+		t.Fatalf("expect the missed expirations, got %d %v", v, err)
+	}
+	if old := tf.settime(0, &itimerspec{}); old.interval.Nano() != int64(time.Millisecond) {
+		t.Fatalf("bad old value %+v", old)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := timerRead(tf, false)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tf.Close()
+	select {
+	case err := <-done:
+		if err != syscall.EBADF {
+			t.Fatalf("expect EBADF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not woken up by close")
+	}
+}
@@ -0,0 +1,58 @@
+package fs
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/sys"
+)
+
+func utsField(b *[65]int8, s string) {
+	copy((*[65]byte)(unsafe.Pointer(b))[:64], s)
+}
+
+func uname(buf *syscall.Utsname) {
+	*buf = syscall.Utsname{}
+	utsField(&buf.Sysname, "eggos")
+	utsField(&buf.Nodename, kernel.Hostname())
+	utsField(&buf.Release, kernel.OSRelease())
+	utsField(&buf.Version, kernel.Version)
+	utsField(&buf.Machine, kernel.Machine())
+	utsField(&buf.Domainname, kernel.Domainname())
+}
+
+// sethostname sets the hostname or domain name, the names longer than
+// kernel.MaxHostnameLen are refused like linux.
+func sethostname(no uintptr, name []byte) error {
+	if len(name) > kernel.MaxHostnameLen {
+		return syscall.EINVAL
+	}
+	if no == syscall.SYS_SETDOMAINNAME {
+		kernel.SetDomainname(string(name))
+	} else {
+		kernel.SetHostname(string(name))
+	}
+	return nil
+}
+
+// func Uname(buf *Utsname)
+func sysUname(c *isyscall.Request) {
+	uname((*syscall.Utsname)(unsafe.Pointer(c.Args[0])))
+	c.Ret = 0
+	c.Done()
+}
+
+// func sethostname(name []byte)
+// func setdomainname(name []byte)
+func sysSethostname(c *isyscall.Request) {
+	var err error
+	if int(c.Args[1]) < 0 {
+		err = syscall.EINVAL
+	} else {
+		err = sethostname(c.NO, sys.UnsafeBuffer(c.Args[0], int(c.Args[1])))
+	}
+	c.Ret = isyscall.Error(err)
+	c.Done()
+}
@@ -0,0 +1,51 @@
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel"
+	"github.com/spf13/afero"
+)
+
+func utsString(b *[65]int8) string {
+	buf := (*[65]byte)(unsafe.Pointer(b))[:]
+	return string(buf[:strings.IndexByte(string(buf), 0)])
+}
+
+func TestUname(t *testing.T) {
+	old := kernel.Hostname()
+	defer kernel.SetHostname(old)
+	etcInit()
+
+	name := strings.Repeat("h", kernel.MaxHostnameLen)
+	if err := sethostname(syscall.SYS_SETHOSTNAME, []byte(name+"h")); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	if err := sethostname(syscall.SYS_SETHOSTNAME, []byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	var buf syscall.Utsname
+	uname(&buf)
+	if got := utsString(&buf.Nodename); got != name {
+		t.Fatalf("expect %s, got %s", name, got)
+	}
+	if got := utsString(&buf.Machine); got != "i686" {
+		t.Fatalf("expect i686, got %s", got)
+	}
+	if got := utsString(&buf.Release); got != kernel.Version {
+		t.Fatalf("expect release %s, got %s", kernel.Version, got)
+	}
+
+	// the Go API truncates
+	kernel.SetHostname(name + "tail")
+	if got := kernel.Hostname(); got != name {
+		t.Fatalf("expect truncated hostname, got %s", got)
+	}
+	kernel.SetHostname("eggos.test")
+	if b, err := afero.ReadFile(Root, "/etc/hostname"); err != nil || string(b) != "eggos.test\n" {
+		t.Fatalf("got %q %v", b, err)
+	}
+}
@@ -1,80 +1,235 @@
 package fs
 
 import (
+	"bytes"
+	"container/heap"
 	"io"
-	"math/rand"
 	"os"
+	"sync"
 	"syscall"
 	"unsafe"
 
 	"github.com/icexin/eggos/console"
 	"github.com/icexin/eggos/fs/mount"
 	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/random"
 	"github.com/icexin/eggos/sys"
 
 	"github.com/spf13/afero"
 )
 
+const (
+	// syscall numbers not defined in package syscall
+	_SYS_MEMFD_CREATE    = 356
+	_SYS_COPY_FILE_RANGE = 377
+	// getrandom is 355 on i386, the 318 of x86-64 is getcpu here, eggos
+	// only runs the i386 syscall table.
+	_SYS_GETRANDOM = 355
+)
+
+// the ioctl setting O_NONBLOCK, not defined in package syscall
+const _FIONBIO = 0x5421
+
+const (
+	// flags of getrandom
+	_GRND_NONBLOCK = 0x1
+	_GRND_RANDOM   = 0x2
+	_GRND_INSECURE = 0x4
+
+	_GRND_CHUNK = 256
+)
+
 var (
-	inodes []*Inode
+	// inodeMutex protects inodes and freefds
+	inodeMutex sync.Mutex
+	inodes     []*Inode
+	// freefds holds the fds released by Release, the lowest one is reused
+	// before growing inodes, so that close(0) and open gives fd 0 as POSIX.
+	freefds fdHeap
+	// nopen is the number of inodes in use
+	nopen int
+	// tailFree is the number of free slots at the tail of inodes
+	tailFree int
 
 	Root = mount.NewMountableFs(afero.NewMemMapFs())
 )
 
+// fdHeap is a min-heap of fds
+type fdHeap []int
+
+func (h fdHeap) Len() int            { return len(h) }
+func (h fdHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h fdHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fdHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *fdHeap) Pop() interface{} {
+	old := *h
+	fd := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return fd
+}
+
 type Ioctler interface {
 	Ioctl(op, arg uintptr) error
 }
 
+// NonBlockReader is implemented by the files which can be read without
+// blocking, it's used by the fds with O_NONBLOCK.
+type NonBlockReader interface {
+	// ReadNonBlock returns EAGAIN if no data is ready
+	ReadNonBlock(p []byte) (int, error)
+}
+
+// NonBlockWriter is like NonBlockReader, but for writing.
+type NonBlockWriter interface {
+	// WriteNonBlock returns EAGAIN if the write would block
+	WriteNonBlock(p []byte) (int, error)
+}
+
+// readable is implemented by the files which can tell whether a read will
+// block, they are notified to epoll by notifyReadable.
+type readable interface {
+	Readable() bool
+}
+
 type Inode struct {
-	File  io.ReadWriteCloser
-	Fd    int
+	// stats must be the first field for the 64bit atomics on 386
+	stats fdStats
+
+	File io.ReadWriteCloser
+	Fd   int
+	// Flags holds the flags the fd opened with, such as O_RDWR and O_CLOEXEC
+	Flags int
+	// Name describes the file, such as the path of the file, used by /proc/self/fd
+	Name string
+	// Uid and Gid are the owner reported by fstat
+	Uid, Gid uint32
+
+	// mount is the mount point of the fs the file opened from, used by Umount
+	mount string
+	// mutex serializes the positional io emulated by seeking and getdents
+	mutex sync.Mutex
+	// dir is the directory entries pending for getdents
+	dir   *dirState
 	inuse bool
 }
 
-func (i *Inode) Release() {
+// Release marks the inode as unused and gives its fd back to the free list.
+// Releasing an inode twice returns EBADF.
+func (i *Inode) Release() error {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	return i.release()
+}
+
+// release must be called with inodeMutex held
+func (i *Inode) release() error {
+	if !i.inuse {
+		return syscall.EBADF
+	}
+	inodes[i.Fd] = nil
+	heap.Push(&freefds, i.Fd)
+	nopen--
+	foldStats(&i.stats)
 	i.inuse = false
 	i.File = nil
+	if i.Fd == len(inodes)-1-tailFree {
+		// the free slots below join the tail
+		for tailFree < len(inodes) && inodes[len(inodes)-1-tailFree] == nil {
+			tailFree++
+		}
+	}
 	i.Fd = -1
+	compactInodes()
+	return nil
 }
 
-func AllocInode() (int, *Inode) {
-	var fd int
-	var ni *Inode
-	for i := range inodes {
-		entry := inodes[i]
-		if !entry.inuse {
-			fd = i
-			ni = entry
-			break
+// compactInodes trims the free slots at the tail of inodes if they are more
+// than half of the table, so that the table shrinks after a burst of opens.
+// It must be called with inodeMutex held.
+func compactInodes() {
+	if tailFree <= len(inodes)/2 {
+		return
+	}
+	n := len(inodes) - tailFree
+	inodes = append([]*Inode(nil), inodes[:n]...)
+	tailFree = 0
+	fds := freefds[:0]
+	for _, fd := range freefds {
+		if fd < n {
+			fds = append(fds, fd)
 		}
 	}
-	if fd == 0 {
-		ni = new(Inode)
+	freefds = fds
+	heap.Init(&freefds)
+}
+
+// AllocInode allocates a new inode, it returns EMFILE if the number of
+// open fds reaches the soft limit of RLIMIT_NOFILE.
+func AllocInode() (int, *Inode, error) {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+
+	if uint64(nopen) >= nofileLimit.Cur {
+		return -1, nil, syscall.EMFILE
+	}
+
+	var fd int
+	if len(freefds) > 0 {
+		fd = heap.Pop(&freefds).(int)
+		if fd >= len(inodes)-tailFree {
+			tailFree = len(inodes) - 1 - fd
+		}
+	} else {
 		fd = len(inodes)
-		inodes = append(inodes, ni)
+		inodes = append(inodes, nil)
+	}
+	// always use a fresh inode, so that a stale reference to a released inode
+	// can't touch the file now owning the fd.
+	ni := &Inode{
+		Fd:    fd,
+		inuse: true,
 	}
-	ni.inuse = true
-	ni.Fd = fd
-	return fd, ni
+	inodes[fd] = ni
+	nopen++
+	openStats(&ni.stats)
+	return fd, ni, nil
 }
 
-func AllocFileNode(r io.ReadWriteCloser) (int, *Inode) {
-	fd, ni := AllocInode()
+func AllocFileNode(r io.ReadWriteCloser) (int, *Inode, error) {
+	fd, ni, err := AllocInode()
+	if err != nil {
+		return -1, nil, err
+	}
 	ni.File = r
-	return fd, ni
+	return fd, ni, nil
 }
 
 func GetInode(fd int) (*Inode, error) {
-	if int(fd) >= len(inodes) {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+
+	if fd < 0 || fd >= len(inodes) {
 		return nil, syscall.EBADF
 	}
 	ni := inodes[fd]
-	if !ni.inuse {
+	// the File of an open in flight is not set yet
+	if ni == nil || !ni.inuse || ni.File == nil {
 		return nil, syscall.EBADF
 	}
 	return ni, nil
 }
 
+// file returns the File and Flags of the inode, EBADF if the inode has been
+// closed by another thread.
+func (i *Inode) file() (io.ReadWriteCloser, int, error) {
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	if !i.inuse || i.File == nil {
+		return nil, 0, syscall.EBADF
+	}
+	return i.File, i.Flags, nil
+}
+
 func fscall(fn int) isyscall.Handler {
 	return func(c *isyscall.Request) {
 		var err error
@@ -82,7 +237,7 @@ func fscall(fn int) isyscall.Handler {
 			var fd int
 			fd, err = sysOpen(c.Args[0], c.Args[1], c.Args[2], c.Args[3])
 			if err != nil {
-				c.Ret = isyscall.Error(err)
+				c.Ret = isyscall.Errno(countErrno(err))
 			} else {
 				c.Ret = uintptr(fd)
 			}
@@ -94,7 +249,7 @@ func fscall(fn int) isyscall.Handler {
 
 		ni, err = GetInode(int(c.Args[0]))
 		if err != nil {
-			c.Ret = isyscall.Error(err)
+			c.Ret = isyscall.Errno(countErrno(err))
 			c.Done()
 			return
 		}
@@ -108,44 +263,155 @@ func fscall(fn int) isyscall.Handler {
 			var n int
 			n, err = sysWrite(ni, c.Args[1], c.Args[2])
 			c.Ret = uintptr(n)
+		case syscall.SYS_READV:
+			var n int
+			n, err = sysReadv(ni, c.Args[1], int(c.Args[2]))
+			c.Ret = uintptr(n)
+		case syscall.SYS_WRITEV:
+			var n int
+			n, err = sysWritev(ni, c.Args[1], int(c.Args[2]))
+			c.Ret = uintptr(n)
+		case syscall.SYS_PREAD64:
+			var n int
+			n, err = sysPread64(ni, c.Args[1], c.Args[2], offset64(c.Args[3], c.Args[4]))
+			c.Ret = uintptr(n)
+		case syscall.SYS_PWRITE64:
+			var n int
+			n, err = sysPwrite64(ni, c.Args[1], c.Args[2], offset64(c.Args[3], c.Args[4]))
+			c.Ret = uintptr(n)
 		case syscall.SYS_CLOSE:
 			err = sysClose(ni)
 		case syscall.SYS_FSTAT64:
 			err = sysStat(ni, c.Args[1])
 		case syscall.SYS_IOCTL:
 			err = sysIoctl(ni, c.Args[1], c.Args[2])
+		case syscall.SYS_FTRUNCATE:
+			err = sysFtruncate(ni, int64(int32(c.Args[1])))
+		case syscall.SYS_FTRUNCATE64:
+			err = sysFtruncate(ni, offset64(c.Args[1], c.Args[2]))
+		case syscall.SYS_FALLOCATE:
+			err = sysFallocate(ni, uint32(c.Args[1]), offset64(c.Args[2], c.Args[3]), offset64(c.Args[4], c.Args[5]))
+		case syscall.SYS_FCHMOD:
+			err = sysFchmod(ni, uint32(c.Args[1]))
+		case syscall.SYS_FCHOWN, syscall.SYS_FCHOWN32:
+			legacy := fn == syscall.SYS_FCHOWN
+			err = sysFchown(ni, chownId(c.Args[1], legacy), chownId(c.Args[2], legacy))
 		}
 
 		if err != nil {
-			c.Ret = isyscall.Error(err)
+			c.Ret = isyscall.Errno(countErrno(err))
+		} else {
+			ni.stats.count(fn, c.Ret)
 		}
 		c.Done()
 	}
 }
 
-func sysOpen(dirfd, name, flags, perm uintptr) (int, error) {
-	path := cstring(name)
-	fd, ni := AllocInode()
-	f, err := Root.OpenFile(path, int(flags), os.FileMode(perm))
+func sysOpen(dirfd, name, flags, perm uintptr) (fd int, err error) {
+	path, err := atPath(dirfd, name)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, syscall.ENOENT
+		return 0, err
+	}
+	fd, ni, err := AllocInode()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			ni.Release()
 		}
+	}()
+	// the inode is bound to its mount before opening, so that Umount and
+	// Remount see the open in flight and return EBUSY.
+	inodeMutex.Lock()
+	ni.Flags = int(flags)
+	ni.Name = path
+	ni.mount = Root.MountPath(path)
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC) != 0 {
+		err = checkWritable(path)
+	}
+	inodeMutex.Unlock()
+	if err == nil {
+		err = checkOpen(path, int(flags))
+	}
+	if err != nil {
 		return 0, err
 	}
+
+	var events uint32
+	if inotifyWatched() {
+		events = openEvents(path, int(flags))
+	}
+	f, err := openFile(path, int(flags), os.FileMode(perm))
+	if err != nil {
+		return 0, fsErrno(err)
+	}
+	if events != 0 {
+		if info, err := f.Stat(); err == nil && info.IsDir() {
+			events |= syscall.IN_ISDIR
+		}
+		inotify(path, events, 0)
+	}
+	uid, gid := fileOwner(path)
+	inodeMutex.Lock()
 	ni.File = f
+	ni.Uid, ni.Gid = uid, gid
+	inodeMutex.Unlock()
 	return fd, nil
 }
 
+// openEvents returns the inotify events of opening name
+func openEvents(name string, flags int) uint32 {
+	events := uint32(syscall.IN_OPEN)
+	_, err := statFile(name)
+	switch {
+	case err != nil && flags&syscall.O_CREAT != 0:
+		events |= syscall.IN_CREATE
+	case err == nil && flags&syscall.O_TRUNC != 0:
+		events |= syscall.IN_MODIFY
+	}
+	return events
+}
+
 func sysClose(ni *Inode) error {
-	err := ni.File.Close()
-	ni.Release()
+	// drop the locks before release clears the File the lock key needs
+	unlockAll(ni)
+	inodeMutex.Lock()
+	file, name, flags := ni.File, ni.Name, ni.Flags
+	err := ni.release()
+	inodeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return syscall.EBADF
+	}
+	err = file.Close()
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		inotify(name, syscall.IN_CLOSE_WRITE, 0)
+	} else {
+		inotify(name, syscall.IN_CLOSE_NOWRITE, 0)
+	}
 	return err
 }
 
 func sysRead(ni *Inode, p, n uintptr) (int, error) {
-	buf := sys.UnsafeBuffer(p, int(n))
-	ret, err := ni.File.Read(buf)
+	return readBuf(ni, sys.UnsafeBuffer(p, int(n)), false)
+}
+
+// readBuf reads ni to buf, it doesn't block if nonblock is set and the file
+// can be read without blocking.
+func readBuf(ni *Inode, buf []byte, nonblock bool) (int, error) {
+	file, flags, err := ni.file()
+	if err != nil {
+		return 0, err
+	}
+	var ret int
+	if r, ok := file.(NonBlockReader); ok && (nonblock || flags&syscall.O_NONBLOCK != 0) {
+		ret, err = r.ReadNonBlock(buf)
+	} else {
+		ret, err = file.Read(buf)
+	}
 
 	switch {
 	case ret != 0:
@@ -160,16 +426,207 @@ func sysRead(ni *Inode, p, n uintptr) (int, error) {
 }
 
 func sysWrite(ni *Inode, p, n uintptr) (int, error) {
-	buf := sys.UnsafeBuffer(p, int(n))
-	_n, err := ni.File.Write(buf)
+	return writeBuf(ni, sys.UnsafeBuffer(p, int(n)))
+}
+
+func writeBuf(ni *Inode, buf []byte) (int, error) {
+	file, flags, err := ni.file()
+	if err != nil {
+		return 0, err
+	}
+	var _n int
+	if w, ok := file.(NonBlockWriter); ok && flags&syscall.O_NONBLOCK != 0 {
+		_n, err = w.WriteNonBlock(buf)
+	} else {
+		_n, err = file.Write(buf)
+	}
 	if _n != 0 {
+		inotify(ni.Name, syscall.IN_MODIFY, 0)
 		return _n, nil
 	}
 	return 0, err
 }
 
+const (
+	_IOV_MAX = 1024
+	// the vectors of readv and writev not larger than iovCombine in total
+	// are done by one read or write through a temporary buffer, so that the
+	// pipes and sockets see them at once.
+	iovCombine = 64 << 10
+)
+
+// iovecs decodes the iovec array of readv and writev, the empty vectors are
+// skipped.
+func iovecs(p uintptr, cnt int) ([][]byte, int, error) {
+	if cnt < 0 || cnt > _IOV_MAX {
+		return nil, 0, syscall.EINVAL
+	}
+	if cnt == 0 {
+		return nil, 0, nil
+	}
+	vecs := (*[_IOV_MAX]syscall.Iovec)(unsafe.Pointer(p))[:cnt:cnt]
+	bufs := make([][]byte, 0, cnt)
+	total := 0
+	for _, v := range vecs {
+		n := int(v.Len)
+		// the total must fit in the return value
+		if n < 0 || total+n < total {
+			return nil, 0, syscall.EINVAL
+		}
+		total += n
+		if n > 0 {
+			bufs = append(bufs, sys.UnsafeBuffer(uintptr(unsafe.Pointer(v.Base)), n))
+		}
+	}
+	return bufs, total, nil
+}
+
+func sysReadv(ni *Inode, p uintptr, cnt int) (int, error) {
+	bufs, total, err := iovecs(p, cnt)
+	if err != nil || len(bufs) == 0 {
+		return 0, err
+	}
+	if len(bufs) > 1 && total <= iovCombine {
+		tmp := make([]byte, total)
+		n, err := readBuf(ni, tmp, false)
+		tmp = tmp[:n]
+		for _, buf := range bufs {
+			tmp = tmp[copy(buf, tmp):]
+		}
+		return n, err
+	}
+	done := 0
+	for i, buf := range bufs {
+		// only the first read blocks, the data already read is returned
+		// rather than waiting for more.
+		n, err := readBuf(ni, buf, i > 0)
+		done += n
+		if err != nil {
+			if done > 0 {
+				return done, nil
+			}
+			return 0, err
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return done, nil
+}
+
+func sysWritev(ni *Inode, p uintptr, cnt int) (int, error) {
+	bufs, total, err := iovecs(p, cnt)
+	if err != nil || len(bufs) == 0 {
+		return 0, err
+	}
+	if len(bufs) > 1 && total <= iovCombine {
+		tmp := make([]byte, 0, total)
+		for _, buf := range bufs {
+			tmp = append(tmp, buf...)
+		}
+		return writeBuf(ni, tmp)
+	}
+	done := 0
+	for _, buf := range bufs {
+		n, err := writeBuf(ni, buf)
+		done += n
+		if err != nil {
+			if done > 0 {
+				return done, nil
+			}
+			return 0, err
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return done, nil
+}
+
+// offset64 joins the 64bit offset passed by two registers
+func offset64(lo, hi uintptr) int64 {
+	return int64(uint64(hi)<<32 | uint64(lo))
+}
+
+func sysPread64(ni *Inode, p, n uintptr, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	buf := sys.UnsafeBuffer(p, int(n))
+
+	var ret int
+	var err error
+	switch f := ni.File.(type) {
+	case io.ReaderAt:
+		ret, err = f.ReadAt(buf, off)
+	case io.ReadSeeker:
+		ni.mutex.Lock()
+		ret, err = seekDo(f, off, func() (int, error) {
+			return f.Read(buf)
+		})
+		ni.mutex.Unlock()
+	default:
+		return 0, syscall.ESPIPE
+	}
+
+	switch {
+	case ret != 0:
+		return ret, nil
+	case err == io.EOF:
+		return 0, nil
+	default:
+		return ret, err
+	}
+}
+
+func sysPwrite64(ni *Inode, p, n uintptr, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	buf := sys.UnsafeBuffer(p, int(n))
+
+	var ret int
+	var err error
+	switch f := ni.File.(type) {
+	case io.WriterAt:
+		ret, err = f.WriteAt(buf, off)
+	case io.WriteSeeker:
+		ni.mutex.Lock()
+		ret, err = seekDo(f, off, func() (int, error) {
+			return f.Write(buf)
+		})
+		ni.mutex.Unlock()
+	default:
+		return 0, syscall.ESPIPE
+	}
+	if ret != 0 {
+		inotify(ni.Name, syscall.IN_MODIFY, 0)
+		return ret, nil
+	}
+	return 0, err
+}
+
+// seekDo calls fn at offset off of f, and restores the position of f after that.
+func seekDo(f io.Seeker, off int64, fn func() (int, error)) (int, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, syscall.ESPIPE
+	}
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fn()
+	if _, err1 := f.Seek(pos, io.SeekStart); err == nil {
+		err = err1
+	}
+	return n, err
+}
+
 func sysStat(ni *Inode, statptr uintptr) error {
-	file, ok := ni.File.(afero.File)
+	file, ok := ni.File.(interface {
+		Stat() (os.FileInfo, error)
+	})
 	if !ok {
 		return syscall.EINVAL
 	}
@@ -178,14 +635,373 @@ func sysStat(ni *Inode, statptr uintptr) error {
 	if err != nil {
 		return err
 	}
-	stat.Mode = uint32(info.Mode())
+	fillStat(stat, info, ni.Name)
+	stat.Uid, stat.Gid = ni.Uid, ni.Gid
+	return nil
+}
+
+func fillStat(stat *syscall.Stat_t, info os.FileInfo, name string) {
+	stat.Mode = unixMode(info.Mode())
+	stat.Nlink = linkCount(name)
+	stat.Uid, stat.Gid = fileOwner(name)
 	stat.Mtim.Sec = int32(info.ModTime().Unix())
 	stat.Size = info.Size()
+}
 
+// unixMode converts os.FileMode to the st_mode of stat
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		m |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	default:
+		m |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+// canWrite reports whether the file of inode supports writing
+func (i *Inode) canWrite() bool {
+	switch f := i.File.(type) {
+	case *fileHelper:
+		return f.w != nil
+	case afero.File:
+		return i.Flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	default:
+		return true
+	}
+}
+
+// func sendfile(outfd int, infd int, offset *int64, count int) (written int)
+func sysSendfile(c *isyscall.Request) {
+	n, err := sendfile(c.NO, c.Args[0], c.Args[1], c.Args[2], c.Args[3])
+	if err != nil {
+		c.Ret = isyscall.Errno(errnoFromErr(err))
+	} else {
+		c.Ret = uintptr(n)
+	}
+	c.Done()
+}
+
+func sendfile(no, outfd, infd, offptr, count uintptr) (int64, error) {
+	out, err := GetInode(int(outfd))
+	if err != nil {
+		return 0, err
+	}
+	in, err := GetInode(int(infd))
+	if err != nil {
+		return 0, err
+	}
+	if !out.canWrite() {
+		return 0, syscall.EINVAL
+	}
+	file, ok := in.File.(afero.File)
+	if !ok {
+		return 0, syscall.EINVAL
+	}
+
+	var n int64
+	if offptr == 0 {
+		size := copySize(file, nil, int64(count))
+		n, err = copyChunked(out.File, io.LimitReader(file, int64(count)), size)
+	} else {
+		// read from the offset without moving the file position
+		var off int64
+		if no == syscall.SYS_SENDFILE64 {
+			off = *(*int64)(unsafe.Pointer(offptr))
+		} else {
+			off = int64(*(*int32)(unsafe.Pointer(offptr)))
+		}
+		size := copySize(file, &off, int64(count))
+		n, err = copyChunked(out.File, io.NewSectionReader(file, off, int64(count)), size)
+		if no == syscall.SYS_SENDFILE64 {
+			*(*int64)(unsafe.Pointer(offptr)) = off + n
+		} else {
+			*(*int32)(unsafe.Pointer(offptr)) = int32(off + n)
+		}
+	}
+	// short copy is not an error
+	if n != 0 || err == io.EOF {
+		return n, nil
+	}
+	return n, err
+}
+
+// func copy_file_range(infd int, inoff *int64, outfd int, outoff *int64, len int, flags int) (n int)
+func sysCopyFileRange(c *isyscall.Request) {
+	n, err := copyFileRange(c.Args[0], c.Args[1], c.Args[2], c.Args[3], c.Args[4], c.Args[5])
+	if err != nil {
+		c.Ret = isyscall.Errno(errnoFromErr(err))
+	} else {
+		c.Ret = uintptr(n)
+	}
+	c.Done()
+}
+
+func copyFileRange(infd, inoffptr, outfd, outoffptr, count, flags uintptr) (int64, error) {
+	if flags != 0 {
+		return 0, syscall.EINVAL
+	}
+	in, err := GetInode(int(infd))
+	if err != nil {
+		return 0, err
+	}
+	out, err := GetInode(int(outfd))
+	if err != nil {
+		return 0, err
+	}
+	src, ok1 := in.File.(afero.File)
+	dst, ok2 := out.File.(afero.File)
+	if !ok1 || !ok2 {
+		return 0, syscall.EINVAL
+	}
+	if in.Flags&syscall.O_ACCMODE == syscall.O_WRONLY || !out.canWrite() || out.Flags&syscall.O_APPEND != 0 {
+		return 0, syscall.EBADF
+	}
+	if Root.FindFs(in.Name) != Root.FindFs(out.Name) {
+		return 0, syscall.EXDEV
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	var inoff, outoff *int64
+	if inoffptr != 0 {
+		inoff = (*int64)(unsafe.Pointer(inoffptr))
+	}
+	if outoffptr != 0 {
+		outoff = (*int64)(unsafe.Pointer(outoffptr))
+	}
+	if src == dst && inoff != nil && outoff != nil {
+		// overlapping ranges of the same file
+		if *inoff < *outoff+int64(count) && *outoff < *inoff+int64(count) {
+			return 0, syscall.EINVAL
+		}
+	}
+
+	var r io.Reader = io.LimitReader(src, int64(count))
+	if inoff != nil {
+		r = io.NewSectionReader(src, *inoff, int64(count))
+	}
+	var w io.Writer = dst
+	if outoff != nil {
+		w = &offsetWriter{w: dst, off: *outoff}
+	}
+
+	var n int64
+	if _, ok := Root.FindFs(in.Name).(*afero.MemMapFs); ok {
+		// the content of MemMapFs is in memory, copy it with one read and
+		// one write instead of the small chunks of io.Copy
+		var buf bytes.Buffer
+		buf.Grow(int(copySize(src, inoff, int64(count))))
+		if _, err = buf.ReadFrom(r); err == nil {
+			var m int
+			m, err = w.Write(buf.Bytes())
+			n = int64(m)
+		}
+	} else {
+		n, err = copyChunked(w, r, copySize(src, inoff, int64(count)))
+	}
+
+	if inoff != nil {
+		*inoff += n
+	}
+	if outoff != nil {
+		*outoff += n
+	}
+	if n != 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// copyChunk is the max buffer of sendfile and copy_file_range, larger than
+// the one of io.Copy to save the reads and writes.
+const copyChunk = 256 << 10
+
+// copyChunked copies src to dst until EOF, size is the bytes expected and
+// bounds the buffer. The WriterTo and ReaderFrom of files are used if any.
+func copyChunked(dst io.Writer, src io.Reader, size int64) (int64, error) {
+	if size > copyChunk {
+		size = copyChunk
+	}
+	if size <= 0 {
+		// nothing is expected, but the file may be growing
+		size = 32 << 10
+	}
+	return io.CopyBuffer(dst, src, make([]byte, size))
+}
+
+// copySize returns the bytes can be copied from src, count is capped at the
+// size left after the offset.
+func copySize(src afero.File, off *int64, count int64) int64 {
+	info, err := src.Stat()
+	if err != nil {
+		return 0
+	}
+	var start int64
+	if off != nil {
+		start = *off
+	} else if start, err = src.Seek(0, io.SeekCurrent); err != nil {
+		return 0
+	}
+	if left := info.Size() - start; left < count {
+		count = left
+	}
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// offsetWriter writes to w at off, the position of w is not changed
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+func sysFtruncate(ni *Inode, size int64) error {
+	file, ok := ni.File.(interface {
+		Truncate(size int64) error
+	})
+	if !ok {
+		return syscall.EINVAL
+	}
+	if size < 0 || ni.Flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return syscall.EINVAL
+	}
+	if ni.mount != "" {
+		if err := checkWritable(ni.mount); err != nil {
+			return err
+		}
+	}
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	inotify(ni.Name, syscall.IN_MODIFY, 0)
 	return nil
 }
 
+const (
+	_FALLOC_FL_KEEP_SIZE  = 0x1
+	_FALLOC_FL_PUNCH_HOLE = 0x2
+)
+
+// sysFallocate extends the file for mode 0 and zeros the range for
+// punching holes. The files are in memory, there is no space to reserve
+// for FALLOC_FL_KEEP_SIZE.
+func sysFallocate(ni *Inode, mode uint32, off, length int64) error {
+	file, ok := ni.File.(interface {
+		Stat() (os.FileInfo, error)
+		Truncate(size int64) error
+		WriteAt(p []byte, off int64) (int, error)
+	})
+	if !ok {
+		return syscall.ENODEV
+	}
+	if off < 0 || length <= 0 || off+length < 0 {
+		return syscall.EINVAL
+	}
+	if ni.Flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return syscall.EBADF
+	}
+	if ni.mount != "" {
+		if err := checkWritable(ni.mount); err != nil {
+			return err
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return syscall.EISDIR
+	}
+	end := off + length
+	switch mode {
+	case 0:
+		if end > info.Size() {
+			return file.Truncate(end)
+		}
+		return nil
+	case _FALLOC_FL_KEEP_SIZE:
+		return nil
+	case _FALLOC_FL_PUNCH_HOLE | _FALLOC_FL_KEEP_SIZE:
+		if end > info.Size() {
+			end = info.Size()
+		}
+		zero := make([]byte, 4096)
+		for off < end {
+			n := int64(len(zero))
+			if end-off < n {
+				n = end - off
+			}
+			if _, err := file.WriteAt(zero[:n], off); err != nil {
+				return err
+			}
+			off += n
+		}
+		return nil
+	}
+	return syscall.EOPNOTSUPP
+}
+
+// sysFchmod changes the mode by the file if it can, the afero files can't,
+// they are changed by path.
+func sysFchmod(ni *Inode, mode uint32) error {
+	if file, ok := ni.File.(interface {
+		Chmod(mode os.FileMode) error
+	}); ok {
+		return file.Chmod(os.FileMode(mode & 0777))
+	}
+	if _, ok := ni.File.(afero.File); !ok || ni.Name == "" {
+		return syscall.EINVAL
+	}
+	if ni.mount != "" {
+		if err := checkWritable(ni.mount); err != nil {
+			return err
+		}
+	}
+	return chmod(ni.Name, mode)
+}
+
 func sysIoctl(ni *Inode, op, arg uintptr) error {
+	// FIONBIO is the same as setting O_NONBLOCK by fcntl for all the files
+	if op == _FIONBIO {
+		inodeMutex.Lock()
+		if *(*int32)(unsafe.Pointer(arg)) != 0 {
+			ni.Flags |= syscall.O_NONBLOCK
+		} else {
+			ni.Flags &^= syscall.O_NONBLOCK
+		}
+		inodeMutex.Unlock()
+		return nil
+	}
 	ctl, ok := ni.File.(Ioctler)
 	if !ok {
 		return syscall.EINVAL
@@ -194,61 +1010,133 @@ func sysIoctl(ni *Inode, op, arg uintptr) error {
 }
 
 func sysFcntl(call *isyscall.Request) {
-	call.Ret = 0
+	switch call.Args[1] {
+	case syscall.F_GETFL, syscall.F_SETFL:
+		ret, err := fcntlFlags(int(call.Args[0]), int(call.Args[1]), int(call.Args[2]))
+		if err != nil {
+			call.Ret = isyscall.Errno(errnoFromErr(err))
+		} else {
+			call.Ret = uintptr(ret)
+		}
+	case syscall.F_GETLK, syscall.F_SETLK, syscall.F_SETLKW, _F_GETLK32, _F_SETLK32, _F_SETLKW32:
+		call.Ret = isyscall.Errno(errnoFromErr(fcntlLock(int(call.Args[0]), int(call.Args[1]), call.Args[2])))
+	case _F_ADD_SEALS, _F_GET_SEALS:
+		ret, err := memfdFcntl(call.Args[0], call.Args[1], call.Args[2])
+		if err != nil {
+			call.Ret = isyscall.Errno(errnoFromErr(err))
+		} else {
+			call.Ret = uintptr(ret)
+		}
+	default:
+		call.Ret = 0
+	}
 	call.Done()
 }
 
-// func Uname(buf *Utsname)
-func sysUname(c *isyscall.Request) {
-	unsafebuf := func(b *[65]int8) []byte {
-		return (*[65]byte)(unsafe.Pointer(b))[:]
+// fcntlFlags gets or sets the status flags of fd, only O_APPEND and
+// O_NONBLOCK can be changed.
+func fcntlFlags(fd, cmd, arg int) (int, error) {
+	const (
+		setmask  = syscall.O_APPEND | syscall.O_NONBLOCK
+		openonly = syscall.O_CLOEXEC | syscall.O_CREAT | syscall.O_EXCL | syscall.O_NOCTTY | syscall.O_TRUNC
+	)
+	ni, err := GetInode(fd)
+	if err != nil {
+		return 0, err
+	}
+	inodeMutex.Lock()
+	defer inodeMutex.Unlock()
+	if cmd == syscall.F_GETFL {
+		return ni.Flags &^ openonly, nil
+	}
+	ni.Flags = ni.Flags&^setmask | arg&setmask
+	return 0, nil
+}
+
+// notifyReadable tells epoll the fds which become readable
+func notifyReadable() {
+	var fds []int
+	inodeMutex.Lock()
+	for fd, ni := range inodes {
+		if ni == nil || !ni.inuse {
+			continue
+		}
+		if r, ok := ni.File.(readable); ok && r.Readable() {
+			fds = append(fds, fd)
+		}
+	}
+	inodeMutex.Unlock()
+	for _, fd := range fds {
+		evnotify(uintptr(fd), syscall.EPOLLIN)
 	}
-	buf := (*syscall.Utsname)(unsafe.Pointer(c.Args[0]))
-	copy(unsafebuf(&buf.Machine), "x86_32")
-	copy(unsafebuf(&buf.Domainname), "icexin.com")
-	copy(unsafebuf(&buf.Nodename), "icexin.local")
-	copy(unsafebuf(&buf.Release), "0")
-	copy(unsafebuf(&buf.Sysname), "eggos")
-	copy(unsafebuf(&buf.Version), "0")
-	c.Ret = 0
-	c.Done()
 }
 
 // func fstatat(dirfd int, path string, stat *Stat_t, flags int)
 func sysFstatat64(c *isyscall.Request) {
-	name := cstring(c.Args[1])
+	name, err := atPath(c.Args[0], c.Args[1])
+	if err != nil {
+		c.Ret = isyscall.Errno(errnoFromErr(err))
+		c.Done()
+		return
+	}
 	stat := (*syscall.Stat_t)(unsafe.Pointer(c.Args[2]))
-	info, err := Root.Stat(name)
+	info, err := statFile(name)
 	if err != nil {
-		if os.IsNotExist(err) {
-			c.Ret = isyscall.Errno(syscall.ENOENT)
-		} else {
-			c.Ret = isyscall.Error(err)
-		}
+		c.Ret = isyscall.Errno(errnoFromErr(err))
 		c.Done()
 		return
 	}
-	stat.Mode = uint32(info.Mode())
-	stat.Mtim.Sec = int32(info.ModTime().Unix())
-	stat.Size = info.Size()
+	fillStat(stat, info, name)
 	c.Ret = 0
 	c.Done()
 }
 
+// func getrandom(buf []byte, flags int)
 func sysRandom(call *isyscall.Request) {
-	p, n := call.Args[0], call.Args[1]
-	buf := sys.UnsafeBuffer(p, int(n))
-	rand.Read(buf)
-	call.Ret = n
+	buf := sys.UnsafeBuffer(call.Args[0], int(call.Args[1]))
+	n, err := getrandom(buf, call.Args[2])
+	if err != nil {
+		call.Ret = isyscall.Errno(errnoFromErr(err))
+	} else {
+		call.Ret = uintptr(n)
+	}
 	call.Done()
 }
 
-func cstring(ptr uintptr) string {
-	var n int
-	for p := ptr; *(*byte)(unsafe.Pointer(p)) != 0; p++ {
-		n++
+func getrandom(buf []byte, flags uintptr) (int, error) {
+	if flags&^(_GRND_NONBLOCK|_GRND_RANDOM|_GRND_INSECURE) != 0 {
+		return 0, syscall.EINVAL
 	}
-	return string(sys.UnsafeBuffer(ptr, n))
+	if flags&(_GRND_RANDOM|_GRND_INSECURE) == _GRND_RANDOM|_GRND_INSECURE {
+		return 0, syscall.EINVAL
+	}
+	if flags&(_GRND_NONBLOCK|_GRND_INSECURE) == _GRND_NONBLOCK && !random.Ready() {
+		return 0, syscall.EAGAIN
+	}
+	read := random.Read
+	if flags&_GRND_INSECURE != 0 {
+		read = random.ReadInsecure
+	}
+	n := len(buf)
+	// large requests are served chunk by chunk, like linux does, so that
+	// other readers are not blocked for long.
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > _GRND_CHUNK {
+			chunk = chunk[:_GRND_CHUNK]
+		}
+		// GRND_RANDOM rekeys the DRBG from hardware for every chunk
+		if flags&_GRND_RANDOM != 0 {
+			random.MixHardware()
+		}
+		read(chunk)
+		buf = buf[len(chunk):]
+	}
+	return n, nil
+}
+
+func cstring(ptr uintptr) string {
+	return sys.CString(ptr)
 }
 
 type fileHelper struct {
@@ -278,6 +1166,20 @@ func (r *fileHelper) Write(p []byte) (int, error) {
 	return 0, syscall.EROFS
 }
 
+// ReadNonBlock falls back to Read if the reader can't be read without
+// blocking.
+func (r *fileHelper) ReadNonBlock(p []byte) (int, error) {
+	if nb, ok := r.r.(NonBlockReader); ok {
+		return nb.ReadNonBlock(p)
+	}
+	return r.Read(p)
+}
+
+func (r *fileHelper) Readable() bool {
+	x, ok := r.r.(readable)
+	return ok && x.Readable()
+}
+
 func (r *fileHelper) Ioctl(op, arg uintptr) error {
 	var x interface{}
 	if r.r != nil {
@@ -303,18 +1205,34 @@ func Mount(target string, fs afero.Fs) error {
 	return Root.Mount(target, fs)
 }
 
+// openConsole opens the registered /dev/console as the next fd
+func openConsole() {
+	f, err := openFile("/dev/console", os.O_RDWR, 0)
+	if err != nil {
+		panic(err)
+	}
+	_, ni, _ := AllocFileNode(f)
+	ni.Flags = os.O_RDWR
+	ni.Name = "/dev/console"
+}
+
 func vfsInit() {
-	c := console.Console()
-	// stdin
-	AllocFileNode(NewFile(c, nil, nil))
-	// stdout
-	AllocFileNode(NewFile(nil, c, nil))
-	// stderr
-	AllocFileNode(NewFile(nil, c, nil))
+	etcInit()
+	devInit()
+
+	// stdin, stdout and stderr
+	openConsole()
+	openConsole()
+	openConsole()
 	// epoll fd
-	AllocFileNode(NewFile(nil, nil, nil))
+	_, ni, _ := AllocFileNode(NewFile(nil, nil, nil))
+	ni.Name = "anon_inode:[eventpoll]"
+	console.OnReadable(notifyReadable)
 
-	etcInit()
+	procInit()
+	sysfsInit()
+	initrdInit()
+	cmdlineInit()
 }
 
 func sysInit() {
@@ -322,13 +1240,84 @@ func sysInit() {
 	isyscall.Register(syscall.SYS_WRITE, fscall(syscall.SYS_WRITE))
 	isyscall.Register(syscall.SYS_READ, fscall(syscall.SYS_READ))
 	isyscall.Register(syscall.SYS_CLOSE, fscall(syscall.SYS_CLOSE))
+	isyscall.Register(syscall.SYS_READV, fscall(syscall.SYS_READV))
+	isyscall.Register(syscall.SYS_WRITEV, fscall(syscall.SYS_WRITEV))
+	isyscall.Register(syscall.SYS_PREAD64, fscall(syscall.SYS_PREAD64))
+	isyscall.Register(syscall.SYS_PWRITE64, fscall(syscall.SYS_PWRITE64))
 	isyscall.Register(syscall.SYS_FSTAT64, fscall(syscall.SYS_FSTAT64))
 	isyscall.Register(syscall.SYS_IOCTL, fscall(syscall.SYS_IOCTL))
+	isyscall.Register(syscall.SYS_FTRUNCATE, fscall(syscall.SYS_FTRUNCATE))
+	isyscall.Register(syscall.SYS_FTRUNCATE64, fscall(syscall.SYS_FTRUNCATE64))
+	isyscall.Register(syscall.SYS_FCHMOD, fscall(syscall.SYS_FCHMOD))
+	isyscall.Register(syscall.SYS_FALLOCATE, fscall(syscall.SYS_FALLOCATE))
+	isyscall.Register(syscall.SYS_FCHOWN, fscall(syscall.SYS_FCHOWN))
+	isyscall.Register(syscall.SYS_FCHOWN32, fscall(syscall.SYS_FCHOWN32))
 	isyscall.Register(syscall.SYS_FCNTL, sysFcntl)
 	isyscall.Register(syscall.SYS_FCNTL64, sysFcntl)
 	isyscall.Register(syscall.SYS_FSTATAT64, sysFstatat64)
+	isyscall.Register(syscall.SYS_FLOCK, sysFlock)
+	isyscall.Register(syscall.SYS_POLL, sysPoll)
+	isyscall.Register(syscall.SYS_PPOLL, sysPoll)
+	isyscall.Register(syscall.SYS_SELECT, sysSelect)
+	isyscall.Register(syscall.SYS__NEWSELECT, sysSelect)
+	isyscall.Register(syscall.SYS_PSELECT6, sysSelect)
+	isyscall.Register(syscall.SYS_LINK, sysLinkat)
+	isyscall.Register(syscall.SYS_INOTIFY_INIT, sysInotifyInit)
+	isyscall.Register(syscall.SYS_INOTIFY_INIT1, sysInotifyInit)
+	isyscall.Register(syscall.SYS_INOTIFY_ADD_WATCH, sysInotifyAddWatch)
+	isyscall.Register(syscall.SYS_INOTIFY_RM_WATCH, sysInotifyRmWatch)
+	isyscall.Register(syscall.SYS_CHDIR, sysChdir)
+	isyscall.Register(syscall.SYS_GETCWD, sysGetcwd)
+	isyscall.Register(syscall.SYS_LINKAT, sysLinkat)
+	isyscall.Register(syscall.SYS_GETDENTS, sysGetdents)
+	isyscall.Register(syscall.SYS_GETDENTS64, sysGetdents)
+	isyscall.Register(syscall.SYS_MMAP2, sysMmap)
+	isyscall.Register(syscall.SYS_MUNMAP, sysMunmap)
 	isyscall.Register(syscall.SYS_UNAME, sysUname)
-	isyscall.Register(355, sysRandom)
+	isyscall.Register(syscall.SYS_SYSINFO, sysSysinfo)
+	isyscall.Register(syscall.SYS_SETHOSTNAME, sysSethostname)
+	isyscall.Register(syscall.SYS_SETDOMAINNAME, sysSethostname)
+	isyscall.Register(_SYS_GETRANDOM, sysRandom)
+	isyscall.Register(_SYS_COPY_FILE_RANGE, sysCopyFileRange)
+	isyscall.Register(_SYS_MEMFD_CREATE, sysMemfdCreate)
+	isyscall.Register(syscall.SYS_UMOUNT2, sysUmount2)
+	isyscall.Register(syscall.SYS_MKDIRAT, sysMkdirat)
+	isyscall.Register(syscall.SYS_UNLINKAT, sysUnlinkat)
+	isyscall.Register(syscall.SYS_RENAME, sysRename)
+	isyscall.Register(syscall.SYS_RENAMEAT, sysRename)
+	isyscall.Register(syscall.SYS_CHMOD, sysChmod)
+	isyscall.Register(syscall.SYS_FCHMODAT, sysChmod)
+	isyscall.Register(syscall.SYS_CHOWN, sysChown)
+	isyscall.Register(syscall.SYS_CHOWN32, sysChown)
+	isyscall.Register(syscall.SYS_LCHOWN, sysChown)
+	isyscall.Register(syscall.SYS_LCHOWN32, sysChown)
+	isyscall.Register(syscall.SYS_FCHOWNAT, sysChown)
+	isyscall.Register(syscall.SYS_TRUNCATE, sysTruncate)
+	isyscall.Register(syscall.SYS_TRUNCATE64, sysTruncate)
+	isyscall.Register(syscall.SYS_MKNOD, sysMknodat)
+	isyscall.Register(_SYS_SOCKET, sysSocket)
+	isyscall.Register(_SYS_BIND, sysSockcall)
+	isyscall.Register(_SYS_CONNECT, sysSockcall)
+	isyscall.Register(_SYS_LISTEN, sysSockcall)
+	isyscall.Register(_SYS_ACCEPT4, sysSockcall)
+	isyscall.Register(_SYS_GETSOCKOPT, sysSockcall)
+	isyscall.Register(_SYS_SETSOCKOPT, sysSockcall)
+	isyscall.Register(_SYS_GETSOCKNAME, sysSockcall)
+	isyscall.Register(_SYS_GETPEERNAME, sysSockcall)
+	isyscall.Register(syscall.SYS_MKNODAT, sysMknodat)
+	isyscall.Register(syscall.SYS_EVENTFD, sysEventfd2)
+	isyscall.Register(syscall.SYS_EVENTFD2, sysEventfd2)
+	isyscall.Register(syscall.SYS_GETRLIMIT, sysGetrlimit)
+	isyscall.Register(syscall.SYS_UGETRLIMIT, sysGetrlimit)
+	isyscall.Register(syscall.SYS_SETRLIMIT, sysSetrlimit)
+	isyscall.Register(syscall.SYS_PRLIMIT64, sysPrlimit64)
+	isyscall.Register(syscall.SYS_TIMERFD_CREATE, sysTimerfdCreate)
+	isyscall.Register(syscall.SYS_TIMERFD_SETTIME, sysTimerfdSettime)
+	isyscall.Register(syscall.SYS_TIMERFD_GETTIME, sysTimerfdGettime)
+	isyscall.Register(syscall.SYS_SENDFILE, sysSendfile)
+	isyscall.Register(syscall.SYS_SENDFILE64, sysSendfile)
+
+	go loadavgLoop()
 }
 
 func Init() {
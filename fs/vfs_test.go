@@ -0,0 +1,766 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/icexin/eggos/fs/devfs"
+	"github.com/icexin/eggos/kernel/random"
+	"github.com/spf13/afero"
+)
+
+type nopFile struct{}
+
+func (nopFile) Read(p []byte) (int, error)  { return 0, nil }
+func (nopFile) Write(p []byte) (int, error) { return len(p), nil }
+func (nopFile) Close() error                { return nil }
+
+func TestInodeReuseFdZero(t *testing.T) {
+	fd, ni, _ := AllocFileNode(nopFile{})
+	if err := sysClose(ni); err != nil {
+		t.Fatal(err)
+	}
+	fd1, ni1, _ := AllocFileNode(nopFile{})
+	defer ni1.Release()
+	if fd1 != fd {
+		t.Fatalf("expect fd %d to be reused, got %d", fd, fd1)
+	}
+}
+
+func TestInodeLowestFd(t *testing.T) {
+	var fds []int
+	var nis []*Inode
+	for i := 0; i < 3; i++ {
+		fd, ni, _ := AllocFileNode(nopFile{})
+		fds = append(fds, fd)
+		nis = append(nis, ni)
+	}
+	sysClose(nis[0])
+	sysClose(nis[2])
+	sysClose(nis[1])
+	for _, want := range fds {
+		fd, ni, _ := AllocFileNode(nopFile{})
+		defer ni.Release()
+		if fd != want {
+			t.Fatalf("expect the lowest fd %d, got %d", want, fd)
+		}
+	}
+}
+
+func TestInodeDoubleClose(t *testing.T) {
+	fd, ni, _ := AllocFileNode(nopFile{})
+	if err := sysClose(ni); err != nil {
+		t.Fatal(err)
+	}
+	if err := sysClose(ni); err != syscall.EBADF {
+		t.Fatalf("expect EBADF on double close, got %v", err)
+	}
+	if _, err := GetInode(fd); err != syscall.EBADF {
+		t.Fatalf("expect EBADF on closed fd, got %v", err)
+	}
+
+	// a stale inode must not release the new owner of the fd
+	fd1, ni1, _ := AllocFileNode(nopFile{})
+	defer ni1.Release()
+	if ni.Release() != syscall.EBADF {
+		t.Fatal("expect EBADF on releasing stale inode")
+	}
+	if _, err := GetInode(fd1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInodeStress(t *testing.T) {
+	const (
+		workers = 16
+		loops   = 2000
+	)
+	before := len(inodes)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < loops; j++ {
+				fd, ni, err := AllocFileNode(nopFile{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := GetInode(fd)
+				if err != nil || got != ni {
+					t.Errorf("GetInode(%d) = %p, %v", fd, got, err)
+					return
+				}
+				// dup
+				_, dup, err := AllocFileNode(got.File)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := sysClose(ni); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := sysClose(dup); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(inodes) - before; n > 2*workers {
+		t.Fatalf("inode table grow %d, expect at most %d", n, 2*workers)
+	}
+}
+
+func TestInodeCompact(t *testing.T) {
+	inodeMutex.Lock()
+	before := len(inodes)
+	inodeMutex.Unlock()
+
+	var nis []*Inode
+	for i := 0; i < 100; i++ {
+		_, ni, err := AllocFileNode(nopFile{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nis = append(nis, ni)
+	}
+	for _, ni := range nis {
+		ni.Release()
+	}
+	inodeMutex.Lock()
+	n := len(inodes)
+	inodeMutex.Unlock()
+	if n > before {
+		t.Fatalf("expect inode table shrink to %d, got %d", before, n)
+	}
+
+	// the tail count follows releases in any order
+	for _, order := range []string{"reverse", "holes"} {
+		nis = nis[:0]
+		for i := 0; i < 100; i++ {
+			_, ni, _ := AllocFileNode(nopFile{})
+			nis = append(nis, ni)
+		}
+		var rel []*Inode
+		for i := range nis {
+			if order == "reverse" {
+				rel = append(rel, nis[len(nis)-1-i])
+			} else if i%2 == 0 {
+				rel = append(rel, nis[i])
+			}
+		}
+		if order == "holes" {
+			for i := len(nis) - 1; i > 0; i -= 2 {
+				rel = append(rel, nis[i])
+			}
+		}
+		for _, ni := range rel {
+			ni.Release()
+			inodeMutex.Lock()
+			tail := 0
+			for tail < len(inodes) && inodes[len(inodes)-1-tail] == nil {
+				tail++
+			}
+			if tail != tailFree {
+				inodeMutex.Unlock()
+				t.Fatalf("%s: %d free slots at tail, tailFree is %d", order, tail, tailFree)
+			}
+			inodeMutex.Unlock()
+		}
+		inodeMutex.Lock()
+		n = len(inodes)
+		inodeMutex.Unlock()
+		if n > before {
+			t.Fatalf("%s: expect inode table shrink to %d, got %d", order, before, n)
+		}
+	}
+
+	// the lowest fd is still reused
+	fd, ni, _ := AllocFileNode(nopFile{})
+	defer ni.Release()
+	for i, ni := range inodes[:fd] {
+		if ni == nil {
+			t.Fatalf("fd %d allocated while %d is free", fd, i)
+		}
+	}
+}
+
+func TestNoFileLimit(t *testing.T) {
+	soft, hard := NoFileLimit()
+	defer SetNoFileLimit(soft, hard)
+
+	n := OpenFDCount()
+	if err := SetNoFileLimit(uint64(n+1), hard); err != nil {
+		t.Fatal(err)
+	}
+	_, ni, err := AllocFileNode(nopFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ni.Release()
+	if _, _, err = AllocFileNode(nopFile{}); err != syscall.EMFILE {
+		t.Fatalf("expect EMFILE, got %v", err)
+	}
+
+	rlim := syscall.Rlimit{Cur: hard + 1, Max: hard}
+	if err := setrlimit(syscall.RLIMIT_NOFILE, &rlim); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	rlim = syscall.Rlimit{Cur: soft, Max: hard + 1}
+	if err := setrlimit(syscall.RLIMIT_NOFILE, &rlim); err != syscall.EPERM {
+		t.Fatalf("expect EPERM, got %v", err)
+	}
+}
+
+func TestRlimit(t *testing.T) {
+	rlim, err := getrlimit(syscall.RLIMIT_STACK)
+	if err != nil || rlim.Cur != 8<<20 || rlim.Max != _RLIM_INFINITY {
+		t.Fatalf("getrlimit = %+v, %v", rlim, err)
+	}
+	core := *rlimits[syscall.RLIMIT_CORE]
+	// the hard limit can't be raised back by setrlimit
+	defer func() { *rlimits[syscall.RLIMIT_CORE] = core }()
+	if err := setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{Cur: 1 << 20, Max: 2 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if rlim, _ = getrlimit(syscall.RLIMIT_CORE); rlim.Cur != 1<<20 || rlim.Max != 2<<20 {
+		t.Fatalf("getrlimit = %+v", rlim)
+	}
+	if err := setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{Cur: 0, Max: 4 << 20}); err != syscall.EPERM {
+		t.Fatalf("expect EPERM, got %v", err)
+	}
+	if _, err := getrlimit(_RLIM_NLIMITS); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
+
+func TestOpenFailNoLeak(t *testing.T) {
+	n := OpenFDCount()
+	size := len(inodes)
+	name := []byte("/no/such/file\x00")
+	for i := 0; i < 10000; i++ {
+		if _, err := sysOpen(0, uintptr(unsafe.Pointer(&name[0])), syscall.O_RDONLY, 0); err != syscall.ENOENT {
+			t.Fatalf("expect ENOENT, got %v", err)
+		}
+	}
+	if OpenFDCount() != n {
+		t.Fatalf("failed opens leak %d fds", OpenFDCount()-n)
+	}
+	if len(inodes) > size+1 {
+		t.Fatalf("inode table grows from %d to %d", size, len(inodes))
+	}
+}
+
+func TestNilFileEBADF(t *testing.T) {
+	// an inode allocated by an open in flight
+	fd, ni, _ := AllocInode()
+	defer ni.Release()
+	if _, err := GetInode(fd); err != syscall.EBADF {
+		t.Fatalf("expect EBADF from GetInode, got %v", err)
+	}
+	buf := make([]byte, 1)
+	p := uintptr(unsafe.Pointer(&buf[0]))
+	if _, err := sysRead(ni, p, 1); err != syscall.EBADF {
+		t.Fatalf("expect EBADF from read, got %v", err)
+	}
+	if _, err := sysWrite(ni, p, 1); err != syscall.EBADF {
+		t.Fatalf("expect EBADF from write, got %v", err)
+	}
+}
+
+func openTest(t *testing.T, name string, flags int) (int, *Inode) {
+	f, err := Root.OpenFile(name, flags, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, ni, err := AllocFileNode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni.Flags, ni.Name = flags, name
+	return fd, ni
+}
+
+// shortFile accepts at most limit bytes in total
+type shortFile struct {
+	bytes.Buffer
+	limit int
+}
+
+func (f *shortFile) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		p = p[:f.limit]
+	}
+	f.limit -= len(p)
+	return f.Buffer.Write(p)
+}
+
+func (f *shortFile) Close() error { return nil }
+
+func iovec(bufs ...[]byte) []syscall.Iovec {
+	var vecs []syscall.Iovec
+	for _, buf := range bufs {
+		v := syscall.Iovec{}
+		if len(buf) > 0 {
+			v.Base = &buf[0]
+		}
+		v.SetLen(len(buf))
+		vecs = append(vecs, v)
+	}
+	return vecs
+}
+
+func TestReadvWritev(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	f, _ := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	_, ni, _ := AllocFileNode(f)
+	defer sysClose(ni)
+
+	vecs := iovec([]byte("hello"), nil, []byte(" "), []byte("world"))
+	n, err := sysWritev(ni, uintptr(unsafe.Pointer(&vecs[0])), len(vecs))
+	if err != nil || n != 11 {
+		t.Fatalf("expect 11 bytes written, got %d %v", n, err)
+	}
+	f.Seek(0, io.SeekStart)
+	a, b := make([]byte, 3), make([]byte, 20)
+	vecs = iovec(a, nil, b)
+	n, err = sysReadv(ni, uintptr(unsafe.Pointer(&vecs[0])), len(vecs))
+	if err != nil || n != 11 || string(a) != "hel" || string(b[:8]) != "lo world" {
+		t.Fatalf("got %d %v %q %q", n, err, a, b)
+	}
+
+	// the vectors beyond iovCombine are written one by one
+	big := make([]byte, iovCombine)
+	short := &shortFile{limit: iovCombine + 10}
+	_, sni, _ := AllocFileNode(short)
+	defer sysClose(sni)
+	vecs = iovec(big, big)
+	n, err = sysWritev(sni, uintptr(unsafe.Pointer(&vecs[0])), len(vecs))
+	if err != nil || n != iovCombine+10 || short.Len() != n {
+		t.Fatalf("expect %d bytes written, got %d %v", iovCombine+10, n, err)
+	}
+
+	// a short write of the combined vectors returns the bytes written
+	partial := &shortFile{limit: 7}
+	_, pni, _ := AllocFileNode(partial)
+	defer sysClose(pni)
+	vecs = iovec([]byte("hello"), []byte("world"))
+	n, err = sysWritev(pni, uintptr(unsafe.Pointer(&vecs[0])), len(vecs))
+	if err != nil || n != 7 || partial.String() != "hellowo" {
+		t.Fatalf("expect 7 bytes written, got %d %v %q", n, err, partial.String())
+	}
+
+	if _, err = sysWritev(ni, uintptr(unsafe.Pointer(&vecs[0])), _IOV_MAX+1); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
+
+func TestCopyFileRange(t *testing.T) {
+	afero.WriteFile(Root, "/tmp/copy_src", []byte("hello world"), 0644)
+	infd, in := openTest(t, "/tmp/copy_src", os.O_RDONLY)
+	defer sysClose(in)
+	outfd, out := openTest(t, "/tmp/copy_dst", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	defer sysClose(out)
+
+	inoff := int64(6)
+	n, err := copyFileRange(uintptr(infd), uintptr(unsafe.Pointer(&inoff)), uintptr(outfd), 0, 100, 0)
+	if err != nil || n != 5 || inoff != 11 {
+		t.Fatalf("copy_file_range = %d, %v, inoff %d", n, err, inoff)
+	}
+	// without offset, the file positions are used
+	n, err = copyFileRange(uintptr(infd), 0, uintptr(outfd), 0, 5, 0)
+	if err != nil || n != 5 {
+		t.Fatalf("copy_file_range = %d, %v", n, err)
+	}
+	b, _ := afero.ReadFile(Root, "/tmp/copy_dst")
+	if string(b) != "worldhello" {
+		t.Fatalf("got %q", b)
+	}
+
+	// a huge count is capped at the size of source
+	inoff = 0
+	outfd2, out2 := openTest(t, "/tmp/copy_dst2", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	defer sysClose(out2)
+	n, err = copyFileRange(uintptr(infd), uintptr(unsafe.Pointer(&inoff)), uintptr(outfd2), 0, ^uintptr(0), 0)
+	if err != nil || n != 11 {
+		t.Fatalf("copy_file_range = %d, %v", n, err)
+	}
+
+	if _, err = copyFileRange(uintptr(outfd), 0, uintptr(infd), 0, 5, 0); err != syscall.EBADF {
+		t.Fatalf("expect EBADF, got %v", err)
+	}
+}
+
+func TestSendfile(t *testing.T) {
+	afero.WriteFile(Root, "/tmp/sendfile_src", []byte("hello world"), 0644)
+	infd, in := openTest(t, "/tmp/sendfile_src", os.O_RDONLY)
+	defer sysClose(in)
+	outfd, out := openTest(t, "/tmp/sendfile_dst", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	defer sysClose(out)
+
+	// the offset is updated but not the position of source
+	off := int64(6)
+	n, err := sendfile(syscall.SYS_SENDFILE64, uintptr(outfd), uintptr(infd), uintptr(unsafe.Pointer(&off)), 100)
+	if err != nil || n != 5 || off != 11 {
+		t.Fatalf("sendfile = %d, %v, off %d", n, err, off)
+	}
+	n, err = sendfile(syscall.SYS_SENDFILE64, uintptr(outfd), uintptr(infd), 0, 5)
+	if err != nil || n != 5 {
+		t.Fatalf("sendfile = %d, %v", n, err)
+	}
+	if pos, _ := in.File.(afero.File).Seek(0, io.SeekCurrent); pos != 5 {
+		t.Fatalf("expect the position 5, got %d", pos)
+	}
+	b, _ := afero.ReadFile(Root, "/tmp/sendfile_dst")
+	if string(b) != "worldhello" {
+		t.Fatalf("got %q", b)
+	}
+
+	// a big file is copied chunk by chunk
+	big := bytes.Repeat([]byte("0123456789abcdef"), copyChunk/16*3+1)
+	afero.WriteFile(Root, "/tmp/sendfile_big", big, 0644)
+	bigfd, bigin := openTest(t, "/tmp/sendfile_big", os.O_RDONLY)
+	defer sysClose(bigin)
+	outfd2, out2 := openTest(t, "/tmp/sendfile_dst2", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	defer sysClose(out2)
+	n, err = sendfile(syscall.SYS_SENDFILE64, uintptr(outfd2), uintptr(bigfd), 0, ^uintptr(0)>>1)
+	if err != nil || n != int64(len(big)) {
+		t.Fatalf("sendfile = %d, %v", n, err)
+	}
+	if b, _ := afero.ReadFile(Root, "/tmp/sendfile_dst2"); !bytes.Equal(b, big) {
+		t.Fatal("content mismatch")
+	}
+
+	if _, err = sendfile(syscall.SYS_SENDFILE64, uintptr(infd), uintptr(outfd), 0, 5); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
+
+func TestUmount(t *testing.T) {
+	if err := Mount("/mnt/outer", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mount("/mnt/outer/inner", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Umount("/mnt/outer"); err != syscall.EBUSY {
+		t.Fatalf("expect EBUSY on nested mount, got %v", err)
+	}
+	if err := Umount("/mnt"); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL on non mount point, got %v", err)
+	}
+
+	name := []byte("/mnt/outer/inner/file\x00")
+	fd, err := sysOpen(0, uintptr(unsafe.Pointer(&name[0])), uintptr(os.O_RDWR|os.O_CREATE), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Umount("/mnt/outer/inner"); err != syscall.EBUSY {
+		t.Fatalf("expect EBUSY on opened file, got %v", err)
+	}
+	ni, _ := GetInode(fd)
+	sysClose(ni)
+	if err = Umount("/mnt/outer/inner"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Umount("/mnt/outer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range Mounts() {
+		if strings.HasPrefix(m.Path, "/mnt") {
+			t.Fatalf("%s is still mounted", m.Path)
+		}
+	}
+	// the path can be reused
+	if err = Mount("/mnt/outer", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	Umount("/mnt/outer")
+}
+
+func TestChmod(t *testing.T) {
+	if err := Mount("/mnt/chmod", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/chmod")
+
+	name := []byte("/mnt/chmod/file\x00")
+	fd, err := sysOpen(0, uintptr(unsafe.Pointer(&name[0])), uintptr(os.O_RDWR|os.O_CREATE), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, _ := GetInode(fd)
+	defer sysClose(ni)
+
+	mode := func() uint32 {
+		var stat syscall.Stat_t
+		if err := sysStat(ni, uintptr(unsafe.Pointer(&stat))); err != nil {
+			t.Fatal(err)
+		}
+		return stat.Mode & 0777
+	}
+	if err = sysFchmod(ni, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(); m != 0600 {
+		t.Fatalf("expect mode 0600, got %o", m)
+	}
+	if err = chmod("/mnt/chmod/file", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(); m != 0755 {
+		t.Fatalf("expect mode 0755, got %o", m)
+	}
+	if err = chmod("/mnt/chmod/none", 0755); err != syscall.ENOENT {
+		t.Fatalf("expect ENOENT, got %v", err)
+	}
+}
+
+func TestFallocate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	f, _ := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	f.Write([]byte("hello world"))
+	_, ni, _ := AllocFileNode(f)
+	ni.Flags = os.O_RDWR
+	defer sysClose(ni)
+
+	size := func() int64 {
+		info, _ := f.Stat()
+		return info.Size()
+	}
+	if err := sysFallocate(ni, 0, 0, 4096); err != nil || size() != 4096 {
+		t.Fatalf("expect size 4096, got %d %v", size(), err)
+	}
+	if err := sysFallocate(ni, _FALLOC_FL_KEEP_SIZE, 0, 8192); err != nil || size() != 4096 {
+		t.Fatalf("expect size 4096, got %d %v", size(), err)
+	}
+	if err := sysFallocate(ni, _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	f.ReadAt(buf, 0)
+	if string(buf) != "he\x00\x00\x00 world" || size() != 4096 {
+		t.Fatalf("got %q, size %d", buf, size())
+	}
+	if err := sysFallocate(ni, _FALLOC_FL_PUNCH_HOLE, 0, 1); err != syscall.EOPNOTSUPP {
+		t.Fatalf("expect EOPNOTSUPP, got %v", err)
+	}
+	if err := sysFallocate(ni, 0, 0, 0); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
+
+func TestReadOnlyMount(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	afero.WriteFile(mfs, "/file", []byte("hello"), 0644)
+	if err := MountWithFlags("/mnt/ro", mfs, syscall.MS_RDONLY); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/ro")
+
+	name := []byte("/mnt/ro/file\x00")
+	open := func(flags int) (int, error) {
+		return sysOpen(0, uintptr(unsafe.Pointer(&name[0])), uintptr(flags), 0644)
+	}
+	if _, err := open(os.O_RDWR); err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	if err := mkdirat("/mnt/ro/dir", 0755); err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	if err := unlinkat("/mnt/ro/file", 0); err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	if err := rename("/mnt/ro/file", "/mnt/ro/file1"); err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	if err := chmod("/mnt/ro/file", 0600); err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	if err := truncate("/mnt/ro/file", 0); err != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	// the check is done by Root itself, not only by the syscalls
+	if _, err := Root.OpenFile("/mnt/ro/file", os.O_WRONLY, 0); fsErrno(err) != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	if err := Root.Mkdir("/mnt/ro/dir", 0755); fsErrno(err) != syscall.EROFS {
+		t.Fatalf("expect EROFS, got %v", err)
+	}
+	fd, err := open(os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, _ := GetInode(fd)
+	sysClose(ni)
+
+	// make it writable for maintenance
+	if err = Remount("/mnt/ro", 0); err != nil {
+		t.Fatal(err)
+	}
+	fd, err = open(os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni, _ = GetInode(fd)
+	if err = Remount("/mnt/ro", syscall.MS_RDONLY); err != syscall.EBUSY {
+		t.Fatalf("expect EBUSY, got %v", err)
+	}
+	sysClose(ni)
+	if err = unlinkat("/mnt/ro/file", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = Remount("/mnt/ro", syscall.MS_RDONLY); err != nil {
+		t.Fatal(err)
+	}
+	if err = Remount("/mnt", 0); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+}
+
+func TestMknod(t *testing.T) {
+	dev := devfs.New()
+	if err := Mount("/mnt/dev", dev); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/dev")
+	// 240-254 are reserved by linux for local use, no driver takes them
+	RegisterCharDevice(240, 7, func() io.ReadWriteCloser {
+		return nopCloser{null{}}
+	})
+
+	if err := mknodat("/mnt/dev/null", syscall.S_IFCHR|0666, 240<<8|7); err != nil {
+		t.Fatal(err)
+	}
+	if err := mknodat("/mnt/dev/null", syscall.S_IFCHR|0666, 240<<8|7); err != syscall.EEXIST {
+		t.Fatalf("expect EEXIST, got %v", err)
+	}
+	if err := mknodat("/mnt/dev/none", syscall.S_IFCHR|0666, 250<<8); err != syscall.ENXIO {
+		t.Fatalf("expect ENXIO, got %v", err)
+	}
+	if err := mknodat("/mnt/dev/sda", syscall.S_IFBLK|0666, 8<<8); err != syscall.EPERM {
+		t.Fatalf("expect EPERM, got %v", err)
+	}
+	f, err := Root.OpenFile("/mnt/dev/null", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("write to null:%d %v", n, err)
+	}
+	f.Close()
+
+	if err := mknodat("/mnt/dev/fifo", syscall.S_IFIFO|0640, 0); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := statFile("/mnt/dev/fifo"); info.Mode() != os.ModeNamedPipe|0640 {
+		t.Fatalf("bad fifo mode %v", info.Mode())
+	}
+	r, _ := Root.Open("/mnt/dev/fifo")
+	w, _ := Root.OpenFile("/mnt/dev/fifo", os.O_WRONLY, 0)
+	go w.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read fifo:%q %v", buf, err)
+	}
+}
+
+func TestMknodOrdinaryFs(t *testing.T) {
+	if err := Mount("/mnt/mem", afero.NewMemMapFs()); err != nil {
+		t.Fatal(err)
+	}
+	defer Umount("/mnt/mem")
+
+	if err := mknodat("/mnt/mem/fifo", syscall.S_IFIFO|0600, 0); err != nil {
+		t.Fatal(err)
+	}
+	info, err := statFile("/mnt/mem/fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != os.ModeNamedPipe|0600 {
+		t.Fatalf("bad fifo mode %v", info.Mode())
+	}
+	r, err := openFile("/mnt/mem/fifo", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openFile("/mnt/mem/fifo", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read fifo:%q %v", buf, err)
+	}
+	if info, _ := r.Stat(); info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("bad fstat mode %v", info.Mode())
+	}
+	r.Close()
+	w.Close()
+
+	if err := rename("/mnt/mem/fifo", "/mnt/mem/fifo1"); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := statFile("/mnt/mem/fifo1"); info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("mode lost after rename: %v", info.Mode())
+	}
+	if err := unlinkat("/mnt/mem/fifo1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if lookupNode("/mnt/mem/fifo1") != nil {
+		t.Fatal("node not removed on unlink")
+	}
+}
+
+func TestFcntlNonBlock(t *testing.T) {
+	e := newEventFd(0, 0)
+	fd, ni, err := AllocFileNode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysClose(ni)
+	if _, err := fcntlFlags(fd, syscall.F_SETFL, syscall.O_NONBLOCK); err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := fcntlFlags(fd, syscall.F_GETFL, 0); flags&syscall.O_NONBLOCK == 0 {
+		t.Fatalf("O_NONBLOCK not set, flags %#x", flags)
+	}
+	var buf [8]byte
+	if _, err := sysRead(ni, uintptr(unsafe.Pointer(&buf[0])), 8); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+}
+
+func TestGetrandomNotReady(t *testing.T) {
+	if random.Ready() {
+		t.Skip("the pool is seeded")
+	}
+	buf := make([]byte, 16)
+	if _, err := getrandom(buf, _GRND_NONBLOCK); err != syscall.EAGAIN {
+		t.Fatalf("expect EAGAIN, got %v", err)
+	}
+	if _, err := getrandom(buf, 0x80); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	if _, err := getrandom(buf, _GRND_RANDOM|_GRND_INSECURE); err != syscall.EINVAL {
+		t.Fatalf("expect EINVAL, got %v", err)
+	}
+	// GRND_INSECURE never waits for the seed
+	if n, err := getrandom(buf, _GRND_INSECURE|_GRND_NONBLOCK); err != nil || n != len(buf) {
+		t.Fatalf("expect %d bytes, got %d %v", len(buf), n, err)
+	}
+}
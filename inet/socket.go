@@ -114,7 +114,11 @@ func sysSocket(domain, typ, proto uintptr) uintptr {
 		return isyscall.Error(e(err))
 	}
 
-	sfile := allocSockFile(ep, wq)
+	sfile, err1 := allocSockFile(ep, wq)
+	if err1 != nil {
+		ep.Close()
+		return isyscall.Error(err1)
+	}
 	return uintptr(sfile.fd)
 }
 
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -32,10 +34,17 @@ type sockFile struct {
 	// rdbuf contains bytes that have been read from the endpoint,
 	// but haven't yet been returned.
 	rdbuf buffer.View
+
+	// events is the waiters registered by setupEvent
+	events    []*waiter.Entry
+	closeOnce sync.Once
 }
 
-func allocSockFile(ep tcpip.Endpoint, wq *waiter.Queue) *sockFile {
-	fd, ni := fs.AllocInode()
+func allocSockFile(ep tcpip.Endpoint, wq *waiter.Queue) (*sockFile, error) {
+	fd, ni, err := fs.AllocInode()
+	if err != nil {
+		return nil, err
+	}
 
 	sfile := &sockFile{
 		fd: fd,
@@ -45,7 +54,8 @@ func allocSockFile(ep tcpip.Endpoint, wq *waiter.Queue) *sockFile {
 	sfile.setupEvent()
 
 	ni.File = sfile
-	return sfile
+	ni.Name = "socket:"
+	return sfile, nil
 }
 
 func findSockFile(fd uintptr) (*sockFile, error) {
@@ -118,8 +128,41 @@ write:
 	}
 }
 
+// Poll returns the readiness of the endpoint for poll
+func (s *sockFile) Poll() uint32 {
+	mask := s.ep.Readiness(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
+	if s.rdbuf != nil {
+		mask |= waiter.EventIn
+	}
+	return mask.ToLinux()
+}
+
+// Ioctl supports FIONREAD, FIONBIO is handled by fs for all the fds.
+func (s *sockFile) Ioctl(op, arg uintptr) error {
+	switch op {
+	case syscall.TIOCINQ:
+		n, terr := s.ep.GetSockOptInt(tcpip.ReceiveQueueSizeOption)
+		if terr != nil {
+			return e(terr)
+		}
+		*(*int32)(unsafe.Pointer(arg)) = int32(n + len(s.rdbuf))
+		return nil
+	default:
+		return syscall.ENOTTY
+	}
+}
+
+func (s *sockFile) Stat() (os.FileInfo, error) {
+	return fs.SocketInfo(), nil
+}
+
+// Close tears down the endpoint once, the events of the endpoint are not
+// reported to the fd any more, which may be reused.
 func (s *sockFile) Close() error {
-	s.ep.Close()
+	s.closeOnce.Do(func() {
+		s.stopEvent()
+		s.ep.Close()
+	})
 	return nil
 }
 
@@ -130,38 +173,42 @@ func (e evcallback) Callback(entry *waiter.Entry) {
 }
 
 func (s *sockFile) setupEvent() {
-	s.wq.EventRegister(&waiter.Entry{
-		Callback: evcallback(s.evin),
-	}, waiter.EventIn)
-	s.wq.EventRegister(&waiter.Entry{
-		Callback: evcallback(s.evout),
-	}, waiter.EventOut)
-	s.wq.EventRegister(&waiter.Entry{
-		Callback: evcallback(s.everr),
-	}, waiter.EventErr)
-	s.wq.EventRegister(&waiter.Entry{
-		Callback: evcallback(s.evehup),
-	}, waiter.EventHUp)
+	s.events = []*waiter.Entry{
+		{Callback: evcallback(s.evin)},
+		{Callback: evcallback(s.evout)},
+		{Callback: evcallback(s.everr)},
+		{Callback: evcallback(s.evehup)},
+	}
+	masks := []waiter.EventMask{waiter.EventIn, waiter.EventOut, waiter.EventErr, waiter.EventHUp}
+	for i, entry := range s.events {
+		s.wq.EventRegister(entry, masks[i])
+	}
 }
 
 func (s *sockFile) stopEvent() {
-	s.wq.EventUnregister(nil)
+	for _, entry := range s.events {
+		s.wq.EventUnregister(entry)
+	}
 }
 
 func (s *sockFile) evin(e *waiter.Entry) {
 	evnotify(uintptr(s.fd), uintptr(waiter.EventIn.ToLinux()))
+	fs.PollWakeup()
 }
 
 func (s *sockFile) evout(e *waiter.Entry) {
 	evnotify(uintptr(s.fd), uintptr(waiter.EventOut.ToLinux()))
+	fs.PollWakeup()
 }
 
 func (s *sockFile) everr(e *waiter.Entry) {
 	evnotify(uintptr(s.fd), uintptr(waiter.EventErr.ToLinux()))
+	fs.PollWakeup()
 }
 
 func (s *sockFile) evehup(e *waiter.Entry) {
 	evnotify(uintptr(s.fd), uintptr(waiter.EventHUp.ToLinux()))
+	fs.PollWakeup()
 }
 
 func (s *sockFile) Bind(uaddr, uaddrlen uintptr) error {
@@ -227,7 +274,11 @@ func (s *sockFile) Accept4(uaddr, uaddrlen, flag uintptr) (int, error) {
 	saddr.family = syscall.AF_INET
 	saddr.port = htons(newaddr.Port)
 	copy(saddr.ip[:], newaddr.Addr)
-	sfile := allocSockFile(newep, wq)
+	sfile, err1 := allocSockFile(newep, wq)
+	if err1 != nil {
+		newep.Close()
+		return 0, err1
+	}
 	return sfile.fd, nil
 }
 
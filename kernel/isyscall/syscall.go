@@ -2,6 +2,7 @@ package isyscall
 
 import (
 	"fmt"
+	"sync/atomic"
 	"syscall"
 	_ "unsafe"
 )
@@ -29,6 +30,9 @@ type Request struct {
 }
 
 func (r *Request) Done() {
+	if atomic.LoadInt32(&tracing) != 0 {
+		trace(r)
+	}
 	wakeup(&r.Lock, 1)
 	// syscall.Syscall6(_SYS_futex, uintptr(unsafe.Pointer(&r.Lock)), _FUTEX_WAKE, 1, 0, 0, 0)
 }
@@ -41,6 +45,17 @@ func Register(no uintptr, handler Handler) {
 	handlers[no] = handler
 }
 
+// NumHandlers returns the number of registered syscalls
+func NumHandlers() int {
+	n := 0
+	for _, h := range handlers {
+		if h != nil {
+			n++
+		}
+	}
+	return n
+}
+
 func Errno(code syscall.Errno) uintptr {
 	return uintptr(-code)
 }
@@ -0,0 +1,223 @@
+package isyscall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/icexin/eggos/sys"
+)
+
+const (
+	// number of lines kept for TraceLog
+	traceRingSize = 256
+	// lines waiting for the writer, new lines are dropped if full
+	tracePending = 256
+)
+
+// the format of arguments, one byte for every argument:
+// 'd' decimal, 'x' hex, 'o' octal, 's' C string,
+// 'w' buffer with the length in next argument,
+// 'r' buffer filled by the call with the length in return value.
+var traceArgs = map[uintptr]string{
+	syscall.SYS_EXIT_GROUP:  "d",
+	syscall.SYS_READ:        "drd",
+	syscall.SYS_WRITE:       "dwd",
+	syscall.SYS_PREAD64:     "drddd",
+	syscall.SYS_PWRITE64:    "dwddd",
+	syscall.SYS_OPEN:        "sxo",
+	syscall.SYS_OPENAT:      "dsxo",
+	syscall.SYS_CLOSE:       "d",
+	syscall.SYS__LLSEEK:     "dddxd",
+	syscall.SYS_IOCTL:       "dxx",
+	syscall.SYS_FCNTL:       "dxx",
+	syscall.SYS_FCNTL64:     "dxx",
+	syscall.SYS_DUP:         "d",
+	syscall.SYS_DUP2:        "dd",
+	syscall.SYS_STAT64:      "sx",
+	syscall.SYS_LSTAT64:     "sx",
+	syscall.SYS_FSTAT64:     "dx",
+	syscall.SYS_FSTATAT64:   "dsxx",
+	syscall.SYS_FTRUNCATE64: "ddd",
+	syscall.SYS_ACCESS:      "so",
+	syscall.SYS_FACCESSAT:   "dsox",
+	syscall.SYS_READLINK:    "sxd",
+	syscall.SYS_CHDIR:       "s",
+	syscall.SYS_MKDIR:       "so",
+	syscall.SYS_MKDIRAT:     "dso",
+	syscall.SYS_UNLINK:      "s",
+	syscall.SYS_UNLINKAT:    "dsx",
+	syscall.SYS_RENAME:      "ss",
+	syscall.SYS_RENAMEAT:    "dsds",
+	syscall.SYS_GETDENTS64:  "dxd",
+	syscall.SYS_MOUNT:       "sssxx",
+	syscall.SYS_UMOUNT2:     "sx",
+	syscall.SYS_UNAME:       "x",
+	356:                     "sx",  // memfd_create
+	355:                     "xdx", // getrandom, the output is not traced
+}
+
+var (
+	tracing int32
+	// set while the writer is writing, the writes to traceFd issued by
+	// the writer itself are not traced, otherwise tracing to a file
+	// feeds back forever.
+	traceWriting int32
+	// the fd of writer, -1 if the writer is not a file
+	traceFd int32 = -1
+
+	traceMutex   sync.Mutex
+	traceWriter  io.Writer
+	traceBufLen  = 32
+	traceRing    [traceRingSize]string
+	traceNext    int
+	traceDropped int
+
+	traceOnce  sync.Once
+	traceLines = make(chan string, tracePending)
+)
+
+// Name returns the name of syscall no
+func Name(no uintptr) string {
+	if no < uintptr(len(names)) && names[no] != "" {
+		return names[no]
+	}
+	return fmt.Sprintf("syscall_%d", no)
+}
+
+// SetTrace logs every syscall, with its arguments and return value, to w
+// and the ring buffer read by TraceLog. A nil w disables tracing.
+func SetTrace(w io.Writer) {
+	fd := int32(-1)
+	if f, ok := w.(interface{ Fd() uintptr }); ok {
+		fd = int32(f.Fd())
+	}
+	traceMutex.Lock()
+	traceWriter = w
+	atomic.StoreInt32(&traceFd, fd)
+	traceMutex.Unlock()
+	if w == nil {
+		atomic.StoreInt32(&tracing, 0)
+		return
+	}
+	traceOnce.Do(func() {
+		go traceLoop()
+	})
+	atomic.StoreInt32(&tracing, 1)
+}
+
+// SetTraceBufLen sets the max bytes of buffer arguments printed in trace.
+func SetTraceBufLen(n int) {
+	traceMutex.Lock()
+	traceBufLen = n
+	traceMutex.Unlock()
+}
+
+// TraceLog returns the recent lines of trace.
+func TraceLog() []byte {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	var buf bytes.Buffer
+	for i := 0; i < traceRingSize; i++ {
+		line := traceRing[(traceNext+i)%traceRingSize]
+		buf.WriteString(line)
+	}
+	if traceDropped != 0 {
+		fmt.Fprintf(&buf, "(%d lines dropped by writer)\n", traceDropped)
+	}
+	return buf.Bytes()
+}
+
+func traceLoop() {
+	for line := range traceLines {
+		traceMutex.Lock()
+		w := traceWriter
+		traceMutex.Unlock()
+		if w == nil {
+			continue
+		}
+		atomic.StoreInt32(&traceWriting, 1)
+		io.WriteString(w, line)
+		atomic.StoreInt32(&traceWriting, 0)
+	}
+}
+
+func formatBuffer(b *strings.Builder, p uintptr, n int, max int) {
+	if p == 0 {
+		b.WriteString("NULL")
+		return
+	}
+	if n < 0 {
+		n = 0
+	}
+	more := ""
+	if n > max {
+		n, more = max, "..."
+	}
+	fmt.Fprintf(b, "%q%s", sys.UnsafeBuffer(p, n), more)
+}
+
+// trace is called by Done if tracing is enabled
+func trace(r *Request) {
+	if (r.NO == syscall.SYS_WRITE || r.NO == syscall.SYS_WRITEV) &&
+		atomic.LoadInt32(&traceWriting) != 0 &&
+		int32(r.Args[0]) == atomic.LoadInt32(&traceFd) {
+		return
+	}
+	traceMutex.Lock()
+	max := traceBufLen
+	traceMutex.Unlock()
+
+	var b strings.Builder
+	b.WriteString(Name(r.NO))
+	b.WriteByte('(')
+	format, ok := traceArgs[r.NO]
+	if !ok {
+		format = "xxxxxx"
+	}
+	ret := int32(r.Ret)
+	for i := 0; i < len(format); i++ {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		arg := r.Args[i]
+		switch format[i] {
+		case 'd':
+			fmt.Fprintf(&b, "%d", int32(arg))
+		case 'o':
+			fmt.Fprintf(&b, "%#o", arg)
+		case 's':
+			if arg == 0 {
+				b.WriteString("NULL")
+			} else {
+				fmt.Fprintf(&b, "%q", sys.CString(arg))
+			}
+		case 'w':
+			formatBuffer(&b, arg, int(r.Args[i+1]), max)
+		case 'r':
+			formatBuffer(&b, arg, int(ret), max)
+		default:
+			fmt.Fprintf(&b, "%#x", arg)
+		}
+	}
+	if ret < 0 && ret > -4096 {
+		fmt.Fprintf(&b, ") = -1 errno %d (%s)\n", -ret, syscall.Errno(-ret))
+	} else {
+		fmt.Fprintf(&b, ") = %d\n", r.Ret)
+	}
+	line := b.String()
+
+	traceMutex.Lock()
+	traceRing[traceNext] = line
+	traceNext = (traceNext + 1) % traceRingSize
+	select {
+	case traceLines <- line:
+	default:
+		traceDropped++
+	}
+	traceMutex.Unlock()
+}
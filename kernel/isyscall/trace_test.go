@@ -0,0 +1,71 @@
+package isyscall
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestTrace(t *testing.T) {
+	SetTrace(ioutil.Discard)
+	defer SetTrace(nil)
+	SetTraceBufLen(4)
+
+	path := []byte("/etc/hosts\x00")
+	trace(&Request{
+		NO:   syscall.SYS_OPEN,
+		Args: [6]uintptr{uintptr(unsafe.Pointer(&path[0])), syscall.O_RDONLY},
+		Ret:  Errno(syscall.ENOENT),
+	})
+	msg := []byte("hello")
+	trace(&Request{
+		NO:   syscall.SYS_WRITE,
+		Args: [6]uintptr{1, uintptr(unsafe.Pointer(&msg[0])), uintptr(len(msg))},
+		Ret:  uintptr(len(msg)),
+	})
+
+	log := string(TraceLog())
+	for _, line := range []string{
+		`open("/etc/hosts", 0x0, 0) = -1 errno 2 (no such file or directory)`,
+		`write(1, "hell"..., 5) = 5`,
+	} {
+		if !strings.Contains(log, line+"\n") {
+			t.Errorf("%q not found in trace:\n%s", line, log)
+		}
+	}
+}
+
+// fdWriter is a writer backed by fd, like os.File
+type fdWriter uintptr
+
+func (w fdWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w fdWriter) Fd() uintptr                 { return uintptr(w) }
+
+func TestTraceSkipOwnWrites(t *testing.T) {
+	SetTrace(fdWriter(2))
+	defer SetTrace(nil)
+
+	msg := []byte("x")
+	write := func(fd uintptr) {
+		trace(&Request{
+			NO:   syscall.SYS_WRITE,
+			Args: [6]uintptr{fd, uintptr(unsafe.Pointer(&msg[0])), 1},
+			Ret:  1,
+		})
+	}
+	atomic.StoreInt32(&traceWriting, 1)
+	write(2)
+	write(7)
+	atomic.StoreInt32(&traceWriting, 0)
+
+	log := string(TraceLog())
+	if strings.Contains(log, "write(2, ") {
+		t.Errorf("the writes of tracer are traced:\n%s", log)
+	}
+	if !strings.Contains(log, "write(7, ") {
+		t.Errorf("the writes of others are dropped:\n%s", log)
+	}
+}
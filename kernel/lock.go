@@ -1,46 +1,79 @@
 package kernel
 
 import (
+	"syscall"
 	"unsafe"
 )
 
 const (
-	_FUTEX_WAIT         = 0
-	_FUTEX_WAKE         = 1
-	_FUTEX_PRIVATE_FLAG = 128
-	_FUTEX_WAIT_PRIVATE = _FUTEX_WAIT | _FUTEX_PRIVATE_FLAG
-	_FUTEX_WAKE_PRIVATE = _FUTEX_WAKE | _FUTEX_PRIVATE_FLAG
+	_FUTEX_WAIT           = 0
+	_FUTEX_WAKE           = 1
+	_FUTEX_WAIT_BITSET    = 9
+	_FUTEX_WAKE_BITSET    = 10
+	_FUTEX_PRIVATE_FLAG   = 128
+	_FUTEX_CLOCK_REALTIME = 256
+	_FUTEX_WAIT_PRIVATE   = _FUTEX_WAIT | _FUTEX_PRIVATE_FLAG
+	_FUTEX_WAKE_PRIVATE   = _FUTEX_WAKE | _FUTEX_PRIVATE_FLAG
+
+	_FUTEX_BITSET_MATCH_ANY = 0xffffffff
 )
 
+// futex implements the futex syscall of linux, there is only one address
+// space, so the private flag changes nothing. The timeout of FUTEX_WAIT is
+// relative and the one of FUTEX_WAIT_BITSET is absolute, both clocks are
+// the same time since boot.
 //go:nosplit
-func futex(addr *uintptr, op, val uintptr, ts *timespec) {
-	switch op {
-	case _FUTEX_WAIT, _FUTEX_WAIT_PRIVATE:
+func futex(addr *uintptr, op, val uintptr, ts *timespec, bitset uintptr) uintptr {
+	switch op &^ (_FUTEX_PRIVATE_FLAG | _FUTEX_CLOCK_REALTIME) {
+	case _FUTEX_WAIT:
+		var deadline int64
 		if ts != nil {
-			sleeptimeout(addr, val, ts)
-			return
+			deadline = nanosecond() + int64(ts.tv_nsec) + int64(ts.tv_sec)*second
 		}
-		for *addr == val {
-			sleepon(addr)
+		return futexwait(addr, val, deadline, _FUTEX_BITSET_MATCH_ANY)
+	case _FUTEX_WAIT_BITSET:
+		if bitset == 0 {
+			return errno(-int(syscall.EINVAL))
+		}
+		var deadline int64
+		if ts != nil {
+			deadline = int64(ts.tv_nsec) + int64(ts.tv_sec)*second
+		}
+		return futexwait(addr, val, deadline, uint32(bitset))
+	case _FUTEX_WAKE:
+		return uintptr(wakeupbits(addr, int(val), _FUTEX_BITSET_MATCH_ANY))
+	case _FUTEX_WAKE_BITSET:
+		if bitset == 0 {
+			return errno(-int(syscall.EINVAL))
 		}
-		return
-	case _FUTEX_WAKE, _FUTEX_WAKE_PRIVATE:
-		wakeup(addr, int(val))
+		return uintptr(wakeupbits(addr, int(val), uint32(bitset)))
 	default:
-		panic("futex: invalid op")
+		return errno(-int(syscall.ENOSYS))
 	}
 }
 
+// futexwait sleeps on addr while *addr == val, a deadline of zero means no
+// timeout.
 //go:nosplit
-func sleeptimeout(addr *uintptr, val uintptr, ts *timespec) {
-	if ts == nil {
-		panic("sleeptimeout: nil ts")
+func futexwait(addr *uintptr, val uintptr, deadline int64, bitset uint32) uintptr {
+	if *(*uint32)(unsafe.Pointer(addr)) != uint32(val) {
+		return errno(-int(syscall.EAGAIN))
 	}
-	deadline := nanosecond() + int64(ts.tv_nsec) + int64(ts.tv_sec)*second
-	// check on every timer intr
-	for nanosecond() < deadline && *addr == val {
-		sleepon(&sleeplock)
+	t := Mythread()
+	for *(*uint32)(unsafe.Pointer(addr)) == uint32(val) {
+		if deadline != 0 && nanosecond() >= deadline {
+			return errno(-int(syscall.ETIMEDOUT))
+		}
+		t.sleepBits = bitset
+		if deadline != 0 {
+			// check on every timer intr
+			sleepon(&sleeplock)
+		} else {
+			sleepon(addr)
+		}
+		t.sleepBits = 0
 	}
+	return 0
 }
 
 //go:nosplit
@@ -55,28 +88,37 @@ func sleepon(lock *uintptr) {
 // wakeup thread sleep on lock, n == -1 means all threads
 //go:nosplit
 func wakeup(lock *uintptr, n int) {
+	wakeupbits(lock, n, _FUTEX_BITSET_MATCH_ANY)
+}
+
+// wakeupbits wakes up at most n threads sleeping on lock whose bitset
+// intersects with bits, it returns the number of threads woken up.
+//go:nosplit
+func wakeupbits(lock *uintptr, n int, bits uint32) int {
 	limit := uint(n)
 	cnt := uint(0)
 	for i := 0; i < _NTHREDS; i++ {
 		t := &threads[i]
-		if t.sleepKey == uintptr(unsafe.Pointer(lock)) && cnt < limit {
+		if t.sleepKey == uintptr(unsafe.Pointer(lock)) && cnt < limit &&
+			(t.sleepBits == 0 || t.sleepBits&bits != 0) {
 			cnt++
 			t.state = RUNNABLE
 		}
 	}
+	return int(cnt)
 }
 
 type note uintptr
 
 //go:nosplit
 func (n *note) sleep(ts *timespec) {
-	futex((*uintptr)(unsafe.Pointer(n)), _FUTEX_WAIT, 0, ts)
+	futex((*uintptr)(unsafe.Pointer(n)), _FUTEX_WAIT, 0, ts, 0)
 }
 
 //go:nosplit
 func (n *note) wakeup() {
 	*n = 1
-	futex((*uintptr)(unsafe.Pointer(n)), _FUTEX_WAKE, 1, nil)
+	futex((*uintptr)(unsafe.Pointer(n)), _FUTEX_WAKE, 1, nil, 0)
 }
 
 //go:nosplit
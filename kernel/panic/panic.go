@@ -0,0 +1,135 @@
+// Package panic writes a report of the panic of kernel main, with the stack
+// resolved by ksyms, the registers of the last fault and the memory stats.
+//
+// The report is written by Recover deferred in main:
+//
+//	kpanic.Install()
+//	defer kpanic.Recover()
+package panic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/icexin/eggos/debug/ksyms"
+	"github.com/icexin/eggos/kernel"
+	"github.com/icexin/eggos/mm"
+)
+
+// CrashLog is where Recover saves the report if the root fs is writable
+const CrashLog = "/crash.log"
+
+var (
+	mutex   sync.Mutex
+	out     io.Writer = os.Stderr
+	saveLog bool
+	handler func(interface{})
+)
+
+// Install makes Recover write the reports to /dev/console and CrashLog.
+func Install() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if f, err := os.OpenFile("/dev/console", os.O_WRONLY, 0); err == nil {
+		out = f
+	}
+	saveLog = true
+}
+
+// SetPanicHandler registers fn called with the panic value after the report
+// is written, instead of halting.
+func SetPanicHandler(fn func(v interface{})) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	handler = fn
+}
+
+// Recover reports the panic of the calling goroutine, it must be deferred
+// directly.
+func Recover() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(0, pcs)]
+	stack := make([]byte, 16<<10)
+	stack = stack[:runtime.Stack(stack, false)]
+
+	var buf bytes.Buffer
+	WriteReport(&buf, v, pcs, stack)
+	mutex.Lock()
+	w, save, fn := out, saveLog, handler
+	mutex.Unlock()
+	w.Write(buf.Bytes())
+	if save {
+		// the error is ignored if the root fs is readonly
+		if f, err := os.Create(CrashLog); err == nil {
+			f.Write(buf.Bytes())
+			f.Close()
+		}
+	}
+	if fn != nil {
+		fn(v)
+		return
+	}
+	os.Exit(2)
+}
+
+// frames drops the frames of recovering, the stack starts from the caller
+// of panic.
+func frames(pcs []uintptr) []uintptr {
+	for i, pc := range pcs {
+		if name, _, _ := ksyms.Resolve(pc - 1); name == "runtime.gopanic" {
+			return pcs[i+1:]
+		}
+	}
+	return pcs
+}
+
+// WriteReport writes the report of the panic v, pcs is the return addresses
+// from runtime.Callers and stack the text of runtime.Stack.
+func WriteReport(w io.Writer, v interface{}, pcs []uintptr, stack []byte) {
+	fmt.Fprintf(w, "==== eggos panic ====\n")
+	switch e := v.(type) {
+	case error:
+		fmt.Fprintf(w, "panic: %s\n", e.Error())
+	default:
+		fmt.Fprintf(w, "panic: %v\n", e)
+	}
+
+	fmt.Fprintf(w, "\nstack:\n")
+	for i, pc := range frames(pcs) {
+		// pc is the return address, the call is before it
+		name, file, line := ksyms.Resolve(pc - 1)
+		if name == "" {
+			fmt.Fprintf(w, "#%-2d %08x ?\n", i, pc)
+			continue
+		}
+		if s, ok := ksyms.Lookup(pc - 1); ok && name != s.Name {
+			// inlined into s
+			name += " (inlined in " + s.Name + ")"
+		}
+		fmt.Fprintf(w, "#%-2d %08x %s\n    %s:%d\n", i, pc, name, file, line)
+	}
+
+	if tf, ok := kernel.LastFault(); ok {
+		fmt.Fprintf(w, "\nregisters of the last fault:\n")
+		fmt.Fprintf(w, "eip %08x esp %08x ebp %08x eflags %08x\n", tf.IP, tf.SP, tf.BP, tf.FLAGS)
+		fmt.Fprintf(w, "eax %08x ebx %08x ecx %08x edx %08x\n", tf.AX, tf.BX, tf.CX, tf.DX)
+		fmt.Fprintf(w, "esi %08x edi %08x trap %d err %#x\n", tf.SI, tf.DI, tf.Trapno, tf.Err)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	pages := mm.Stat()
+	fmt.Fprintf(w, "\nmemory:\n")
+	fmt.Fprintf(w, "heap %d kB in use, %d kB from system, %d gc\n", ms.HeapInuse>>10, ms.Sys>>10, ms.NumGC)
+	fmt.Fprintf(w, "pages %d kB free of %d kB, %d goroutines\n", pages.Free>>10, pages.Total>>10, runtime.NumGoroutine())
+
+	fmt.Fprintf(w, "\n%s\n", stack)
+}
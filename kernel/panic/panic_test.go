@@ -0,0 +1,41 @@
+package panic
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func crash() {
+	panic(errors.New("boom"))
+}
+
+func TestRecover(t *testing.T) {
+	var buf bytes.Buffer
+	mutex.Lock()
+	out = &buf
+	mutex.Unlock()
+	var got interface{}
+	SetPanicHandler(func(v interface{}) { got = v })
+	defer SetPanicHandler(nil)
+
+	func() {
+		defer Recover()
+		crash()
+	}()
+	if err, ok := got.(error); !ok || err.Error() != "boom" {
+		t.Fatalf("handler got %v", got)
+	}
+	report := buf.String()
+	for _, s := range []string{"panic: boom\n", "panic_test.go:11\n", "memory:\n"} {
+		if !strings.Contains(report, s) {
+			t.Fatalf("%q missing in report:\n%s", s, report)
+		}
+	}
+	// the stack starts from the panicking function
+	if i := strings.Index(report, "stack:\n"); !strings.HasPrefix(report[i+len("stack:\n"):], "#0 ") ||
+		!strings.Contains(strings.SplitN(report[i:], "\n", 3)[1], "panic.crash") {
+		t.Fatalf("bad first frame:\n%s", report)
+	}
+}
@@ -1,8 +1,20 @@
 package kernel
 
+import (
+	"time"
+
+	"github.com/icexin/eggos/kernel/random"
+)
+
 // called when go runtime init done
 func Init() {
+	random.Init()
 	go traploop()
 	go handleForward()
 	bootstrapDone = true
 }
+
+// Uptime returns the time elapsed since boot
+func Uptime() time.Duration {
+	return time.Duration(nanosecond())
+}
@@ -0,0 +1,24 @@
+#include "textflag.h"
+
+// func rdrand() (v uint32, ok bool)
+TEXT ·rdrand(SB), NOSPLIT, $0-5
+	// RDRAND AX
+	BYTE $0x0f; BYTE $0xc7; BYTE $0xf0
+	SETCS ok+4(FP)
+	MOVL AX, v+0(FP)
+	RET
+
+// func rdseed() (v uint32, ok bool)
+TEXT ·rdseed(SB), NOSPLIT, $0-5
+	// RDSEED AX
+	BYTE $0x0f; BYTE $0xc7; BYTE $0xf8
+	SETCS ok+4(FP)
+	MOVL AX, v+0(FP)
+	RET
+
+// func rdtsc() uint64
+TEXT ·rdtsc(SB), NOSPLIT, $0-8
+	RDTSC
+	MOVL AX, ret_lo+0(FP)
+	MOVL DX, ret_hi+4(FP)
+	RET
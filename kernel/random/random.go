@@ -0,0 +1,216 @@
+// Package random is the entropy pool of kernel. The seed is collected from
+// RDSEED and RDRAND, and from the jitter of TSC and the interrupt timings,
+// all the output comes from a ChaCha20 DRBG keyed by the pool.
+package random
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/klauspost/cpuid"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	// bits of entropy needed to (re)seed the DRBG
+	seedBits = 256
+	// the max bytes generated by one key, the key is replaced after that
+	chunkSize = 256
+	// number of TSC samples collected at boot
+	jitterSamples = 4096
+	// bits credited for the samples, only one bit for every 64 samples,
+	// the timings of a tight loop are far from independent. The jitter
+	// alone never seeds the pool, the interrupts must make up the rest.
+	jitterBits = jitterSamples / 64
+)
+
+//go:nosplit
+func rdrand() (v uint32, ok bool)
+
+//go:nosplit
+func rdseed() (v uint32, ok bool)
+
+//go:nosplit
+func rdtsc() uint64
+
+var (
+	mutex sync.Mutex
+	cond  = sync.NewCond(&mutex)
+
+	// pending accumulates the entropy not mixed into key yet
+	pending     hash.Hash = sha256.New()
+	pendingBits int
+
+	key   [chacha20.KeySize]byte
+	ready bool
+
+	hasRdrand, hasRdseed bool
+)
+
+// reseed mixes the pending entropy into key, it must be called with mutex
+// held.
+func reseed() {
+	h := sha256.New()
+	h.Write(key[:])
+	h.Write(pending.Sum(nil))
+	copy(key[:], h.Sum(nil))
+	pending.Reset()
+	pendingBits = 0
+	if !ready {
+		ready = true
+		cond.Broadcast()
+	}
+}
+
+func addEntropy(data []byte, bits int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	pending.Write(data)
+	pendingBits += bits
+	// only reseed with enough entropy, so that the new key can't be
+	// guessed from the output in between.
+	if pendingBits >= seedBits {
+		reseed()
+	}
+}
+
+// AddEntropy mixes seed into the pool without crediting any entropy, it's
+// used for the data whose quality is unknown.
+func AddEntropy(seed []byte) {
+	addEntropy(seed, 0)
+}
+
+// hwrand returns 32 bits from RDSEED or RDRAND
+func hwrand() (uint32, bool) {
+	for i := 0; hasRdseed && i < 10; i++ {
+		if v, ok := rdseed(); ok {
+			return v, true
+		}
+	}
+	for i := 0; hasRdrand && i < 10; i++ {
+		if v, ok := rdrand(); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// jitter collects the timing jitter of a memory-touching loop
+func jitter() []byte {
+	var mem [4096]byte
+	samples := make([]byte, jitterSamples)
+	last := rdtsc()
+	for i := range samples {
+		for j := 0; j < len(mem); j += 64 {
+			mem[j] += byte(j + i)
+		}
+		now := rdtsc()
+		samples[i] = byte(now-last) ^ mem[i%len(mem)]
+		last = now
+	}
+	return samples
+}
+
+// Init seeds the pool, it's called once at boot.
+func Init() {
+	hasRdrand = cpuid.CPU.Rdrand()
+	hasRdseed = cpuid.CPU.Rdseed()
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(time.Now().UnixNano()))
+	addEntropy(buf[:], 0)
+
+	// the hardware source gives the full seed if available
+	for i := 0; i < seedBits/32; i++ {
+		v, ok := hwrand()
+		if !ok {
+			break
+		}
+		binary.LittleEndian.PutUint32(buf[:], v)
+		addEntropy(buf[:4], 32)
+	}
+	addEntropy(jitter(), jitterBits)
+}
+
+// AddInterruptTiming mixes the time of interrupt irq into the pool, one bit
+// is credited for every interrupt.
+func AddInterruptTiming(irq uintptr) {
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[:], rdtsc())
+	binary.LittleEndian.PutUint32(buf[8:], uint32(irq))
+	addEntropy(buf[:], 1)
+}
+
+// Ready reports whether the pool has been seeded
+func Ready() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return ready
+}
+
+// Read fills p with random bytes, it blocks until the pool is seeded.
+func Read(p []byte) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for !ready {
+		cond.Wait()
+	}
+	return generate(p)
+}
+
+// ReadInsecure is Read without waiting for the pool to be seeded, the
+// output before seeding is not fit for keys.
+func ReadInsecure(p []byte) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return generate(p)
+}
+
+// MixHardware mixes fresh RDSEED or RDRAND output into the key right away,
+// it does nothing without the hardware source.
+func MixHardware() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	h := sha256.New()
+	h.Write(key[:])
+	var buf [4]byte
+	for i := 0; i < seedBits/32; i++ {
+		v, ok := hwrand()
+		if !ok {
+			return
+		}
+		binary.LittleEndian.PutUint32(buf[:], v)
+		h.Write(buf[:])
+	}
+	copy(key[:], h.Sum(nil))
+}
+
+// generate fills p from the DRBG, it must be called with mutex held.
+func generate(p []byte) (int, error) {
+	var nonce [chacha20.NonceSize]byte
+	var buf [chacha20.KeySize + chunkSize]byte
+	total := len(p)
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		// every key is used only once, the first 32 bytes of stream become
+		// the next key, so that the past output can't be recovered.
+		c, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+		if err != nil {
+			return total - len(p), err
+		}
+		for i := range buf {
+			buf[i] = 0
+		}
+		c.XORKeyStream(buf[:chacha20.KeySize+n], buf[:chacha20.KeySize+n])
+		copy(key[:], buf[:chacha20.KeySize])
+		copy(p, buf[chacha20.KeySize:chacha20.KeySize+n])
+		p = p[n:]
+	}
+	return total, nil
+}
@@ -0,0 +1,121 @@
+package random
+
+import (
+	"bytes"
+	"testing"
+)
+
+// reset drops the state of pool, as if the kernel is rebooted
+func reset() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	pending.Reset()
+	pendingBits = 0
+	key = [len(key)]byte{}
+	ready = false
+}
+
+func TestDistribution(t *testing.T) {
+	boot()
+	buf := make([]byte, 1<<20)
+	if _, err := Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var counts [256]int
+	ones := 0
+	for _, b := range buf {
+		counts[b]++
+		for ; b != 0; b &= b - 1 {
+			ones++
+		}
+	}
+	// monobit, the standard deviation of ones is sqrt(n)/2 = 1448
+	bits := len(buf) * 8
+	if diff := ones - bits/2; diff > 6*1448 || diff < -6*1448 {
+		t.Errorf("ones:%d of %d bits", ones, bits)
+	}
+	// chi-square of byte frequency with 255 degrees of freedom, 400 is far
+	// beyond the 0.9999 quantile.
+	expect := float64(len(buf)) / 256
+	chi := 0.0
+	for _, n := range counts {
+		d := float64(n) - expect
+		chi += d * d / expect
+	}
+	if chi > 400 {
+		t.Errorf("chi-square:%f", chi)
+	}
+}
+
+// boot is Init followed by enough interrupts to seed the pool
+func boot() {
+	reset()
+	Init()
+	for irq := uintptr(0); !Ready(); irq++ {
+		AddInterruptTiming(irq % 16)
+	}
+}
+
+func TestBoots(t *testing.T) {
+	var out [2][64]byte
+	for i := range out {
+		boot()
+		Read(out[i][:])
+	}
+	if bytes.Equal(out[0][:], out[1][:]) {
+		t.Fatalf("same output on two boots:%x", out[0])
+	}
+}
+
+func TestNoRepeat(t *testing.T) {
+	boot()
+	a := make([]byte, chunkSize*3+7)
+	b := make([]byte, len(a))
+	Read(a)
+	Read(b)
+	if bytes.Equal(a, b) {
+		t.Fatal("same output on two reads")
+	}
+	// every chunk is generated by a new key
+	for i := chunkSize; i+chunkSize <= len(a); i += chunkSize {
+		if bytes.Equal(a[:chunkSize], a[i:i+chunkSize]) {
+			t.Fatalf("chunk %d repeated", i/chunkSize)
+		}
+	}
+}
+
+func TestJitterOnly(t *testing.T) {
+	// a cpu without RDRAND and RDSEED
+	reset()
+	addEntropy(jitter(), jitterBits)
+	if Ready() {
+		t.Fatal("pool seeded by jitter alone")
+	}
+	n := 0
+	for ; !Ready(); n++ {
+		AddInterruptTiming(0)
+	}
+	if n != seedBits-jitterBits {
+		t.Fatalf("seeded after %d interrupts, expect %d", n, seedBits-jitterBits)
+	}
+}
+
+func TestMixHardware(t *testing.T) {
+	boot()
+	saved := key
+	var a, b [32]byte
+	Read(a[:])
+	key = saved
+	MixHardware()
+	Read(b[:])
+	if hw := hasRdrand || hasRdseed; hw == bytes.Equal(a[:], b[:]) {
+		t.Fatalf("hardware source %v, output changed %v", hw, !bytes.Equal(a[:], b[:]))
+	}
+
+	// ReadInsecure doesn't wait for the seed
+	reset()
+	if n, err := ReadInsecure(a[:]); err != nil || n != len(a) {
+		t.Fatalf("expect %d bytes, got %d %v", len(a), n, err)
+	}
+}
@@ -17,8 +17,19 @@ var (
 	sigs   [_NSIG]signal
 	sinfo  siginfo
 	sigctx ucontext
+
+	// faultFrame is the trap frame of the last signal, it's reported by the
+	// panic handler as the registers of the fault.
+	faultFrame TrapFrame
+	faulted    bool
 )
 
+// LastFault returns the trap frame of the last fault delivered as a signal,
+// ok is false if no fault happened.
+func LastFault() (tf TrapFrame, ok bool) {
+	return faultFrame, faulted
+}
+
 type sighandler func(sig uint32, info *siginfo, ctx *ucontext)
 
 type signal struct {
@@ -193,6 +204,8 @@ func callSigHandler(pc, sp uintptr, no uintptr, info *siginfo, ctx *ucontext)
 //go:nosplit
 func Signal(signo, sigcode, sigaddr uintptr) {
 	my := Mythread()
+	faultFrame = *my.tf
+	faulted = true
 
 	sig := sigs[signo]
 	if sig.sigactiont.sa_handler == 0 {
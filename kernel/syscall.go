@@ -33,8 +33,10 @@ const (
 	SYS_futex             = 240
 	SYS_sched_getaffinity = 242
 	SYS_set_thread_area   = 243
+	SYS_get_thread_area   = 244
 	SYS_exit_group        = 252
 	SYS_clock_gettime     = 265
+	SYS_clone3            = 435
 
 	SYS_EXIT       = 1
 	SYS_FCNTL      = 55
@@ -44,6 +46,7 @@ const (
 
 	SYS_WAIT_IRQ     = 500
 	SYS_WAIT_SYSCALL = 501
+	SYS_FREE_PAGES   = 502
 )
 
 const (
@@ -67,10 +70,10 @@ var (
 
 	// kernelCalls is the syscalls must be implement in kernel
 	kernelCalls = [...]uintptr{
-		SYS_EXIT, SYS_set_thread_area, SYS_sched_yield, SYS_nanosleep, SYS_brk,
-		SYS_munmap, SYS_mmap2, SYS_madvise, SYS_clone, SYS_gettid,
+		SYS_EXIT, SYS_set_thread_area, SYS_get_thread_area, SYS_sched_yield, SYS_nanosleep, SYS_brk,
+		SYS_munmap, SYS_mmap2, SYS_madvise, SYS_clone, SYS_clone3, SYS_gettid,
 		SYS_futex, SYS_rt_sigaction, SYS_rt_sigprocmask, SYS_sigaltstack,
-		SYS_clock_gettime, SYS_exit_group, SYS_WAIT_IRQ, SYS_WAIT_SYSCALL,
+		SYS_clock_gettime, SYS_exit_group, SYS_WAIT_IRQ, SYS_WAIT_SYSCALL, SYS_FREE_PAGES,
 		syscall.SYS_EPOLL_CREATE1, syscall.SYS_EPOLL_CTL, syscall.SYS_EPOLL_WAIT,
 		// SYS_RANDOM,
 	}
@@ -139,6 +142,19 @@ func canForward(tf *TrapFrame) bool {
 	if no == SYS_write && tf.BX == 2 {
 		return false
 	}
+	switch no {
+	case SYS_mmap2:
+		// the file mappings are served by fs
+		if tf.SI&_MAP_ANON == 0 && int32(tf.DI) != -1 {
+			return true
+		}
+	case SYS_munmap:
+		// the munmap of runtime is done without entering syscall, only
+		// the ones of programs may unmap files.
+		if readgstatus(getg()) == _Gsyscall {
+			return true
+		}
+	}
 	for i := 0; i < len(kernelCalls); i++ {
 		if no == kernelCalls[i] {
 			return false
@@ -173,6 +189,14 @@ func doBootSyscall(no, a0, a1, a2, a3, a4, a5 uintptr) uintptr {
 		desc.entryNumber = _GO_TLS_IDX
 		my.tls = *desc
 		return 0
+	case SYS_get_thread_area:
+		// only the go tls entry is given out by set_thread_area
+		desc := (*userDesc)(unsafe.Pointer(a0))
+		if desc.entryNumber != _GO_TLS_IDX {
+			return errno(-int(syscall.EINVAL))
+		}
+		*desc = my.tls
+		return 0
 	case SYS_read:
 		return a2
 	case SYS_write:
@@ -205,11 +229,14 @@ func doBootSyscall(no, a0, a1, a2, a3, a4, a5 uintptr) uintptr {
 		return 0
 	case SYS_clone:
 		return uintptr(clone(my.tf.IP, a1))
+	case SYS_clone3:
+		// the libcs fall back to clone on ENOSYS
+		return errno(-int(syscall.ENOSYS))
 	case SYS_gettid:
 		return uintptr(my.id)
 	case SYS_futex:
-		futex((*uintptr)(unsafe.Pointer(a0)), a1, a2, (*timespec)(unsafe.Pointer(a3)))
-		return 0
+		// the bitset is val3, the last argument
+		return futex((*uintptr)(unsafe.Pointer(a0)), a1, a2, (*timespec)(unsafe.Pointer(a3)), a5)
 	case SYS_sched_getaffinity:
 		return ^uintptr(0)
 	case SYS_rt_sigaction:
@@ -253,6 +280,9 @@ func doBootSyscall(no, a0, a1, a2, a3, a4, a5 uintptr) uintptr {
 		return waitIRQ()
 	case SYS_WAIT_SYSCALL:
 		return fetchPendingCall()
+	case SYS_FREE_PAGES:
+		mm.Munmap(a0, a1)
+		return 0
 
 	default:
 		uart.WriteString("unknown syscall\n")
@@ -272,6 +302,12 @@ func mmap(addr unsafe.Pointer, n uintptr, prot, flags, fd int32, off uint32) uin
 	return mm.Mmap(uintptr(addr), n)
 }
 
+// FreePages unmaps the pages of [va, va+size) and gives them back, it's
+// used by fs to release the file mappings.
+func FreePages(va, size uintptr) {
+	syscall.Syscall(SYS_FREE_PAGES, va, size, 0)
+}
+
 //go:nosplit
 func syscal_init() {
 	epollInit()
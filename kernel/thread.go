@@ -64,9 +64,21 @@ type Thread struct {
 	// sysmon 会调用usleep，进而调用sleepon，如果sleepKey是个指针会触发gcWriteBarrier
 	// 而sysmon没有P，会导致空指针
 	sleepKey uintptr
-	tls      userDesc
+	// sleepBits is the bitset of FUTEX_WAIT_BITSET
+	sleepBits uint32
+	tls       userDesc
+	// sigpage is the default signal stack allocated with the thread, freed
+	// on exit even if sigaltstack replaced it.
+	sigpage uintptr
 }
 
+var (
+	// allocPage and freePage manage the signal stack page of threads,
+	// replaced by tests running on host.
+	allocPage = mm.Alloc
+	freePage  = mm.Free
+)
+
 //go:nosplit
 func allocThread() *Thread {
 	var t *Thread
@@ -82,7 +94,8 @@ func allocThread() *Thread {
 		panic("no thread slot available")
 	}
 	// t.sigstack.ss_flags = _SS_DISABLE
-	t.sigstack.ss_sp = mm.Alloc()
+	t.sigpage = allocPage()
+	t.sigstack.ss_sp = t.sigpage
 	t.sigstack.ss_size = mm.PGSIZE
 	t.state = INITING
 	return t
@@ -167,6 +180,10 @@ func idle() {
 	}
 }
 
+// clone serves the clone syscall of the runtime creating an M, the child is
+// a kernel thread sharing everything, starting at pc on the stack sp. The
+// thread id is the index in threads, returned by gettid. It runs nosplit
+// in the trap, so it can't start a goroutine.
 //go:nosplit
 func clone(pc, sp uintptr) int {
 	my := Mythread()
@@ -192,12 +209,35 @@ func clone(pc, sp uintptr) int {
 	return chld.id
 }
 
+// exit ends the current thread, its slot is reclaimed by the scheduler
+// after switching away, since the thread is still running on its stack.
 //go:nosplit
 func exit() {
 	t := Mythread()
 	t.state = EXIT
-	Yield()
-	// TODO: handle thread exit in scheduler
+	Sched()
+	panic("exited thread scheduled")
+}
+
+// freeThread makes the slot of the exited thread t available to
+// allocThread. The pointers are cleared through uintptr to avoid the write
+// barrier.
+//go:nosplit
+func freeThread(t *Thread) {
+	if t.sigpage != 0 {
+		freePage(t.sigpage)
+	}
+	*(*uintptr)(unsafe.Pointer(&t.tf)) = 0
+	*(*uintptr)(unsafe.Pointer(&t.context)) = 0
+	t.stack = 0
+	t.sigstack = stackt{}
+	t.sigset = sigset{}
+	t.counter = 0
+	t.sleepKey = 0
+	t.sleepBits = 0
+	t.tls = userDesc{}
+	t.sigpage = 0
+	t.state = UNUSED
 }
 
 //go:nosplit
@@ -261,6 +301,16 @@ func switchto(t *Thread) {
 
 	used := nanosecond() - begin
 	t.counter += used
+	reap(t)
+}
+
+// reap reclaims t if it has exited, it's called on the scheduler stack
+// after t switched away.
+//go:nosplit
+func reap(t *Thread) {
+	if t.state == EXIT {
+		freeThread(t)
+	}
 }
 
 func ThreadStat(stat *[_NTHREDS]int64) {
@@ -0,0 +1,67 @@
+package kernel
+
+import "testing"
+
+// fakePages replaces the page allocator of thread slots, restore puts back
+// the allocator and empties the table.
+func fakePages(t *testing.T) (pages map[uintptr]bool, restore func()) {
+	pages = make(map[uintptr]bool)
+	next := uintptr(0x1000)
+	oldAlloc, oldFree := allocPage, freePage
+	allocPage = func() uintptr {
+		next += 0x1000
+		pages[next] = true
+		return next
+	}
+	freePage = func(p uintptr) {
+		if !pages[p] {
+			t.Fatalf("free of page %x not allocated", p)
+		}
+		delete(pages, p)
+	}
+	return pages, func() {
+		allocPage, freePage = oldAlloc, oldFree
+		threads = [_NTHREDS]Thread{}
+	}
+}
+
+func TestThreadExit(t *testing.T) {
+	pages, restore := fakePages(t)
+	defer restore()
+	var tf TrapFrame
+	// more threads than the table holds come and go, like the Ms of
+	// LockOSThread goroutines.
+	for i := 0; i < 3*_NTHREDS; i++ {
+		th := allocThread()
+		th.tf = &tf
+		th.state = RUNNABLE
+		th.counter = 1
+
+		th.state = EXIT
+		reap(th)
+		if th.state != UNUSED || th.tf != nil || th.counter != 0 {
+			t.Fatalf("thread %d not reclaimed: %+v", th.id, th)
+		}
+	}
+	if len(pages) != 0 {
+		t.Fatalf("%d signal stack pages leaked", len(pages))
+	}
+
+	// the running threads keep their slots
+	for i := 0; i < _NTHREDS; i++ {
+		th := allocThread()
+		th.state = RUNNABLE
+		reap(th)
+	}
+	for i := range threads {
+		if threads[i].state != RUNNABLE {
+			t.Fatalf("slot %d reclaimed while runnable", i)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expect panic on a full table")
+		}
+	}()
+	allocThread()
+}
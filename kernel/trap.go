@@ -7,6 +7,7 @@ import (
 	"unsafe"
 
 	"github.com/icexin/eggos/debug"
+	"github.com/icexin/eggos/kernel/random"
 	"github.com/icexin/eggos/kernel/trap"
 	"github.com/icexin/eggos/pic"
 	"github.com/icexin/eggos/sys"
@@ -149,6 +150,7 @@ func traploop() {
 				pic.EOI(trapno)
 				continue
 			}
+			random.AddInterruptTiming(trapno)
 			handler()
 		}
 	}
@@ -0,0 +1,101 @@
+package kernel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// MaxHostnameLen is the max length of the fields of uname, the longer ones
+// are truncated.
+const MaxHostnameLen = 64
+
+// Version is the eggos version, set at build time by
+// -ldflags "-X github.com/icexin/eggos/kernel.Version=..."
+var Version = "dev"
+
+var (
+	utsMutex   sync.Mutex
+	hostname   = "icexin.local"
+	domainname = "icexin.com"
+	osRelease  string
+	// hostnameHooks are called after changing the hostname
+	hostnameHooks []func(string)
+)
+
+func truncUts(s string) string {
+	if len(s) > MaxHostnameLen {
+		s = s[:MaxHostnameLen]
+	}
+	return s
+}
+
+// Hostname returns the nodename of uname
+func Hostname() string {
+	utsMutex.Lock()
+	defer utsMutex.Unlock()
+	return hostname
+}
+
+// SetHostname changes the hostname, name is truncated to MaxHostnameLen
+// bytes.
+func SetHostname(name string) {
+	name = truncUts(name)
+	utsMutex.Lock()
+	hostname = name
+	hooks := hostnameHooks
+	utsMutex.Unlock()
+	for _, fn := range hooks {
+		fn(name)
+	}
+}
+
+// OnHostname registers fn called with the new hostname after every change
+func OnHostname(fn func(name string)) {
+	utsMutex.Lock()
+	defer utsMutex.Unlock()
+	hostnameHooks = append(hostnameHooks, fn)
+}
+
+// Domainname returns the NIS domain name of uname
+func Domainname() string {
+	utsMutex.Lock()
+	defer utsMutex.Unlock()
+	return domainname
+}
+
+// SetDomainname changes the domain name, name is truncated to
+// MaxHostnameLen bytes.
+func SetDomainname(name string) {
+	utsMutex.Lock()
+	defer utsMutex.Unlock()
+	domainname = truncUts(name)
+}
+
+// OSRelease returns the release of uname, it's Version if not set.
+func OSRelease() string {
+	utsMutex.Lock()
+	defer utsMutex.Unlock()
+	if osRelease == "" {
+		return truncUts(Version)
+	}
+	return osRelease
+}
+
+// SetOSRelease changes the release of uname, release is truncated to
+// MaxHostnameLen bytes.
+func SetOSRelease(release string) {
+	utsMutex.Lock()
+	defer utsMutex.Unlock()
+	osRelease = truncUts(release)
+}
+
+// Machine returns the machine of uname by the architecture eggos built for
+func Machine() string {
+	switch runtime.GOARCH {
+	case "386":
+		return "i686"
+	case "amd64":
+		return "x86_64"
+	}
+	return runtime.GOARCH
+}
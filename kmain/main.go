@@ -2,37 +2,96 @@ package main
 
 import (
 	"io"
+	"log"
 	_ "net/http/pprof"
 	"runtime"
+	"strings"
 
 	"github.com/icexin/eggos/app/sh"
 	"github.com/icexin/eggos/cga/fbcga"
 	"github.com/icexin/eggos/console"
 	"github.com/icexin/eggos/fs"
+	"github.com/icexin/eggos/fs/ninep"
 	"github.com/icexin/eggos/inet"
 
 	_ "github.com/icexin/eggos/e1000"
 	"github.com/icexin/eggos/kbd"
 	"github.com/icexin/eggos/kernel"
+	"github.com/icexin/eggos/kernel/isyscall"
+	kpanic "github.com/icexin/eggos/kernel/panic"
+	"github.com/icexin/eggos/multiboot"
 	"github.com/icexin/eggos/pci"
 	"github.com/icexin/eggos/uart"
 	"github.com/icexin/eggos/vbe"
+	"github.com/icexin/eggos/virtio9p"
+	"github.com/spf13/afero"
 )
 
+// ninepFsType mounts the tree source of the virtio-9p share, it's the 9p
+// type of the mount= directives in the kernel command line.
+func ninepFsType(source string) (afero.Fs, error) {
+	t, err := virtio9p.Transport()
+	if err != nil {
+		return nil, err
+	}
+	hostfs, err := ninep.New(t, source)
+	if err != nil {
+		return nil, err
+	}
+	return hostfs, nil
+}
+
+// mountHost mounts the directory shared by QEMU virtio-9p at /host, unless
+// the kernel command line has mounted it.
+func mountHost() {
+	for _, m := range fs.Mounts() {
+		if m.Path == "/host" {
+			return
+		}
+	}
+	if _, err := virtio9p.Transport(); err != nil {
+		return
+	}
+	hostfs, err := ninepFsType("")
+	if err == nil {
+		err = fs.Mount("/host", hostfs)
+	}
+	if err != nil {
+		log.Printf("mount /host: %s", err)
+	}
+}
+
+// setupTrace enables syscall tracing to console if strace is given in the
+// kernel command line.
+func setupTrace() {
+	for _, arg := range strings.Fields(multiboot.BootInfo.CmdlineString()) {
+		if arg == "strace" {
+			isyscall.SetTrace(console.Console())
+		}
+	}
+}
+
 func main() {
 	// trap and syscall threads use two Ps,
 	// and the remaining one is for other goroutines
 	runtime.GOMAXPROCS(3)
+	defer kpanic.Recover()
 
 	uart.Init()
 	kbd.Init()
 	console.Init()
 	kernel.Init()
+	setupTrace()
 
+	// the virtio-9p share is found by pci before fs mounts the kernel
+	// command line
+	pci.Init()
+	fs.RegisterFsType("9p", ninepFsType)
 	fs.Init()
+	kpanic.Install()
 	vbe.Init()
 	fbcga.Init()
-	pci.Init()
+	mountHost()
 
 	err := inet.Init()
 	if err != nil {
@@ -60,6 +60,9 @@ type page struct {
 
 type kmmstat struct {
 	alloc int
+	// total and free count the physical pages
+	total int
+	free  int
 }
 
 type kmmt struct {
@@ -85,16 +88,95 @@ func (k *kmmt) alloc() uintptr {
 		panic("kmemt.alloc")
 	}
 	k.stat.alloc++
+	k.stat.free--
 	k.freelist = r.next
 	return uintptr(unsafe.Pointer(r))
 }
 
+// allocContig allocates n physically contiguous pages, the free list is
+// in descending address order mostly, so a run of n nodes whose addresses
+// decrease by PGSIZE is a contiguous range.
+//go:nosplit
+func (k *kmmt) allocContig(n int) uintptr {
+	var prev *page
+	for r := k.freelist; r != nil; {
+		last, cnt := r, 1
+		for cnt < n && last.next != nil &&
+			uintptr(unsafe.Pointer(last.next)) == uintptr(unsafe.Pointer(last))-PGSIZE {
+			last = last.next
+			cnt++
+		}
+		if cnt == n {
+			if prev == nil {
+				k.freelist = last.next
+			} else {
+				prev.next = last.next
+			}
+			k.stat.alloc += n
+			k.stat.free -= n
+			return uintptr(unsafe.Pointer(last))
+		}
+		prev, r = last, last.next
+	}
+	panic("kmemt.allocContig")
+}
+
 //go:nosplit
 func (k *kmmt) freeRange(start, end uintptr) {
 	p := pageRoundUp(start)
 	for ; p+PGSIZE <= end; p += PGSIZE {
+		if reserved(p) {
+			continue
+		}
 		k.free(p)
+		k.stat.total++
+	}
+}
+
+// inPages reports whether the page p overlaps the memory [start, end)
+//go:nosplit
+func inPages(p, start, end uintptr) bool {
+	return p >= pageRoundDown(start) && p < pageRoundUp(end)
+}
+
+// strEnd returns the end of the C string at addr, including the NUL
+//go:nosplit
+func strEnd(addr uintptr) uintptr {
+	for *(*byte)(unsafe.Pointer(addr)) != 0 {
+		addr++
 	}
+	return addr + 1
+}
+
+// reserved reports whether the page p is used by boot modules, the module
+// list or the command lines.
+//go:nosplit
+func reserved(p uintptr) bool {
+	if !multiboot.Enabled() {
+		return false
+	}
+	info := &multiboot.BootInfo
+	if info.Flags&multiboot.FlagInfoCmdline != 0 && info.Cmdline != 0 {
+		if inPages(p, uintptr(info.Cmdline), strEnd(uintptr(info.Cmdline))) {
+			return true
+		}
+	}
+	mods := info.Modules()
+	if len(mods) != 0 {
+		list := uintptr(info.ModsAddr)
+		if inPages(p, list, list+uintptr(len(mods))*unsafe.Sizeof(mods[0])) {
+			return true
+		}
+	}
+	for i := range mods {
+		if inPages(p, uintptr(mods[i].Start), uintptr(mods[i].End)) {
+			return true
+		}
+		if c := uintptr(mods[i].Cmdline); c != 0 && inPages(p, c, strEnd(c)) {
+			return true
+		}
+	}
+	return false
 }
 
 //go:nosplit
@@ -106,6 +188,7 @@ func (k *kmmt) free(p uintptr) {
 	r := (*page)(unsafe.Pointer(p))
 	r.next = k.freelist
 	k.freelist = r
+	k.stat.free++
 }
 
 //go:notinheap
@@ -197,6 +280,15 @@ func Mmap(va, size uintptr) uintptr {
 	return va
 }
 
+// Munmap frees the pages of [va, va+size), the virtual addresses are not
+// reused.
+//go:nosplit
+func Munmap(va, size uintptr) {
+	vmm.munmap(va, size)
+	// flush the TLB of the freed pages
+	lcr3(vmm.pgdir)
+}
+
 //go:nosplit
 func Fixmap(va, pa, size uintptr) {
 	vmm.fixmap(va, pa, size, PTE_P|PTE_W)
@@ -212,6 +304,35 @@ func Alloc() uintptr {
 	return ptr
 }
 
+// Free returns the page p allocated by Alloc
+//go:nosplit
+func Free(p uintptr) {
+	kmm.free(p)
+}
+
+// AllocPages allocates n physically contiguous zeroed pages, used by the
+// devices which need buffers larger than one page.
+//go:nosplit
+func AllocPages(n int) uintptr {
+	ptr := kmm.allocContig(n)
+	sys.Memclr(ptr, n*PGSIZE)
+	return ptr
+}
+
+// MemStat describes the usage of physical memory in bytes
+type MemStat struct {
+	Total uintptr
+	Free  uintptr
+}
+
+// Stat returns the usage of physical memory
+func Stat() MemStat {
+	return MemStat{
+		Total: uintptr(kmm.stat.total) * PGSIZE,
+		Free:  uintptr(kmm.stat.free) * PGSIZE,
+	}
+}
+
 //go:nosplit
 func (v *vmmt) fixmap(va, pa, size, perm uintptr) bool {
 	p := pageRoundDown(va)
@@ -80,9 +80,62 @@ func (i *Info) MmapEntries() []MmapEntry {
 	return (*[128]MmapEntry)(unsafe.Pointer(uintptr(i.MmapAddr)))[:n]
 }
 
+// CmdlineString returns the command line of kernel.
+func (i *Info) CmdlineString() string {
+	if i.Flags&FlagInfoCmdline == 0 || i.Cmdline == 0 {
+		return ""
+	}
+	return cstring(i.Cmdline)
+}
+
 type MmapEntry struct {
 	Size uint32
 	Addr uint64
 	Len  uint64
 	Type uint32
 }
+
+// Modules returns the boot modules loaded by the bootloader.
+//go:nosplit
+func (i *Info) Modules() []Module {
+	if i.Flags&FlagInfoMods == 0 || i.ModsCount == 0 {
+		return nil
+	}
+	n := i.ModsCount
+	if n > maxModules {
+		n = maxModules
+	}
+	return (*[maxModules]Module)(unsafe.Pointer(uintptr(i.ModsAddr)))[:n]
+}
+
+const maxModules = 64
+
+// Module is a boot module, the memory [Start, End) holds the content of module.
+type Module struct {
+	Start   uint32
+	End     uint32
+	Cmdline uint32
+	_       uint32
+}
+
+// Data returns the content of module.
+func (m *Module) Data() []byte {
+	return (*[1 << 30]byte)(unsafe.Pointer(uintptr(m.Start)))[:m.End-m.Start]
+}
+
+// CmdlineString returns the command line of module.
+func (m *Module) CmdlineString() string {
+	if m.Cmdline == 0 {
+		return ""
+	}
+	return cstring(m.Cmdline)
+}
+
+func cstring(addr uint32) string {
+	buf := (*[1 << 12]byte)(unsafe.Pointer(uintptr(addr)))
+	var n int
+	for n < len(buf) && buf[n] != 0 {
+		n++
+	}
+	return string(buf[:n])
+}
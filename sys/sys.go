@@ -12,6 +12,12 @@ func Outb(port uint16, data byte)
 //go:nosplit
 func Inb(reg uint16) byte
 
+//go:nosplit
+func Outw(port uint16, data uint16)
+
+//go:nosplit
+func Inw(port uint16) uint16
+
 //go:nosplit
 func Outl(port uint16, data uint32)
 
@@ -38,6 +44,15 @@ func UnsafeBuffer(p uintptr, n int) []byte {
 	return (*[1 << 30]byte)(unsafe.Pointer(p))[:n]
 }
 
+// CString returns the NUL terminated string at p
+func CString(p uintptr) string {
+	var n int
+	for q := p; *(*byte)(unsafe.Pointer(q)) != 0; q++ {
+		n++
+	}
+	return string(UnsafeBuffer(p, n))
+}
+
 //go:nosplit
 func Memclr(p uintptr, n int) {
 	s := (*(*[1 << 30]byte)(unsafe.Pointer(p)))[:n]
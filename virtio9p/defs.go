@@ -0,0 +1,43 @@
+package virtio9p
+
+const (
+	// registers of legacy virtio pci device in I/O bar0
+	REG_HOST_FEATURES  = 0x00
+	REG_GUEST_FEATURES = 0x04
+	REG_QUEUE_PFN      = 0x08
+	REG_QUEUE_SIZE     = 0x0c
+	REG_QUEUE_SELECT   = 0x0e
+	REG_QUEUE_NOTIFY   = 0x10
+	REG_STATUS         = 0x12
+	REG_ISR            = 0x13
+	// device config, starts with tag_len[2] tag[tag_len]
+	REG_CONFIG = 0x14
+
+	STATUS_ACKNOWLEDGE = 1
+	STATUS_DRIVER      = 2
+	STATUS_DRIVER_OK   = 4
+	STATUS_FAILED      = 0x80
+
+	// the mount tag is in device config
+	F_MOUNT_TAG = 1 << 0
+
+	ISR_QUEUE = 1 << 0
+
+	DESC_F_NEXT  = 1
+	DESC_F_WRITE = 2
+
+	VRING_ALIGN = 4096
+)
+
+// vring descriptor
+type desc struct {
+	addr  uint64
+	len   uint32
+	flags uint16
+	next  uint16
+}
+
+type usedElem struct {
+	id  uint32
+	len uint32
+}
@@ -0,0 +1,219 @@
+// Package virtio9p drives the legacy virtio-9p pci device of QEMU, which
+// carries the 9P messages of a host directory share, like
+//
+//	-fsdev local,id=host,path=/src,security_model=none
+//	-device virtio-9p-pci,fsdev=host,mount_tag=host
+package virtio9p
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/debug"
+	"github.com/icexin/eggos/fs/ninep"
+	"github.com/icexin/eggos/mm"
+	"github.com/icexin/eggos/pci"
+	"github.com/icexin/eggos/pic"
+	"github.com/icexin/eggos/sys"
+)
+
+const (
+	// pages of tx and rx buffer, which limits the msize
+	bufPages = 8
+	msize    = bufPages * mm.PGSIZE
+)
+
+var (
+	_ pci.Driver      = (*driver)(nil)
+	_ ninep.Transport = (*driver)(nil)
+
+	// ErrNoDevice is returned by Transport if no virtio-9p device found
+	ErrNoDevice = errors.New("virtio9p: no device")
+)
+
+type driver struct {
+	dev  *pci.Device
+	port uint16
+	tag  string
+	ok   bool
+
+	qsize    uint16
+	descs    uintptr
+	avail    uintptr
+	used     uintptr
+	lastUsed uint16
+
+	txbuf, rxbuf uintptr
+
+	mutex sync.Mutex
+	// signaled by interrupt when used ring is updated
+	done chan struct{}
+}
+
+func newDriver() *driver {
+	return &driver{
+		done: make(chan struct{}, 1),
+	}
+}
+
+func (d *driver) Name() string {
+	return "virtio9p"
+}
+
+func (d *driver) Idents() []pci.Identity {
+	return []pci.Identity{
+		{Vendor: 0x1af4, Device: 0x1009},
+	}
+}
+
+func (d *driver) Init(dev *pci.Device) error {
+	d.dev = dev
+	dev.Addr.EnableBusMaster()
+	addr, _, _, ismem := dev.Addr.ReadBAR(0)
+	if ismem {
+		return errors.New("virtio9p: not I/O bar")
+	}
+	d.port = uint16(addr)
+
+	// reset
+	sys.Outb(d.port+REG_STATUS, 0)
+	sys.Outb(d.port+REG_STATUS, STATUS_ACKNOWLEDGE)
+	sys.Outb(d.port+REG_STATUS, STATUS_ACKNOWLEDGE|STATUS_DRIVER)
+
+	features := sys.Inl(d.port + REG_HOST_FEATURES)
+	sys.Outl(d.port+REG_GUEST_FEATURES, features&F_MOUNT_TAG)
+	if features&F_MOUNT_TAG != 0 {
+		n := uint16(sys.Inb(d.port+REG_CONFIG)) | uint16(sys.Inb(d.port+REG_CONFIG+1))<<8
+		tag := make([]byte, n)
+		for i := range tag {
+			tag[i] = sys.Inb(d.port + REG_CONFIG + 2 + uint16(i))
+		}
+		d.tag = string(tag)
+	}
+
+	sys.Outw(d.port+REG_QUEUE_SELECT, 0)
+	d.qsize = sys.Inw(d.port + REG_QUEUE_SIZE)
+	if d.qsize == 0 {
+		sys.Outb(d.port+REG_STATUS, STATUS_FAILED)
+		return errors.New("virtio9p: queue not available")
+	}
+	// the layout of legacy vring is fixed by the queue size
+	qsize := uintptr(d.qsize)
+	availEnd := qsize*16 + 6 + 2*qsize
+	usedOff := (availEnd + VRING_ALIGN - 1) &^ (VRING_ALIGN - 1)
+	size := usedOff + 6 + 8*qsize
+	ring := mm.AllocPages(int((size + mm.PGSIZE - 1) / mm.PGSIZE))
+	d.descs = ring
+	d.avail = ring + qsize*16
+	d.used = ring + usedOff
+	sys.Outl(d.port+REG_QUEUE_PFN, uint32(ring/mm.PGSIZE))
+
+	d.txbuf = mm.AllocPages(bufPages)
+	d.rxbuf = mm.AllocPages(bufPages)
+
+	sys.Outb(d.port+REG_STATUS, STATUS_ACKNOWLEDGE|STATUS_DRIVER|STATUS_DRIVER_OK)
+	d.ok = true
+	debug.Logf("[virtio9p] tag:%s queue size:%d", d.tag, d.qsize)
+	return nil
+}
+
+func (d *driver) desc(i uint16) *desc {
+	return (*desc)(unsafe.Pointer(d.descs + uintptr(i)*16))
+}
+
+func (d *driver) usedIdx() uint16 {
+	// flags[2] idx[2]
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(d.used))) >> 16)
+}
+
+func (d *driver) Msize() uint32 {
+	return msize
+}
+
+// RoundTrip posts tx and rx as one descriptor chain and waits the device
+// to fill the response.
+func (d *driver) RoundTrip(tx, rx []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(tx) > msize {
+		return 0, errors.New("virtio9p: message too large")
+	}
+	if len(rx) > msize {
+		rx = rx[:msize]
+	}
+	copy(sys.UnsafeBuffer(d.txbuf, len(tx)), tx)
+
+	d0, d1 := d.desc(0), d.desc(1)
+	*d0 = desc{
+		addr:  uint64(d.txbuf),
+		len:   uint32(len(tx)),
+		flags: DESC_F_NEXT,
+		next:  1,
+	}
+	*d1 = desc{
+		addr:  uint64(d.rxbuf),
+		len:   uint32(len(rx)),
+		flags: DESC_F_WRITE,
+	}
+
+	// flags[2] idx[2] ring[qsize]
+	availIdx := (*uint16)(unsafe.Pointer(d.avail + 2))
+	idx := *availIdx
+	*(*uint16)(unsafe.Pointer(d.avail + 4 + uintptr(idx%d.qsize)*2)) = 0
+	sys.Mfence()
+	*availIdx = idx + 1
+	sys.Mfence()
+	sys.Outw(d.port+REG_QUEUE_NOTIFY, 0)
+
+	for d.usedIdx() == d.lastUsed {
+		// the interrupt may be lost or not routed, poll as a fallback
+		select {
+		case <-d.done:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	elem := (*usedElem)(unsafe.Pointer(d.used + 4 + uintptr(d.lastUsed%d.qsize)*8))
+	d.lastUsed++
+	n := int(elem.len)
+	if n > len(rx) {
+		n = len(rx)
+	}
+	return copy(rx, sys.UnsafeBuffer(d.rxbuf, n)), nil
+}
+
+func (d *driver) Intr() {
+	defer pic.EnableIRQ(uint16(d.dev.IRQLine))
+	defer pic.EOI(uintptr(d.dev.IRQNO))
+	// read clears the isr
+	isr := sys.Inb(d.port + REG_ISR)
+	if isr&ISR_QUEUE == 0 {
+		return
+	}
+	select {
+	case d.done <- struct{}{}:
+	default:
+	}
+}
+
+var drv = newDriver()
+
+// Transport returns the transport of the virtio-9p device, it must be
+// called after pci.Init.
+func Transport() (ninep.Transport, error) {
+	if !drv.ok {
+		return nil, ErrNoDevice
+	}
+	return drv, nil
+}
+
+// Tag returns the mount tag of the device
+func Tag() string {
+	return drv.tag
+}
+
+func init() {
+	pci.Register(drv)
+}